@@ -26,7 +26,7 @@ pushd "${release_dir}" > /dev/null
   version="${semver}-${git_rev}-${timestamp}"
 
   echo -e "\n building artifact using $(go version)..."
-  go build -ldflags "-X main.version=${version}" \
+  go build -ldflags "-X main.version=${version} -X main.commit=${git_rev} -X main.buildDate=${timestamp}" \
     -o "out/${binname}"                          \
     github.com/cloudfoundry/bosh-gcscli
 
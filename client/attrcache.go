@@ -0,0 +1,122 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// attrsCacheSize is the number of objects whose attributes are cached at
+// most. Beyond it, the least recently used are evicted.
+const attrsCacheSize = 1024
+
+// attrsCache holds the attributes of the current generation of objects by
+// name for a while, so that looking up the same object again makes no
+// request. A nil *attrsCache caches nothing.
+type attrsCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu sync.Mutex
+	// order lists the entries, most recently used first.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// attrsEntry is an element of attrsCache.order.
+type attrsEntry struct {
+	name    string
+	attrs   storage.ObjectAttrs
+	expires time.Time
+}
+
+// newAttrsCache returns an empty cache whose entries expire after ttl.
+func newAttrsCache(ttl time.Duration) *attrsCache {
+	return &attrsCache{
+		ttl:     ttl,
+		now:     time.Now,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// get returns a copy of the cached attributes of the object name, if they
+// have not expired.
+func (c *attrsCache) get(name string) (*storage.ObjectAttrs, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*attrsEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, name)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	attrs := entry.attrs
+	return &attrs, true
+}
+
+// put caches a copy of attrs as the attributes of the object name.
+func (c *attrsCache) put(name string, attrs *storage.ObjectAttrs) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &attrsEntry{name: name, attrs: *attrs, expires: c.now().Add(c.ttl)}
+	if elem, ok := c.entries[name]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[name] = c.order.PushFront(entry)
+	if c.order.Len() > attrsCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*attrsEntry).name)
+	}
+}
+
+// forget drops the cached attributes of each of names, e.g. once they have
+// been written.
+func (c *attrsCache) forget(names ...string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		if elem, ok := c.entries[name]; ok {
+			c.order.Remove(elem)
+			delete(c.entries, name)
+		}
+	}
+}
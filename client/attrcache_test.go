@@ -0,0 +1,116 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Caching attributes", func() {
+	const content = "content"
+
+	var server *httptest.Server
+	var lookups, downloads, deletes int
+
+	newBlobstore := func(cacheAttrs bool) *GCSBlobstore {
+		return newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+			cfg.CacheAttrs = cacheAttrs
+		})
+	}
+
+	BeforeEach(func() {
+		lookups, downloads, deletes = 0, 0, 0
+		crc := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc, crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli)))
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			switch {
+			case r.Method == http.MethodDelete:
+				deletes++
+				w.WriteHeader(http.StatusNoContent)
+			case strings.Contains(r.URL.Path, "/b/some-bucket/o/"):
+				lookups++
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"bucket": "some-bucket", "name": "obj", "generation": "7", "size": "%d", "crc32c": %q}`,
+					len(content), base64.StdEncoding.EncodeToString(crc))
+			default:
+				downloads++
+				Expect(r.URL.Query().Get("generation")).To(Equal("7"))
+				w.Header().Set("X-Goog-Generation", "7")
+				w.Write([]byte(content)) //nolint:errcheck
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("looks the attributes up once for exists, stat and get", func() {
+		blobstore := newBlobstore(true)
+		Expect(blobstore.Exists("obj")).To(BeTrue())
+		attrs, err := blobstore.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Generation).To(Equal(int64(7)))
+
+		var out bytes.Buffer
+		Expect(blobstore.Get("obj", &out)).To(Succeed())
+		Expect(out.String()).To(Equal(content))
+		out.Reset()
+		Expect(blobstore.GetGeneration("obj", 7, &out)).To(Succeed())
+
+		Expect(lookups).To(Equal(1))
+		Expect(downloads).To(Equal(2))
+	})
+
+	It("looks the attributes up again once the object is written", func() {
+		blobstore := newBlobstore(true)
+		_, err := blobstore.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(blobstore.Delete("obj")).To(Succeed())
+		_, err = blobstore.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(deletes).To(Equal(1))
+		Expect(lookups).To(Equal(2))
+	})
+
+	It("looks the attributes up every time by default", func() {
+		blobstore := newBlobstore(false)
+		Expect(blobstore.Exists("obj")).To(BeTrue())
+		_, err := blobstore.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(lookups).To(Equal(2))
+	})
+})
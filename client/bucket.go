@@ -0,0 +1,312 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// ErrBucketNameTaken is returned by EnsureBucket when the bucket exists but
+// belongs to someone else. Bucket names are global across all projects.
+var ErrBucketNameTaken = errors.New("bucket name is taken")
+
+// ErrInvalidLocation is returned by EnsureBucket when GCS rejects the
+// configured location.
+var ErrInvalidLocation = errors.New("invalid location")
+
+// ErrBucketExists is returned by CreateBucket when the bucket exists.
+var ErrBucketExists = errors.New("bucket already exists")
+
+// ErrBucketNotEmpty is returned by RemoveBucket when the bucket holds
+// objects.
+var ErrBucketNotEmpty = errors.New("bucket is not empty")
+
+// EnsureBucket creates the configured bucket in the configured project and
+// location if it does not exist, with the configured storage class as its
+// default and the configured lifecycle rules. Without a location, the
+// bucket is created in the storage library's default, US. An existing
+// bucket is left as it is, wherever it is located and whatever its rules.
+//
+// A bucket created concurrently by someone else with access to it counts
+// as existing.
+func (client *GCSBlobstore) EnsureBucket() error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	ctx := client.ctx
+	bucket := client.bucketHandle(client.authenticatedGCS)
+	_, err := bucket.Attrs(ctx)
+	if err == nil || !errors.Is(err, storage.ErrBucketNotExist) {
+		return err
+	}
+
+	location, err := client.createBucket(ctx, bucket)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		// Either it was created since it was looked up, or the name belongs
+		// to a bucket this client cannot see.
+		if _, err := bucket.Attrs(ctx); err != nil {
+			return fmt.Errorf("%w: '%s' exists but cannot be accessed: %v", ErrBucketNameTaken, client.config.BucketName, err)
+		}
+		log.Printf("INFO: Bucket '%s' was created concurrently\n", client.config.BucketName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logCreated(client.config.BucketName, location)
+	return nil
+}
+
+// CreateBucket creates the configured bucket in the configured project and
+// location, with the configured storage class as its default. Unlike
+// EnsureBucket, it fails with ErrBucketExists if the bucket exists and this
+// client can access it, or ErrBucketNameTaken if the name belongs to a
+// bucket it cannot see.
+func (client *GCSBlobstore) CreateBucket() error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	ctx := client.ctx
+	bucket := client.bucketHandle(client.authenticatedGCS)
+	location, err := client.createBucket(ctx, bucket)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		if _, err := bucket.Attrs(ctx); err != nil {
+			return fmt.Errorf("%w: '%s' exists but cannot be accessed: %v", ErrBucketNameTaken, client.config.BucketName, err)
+		}
+		return fmt.Errorf("%w: '%s'", ErrBucketExists, client.config.BucketName)
+	}
+	if err != nil {
+		return err
+	}
+	logCreated(client.config.BucketName, location)
+	return nil
+}
+
+// createBucket creates bucket in the configured project and location and
+// returns the location. An unknown location is reported as
+// ErrInvalidLocation; a bucket that exists is left to the caller as the
+// googleapi.Error GCS returned, a conflict.
+func (client *GCSBlobstore) createBucket(ctx context.Context, bucket *storage.BucketHandle) (string, error) {
+	location := config.NormalizeLocation(client.config.Location)
+	err := bucket.Create(ctx, client.config.ProjectID, &storage.BucketAttrs{
+		StorageClass: client.config.StorageClass,
+		Location:     location,
+		Lifecycle:    client.lifecycle(),
+	})
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest && location != "" {
+		// GCS rejects an unknown location as a bad request without always
+		// naming the field. The storage class has been validated already,
+		// so the location is the likely culprit.
+		return "", fmt.Errorf("creating bucket '%s': %w '%s': %s", client.config.BucketName, ErrInvalidLocation, location, apiErr.Message)
+	}
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("creating bucket '%s': %w", client.config.BucketName, err)
+	}
+	return location, nil
+}
+
+// lifecycle returns the lifecycle rules a bucket is created with: moving
+// STANDARD objects to NEARLINE after the configured nearline age and
+// deleting objects after the configured delete age, if set. With a prefix
+// configured, the rules only apply to the objects under it.
+func (client *GCSBlobstore) lifecycle() storage.Lifecycle {
+	var prefixes []string
+	if client.config.Prefix != "" {
+		prefixes = []string{client.config.Prefix}
+	}
+
+	var lifecycle storage.Lifecycle
+	if age := client.config.LifecycleNearlineAge; age > 0 {
+		lifecycle.Rules = append(lifecycle.Rules, storage.LifecycleRule{
+			Action: storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "NEARLINE"},
+			Condition: storage.LifecycleCondition{
+				AgeInDays:             int64(age),
+				MatchesStorageClasses: []string{"STANDARD"},
+				MatchesPrefix:         prefixes,
+			},
+		})
+	}
+	if age := client.config.LifecycleDeleteAge; age > 0 {
+		lifecycle.Rules = append(lifecycle.Rules, storage.LifecycleRule{
+			Action: storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{
+				AgeInDays:     int64(age),
+				MatchesPrefix: prefixes,
+			},
+		})
+	}
+	return lifecycle
+}
+
+// logCreated logs the creation of the bucket name in location.
+func logCreated(name, location string) {
+	if location == "" {
+		log.Printf("INFO: Created bucket '%s'\n", name)
+	} else {
+		log.Printf("INFO: Created bucket '%s' in %s\n", name, location)
+	}
+}
+
+// RemoveBucket deletes the configured bucket. GCS only deletes an empty
+// bucket, so one holding any object, including a noncurrent generation,
+// fails with ErrBucketNotEmpty.
+//
+// With force, every generation of every object in the bucket, whatever the
+// configured prefix, is first deleted using the bulk worker pool, and the
+// returned result names each as <name>#<generation>. The bucket is kept if
+// any of them could not be deleted, e.g. because of a hold or retention
+// policy. With opts.DryRun, the objects and the bucket are only logged.
+func (client *GCSBlobstore) RemoveBucket(force bool, opts BulkOptions) (*BulkResult, error) {
+	if client.readOnly() {
+		return nil, ErrInvalidROWriteOperation
+	}
+
+	ctx := client.ctx
+	bucket := client.bucketHandle(client.authenticatedGCS)
+	var result *BulkResult
+	if force {
+		var err error
+		if result, err = client.emptyBucket(ctx, opts); err != nil {
+			return nil, err
+		}
+		if err := result.Err(); err != nil {
+			return result, fmt.Errorf("bucket '%s' kept: %w", client.config.BucketName, err)
+		}
+	}
+	if opts.DryRun {
+		log.Printf("INFO: Would remove bucket '%s'\n", client.config.BucketName)
+		return result, nil
+	}
+
+	err := bucket.Delete(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return result, fmt.Errorf("%w: '%s' still holds objects or noncurrent generations; remove them first or use -force", ErrBucketNotEmpty, client.config.BucketName)
+	}
+	if err != nil {
+		return result, fmt.Errorf("removing bucket '%s': %w", client.config.BucketName, err)
+	}
+	log.Printf("INFO: Removed bucket '%s'\n", client.config.BucketName)
+	return result, nil
+}
+
+// emptyBucket deletes every generation of every object in the bucket.
+func (client *GCSBlobstore) emptyBucket(ctx context.Context, opts BulkOptions) (*BulkResult, error) {
+	byKey := map[string]*storage.ObjectAttrs{}
+	var keys []string
+	it := client.bucketHandle(client.authenticatedGCS).Objects(ctx, &storage.Query{Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing objects in bucket '%s': %w", client.config.BucketName, err)
+		}
+		key := fmt.Sprintf("%s#%d", attrs.Name, attrs.Generation)
+		byKey[key] = attrs
+		keys = append(keys, key)
+	}
+	if opts.ObjectCountLimit > 0 && len(keys) > opts.ObjectCountLimit {
+		return nil, fmt.Errorf("%w: %d objects in bucket '%s' exceed the limit of %d", ErrTooManyObjects, len(keys), client.config.BucketName, opts.ObjectCountLimit)
+	}
+
+	remove := func(ctx context.Context, key string) error {
+		attrs := byKey[key]
+		if opts.DryRun {
+			log.Printf("INFO: Would delete '%s' (%d bytes)\n", key, attrs.Size)
+			return nil
+		}
+
+		obj := client.getBucketObjectHandle(client.authenticatedGCS, client.config.BucketName, attrs.Name).Generation(attrs.Generation)
+		err := obj.Delete(ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil
+		}
+		if err != nil {
+			err = heldError(err, key)
+		}
+		client.record("delete", key, "", attrs.Size, err)
+		return err
+	}
+
+	return runPool(ctx, keys, opts, remove), nil
+}
+
+// CheckAccess confirms that the configured credentials are valid and give
+// access to the configured bucket, without reading or writing any object.
+//
+// With credentials, the bucket's attributes are fetched. Anonymous access
+// to a public bucket rarely extends to its attributes, so without
+// credentials the first page of a listing of at most one object is fetched
+// instead.
+func (client *GCSBlobstore) CheckAccess() error {
+	bucket := client.bucketHandle(client.listClient())
+	var err error
+	if client.readOnly() {
+		it := bucket.Objects(client.ctx, nil)
+		it.PageInfo().MaxSize = 1
+		if _, err = it.Next(); err == iterator.Done {
+			err = nil
+		}
+	} else {
+		_, err = bucket.Attrs(client.ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("accessing bucket '%s': %w", client.config.BucketName, err)
+	}
+	return nil
+}
+
+// BucketInfo returns the attributes of the configured bucket, such as its
+// location, default storage class, versioning and access control settings.
+//
+// A missing bucket fails with storage.ErrBucketNotExist, and credentials
+// denied access with the googleapi.Error GCS returned, a 403, each named as
+// such so that one is not mistaken for the other. Without credentials, the
+// attributes can only be read if the bucket grants that publicly, which is
+// rare.
+func (client *GCSBlobstore) BucketInfo() (*storage.BucketAttrs, error) {
+	attrs, err := client.bucketHandle(client.listClient()).Attrs(client.ctx)
+	var apiErr *googleapi.Error
+	switch {
+	case errors.Is(err, storage.ErrBucketNotExist):
+		return nil, fmt.Errorf("bucket '%s' not found: %w", client.config.BucketName, err)
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+		return nil, fmt.Errorf("permission denied reading bucket '%s': %w", client.config.BucketName, err)
+	case err != nil:
+		return nil, fmt.Errorf("reading bucket '%s': %w", client.config.BucketName, err)
+	}
+	return attrs, nil
+}
@@ -0,0 +1,432 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+	"google.golang.org/api/googleapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ensuring the bucket exists", func() {
+	type rule struct {
+		Action struct {
+			Type         string
+			StorageClass string
+		}
+		Condition struct {
+			Age                 int
+			MatchesStorageClass []string
+			MatchesPrefix       []string
+		}
+	}
+	type created struct {
+		Project      string
+		Name         string
+		StorageClass string
+		Location     string
+	}
+
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	// getStatuses are the statuses of successive GETs of the bucket, the
+	// last of which repeats.
+	var getStatuses []int
+	var createStatus int
+	var creates []created
+	var rules [][]rule
+	var location string
+	var prefix string
+	var deleteAge, nearlineAge int
+
+	BeforeEach(func() {
+		createStatus = http.StatusOK
+		creates = nil
+		rules = nil
+		location = ""
+		prefix = ""
+		deleteAge, nearlineAge = 0, 0
+	})
+
+	JustBeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			status := createStatus
+			if r.Method == http.MethodGet {
+				status = getStatuses[0]
+				if len(getStatuses) > 1 {
+					getStatuses = getStatuses[1:]
+				}
+			} else {
+				Expect(r.URL.Path).To(Equal("/storage/v1/b"))
+				var body struct {
+					created
+					Lifecycle struct{ Rule []rule }
+				}
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				body.Project = r.URL.Query().Get("project")
+				creates = append(creates, body.created)
+				rules = append(rules, body.Lifecycle.Rule)
+			}
+
+			w.WriteHeader(status)
+			if status == http.StatusOK {
+				w.Write([]byte(`{"name": "some-bucket"}`)) //nolint:errcheck
+			} else {
+				fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, status, http.StatusText(status))
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.StorageClass = "NEARLINE"
+			cfg.ProjectID = "some-project"
+			cfg.Location = location
+			cfg.Prefix = prefix
+			cfg.LifecycleDeleteAge = deleteAge
+			cfg.LifecycleNearlineAge = nearlineAge
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("leaves an existing bucket alone", func() {
+		getStatuses = []int{http.StatusOK}
+		Expect(blobstore.EnsureBucket()).To(Succeed())
+		Expect(creates).To(BeEmpty())
+	})
+
+	It("creates a missing bucket with the configured storage class, in US by default", func() {
+		getStatuses = []int{http.StatusNotFound}
+		Expect(blobstore.EnsureBucket()).To(Succeed())
+		Expect(creates).To(Equal([]created{{Project: "some-project", Name: "some-bucket", StorageClass: "NEARLINE", Location: "US"}}))
+	})
+
+	Describe("with a location", func() {
+		BeforeEach(func() {
+			location = "europe-west1"
+		})
+
+		It("creates a missing bucket there, in the case GCS expects", func() {
+			getStatuses = []int{http.StatusNotFound}
+			Expect(blobstore.EnsureBucket()).To(Succeed())
+			Expect(creates).To(Equal([]created{{Project: "some-project", Name: "some-bucket", StorageClass: "NEARLINE", Location: "EUROPE-WEST1"}}))
+		})
+
+		It("returns an error naming the location if GCS rejects it", func() {
+			getStatuses = []int{http.StatusNotFound}
+			createStatus = http.StatusBadRequest
+			err := blobstore.EnsureBucket()
+			Expect(errors.Is(err, ErrInvalidLocation)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("'EUROPE-WEST1'"))
+		})
+	})
+
+	Describe("with lifecycle ages", func() {
+		BeforeEach(func() {
+			deleteAge, nearlineAge = 90, 30
+		})
+
+		It("creates a missing bucket with rules moving and deleting old objects", func() {
+			getStatuses = []int{http.StatusNotFound}
+			Expect(blobstore.EnsureBucket()).To(Succeed())
+			Expect(rules).To(HaveLen(1))
+			Expect(rules[0]).To(HaveLen(2))
+
+			nearline, remove := rules[0][0], rules[0][1]
+			Expect(nearline.Action.Type).To(Equal("SetStorageClass"))
+			Expect(nearline.Action.StorageClass).To(Equal("NEARLINE"))
+			Expect(nearline.Condition.Age).To(Equal(30))
+			Expect(nearline.Condition.MatchesStorageClass).To(Equal([]string{"STANDARD"}))
+			Expect(nearline.Condition.MatchesPrefix).To(BeEmpty())
+
+			Expect(remove.Action.Type).To(Equal("Delete"))
+			Expect(remove.Condition.Age).To(Equal(90))
+		})
+
+		Describe("and a prefix", func() {
+			BeforeEach(func() {
+				prefix = "tmp/"
+			})
+
+			It("only applies the rules under the prefix", func() {
+				getStatuses = []int{http.StatusNotFound}
+				Expect(blobstore.CreateBucket()).To(Succeed())
+				Expect(rules[0]).To(HaveLen(2))
+				for _, rule := range rules[0] {
+					Expect(rule.Condition.MatchesPrefix).To(Equal([]string{"tmp/"}))
+				}
+			})
+		})
+	})
+
+	It("accepts a bucket created concurrently", func() {
+		getStatuses = []int{http.StatusNotFound, http.StatusOK}
+		createStatus = http.StatusConflict
+		Expect(blobstore.EnsureBucket()).To(Succeed())
+	})
+
+	It("fails if the name belongs to an inaccessible bucket", func() {
+		getStatuses = []int{http.StatusNotFound, http.StatusForbidden}
+		createStatus = http.StatusConflict
+		err := blobstore.EnsureBucket()
+		Expect(errors.Is(err, ErrBucketNameTaken)).To(BeTrue())
+	})
+
+	It("creates the bucket explicitly, failing if it exists", func() {
+		getStatuses = []int{http.StatusOK}
+		Expect(blobstore.CreateBucket()).To(Succeed())
+		Expect(creates).To(HaveLen(1))
+
+		createStatus = http.StatusConflict
+		err := blobstore.CreateBucket()
+		Expect(errors.Is(err, ErrBucketExists)).To(BeTrue())
+
+		getStatuses = []int{http.StatusForbidden}
+		err = blobstore.CreateBucket()
+		Expect(errors.Is(err, ErrBucketNameTaken)).To(BeTrue())
+	})
+})
+
+var _ = Describe("Removing the bucket", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var mu sync.Mutex
+	var generations map[string]string
+	var held string
+	var removed bool
+
+	BeforeEach(func() {
+		generations = map[string]string{
+			"blob#1":  `{"name": "blob", "generation": "1", "timeDeleted": "2024-01-02T03:04:05Z"}`,
+			"blob#2":  `{"name": "blob", "generation": "2"}`,
+			"other#3": `{"name": "other", "generation": "3"}`,
+		}
+		held = ""
+		removed = false
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			mu.Lock()
+			defer mu.Unlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/some-bucket/o":
+				Expect(r.URL.Query().Get("versions")).To(Equal("true"))
+				Expect(r.URL.Query().Get("prefix")).To(BeEmpty())
+				items := make([]string, 0, len(generations))
+				for _, item := range generations {
+					items = append(items, item)
+				}
+				fmt.Fprintf(w, `{"items": [%s]}`, strings.Join(items, ","))
+			case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/storage/v1/b/some-bucket/o/"):
+				key := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/some-bucket/o/") + "#" + r.URL.Query().Get("generation")
+				if key == held {
+					w.WriteHeader(http.StatusForbidden)
+					fmt.Fprint(w, `{"error": {"code": 403, "message": "Object is under active Temporary hold."}}`)
+					return
+				}
+				delete(generations, key)
+				w.WriteHeader(http.StatusNoContent)
+			case r.Method == http.MethodDelete && r.URL.Path == "/storage/v1/b/some-bucket":
+				if len(generations) > 0 {
+					w.WriteHeader(http.StatusConflict)
+					fmt.Fprint(w, `{"error": {"code": 409, "message": "The bucket you tried to delete is not empty."}}`)
+					return
+				}
+				removed = true
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				Fail("unexpected request " + r.Method + " " + r.URL.Path)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+			cfg.Prefix = "namespace/"
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("refuses to remove a bucket with objects in it", func() {
+		_, err := blobstore.RemoveBucket(false, BulkOptions{})
+		Expect(errors.Is(err, ErrBucketNotEmpty)).To(BeTrue())
+		Expect(removed).To(BeFalse())
+	})
+
+	It("deletes every generation first with force", func() {
+		result, err := blobstore.RemoveBucket(true, BulkOptions{Concurrency: 2, MinConcurrency: 1})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(Equal([]string{"blob#1", "blob#2", "other#3"}))
+		Expect(removed).To(BeTrue())
+	})
+
+	It("keeps the bucket if a generation cannot be deleted", func() {
+		held = "blob#1"
+		result, err := blobstore.RemoveBucket(true, BulkOptions{Concurrency: 1, MinConcurrency: 1})
+		Expect(errors.Is(err, ErrObjectHeld)).To(BeTrue())
+		Expect(result.Failed).To(HaveKey("blob#1"))
+		Expect(removed).To(BeFalse())
+	})
+
+	It("modifies nothing on a dry run", func() {
+		result, err := blobstore.RemoveBucket(true, BulkOptions{Concurrency: 1, MinConcurrency: 1, DryRun: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(HaveLen(3))
+		Expect(generations).To(HaveLen(3))
+		Expect(removed).To(BeFalse())
+	})
+})
+
+var _ = Describe("Checking access to the bucket", func() {
+	var server *httptest.Server
+	var status int
+	var paths []string
+
+	BeforeEach(func() {
+		status, paths = http.StatusOK, nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if status == http.StatusOK {
+				w.Write([]byte(`{"name": "some-bucket", "items": []}`)) //nolint:errcheck
+			} else {
+				fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, status, http.StatusText(status))
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newBlobstore := func(credentialsSource string) *GCSBlobstore {
+		blobstore, err := New(context.Background(), &config.GCSCli{
+			BucketName:        "some-bucket",
+			Endpoint:          server.URL,
+			EmulatorInsecure:  credentialsSource != config.NoneCredentialsSource,
+			CredentialsSource: credentialsSource,
+			MaxAttempts:       1,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return blobstore
+	}
+
+	It("fetches the bucket's attributes", func() {
+		Expect(newBlobstore(config.DefaultCredentialsSource).CheckAccess()).To(Succeed())
+		Expect(paths).To(Equal([]string{"/storage/v1/b/some-bucket"}))
+	})
+
+	It("lists the bucket without credentials", func() {
+		Expect(newBlobstore(config.NoneCredentialsSource).CheckAccess()).To(Succeed())
+		Expect(paths).To(Equal([]string{"/storage/v1/b/some-bucket/o"}))
+	})
+
+	It("returns the error of a denied request", func() {
+		status = http.StatusForbidden
+		err := newBlobstore(config.DefaultCredentialsSource).CheckAccess()
+
+		var apiErr *googleapi.Error
+		Expect(errors.As(err, &apiErr)).To(BeTrue())
+		Expect(apiErr.Code).To(Equal(http.StatusForbidden))
+		Expect(err).To(MatchError(ContainSubstring("accessing bucket 'some-bucket'")))
+	})
+})
+
+var _ = Describe("Reading the bucket's attributes", func() {
+	var server *httptest.Server
+	var status int
+
+	BeforeEach(func() {
+		status = http.StatusOK
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Path).To(Equal("/storage/v1/b/some-bucket"))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if status == http.StatusOK {
+				w.Write([]byte(`{
+					"name": "some-bucket",
+					"location": "EUROPE-WEST1",
+					"locationType": "region",
+					"storageClass": "NEARLINE",
+					"versioning": {"enabled": true},
+					"iamConfiguration": {"uniformBucketLevelAccess": {"enabled": true}, "publicAccessPrevention": "enforced"}
+				}`)) //nolint:errcheck
+			} else {
+				fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, status, http.StatusText(status))
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	bucketInfo := func() (*storage.BucketAttrs, error) {
+		blobstore := newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+		return blobstore.BucketInfo()
+	}
+
+	It("returns the location, storage class, versioning and access settings", func() {
+		attrs, err := bucketInfo()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Location).To(Equal("EUROPE-WEST1"))
+		Expect(attrs.LocationType).To(Equal("region"))
+		Expect(attrs.StorageClass).To(Equal("NEARLINE"))
+		Expect(attrs.VersioningEnabled).To(BeTrue())
+		Expect(attrs.UniformBucketLevelAccess.Enabled).To(BeTrue())
+		Expect(attrs.PublicAccessPrevention).To(Equal(storage.PublicAccessPreventionEnforced))
+	})
+
+	It("names a missing bucket as not found", func() {
+		status = http.StatusNotFound
+		_, err := bucketInfo()
+		Expect(errors.Is(err, storage.ErrBucketNotExist)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("bucket 'some-bucket' not found")))
+	})
+
+	It("names a denied request as such", func() {
+		status = http.StatusForbidden
+		_, err := bucketInfo()
+		var apiErr *googleapi.Error
+		Expect(errors.As(err, &apiErr)).To(BeTrue())
+		Expect(apiErr.Code).To(Equal(http.StatusForbidden))
+		Expect(err).To(MatchError(ContainSubstring("permission denied reading bucket 'some-bucket'")))
+	})
+})
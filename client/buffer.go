@@ -0,0 +1,112 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"cloud.google.com/go/storage"
+)
+
+// PutBuffered uploads src to dest as PutWithOptions does, but retries the
+// whole upload up to retryAttempts times if it fails with a transient error
+// or a checksum mismatch, as Put does for a seekable source.
+//
+// A src which cannot be read again, such as a pipe, is first copied to a
+// temporary file if it is no larger than maxSize, so that each attempt can
+// replay it. A larger src is uploaded from the temporary file and then the
+// rest of src in a single attempt, relying on the resumable upload to
+// resend failed chunks. The temporary file is always removed before
+// returning.
+//
+// With opts.ComputeMD5, the MD5 GCS checks the upload against is computed
+// from the file, or the temporary file, first. A src larger than maxSize
+// then fails, as its MD5 cannot be known before it is uploaded.
+func (client *GCSBlobstore) PutBuffered(src io.Reader, dest string, opts PutOptions, maxSize int64) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	if f, ok := src.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			return client.putReplaying(f, dest, opts)
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "bosh-gcscli-upload-*")
+	if err != nil {
+		return fmt.Errorf("creating upload buffer: %v", err)
+	}
+	// Deferred, so the file is removed even if the upload panics.
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buffered, err := io.CopyN(tmp, src, maxSize+1)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("buffering upload: %v", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("rewinding upload buffer: %v", err)
+	}
+
+	if buffered <= maxSize {
+		return client.putReplaying(tmp, dest, opts)
+	}
+	if opts.ComputeMD5 {
+		return fmt.Errorf("cannot compute the MD5 of the upload of '%s' in advance: it is larger than the %d bytes buffered", dest, maxSize)
+	}
+	log.Printf("WARN: not buffering upload of '%s': larger than %d bytes, it cannot be retried as a whole\n", dest, maxSize)
+	_, err = client.put2(io.MultiReader(tmp, src), dest, opts, nil)
+	return err
+}
+
+// putReplaying uploads src to dest, rewinding src and starting again after
+// a transient failure or a checksum mismatch.
+func (client *GCSBlobstore) putReplaying(src io.ReadSeeker, dest string, opts PutOptions) error {
+	pos, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("finding buffer position: %v", err)
+	}
+
+	if opts.ComputeMD5 {
+		hash := md5.New()
+		if _, err := io.Copy(hash, src); err != nil {
+			return fmt.Errorf("computing MD5 of the upload of '%s': %v", dest, err)
+		}
+		opts.MD5 = hash.Sum(nil)
+		if _, err := src.Seek(pos, io.SeekStart); err != nil {
+			return fmt.Errorf("rewinding buffer after computing MD5: %v", err)
+		}
+	}
+
+	for i := 1; ; i++ {
+		_, err = client.put2(src, dest, opts, nil)
+		if err == nil || i == retryAttempts || !(storage.ShouldRetry(err) || errors.Is(err, ErrUploadChecksumMismatch)) {
+			return err
+		}
+		log.Printf("WARN: upload failed for %s, attempt %d/%d: %v\n", dest, i, retryAttempts, err)
+
+		if _, err := src.Seek(pos, io.SeekStart); err != nil {
+			return fmt.Errorf("resetting buffer position after failed upload: %v", err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Buffered uploads", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	// failures is the number of uploads which fail before one succeeds.
+	var failures int
+	var attempts int
+	var uploaded string
+
+	BeforeEach(func() {
+		attempts = 0
+		uploaded = ""
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`{"name": "some-bucket"}`)) //nolint:errcheck
+				return
+			}
+
+			attempts++
+			if attempts <= failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"error": {"code": 503, "message": "Service Unavailable"}}`)) //nolint:errcheck
+				return
+			}
+
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			Expect(err).ToNot(HaveOccurred())
+			parts := multipart.NewReader(r.Body, params["boundary"])
+			_, err = parts.NextPart()
+			Expect(err).ToNot(HaveOccurred())
+			media, err := parts.NextPart()
+			Expect(err).ToNot(HaveOccurred())
+			content, err := io.ReadAll(media)
+			Expect(err).ToNot(HaveOccurred())
+			uploaded = string(content)
+			w.Write([]byte(`{"name": "obj", "bucket": "some-bucket", "generation": "1"}`)) //nolint:errcheck
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.SingleShotMaxSize = config.MinChunkSize
+			cfg.MaxAttempts = 1
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// pipe returns a reader of content which cannot be read again.
+	pipe := func(content string) io.Reader {
+		return io.MultiReader(strings.NewReader(content))
+	}
+
+	It("replays a buffered upload which failed", func() {
+		failures = 2
+		Expect(blobstore.PutBuffered(pipe("content"), "obj", PutOptions{}, 1024)).To(Succeed())
+		Expect(attempts).To(Equal(3))
+		Expect(uploaded).To(Equal("content"))
+	})
+
+	It("gives up after three attempts", func() {
+		failures = 3
+		Expect(blobstore.PutBuffered(pipe("content"), "obj", PutOptions{}, 1024)).ToNot(Succeed())
+		Expect(attempts).To(Equal(3))
+	})
+
+	It("makes a single attempt at an upload larger than the buffer", func() {
+		failures = 1
+		Expect(blobstore.PutBuffered(pipe("content"), "obj", PutOptions{}, 4)).ToNot(Succeed())
+		Expect(attempts).To(Equal(1))
+	})
+
+	It("removes the buffer once the upload ends", func() {
+		tmp, err := os.MkdirTemp("", "buffer-test")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+		previous, set := os.LookupEnv("TMPDIR")
+		os.Setenv("TMPDIR", tmp)
+		defer func() {
+			if set {
+				os.Setenv("TMPDIR", previous)
+			} else {
+				os.Unsetenv("TMPDIR")
+			}
+		}()
+
+		failures = 1
+		Expect(blobstore.PutBuffered(pipe("content"), "obj", PutOptions{}, 1024)).To(Succeed())
+		left, err := filepath.Glob(filepath.Join(tmp, "*"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(left).To(BeEmpty())
+	})
+})
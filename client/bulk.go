@@ -0,0 +1,509 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultConcurrency is the number of objects processed at once by bulk
+// operations when BulkOptions.Concurrency is not set.
+const DefaultConcurrency = 8
+
+// BulkOptions controls operations acting on every object under a prefix.
+type BulkOptions struct {
+	// Concurrency is the number of objects processed at once.
+	// If left empty, DefaultConcurrency is used.
+	Concurrency int
+	// MinConcurrency is the number of objects processed at once that the
+	// concurrency is never reduced below when GCS responds with 429 Too Many
+	// Requests or 503 Service Unavailable. If left empty, the concurrency may be reduced down to 1.
+	MinConcurrency int
+	// DryRun reports what would be done without modifying any object.
+	DryRun bool
+	// ObjectCountLimit aborts the operation before any object is modified if
+	// more objects than this match. If left empty, there is no limit.
+	ObjectCountLimit int
+	// Match, if non-nil, restricts the operation to the objects whose name
+	// it matches.
+	Match *regexp.Regexp
+	// FailFast cancels all outstanding work on the first error that is not
+	// worth retrying, such as a permission error. Otherwise every object is
+	// attempted regardless of earlier failures.
+	FailFast bool
+	// MissingFails fails the deletion of an object which does not exist,
+	// by DeleteObjects or DeletePrefix, with an error wrapping
+	// ErrObjectNotFound. Otherwise the object is counted as deleted.
+	MissingFails bool
+}
+
+// BulkResult summarises an operation acting on many objects.
+type BulkResult struct {
+	// Succeeded are the names of the objects the operation was applied to,
+	// or would have been applied to in a dry run.
+	Succeeded []string
+	// Failed maps the names of the objects the operation failed on to the
+	// error encountered.
+	Failed map[string]error
+	// Skipped are the names of the objects which were not attempted because
+	// the operation was cancelled by FailFast.
+	Skipped []string
+}
+
+// Err returns a non-nil error summarising the failures, if any.
+//
+// The error wraps the error of one failed object, an authentication or
+// authorization failure if there was one, so that callers can tell why the
+// operation failed.
+func (r *BulkResult) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(r.Failed))
+	for name := range r.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	example := names[0]
+	for _, name := range names {
+		if isAuthError(r.Failed[name]) {
+			example = name
+			break
+		}
+	}
+
+	total := len(r.Failed) + len(r.Succeeded) + len(r.Skipped)
+	return fmt.Errorf("%d of %d objects failed, e.g. '%s': %w", len(r.Failed), total, example, r.Failed[example])
+}
+
+// isAuthError reports whether err means the request was not authenticated
+// or not authorized, which retrying or moving on to other objects does not
+// fix.
+func isAuthError(err error) bool {
+	var apiErr *googleapi.Error
+	var retrieveErr *oauth2.RetrieveError
+	switch {
+	case errors.Is(err, ErrInvalidROWriteOperation), errors.As(err, &retrieveErr):
+		return true
+	case errors.As(err, &apiErr):
+		return apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden
+	}
+	return false
+}
+
+// ErrTooManyObjects is returned by bulk operations when more objects match
+// than BulkOptions.ObjectCountLimit allows.
+var ErrTooManyObjects = errors.New("too many objects")
+
+// checkObjectCount returns an error wrapping ErrTooManyObjects if count
+// exceeds the configured limit.
+func (opts BulkOptions) checkObjectCount(prefix string, count int) error {
+	if opts.ObjectCountLimit > 0 && count > opts.ObjectCountLimit {
+		return fmt.Errorf("%w: %d objects under '%s' exceed the limit of %d", ErrTooManyObjects, count, prefix, opts.ObjectCountLimit)
+	}
+	return nil
+}
+
+// listObjects returns the attributes of every object under prefix whose
+// name is matched by match, or of every object if match is nil.
+//
+// GCS can only filter by prefix, so every object under prefix is listed
+// and match is applied here.
+func (client *GCSBlobstore) listObjects(ctx context.Context, gcs *storage.Client, prefix string, match *regexp.Regexp) ([]*storage.ObjectAttrs, error) {
+	var objects []*storage.ObjectAttrs
+	it := client.objects(ctx, gcs, storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if match != nil && !match.MatchString(attrs.Name) {
+			continue
+		}
+		objects = append(objects, attrs)
+	}
+}
+
+// runBulk calls fn for each object, see runPool.
+func runBulk(ctx context.Context, objects []*storage.ObjectAttrs, opts BulkOptions, fn func(context.Context, *storage.ObjectAttrs) error) *BulkResult {
+	byName := make(map[string]*storage.ObjectAttrs, len(objects))
+	names := make([]string, 0, len(objects))
+	for _, attrs := range objects {
+		byName[attrs.Name] = attrs
+		names = append(names, attrs.Name)
+	}
+	return runPool(ctx, names, opts, func(ctx context.Context, name string) error {
+		return fn(ctx, byName[name])
+	})
+}
+
+// runPool calls fn for each of names, which must be distinct, using a
+// bounded number of goroutines, and collects the outcome of every call.
+//
+// The number of calls in flight starts at opts.Concurrency and adapts to
+// rate limiting, see concurrencyLimiter. Once ctx is cancelled no further
+// calls are started and the remaining names are reported as skipped. The
+// first authentication or authorization failure cancels the remaining
+// work, as it would fail in the same way; with opts.FailFast, so does any
+// other failure not worth retrying.
+func runPool(ctx context.Context, names []string, opts BulkOptions, fn func(context.Context, string) error) *BulkResult {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	limiter := newConcurrencyLimiter(opts.MinConcurrency, concurrency)
+	result := &BulkResult{Failed: map[string]error{}}
+	var mu sync.Mutex
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				limiter.acquire()
+				if ctx.Err() != nil {
+					limiter.release(ctx.Err())
+					mu.Lock()
+					result.Skipped = append(result.Skipped, name)
+					mu.Unlock()
+					continue
+				}
+
+				err := fn(ctx, name)
+				limiter.release(err)
+
+				mu.Lock()
+				if err != nil {
+					result.Failed[name] = err
+				} else {
+					result.Succeeded = append(result.Succeeded, name)
+				}
+				mu.Unlock()
+
+				if isAuthError(err) || (err != nil && opts.FailFast && !storage.ShouldRetry(err)) {
+					cancel()
+				}
+			}
+		}()
+	}
+
+	for i, name := range names {
+		select {
+		case work <- name:
+			continue
+		case <-ctx.Done():
+		}
+
+		mu.Lock()
+		result.Skipped = append(result.Skipped, names[i:]...)
+		mu.Unlock()
+		break
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Strings(result.Succeeded)
+	sort.Strings(result.Skipped)
+	return result
+}
+
+// copyAttrs returns the attributes a copy of an object described by attrs
+// should be written with.
+//
+// GCS only copies the source metadata when no destination attributes are
+// given, so everything is carried over explicitly to also keep the
+// source's storage class.
+func copyAttrs(attrs *storage.ObjectAttrs) storage.ObjectAttrs {
+	return storage.ObjectAttrs{
+		ContentType:        attrs.ContentType,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentDisposition: attrs.ContentDisposition,
+		CacheControl:       attrs.CacheControl,
+		Metadata:           attrs.Metadata,
+		StorageClass:       attrs.StorageClass,
+	}
+}
+
+// RenamePrefix moves every object under oldPrefix to the same path under
+// newPrefix. Each object is copied server-side, preserving its metadata and
+// storage class, and the original is deleted once the copy is verified.
+func (client *GCSBlobstore) RenamePrefix(oldPrefix, newPrefix string, opts BulkOptions) (*BulkResult, error) {
+	if client.readOnly() {
+		return nil, ErrInvalidROWriteOperation
+	}
+
+	ctx := client.ctx
+	objects, err := client.listObjects(ctx, client.authenticatedGCS, oldPrefix, opts.Match)
+	if err != nil {
+		return nil, fmt.Errorf("listing objects under '%s': %v", oldPrefix, err)
+	}
+	if err := opts.checkObjectCount(oldPrefix, len(objects)); err != nil {
+		return nil, err
+	}
+
+	rename := func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		dest := newPrefix + strings.TrimPrefix(attrs.Name, oldPrefix)
+		if opts.DryRun {
+			log.Printf("INFO: Would rename '%s' to '%s'\n", attrs.Name, dest)
+			return nil
+		}
+
+		err := client.renameObject(ctx, attrs, dest)
+		client.record("rename", attrs.Name, dest, attrs.Size, err)
+		if err == nil {
+			log.Printf("INFO: Renamed '%s' to '%s'\n", attrs.Name, dest)
+		}
+		return err
+	}
+
+	return runBulk(ctx, objects, opts, rename), nil
+}
+
+// renameObject copies the object described by attrs to dest and deletes the
+// original once the copy's CRC32C is verified.
+func (client *GCSBlobstore) renameObject(ctx context.Context, attrs *storage.ObjectAttrs, dest string) error {
+	dst := client.getObjectHandle(client.authenticatedGCS, dest)
+	if _, err := client.copyVerified(ctx, attrs, dst); err != nil {
+		return err
+	}
+	return client.deleteCopied(ctx, attrs)
+}
+
+// copyVerified copies the object described by attrs to dst server-side and
+// returns the copy's attributes, or an error unless the copy's CRC32C
+// matches the source. As for uploads, the copy is encrypted with the
+// configured kms_key_name, if any.
+func (client *GCSBlobstore) copyVerified(ctx context.Context, attrs *storage.ObjectAttrs, dst *storage.ObjectHandle) (*storage.ObjectAttrs, error) {
+	src := client.getObjectHandle(client.authenticatedGCS, attrs.Name)
+	copier := dst.CopierFrom(src)
+	copier.ObjectAttrs = copyAttrs(attrs)
+	copier.DestinationKMSKeyName = client.config.KMSKeyName
+	copied, err := copier.Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("copying to '%s': %w", dst.ObjectName(), err)
+	}
+	if copied.CRC32C != attrs.CRC32C {
+		return nil, fmt.Errorf("copy '%s' has CRC32C %d, expected %d; source kept", dst.ObjectName(), copied.CRC32C, attrs.CRC32C)
+	}
+	return copied, nil
+}
+
+// deleteCopied deletes the source of a verified copy. The delete is
+// conditional on the generation that was copied, so an object replaced in
+// the meantime is kept.
+func (client *GCSBlobstore) deleteCopied(ctx context.Context, attrs *storage.ObjectAttrs) error {
+	src := client.getObjectHandle(client.authenticatedGCS, attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+	if err := src.Delete(ctx); err != nil {
+		return fmt.Errorf("deleting '%s' after copy: %w", attrs.Name, err)
+	}
+	return nil
+}
+
+// DeleteObjects deletes each of names using the bulk worker pool. As for
+// Delete, an object which does not exist counts as deleted, so a missing
+// object does not fail the operation; it is logged instead.
+//
+// With opts.DryRun, each object is looked up but not deleted, so missing
+// objects are reported as they would be.
+func (client *GCSBlobstore) DeleteObjects(names []string, opts BulkOptions) (*BulkResult, error) {
+	if client.readOnly() {
+		return nil, ErrInvalidROWriteOperation
+	}
+
+	// runPool needs distinct names, and deleting an object twice could
+	// otherwise remove a newer generation written in between.
+	seen := map[string]bool{}
+	var distinct []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			distinct = append(distinct, name)
+		}
+	}
+	if opts.ObjectCountLimit > 0 && len(distinct) > opts.ObjectCountLimit {
+		return nil, fmt.Errorf("%w: %d objects exceed the limit of %d", ErrTooManyObjects, len(distinct), opts.ObjectCountLimit)
+	}
+
+	remove := func(ctx context.Context, name string) error {
+		if opts.DryRun {
+			attrs, err := client.getObjectHandle(client.authenticatedGCS, name).Attrs(ctx)
+			if err == storage.ErrObjectNotExist && opts.MissingFails {
+				return notFoundError{name: name}
+			} else if err == storage.ErrObjectNotExist {
+				log.Printf("WARN: '%s' does not exist\n", name)
+				return nil
+			} else if err == nil {
+				log.Printf("INFO: Would delete '%s' (%d bytes, generation %d)\n", name, attrs.Size, attrs.Generation)
+			}
+			return err
+		}
+
+		existed, err := client.deleteObject(ctx, name)
+		if err == nil && !existed && opts.MissingFails {
+			return notFoundError{name: name}
+		} else if err == nil && !existed {
+			log.Printf("WARN: '%s' does not exist\n", name)
+		} else if err == nil {
+			log.Printf("INFO: Deleted '%s'\n", name)
+		}
+		return err
+	}
+
+	return runPool(client.ctx, distinct, opts, remove), nil
+}
+
+// DeletePrefix deletes every object under prefix whose name opts.Match
+// matches using the bulk worker pool. Each delete is conditional on the
+// listed generation, so an object replaced since the listing is kept and
+// reported as failed; one deleted in the meantime is logged instead.
+func (client *GCSBlobstore) DeletePrefix(prefix string, opts BulkOptions) (*BulkResult, error) {
+	if client.readOnly() {
+		return nil, ErrInvalidROWriteOperation
+	}
+
+	ctx := client.ctx
+	objects, err := client.listObjects(ctx, client.authenticatedGCS, prefix, opts.Match)
+	if err != nil {
+		return nil, fmt.Errorf("listing objects under '%s': %v", prefix, err)
+	}
+	if err := opts.checkObjectCount(prefix, len(objects)); err != nil {
+		return nil, err
+	}
+
+	remove := func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		if opts.DryRun {
+			log.Printf("INFO: Would delete '%s' (%d bytes, generation %d)\n", attrs.Name, attrs.Size, attrs.Generation)
+			return nil
+		}
+
+		obj := client.getObjectHandle(client.authenticatedGCS, attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+		err := obj.Delete(ctx)
+		if err == storage.ErrObjectNotExist && opts.MissingFails {
+			// The object was deleted since it was listed.
+			return notFoundError{name: attrs.Name}
+		} else if err == storage.ErrObjectNotExist {
+			log.Printf("WARN: '%s' does not exist\n", attrs.Name)
+			return nil
+		}
+		if err != nil {
+			err = heldError(err, attrs.Name)
+		}
+		client.record("delete", attrs.Name, "", attrs.Size, err)
+		if err == nil {
+			log.Printf("INFO: Deleted '%s'\n", attrs.Name)
+		}
+		return err
+	}
+
+	return runBulk(ctx, objects, opts, remove), nil
+}
+
+// ExistsObjects reports whether each of names exists using the bulk worker
+// pool, as for Exists. Names which could not be looked up are missing from
+// the returned map and listed in the result's Failed instead.
+func (client *GCSBlobstore) ExistsObjects(names []string, opts BulkOptions) (map[string]bool, *BulkResult) {
+	seen := map[string]bool{}
+	var distinct []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			distinct = append(distinct, name)
+		}
+	}
+
+	var mu sync.Mutex
+	found := make(map[string]bool, len(distinct))
+	check := func(ctx context.Context, name string) error {
+		exists, err := client.existsAny(ctx, name)
+		if err == nil {
+			mu.Lock()
+			found[name] = exists
+			mu.Unlock()
+		}
+		return err
+	}
+
+	result := runPool(client.ctx, distinct, opts, check)
+	return found, result
+}
+
+// MigratePrefix copies every object under srcPrefix to the same path under
+// dstPrefix in dstBucket, which may be in another location. Each object is
+// rewritten server-side, preserving its metadata and storage class, and
+// verified against the source's CRC32C.
+//
+// If deleteSource is set, each source object is deleted once its copy is
+// verified.
+func (client *GCSBlobstore) MigratePrefix(srcPrefix, dstBucket, dstPrefix string, deleteSource bool, opts BulkOptions) (*BulkResult, error) {
+	if client.readOnly() {
+		return nil, ErrInvalidROWriteOperation
+	}
+
+	ctx := client.ctx
+	objects, err := client.listObjects(ctx, client.authenticatedGCS, srcPrefix, opts.Match)
+	if err != nil {
+		return nil, fmt.Errorf("listing objects under '%s': %v", srcPrefix, err)
+	}
+	if err := opts.checkObjectCount(srcPrefix, len(objects)); err != nil {
+		return nil, err
+	}
+
+	migrate := func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		dest := dstPrefix + strings.TrimPrefix(attrs.Name, srcPrefix)
+		destURL := fmt.Sprintf("gs://%s/%s", dstBucket, dest)
+		if opts.DryRun {
+			log.Printf("INFO: Would migrate '%s' to '%s'\n", attrs.Name, destURL)
+			return nil
+		}
+
+		_, err := client.copyVerified(ctx, attrs, client.getBucketObjectHandle(client.authenticatedGCS, dstBucket, dest))
+		if err == nil && deleteSource {
+			err = client.deleteCopied(ctx, attrs)
+		}
+		client.record("migrate", attrs.Name, destURL, attrs.Size, err)
+		if err == nil {
+			log.Printf("INFO: Migrated '%s' to '%s'\n", attrs.Name, destURL)
+		}
+		return err
+	}
+
+	return runBulk(ctx, objects, opts, migrate), nil
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"errors"
+	"net/http"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"google.golang.org/api/googleapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bulk results", func() {
+	It("has no error when nothing failed", func() {
+		result := &BulkResult{Succeeded: []string{"a"}, Failed: map[string]error{}}
+		Expect(result.Err()).ToNot(HaveOccurred())
+	})
+
+	It("counts the failures and wraps the first one", func() {
+		first := errors.New("first")
+		result := &BulkResult{
+			Succeeded: []string{"a"},
+			Failed:    map[string]error{"c": errors.New("second"), "b": first},
+			Skipped:   []string{"d"},
+		}
+		err := result.Err()
+		Expect(err).To(MatchError(ContainSubstring("2 of 4 objects failed")))
+		Expect(errors.Is(err, first)).To(BeTrue())
+	})
+
+	It("prefers wrapping an authorization failure", func() {
+		denied := &googleapi.Error{Code: http.StatusForbidden}
+		result := &BulkResult{Failed: map[string]error{"a": errors.New("other"), "b": denied}}
+		var apiErr *googleapi.Error
+		Expect(errors.As(result.Err(), &apiErr)).To(BeTrue())
+		Expect(apiErr.Code).To(Equal(http.StatusForbidden))
+	})
+})
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// crc32cTable is the Castagnoli table used by GCS for CRC32C checksums.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// cachePath returns the path a generation of an object is cached at.
+//
+// Each object gets its own directory so that stale generations can be
+// found and removed when a newer one is cached.
+func (client *GCSBlobstore) cachePath(attrs *storage.ObjectAttrs) string {
+	return filepath.Join(client.config.CacheDir,
+		url.PathEscape(attrs.Bucket),
+		url.PathEscape(client.objectName(attrs.Name)),
+		strconv.FormatInt(attrs.Generation, 10))
+}
+
+// cacheable reports whether an object can be stored in the local cache.
+//
+// Objects encrypted with a customer-supplied key are never cached, as that
+// would leave their plaintext on disk. Objects stored with gzip
+// content-encoding are decompressed by GCS on the way down, so their
+// CRC32C cannot be used to validate the cached copy.
+func (client *GCSBlobstore) cacheable(attrs *storage.ObjectAttrs) bool {
+	return client.config.EncryptionKey == nil && attrs.ContentEncoding != "gzip"
+}
+
+// getCached fetches src into dest, serving it from the local cache when the
+// cached copy is of the current generation and its CRC32C is intact.
+func (client *GCSBlobstore) getCached(src string, dest io.Writer) error {
+	attrs, err := client.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !client.cacheable(attrs) {
+		return client.getUncached(src, attrs, dest)
+	}
+
+	path := client.cachePath(attrs)
+	if hit, err := serveCached(path, attrs.CRC32C, dest); err != nil || hit {
+		return err
+	}
+
+	if err := client.populateCache(src, attrs, path, dest); err != nil {
+		return err
+	}
+	return client.evictCache()
+}
+
+// serveCached copies the cache entry at path to dest if it exists and its
+// CRC32C is crc. An entry failing validation is removed.
+func serveCached(path string, crc uint32, dest io.Writer) (bool, error) {
+	cached, err := os.Open(path)
+	if err != nil {
+		return false, nil
+	}
+	defer cached.Close()
+
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(hash, cached); err != nil {
+		return false, err
+	}
+	if hash.Sum32() != crc {
+		log.Printf("WARN: removing cached copy at %s: CRC32C does not match\n", path)
+		os.Remove(path)
+		return false, nil
+	}
+
+	if _, err := cached.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(dest, cached); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now) //nolint:errcheck
+	return true, nil
+}
+
+// populateCache downloads src into dest while saving a copy at path,
+// replacing any other cached generations of the object. A download whose
+// CRC32C does not match fails with ErrChecksumMismatch and is not cached.
+func (client *GCSBlobstore) populateCache(src string, attrs *storage.ObjectAttrs, path string, dest io.Writer) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating cache directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return fmt.Errorf("creating cache file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := crc32.New(crc32cTable)
+	if err := client.getUncached(src, attrs, io.MultiWriter(dest, tmp, hash)); err != nil {
+		return err
+	}
+	// dest has received the download already, so a corrupt one fails even
+	// if no_verify is configured, rather than being neither cached nor
+	// reported.
+	if err := verifyCRC32C(src, attrs, hash.Sum32(), false); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	stale, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for _, old := range stale {
+		if old != tmp.Name() {
+			os.Remove(old)
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// evictCache removes the least recently used entries from the cache until
+// it is no larger than cache_max_size. Without a maximum size the cache
+// grows without bound.
+func (client *GCSBlobstore) evictCache() error {
+	if client.config.CacheMaxSize <= 0 {
+		return nil
+	}
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	err := filepath.WalkDir(client.config.CacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("scanning cache directory: %v", err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		if total <= client.config.CacheMaxSize {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			return fmt.Errorf("evicting cache entry: %v", err)
+		}
+		total -= e.size
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("The download cache", func() {
+	const content = "some content"
+
+	var server *httptest.Server
+	var served string
+	var downloads int
+	var cacheDir string
+
+	crc32c := func(data string) string {
+		sum := make([]byte, 4)
+		binary.BigEndian.PutUint32(sum, crc32.Checksum([]byte(data), crc32.MakeTable(crc32.Castagnoli)))
+		return base64.StdEncoding.EncodeToString(sum)
+	}
+
+	BeforeEach(func() {
+		served, downloads = content, 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"bucket": "some-bucket", "name": "obj", "generation": "1", "size": "%d", "crc32c": "%s"}`, len(content), crc32c(content))
+				return
+			}
+			downloads++
+			w.Write([]byte(served)) //nolint:errcheck
+		}))
+		cacheDir = tempDir()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newBlobstore := func(noVerify bool) *GCSBlobstore {
+		return newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.CacheDir = cacheDir
+			cfg.NoVerify = noVerify
+			cfg.MaxAttempts = 1
+		})
+	}
+
+	cached := func() []string {
+		var files []string
+		filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error { //nolint:errcheck
+			if err == nil && !info.IsDir() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		return files
+	}
+
+	It("serves a download again from the cache", func() {
+		blobstore := newBlobstore(false)
+		for i := 0; i < 2; i++ {
+			var out bytes.Buffer
+			Expect(blobstore.Get("obj", &out)).To(Succeed())
+			Expect(out.String()).To(Equal(content))
+		}
+		Expect(downloads).To(Equal(1))
+		Expect(cached()).To(HaveLen(1))
+	})
+
+	It("fails a corrupt download and caches nothing, even with no_verify", func() {
+		served = "corrupted!!!"
+		for _, noVerify := range []bool{false, true} {
+			var out bytes.Buffer
+			err := newBlobstore(noVerify).Get("obj", &out)
+			Expect(errors.Is(err, ErrChecksumMismatch)).To(BeTrue(), "no_verify: %t", noVerify)
+			Expect(cached()).To(BeEmpty())
+		}
+	})
+})
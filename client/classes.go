@@ -0,0 +1,80 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"cloud.google.com/go/storage"
+)
+
+// StorageClassUsage is the number and total size of the objects of one
+// storage class.
+type StorageClassUsage struct {
+	StorageClass string `json:"storage_class"`
+	Objects      int64  `json:"objects"`
+	Bytes        int64  `json:"bytes"`
+}
+
+// List returns the attributes of every object under prefix, in name order.
+// If match is non-nil, only the objects whose name it matches are returned.
+func (client *GCSBlobstore) List(prefix string, match *regexp.Regexp) ([]*storage.ObjectAttrs, error) {
+	objects, err := client.listObjects(client.ctx, client.listClient(), prefix, match)
+	if err != nil {
+		return nil, fmt.Errorf("listing objects under '%s': %v", prefix, err)
+	}
+	return objects, nil
+}
+
+// listClient returns the client used to list objects: the authenticated
+// one if available, as listing a bucket is rarely granted publicly.
+func (client *GCSBlobstore) listClient() *storage.Client {
+	if client.authenticatedGCS != nil {
+		return client.authenticatedGCS
+	}
+	return client.publicGCS
+}
+
+// StorageClasses lists every object under prefix, or only those whose name
+// is matched by match if non-nil, and returns their count and total size per
+// storage class, ordered by storage class.
+func (client *GCSBlobstore) StorageClasses(prefix string, match *regexp.Regexp) ([]StorageClassUsage, error) {
+	objects, err := client.List(prefix, match)
+	if err != nil {
+		return nil, err
+	}
+
+	byClass := map[string]*StorageClassUsage{}
+	for _, attrs := range objects {
+		usage, ok := byClass[attrs.StorageClass]
+		if !ok {
+			usage = &StorageClassUsage{StorageClass: attrs.StorageClass}
+			byClass[attrs.StorageClass] = usage
+		}
+		usage.Objects++
+		usage.Bytes += attrs.Size
+	}
+
+	report := make([]StorageClassUsage, 0, len(byClass))
+	for _, usage := range byClass {
+		report = append(report, *usage)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].StorageClass < report[j].StorageClass })
+	return report, nil
+}
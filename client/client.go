@@ -17,28 +17,90 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/oauth2/google"
+	"golang.org/x/net/http/httpguts"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iamcredentials/v1"
 
 	"cloud.google.com/go/storage"
 	"github.com/cloudfoundry/bosh-gcscli/config"
+	"github.com/googleapis/gax-go/v2"
+	raw "google.golang.org/api/storage/v1"
 )
 
 // ErrInvalidROWriteOperation is returned when credentials associated with the
 // client disallow an attempted write operation.
 var ErrInvalidROWriteOperation = errors.New("the client operates in read only mode. Change 'credentials_source' parameter value ")
 
+// ErrObjectNotFound is matched, using errors.Is, by the errors returned
+// when reading an object which does not exist. Those errors also match
+// storage.ErrObjectNotExist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// notFoundError is returned for the object name which does not exist.
+type notFoundError struct {
+	name string
+}
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("object '%s' not found", e.name)
+}
+
+func (e notFoundError) Is(target error) bool { return target == ErrObjectNotFound }
+func (e notFoundError) Unwrap() error        { return storage.ErrObjectNotExist }
+
+// wrapNotFound returns err, replaced by a notFoundError if it reports that
+// the object name does not exist.
+func wrapNotFound(name string, err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return notFoundError{name: name}
+	}
+	return err
+}
+
+// ErrObjectExists is returned when an upload which must not overwrite an
+// existing object finds one in its place.
+var ErrObjectExists = errors.New("object already exists")
+
 // GCSBlobstore encapsulates interaction with the GCS blobstore
 type GCSBlobstore struct {
+	// ctx is the context passed to New, which bounds every operation.
+	ctx              context.Context
 	authenticatedGCS *storage.Client
 	publicGCS        *storage.Client
+	// authenticatedAPI and publicAPI are the clients of the JSON API the
+	// storage clients are built on.
+	authenticatedAPI *raw.Service
+	publicAPI        *raw.Service
 	config           *config.GCSCli
+	oplog            *operationLog
+	// attrs caches the attributes of objects if cache_attrs is configured.
+	attrs *attrsCache
+	// transport is the transport requests are sent through, nil for the
+	// storage library's default one.
+	transport http.RoundTripper
+	// dump is the request dump file if dump_request_path is configured.
+	dump io.Closer
+	// iam is the client of the IAM Credentials API urls are signed through,
+	// created by the first signature which needs it.
+	iamOnce sync.Once
+	iam     *iamcredentials.Service
+	iamErr  error
 }
 
 // validateRemoteConfig determines if the configuration of the client matches
@@ -51,84 +113,768 @@ func (client *GCSBlobstore) validateRemoteConfig() error {
 		return nil
 	}
 
-	bucket := client.authenticatedGCS.Bucket(client.config.BucketName)
-	_, err := bucket.Attrs(context.Background())
-	return err
+	bucket := client.bucketHandle(client.authenticatedGCS)
+	attrs, err := bucket.Attrs(client.ctx)
+	if err != nil {
+		return err
+	}
+	if client.config.VerifyBucketEncryption || client.config.RequireCMEK {
+		return client.verifyBucketEncryption(attrs)
+	}
+	return nil
+}
+
+// ErrBucketNotCMEK is returned when require_cmek is configured and the
+// bucket has no default Cloud KMS key.
+var ErrBucketNotCMEK = errors.New("bucket has no default customer-managed encryption key")
+
+// verifyBucketEncryption logs the bucket's default encryption and, if
+// require_cmek is configured, returns ErrBucketNotCMEK unless it is a
+// customer-managed Cloud KMS key. Uploads encrypted with a configured
+// kms_key_name satisfy require_cmek whatever the bucket's default.
+func (client *GCSBlobstore) verifyBucketEncryption(attrs *storage.BucketAttrs) error {
+	var kmsKey string
+	if attrs.Encryption != nil {
+		kmsKey = attrs.Encryption.DefaultKMSKeyName
+	}
+
+	if kmsKey != "" {
+		log.Printf("INFO: Bucket '%s' default encryption: customer-managed key %s\n", attrs.Name, kmsKey)
+		return nil
+	}
+	log.Printf("INFO: Bucket '%s' default encryption: Google-managed key\n", attrs.Name)
+	if client.config.RequireCMEK && client.config.KMSKeyName == "" {
+		return ErrBucketNotCMEK
+	}
+	return nil
+}
+
+// bucketHandle returns a handle to the configured bucket.
+func (client *GCSBlobstore) bucketHandle(gcs *storage.Client) *storage.BucketHandle {
+	return client.namedBucketHandle(gcs, client.config.BucketName)
+}
+
+// namedBucketHandle returns a handle to bucket, which need not be the
+// configured bucket. Requests through it are billed to the configured
+// user_project, as requester-pays buckets require.
+func (client *GCSBlobstore) namedBucketHandle(gcs *storage.Client, bucket string) *storage.BucketHandle {
+	handle := gcs.Bucket(bucket)
+	if client.config.UserProject != "" {
+		handle = handle.UserProject(client.config.UserProject)
+	}
+	return handle
 }
 
-// getObjectHandle returns a handle to an object named src
+// getObjectHandle returns a handle to the object callers know as src, under
+// the configured prefix.
 func (client *GCSBlobstore) getObjectHandle(gcs *storage.Client, src string) *storage.ObjectHandle {
-	handle := gcs.Bucket(client.config.BucketName).Object(src)
+	return client.getBucketObjectHandle(gcs, client.config.BucketName, client.objectName(src))
+}
+
+// getBucketObjectHandle returns a handle to an object named src in bucket,
+// which need not be the configured bucket. The configured prefix is not
+// applied.
+func (client *GCSBlobstore) getBucketObjectHandle(gcs *storage.Client, bucket, src string) *storage.ObjectHandle {
+	handle := client.namedBucketHandle(gcs, bucket).Object(src)
 	if client.config.EncryptionKey != nil {
 		handle = handle.Key(client.config.EncryptionKey)
 	}
-	return handle
+	return client.withRetries(handle)
+}
+
+// withRetries applies the configured retry budget and backoff to handle.
+//
+// Each handle gets a retrier of its own, so concurrent operations don't
+// share a budget. Uploads are only retried as allowed by retry_mode, and
+// chunk_retry takes precedence for the chunks of a resumable upload. A
+// retry waits at least as long as the Retry-After header of a 429 asks.
+func (client *GCSBlobstore) withRetries(handle *storage.ObjectHandle) *storage.ObjectHandle {
+	var opts []storage.RetryOption
+	if client.config.MaxAttempts > 0 {
+		retrier := newRequestRetrier(client.ctx, handle.ObjectName(), client.config.MaxAttempts-1)
+		opts = append(opts, storage.WithErrorFunc(retrier.shouldRetry))
+	} else {
+		opts = append(opts, storage.WithErrorFunc(func(err error) bool {
+			return storage.ShouldRetry(err) && waitRetryAfter(client.ctx, err)
+		}))
+	}
+	if client.config.RetryBaseDelayMs > 0 {
+		opts = append(opts, storage.WithBackoff(gax.Backoff{
+			Initial:    time.Duration(client.config.RetryBaseDelayMs) * time.Millisecond,
+			Max:        maxRetryDelay,
+			Multiplier: 2,
+		}))
+	}
+	return handle.Retryer(opts...)
 }
 
 // New returns a GCSBlobstore configured to operate using the given config
 //
 // non-nil error is returned on invalid Client or config. If the configuration
 // is incompatible with the GCS bucket, a non-nil error is also returned.
+//
+// Every operation of the returned GCSBlobstore is bound by ctx, so a
+// deadline set on it fails operations still running once it passes.
 func New(ctx context.Context, cfg *config.GCSCli) (*GCSBlobstore, error) {
 	if cfg == nil {
 		return nil, errors.New("expected non-nill config object")
 	}
 
-	authenticatedGCS, publicGCS, err := newStorageClients(ctx, cfg)
+	transport, dump, err := newTransport(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("creating storage client: %v", err)
 	}
+	clients, err := newStorageClients(ctx, cfg, transport)
+	if err != nil {
+		closeDump(dump)
+		return nil, fmt.Errorf("creating storage client: %v", err)
+	}
+
+	var oplog *operationLog
+	if cfg.OperationLogPath != "" {
+		if oplog, err = newOperationLog(cfg.OperationLogPath, cfg.BucketName); err != nil {
+			closeDump(dump)
+			return nil, err
+		}
+	}
+
+	var attrs *attrsCache
+	if cfg.CacheAttrs {
+		ttl := cfg.CacheAttrsTTLSeconds
+		if ttl == 0 {
+			ttl = config.DefaultCacheAttrsTTLSeconds
+		}
+		attrs = newAttrsCache(time.Duration(ttl) * time.Second)
+	}
+
+	return &GCSBlobstore{
+		ctx:              ctx,
+		authenticatedGCS: clients.authenticated,
+		publicGCS:        clients.public,
+		authenticatedAPI: clients.authenticatedAPI,
+		publicAPI:        clients.publicAPI,
+		config:           cfg,
+		oplog:            oplog,
+		attrs:            attrs,
+		transport:        transport,
+		dump:             dump,
+	}, nil
+}
+
+// closeDump closes the request dump file of a client which could not be
+// created.
+func closeDump(dump io.Closer) {
+	if dump != nil {
+		dump.Close()
+	}
+}
+
+// Close closes the files the client writes to, the request dump file and
+// the operation log. The client must not be used afterwards.
+func (client *GCSBlobstore) Close() error {
+	var err error
+	if client.dump != nil {
+		err = client.dump.Close()
+	}
+	if logErr := client.oplog.close(); err == nil {
+		err = logErr
+	}
+	return err
+}
 
-	return &GCSBlobstore{authenticatedGCS: authenticatedGCS, publicGCS: publicGCS, config: cfg}, nil
+// record records the outcome of a write to the operation log, see
+// operationLog.record, and forgets any cached attributes of the objects
+// written, whether or not it succeeded.
+func (client *GCSBlobstore) record(operation, object, dest string, size int64, err error) {
+	client.attrs.forget(object, dest)
+	client.oplog.record(operation, object, dest, size, err)
 }
 
 // Get fetches a blob from the GCS blobstore.
 // Destination will be overwritten if it already exists.
+//
+// Unless no_verify is configured, the CRC32C of the bytes written to dest is
+// compared with the blob's and ErrChecksumMismatch is returned if they
+// differ. dest has then received corrupt data and should be discarded.
+//
+// If cache_dir is configured, the blob is served from the local cache when
+// the cached copy is of the blob's current generation.
 func (client *GCSBlobstore) Get(src string, dest io.Writer) error {
-	reader, err := client.getReader(client.publicGCS, src)
+	if client.config.CacheDir != "" {
+		return client.getCached(src, dest)
+	}
+	return client.getUncached(src, nil, dest)
+}
+
+// ErrGenerationNotFound is returned by GetGeneration when the object exists
+// but has no such generation, e.g. because it was deleted or never existed
+// on a bucket without object versioning.
+var ErrGenerationNotFound = errors.New("generation not found")
+
+// GetGeneration fetches the given generation of the blob src and writes it
+// to dest, verifying it as Get does. Prior generations are only kept on
+// buckets with object versioning enabled. The local cache is not used.
+//
+// If src exists but not at generation, the error wraps
+// ErrGenerationNotFound; if it does not exist at all, ErrObjectNotFound.
+func (client *GCSBlobstore) GetGeneration(src string, generation int64, dest io.Writer) error {
+	if attrs, ok := client.attrs.get(src); ok && attrs.Generation == generation {
+		return client.getUncached(src, attrs, dest)
+	}
+
+	attrs, err := client.getObjectHandle(client.publicGCS, src).Generation(generation).Attrs(client.ctx)
+	if err != nil && client.authenticatedGCS != nil {
+		attrs, err = client.getObjectHandle(client.authenticatedGCS, src).Generation(generation).Attrs(client.ctx)
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		if _, statErr := client.Stat(src); statErr != nil {
+			return statErr
+		}
+		return fmt.Errorf("%w: '%s' has no generation %d", ErrGenerationNotFound, src, generation)
+	}
+	if err != nil {
+		return err
+	}
+	return client.getUncached(src, attrs, dest)
+}
+
+// getUncached downloads src into dest. attrs, if non-nil, are the
+// attributes of the generation to download; otherwise they are looked up
+// when needed to verify the download, and the latest generation is
+// downloaded.
+func (client *GCSBlobstore) getUncached(src string, attrs *storage.ObjectAttrs, dest io.Writer) error {
+	if attrs == nil && !client.config.NoVerify {
+		var err error
+		if attrs, err = client.Stat(src); err != nil {
+			return err
+		}
+	}
+
+	gcs := client.publicGCS
+	reader, err := client.getReader(gcs, src, attrs)
+
+	// If the public client fails, try using it as an authenticated actor
+	if err != nil && client.authenticatedGCS != nil {
+		gcs = client.authenticatedGCS
+		reader, err = client.getReader(gcs, src, attrs)
+	}
+
+	if err != nil {
+		return wrapNotFound(src, err)
+	}
+
+	hash := crc32.New(crc32cTable)
+	written, err := client.copyResuming(gcs, src, reader, io.MultiWriter(dest, hash))
+	if err != nil {
+		return err
+	}
+	decompressed := !client.config.NoDecompress
+	if client.config.VerifySize {
+		if err := verifySize(src, reader.Attrs, written, decompressed); err != nil {
+			return err
+		}
+	}
+	if client.config.NoVerify {
+		return nil
+	}
+	return verifyCRC32C(src, attrs, hash.Sum32(), decompressed)
+}
+
+// copyData copies src to dest like io.Copy, but through a buffer of
+// copy_buffer_size bytes, if set, rather than io.Copy's 32 KiB.
+func (client *GCSBlobstore) copyData(dest io.Writer, src io.Reader) (int64, error) {
+	if client.config.CopyBufferSize == 0 {
+		return io.Copy(dest, src)
+	}
+	// Hiding io.WriterTo and io.ReaderFrom, e.g. of an *os.File, keeps
+	// io.CopyBuffer from bypassing the buffer for one of their own.
+	buf := make([]byte, client.config.CopyBufferSize)
+	return io.CopyBuffer(struct{ io.Writer }{dest}, struct{ io.Reader }{src}, buf)
+}
+
+// copyResuming copies reader, the object src opened with gcs, to dest and
+// returns the number of bytes copied.
+//
+// A read failing with a transient error, such as a dropped connection the
+// storage library could not reopen, is resumed with a range request for
+// the same generation from the bytes already copied, rather than starting
+// over, up to max_attempts - 1 times. An object GCS decompresses cannot be
+// read from an offset, so its download is not resumed.
+func (client *GCSBlobstore) copyResuming(gcs *storage.Client, src string, reader *storage.Reader, dest io.Writer) (int64, error) {
+	generation := reader.Attrs.Generation
+	resumable := client.config.NoDecompress || reader.Attrs.ContentEncoding != "gzip"
+
+	var written int64
+	for resumes := 1; ; resumes++ {
+		// Only read errors are resumed, not those writing to dest.
+		body := &readErrRecorder{r: reader}
+		n, err := client.copyData(dest, body)
+		reader.Close()
+		written += n
+		if err == nil {
+			return written, nil
+		}
+		if !resumable || err != body.err || !storage.ShouldRetry(err) {
+			return written, err
+		}
+		if client.config.MaxAttempts > 0 && resumes >= client.config.MaxAttempts {
+			return written, err
+		}
+
+		log.Printf("DEBUG: resuming download of '%s' from byte %d, attempt %d: %v\n", src, written, resumes, err)
+		reader, err = client.getReadHandle(gcs, src).Generation(generation).NewRangeReader(client.ctx, written, -1)
+		if err != nil {
+			return written, fmt.Errorf("resuming download of '%s' from byte %d: %w", src, written, err)
+		}
+		if reader.Attrs.StartOffset != written {
+			reader.Close()
+			return written, fmt.Errorf("%w: download of '%s' was resumed from byte %d rather than %d", ErrRangeIgnored, src, reader.Attrs.StartOffset, written)
+		}
+	}
+}
+
+// readErrRecorder reads from r, recording the error other than io.EOF a
+// read failed with.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// ErrShortDownload is returned when verify_size is configured and fewer
+// bytes were downloaded than the object's size.
+var ErrShortDownload = errors.New("downloaded size does not match object size")
+
+// verifySize returns ErrShortDownload unless written is the size of the
+// object src described by attrs.
+//
+// Objects stored with gzip content-encoding are decompressed by GCS on the
+// way down unless no_decompress is configured, as given by decompressed. The
+// size of a decompressed object cannot be compared and is skipped with a
+// warning.
+func verifySize(src string, attrs storage.ReaderObjectAttrs, written int64, decompressed bool) error {
+	if decompressed && attrs.ContentEncoding == "gzip" {
+		log.Printf("WARN: not verifying size of '%s': it is stored gzip-encoded and was decompressed\n", src)
+		return nil
+	}
+	if written != attrs.Size {
+		return fmt.Errorf("%w: wrote %d of %d bytes of '%s'", ErrShortDownload, written, attrs.Size, src)
+	}
+	return nil
+}
+
+// ErrChecksumMismatch is returned by Get when the CRC32C of the downloaded
+// bytes does not match the object's.
+var ErrChecksumMismatch = errors.New("downloaded CRC32C does not match object")
+
+// verifyCRC32C returns ErrChecksumMismatch unless crc is the CRC32C of the
+// object src described by attrs. As for verifySize, a decompressed object
+// cannot be compared and is skipped with a warning.
+func verifyCRC32C(src string, attrs *storage.ObjectAttrs, crc uint32, decompressed bool) error {
+	if decompressed && attrs.ContentEncoding == "gzip" {
+		log.Printf("WARN: not verifying CRC32C of '%s': it is stored gzip-encoded and was decompressed\n", src)
+		return nil
+	}
+	if crc != attrs.CRC32C {
+		return fmt.Errorf("%w: got %d for '%s', expected %d", ErrChecksumMismatch, crc, src, attrs.CRC32C)
+	}
+	return nil
+}
+
+// getReader opens src for reading, pinned to the generation described by
+// attrs if non-nil.
+func (client *GCSBlobstore) getReader(gcs *storage.Client, src string, attrs *storage.ObjectAttrs) (*storage.Reader, error) {
+	handle := client.getReadHandle(gcs, src)
+	if attrs != nil {
+		handle = handle.Generation(attrs.Generation)
+	}
+	return handle.NewReader(client.ctx)
+}
+
+// getReadHandle returns the handle objects are read through, asking for
+// gzip-encoded objects as stored if no_decompress is configured.
+func (client *GCSBlobstore) getReadHandle(gcs *storage.Client, src string) *storage.ObjectHandle {
+	return client.getObjectHandle(gcs, src).ReadCompressed(client.config.NoDecompress)
+}
+
+// ErrRangeIgnored is returned by GetRange when GCS serves more than the
+// requested range, as it does for an object stored with gzip
+// content-encoding which it decompresses on the way down.
+var ErrRangeIgnored = errors.New("byte range ignored by GCS")
+
+// GetRange fetches the bytes covered by r from a blob in the GCS blobstore
+// and writes them to dest. A range extending past the end of the object
+// stops at the end.
+//
+// Decompressive transcoding serves the whole object whatever the range, so
+// ranges of an object stored gzip-encoded can only be read with
+// no_decompress. Otherwise ErrRangeIgnored is returned, usually before
+// anything is written to dest, and never after more than the length of the
+// range.
+func (client *GCSBlobstore) GetRange(src string, r ByteRange, dest io.Writer) error {
+	reader, err := client.getRangeReader(client.publicGCS, src, r)
 
 	// If the public client fails, try using it as an authenticated actor
 	if err != nil && client.authenticatedGCS != nil {
-		reader, err = client.getReader(client.authenticatedGCS, src)
+		reader, err = client.getRangeReader(client.authenticatedGCS, src, r)
 	}
 
 	if err != nil {
+		return wrapNotFound(src, err)
+	}
+	defer reader.Close()
+
+	if reader.Attrs.StartOffset != r.Start {
+		return fmt.Errorf("%w: '%s' was served from byte %d rather than %d, e.g. because it is stored gzip-encoded", ErrRangeIgnored, src, reader.Attrs.StartOffset, r.Start)
+	}
+	// A range from the start of the object is served in full, rather than
+	// from another offset, when ignored. The whole object is then longer
+	// than the range or, if decompressed, of unknown length.
+	if remain := reader.Remain(); remain < 0 || remain > r.Length() {
+		return fmt.Errorf("%w: the whole of '%s' was served rather than %d bytes, e.g. because it is stored gzip-encoded", ErrRangeIgnored, src, r.Length())
+	}
+	if _, err = client.copyData(dest, io.LimitReader(reader, r.Length())); err != nil {
 		return err
 	}
+	if n, _ := reader.Read(make([]byte, 1)); n > 0 {
+		return fmt.Errorf("%w: more than %d bytes of '%s' were served, e.g. because it is stored gzip-encoded", ErrRangeIgnored, r.Length(), src)
+	}
+	return nil
+}
+
+func (client *GCSBlobstore) getRangeReader(gcs *storage.Client, src string, r ByteRange) (*storage.Reader, error) {
+	return client.getReadHandle(gcs, src).NewRangeReader(client.ctx, r.Start, r.Length())
+}
+
+// newWriter returns a Writer for the object named dest using the
+// authenticated client and the configured storage class.
+//
+// Failed requests are retried according to retry_mode. When chunk_retry is
+// configured, each chunk of the resumable upload is instead retried up to
+// that many times, whatever the retry mode, independently of any retries of
+// the whole operation performed by the caller.
+//
+// conds, if non-nil, are preconditions the upload must meet.
+func (client *GCSBlobstore) newWriter(dest string, conds *storage.Conditions) *storage.Writer {
+	handle := client.getObjectHandle(client.authenticatedGCS, dest)
+	if conds != nil {
+		handle = handle.If(*conds)
+	}
+	if client.config.RetryMode == config.RetryModeAlways {
+		handle = handle.Retryer(storage.WithPolicy(storage.RetryAlways))
+	}
+
+	var retrier *chunkRetrier
+	if client.config.ChunkRetry > 0 {
+		retrier = newChunkRetrier(client.ctx, dest, client.config.ChunkRetry)
+		handle = handle.Retryer(
+			storage.WithPolicy(storage.RetryAlways),
+			storage.WithErrorFunc(retrier.shouldRetry),
+		)
+	}
+
+	remoteWriter := handle.NewWriter(client.ctx)
+	client.setUploadAttrs(&remoteWriter.ObjectAttrs)
+	remoteWriter.ObjectAttrs.KMSKeyName = client.config.KMSKeyName
+	if client.config.ChunkSize > 0 {
+		remoteWriter.ChunkSize = int(client.config.ChunkSize)
+	}
+	if retrier != nil {
+		remoteWriter.ProgressFunc = retrier.progress
+	}
+	return remoteWriter
+}
+
+// setUploadAttrs sets the attributes every upload is given on attrs: the
+// configured content type, storage class and metadata.
+func (client *GCSBlobstore) setUploadAttrs(attrs *storage.ObjectAttrs) {
+	attrs.ContentType = client.config.ContentType
+	if attrs.ContentType == "" {
+		attrs.ContentType = defaultContentType
+	}
+	attrs.StorageClass = client.config.StorageClass
+	attrs.Metadata = client.provenance(client.config.Metadata)
+}
+
+// UploadedByMetadataKey and UploadedAtMetadataKey are the custom metadata
+// keys recording the tool an object was uploaded with and when, in
+// RFC 3339.
+const (
+	UploadedByMetadataKey = "bosh-gcscli-uploaded-by"
+	UploadedAtMetadataKey = "bosh-gcscli-uploaded-at"
+)
+
+// provenance returns metadata with the keys recording who uploaded an
+// object and when added, unless uploaded_by is empty or no_provenance is
+// set. Keys already in metadata are kept.
+func (client *GCSBlobstore) provenance(metadata map[string]string) map[string]string {
+	if client.config.UploadedBy == "" || client.config.NoProvenance {
+		return metadata
+	}
+
+	// The configured metadata is shared by every upload.
+	stamped := make(map[string]string, len(metadata)+2)
+	stamped[UploadedByMetadataKey] = client.config.UploadedBy
+	stamped[UploadedAtMetadataKey] = time.Now().UTC().Format(time.RFC3339)
+	for k, v := range metadata {
+		stamped[k] = v
+	}
+	return stamped
+}
+
+// defaultContentType is the content type of uploads when none is configured.
+const defaultContentType = "application/octet-stream"
+
+// PutOptions are the attributes of an object uploaded from a stream. Fields
+// left empty fall back to the configuration.
+type PutOptions struct {
+	// ContentType is the object's content type, overriding content_type.
+	ContentType string
+	// StorageClass is the object's storage class, overriding storage_class.
+	StorageClass string
+	// Metadata is custom metadata added to the configured metadata, taking
+	// precedence over it for the same key.
+	Metadata map[string]string
+	// CacheControl is the Cache-Control header GCS serves the object with,
+	// e.g. through a signed url, such as "public, max-age=3600".
+	CacheControl string
+	// ContentDisposition is the Content-Disposition header GCS serves the
+	// object with, such as `attachment; filename="release.tgz"` to name the
+	// file a browser downloads it to.
+	ContentDisposition string
+	// GzipEncoded marks a stream the caller has already gzip-compressed. The
+	// object is stored with Content-Encoding: gzip, so GCS decompresses it
+	// for clients that do not accept gzip.
+	GzipEncoded bool
+	// TemporaryHold places a temporary hold on the object, so it cannot be
+	// deleted or replaced until the hold is released.
+	TemporaryHold bool
+	// EventBasedHold places an event-based hold on the object.
+	EventBasedHold bool
+	// MD5 is the MD5 the bytes sent must have, after any compression. GCS
+	// checks it before committing the object and rejects the upload on a
+	// mismatch, so no corrupt object is ever stored.
+	MD5 []byte
+	// ComputeMD5 makes PutBuffered compute MD5 from the buffered source
+	// before uploading it. Other uploads ignore it.
+	ComputeMD5 bool
+}
 
-	_, err = io.Copy(dest, reader)
+// apply sets the attributes given by opts on attrs.
+func (opts PutOptions) apply(attrs *storage.ObjectAttrs) {
+	if opts.ContentType != "" {
+		attrs.ContentType = opts.ContentType
+	}
+	if opts.StorageClass != "" {
+		attrs.StorageClass = opts.StorageClass
+	}
+	attrs.CacheControl = opts.CacheControl
+	attrs.ContentDisposition = opts.ContentDisposition
+	if len(opts.Metadata) > 0 {
+		// The configured metadata is shared by every upload.
+		metadata := make(map[string]string, len(attrs.Metadata)+len(opts.Metadata))
+		for k, v := range attrs.Metadata {
+			metadata[k] = v
+		}
+		for k, v := range opts.Metadata {
+			metadata[k] = v
+		}
+		attrs.Metadata = metadata
+	}
+	if opts.GzipEncoded {
+		attrs.ContentEncoding = "gzip"
+	}
+	attrs.TemporaryHold = opts.TemporaryHold
+	attrs.EventBasedHold = opts.EventBasedHold
+	if opts.MD5 != nil {
+		attrs.MD5 = opts.MD5
+	}
+}
+
+// ErrContentMD5Mismatch is returned when GCS rejects an upload because the
+// bytes it received do not have the MD5 given in PutOptions. Nothing is
+// stored.
+var ErrContentMD5Mismatch = errors.New("uploaded bytes do not match the expected MD5")
+
+// md5Rejected returns err, the failure of an upload of dest with opts, as
+// an ErrContentMD5Mismatch if GCS rejected it for not matching opts.MD5.
+func md5Rejected(dest string, opts PutOptions, err error) error {
+	var apiErr *googleapi.Error
+	if opts.MD5 != nil && errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest && strings.Contains(apiErr.Message, "MD5") {
+		return fmt.Errorf("%w %s: GCS rejected '%s': %s", ErrContentMD5Mismatch, base64.StdEncoding.EncodeToString(opts.MD5), dest, apiErr.Message)
+	}
 	return err
 }
 
-func (client *GCSBlobstore) getReader(gcs *storage.Client, src string) (*storage.Reader, error) {
-	return client.getObjectHandle(gcs, src).NewReader(context.Background())
+// PutWithOptions uploads src to dest with the attributes in opts. Unlike
+// Put, src is streamed once and the upload is not retried as a whole, so it
+// can be any io.Reader, such as a gzip stream.
+//
+// The MD5 of the bytes sent, after compression, is computed as they are
+// streamed and compared with the MD5 GCS computed once the upload completes,
+// returning ErrUploadChecksumMismatch if they differ.
+func (client *GCSBlobstore) PutWithOptions(src io.Reader, dest string, opts PutOptions) error {
+	_, err := client.put2(src, dest, opts, nil)
+	return err
+}
+
+// PutGeneration uploads src to dest like PutWithOptions and returns the
+// generation GCS committed the new object at, e.g. for a later PutIf to
+// replace only that generation.
+func (client *GCSBlobstore) PutGeneration(src io.Reader, dest string, opts PutOptions) (int64, error) {
+	attrs, err := client.put2(src, dest, opts, nil)
+	if err != nil {
+		return 0, err
+	}
+	if attrs.Generation == 0 {
+		return 0, fmt.Errorf("no generation returned for '%s'", dest)
+	}
+	return attrs.Generation, nil
 }
 
-// Put2 is a simplified implementation of file upload with retries removed and accepts
-// a simple io.Reaader instead of io.ReadSeeker making it easier to implement gzip.
+// Put2 uploads src to dest like PutWithOptions, storing it with
+// Content-Encoding: gzip if compressed is set.
+//
+// Deprecated: use PutWithOptions with PutOptions.GzipEncoded.
 func (client *GCSBlobstore) Put2(src io.Reader, dest string, compressed bool) error {
+	return client.PutWithOptions(src, dest, PutOptions{GzipEncoded: compressed})
+}
+
+// ErrGenerationMismatch is returned by PutIf when the object to replace is
+// not at the required generation.
+var ErrGenerationMismatch = errors.New("object generation does not match")
+
+// PutIf uploads src to dest like PutWithOptions, provided that conds hold, and
+// returns the generation of the new object.
+//
+// If conds.DoesNotExist is set and the object exists, an error wrapping
+// ErrObjectExists is returned. If conds.GenerationMatch is set and the
+// object is at another generation or missing, an error wrapping
+// ErrGenerationMismatch is returned. Nothing is written in either case.
+func (client *GCSBlobstore) PutIf(src io.Reader, dest string, opts PutOptions, conds storage.Conditions) (int64, error) {
+	attrs, err := client.put2(src, dest, opts, &conds)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		if conds.DoesNotExist {
+			return 0, fmt.Errorf("%w: '%s'", ErrObjectExists, dest)
+		}
+		return 0, fmt.Errorf("%w: '%s' is not at generation %d", ErrGenerationMismatch, dest, conds.GenerationMatch)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
+// put2 implements PutWithOptions under conds, if non-nil, and returns the
+// attributes of the new object.
+func (client *GCSBlobstore) put2(src io.Reader, dest string, opts PutOptions, conds *storage.Conditions) (*storage.ObjectAttrs, error) {
 	if client.readOnly() {
-		return ErrInvalidROWriteOperation
+		return nil, ErrInvalidROWriteOperation
 	}
 
 	if err := client.validateRemoteConfig(); err != nil {
-		return err
+		return nil, err
 	}
 
-	remoteWriter := client.getObjectHandle(client.authenticatedGCS, dest).NewWriter(context.Background())
-	remoteWriter.ObjectAttrs.StorageClass = client.config.StorageClass
-	remoteWriter.ObjectAttrs.ContentType = "application/octet-stream"
+	remoteWriter := client.newWriter(dest, conds)
+	client.sendSingleShot(remoteWriter, src)
+	opts.apply(&remoteWriter.ObjectAttrs)
 
-	if compressed {
-		remoteWriter.ObjectAttrs.ContentEncoding = "gzip"
+	hash := md5.New()
+	written, err := client.copyData(io.MultiWriter(remoteWriter, hash), src)
+	if err != nil {
+		remoteWriter.CloseWithError(err) //nolint:errcheck,staticcheck
+	} else if err = remoteWriter.Close(); err == nil {
+		err = verifyMD5(dest, remoteWriter.Attrs(), hash.Sum(nil))
+	} else {
+		err = md5Rejected(dest, opts, err)
 	}
+	client.record("put", dest, "", written, err)
+	if err != nil {
+		return nil, err
+	}
+	return client.trimPrefix(remoteWriter.Attrs()), nil
+}
 
-	if _, err := io.Copy(remoteWriter, src); err != nil {
-		remoteWriter.CloseWithError(err) //nolint:errcheck,staticcheck
+// ErrUploadChecksumMismatch is returned by PutWithOptions when the MD5 GCS computed
+// for an uploaded object does not match the bytes that were sent. The
+// corrupt object is left in place.
+var ErrUploadChecksumMismatch = errors.New("uploaded MD5 does not match object")
+
+// verifyMD5 returns ErrUploadChecksumMismatch unless sum is the MD5 of the
+// uploaded object dest described by attrs. Objects GCS has no MD5 for are
+// not checked.
+func verifyMD5(dest string, attrs *storage.ObjectAttrs, sum []byte) error {
+	if len(attrs.MD5) == 0 || bytes.Equal(attrs.MD5, sum) {
+		return nil
+	}
+	return fmt.Errorf("%w: sent %s for '%s', GCS computed %s", ErrUploadChecksumMismatch,
+		base64.StdEncoding.EncodeToString(sum), dest, base64.StdEncoding.EncodeToString(attrs.MD5))
+}
+
+// sendSingleShot makes w upload src in a single request if src is known to
+// be no larger than single_shot_max_size.
+//
+// The size is known for regular files and in-memory readers; anything else,
+// such as a gzip stream, is always uploaded as a resumable upload.
+func (client *GCSBlobstore) sendSingleShot(w *storage.Writer, src io.Reader) {
+	if client.config.SingleShotMaxSize <= 0 {
+		return
+	}
+
+	size := int64(-1)
+	switch r := src.(type) {
+	case *os.File:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			if pos, err := r.Seek(0, io.SeekCurrent); err == nil {
+				size = info.Size() - pos
+			}
+		}
+	case interface{ Len() int }:
+		size = int64(r.Len())
+	}
+	if size >= 0 && size <= client.config.SingleShotMaxSize {
+		w.ChunkSize = 0
+	}
+}
+
+// PutMarker creates dest as an empty object, e.g. to signal that a step of a
+// pipeline has completed.
+//
+// If noClobber is set, ErrObjectExists is returned rather than replacing an
+// existing object. As the precondition makes the upload idempotent, it is
+// also retried on transient errors.
+func (client *GCSBlobstore) PutMarker(dest string, noClobber bool) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	if err := client.validateRemoteConfig(); err != nil {
 		return err
 	}
 
-	return remoteWriter.Close()
+	var conds *storage.Conditions
+	if noClobber {
+		conds = &storage.Conditions{DoesNotExist: true}
+	}
+
+	remoteWriter := client.newWriter(dest, conds)
+	err := remoteWriter.Close()
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		err = ErrObjectExists
+	}
+	client.record("put-marker", dest, "", 0, err)
+	return err
 }
 
 // Put uploads a blob to the GCS blobstore.
@@ -153,32 +899,36 @@ func (client *GCSBlobstore) Put(src io.ReadSeeker, dest string) error {
 
 	var errs []error
 	for i := 0; i < retryAttempts; i++ {
-		err := client.putOnce(src, dest)
+		written, err := client.putOnce(src, dest)
 		if err == nil {
+			client.record("put", dest, "", written, nil)
 			return nil
 		}
 
 		errs = append(errs, err)
-		log.Printf("upload failed for %s, attempt %d/%d: %v\n", dest, i+1, retryAttempts, err)
+		log.Printf("WARN: upload failed for %s, attempt %d/%d: %v\n", dest, i+1, retryAttempts, err)
 
 		if _, err := src.Seek(pos, io.SeekStart); err != nil {
 			return fmt.Errorf("restting buffer position after failed upload: %v", err)
 		}
 	}
 
-	return fmt.Errorf("upload failed for %s after %d attempts: %v", dest, retryAttempts, errs)
+	err = fmt.Errorf("upload failed for %s after %d attempts: %v", dest, retryAttempts, errs)
+	client.record("put", dest, "", 0, err)
+	return err
 }
 
-func (client *GCSBlobstore) putOnce(src io.ReadSeeker, dest string) error {
-	remoteWriter := client.getObjectHandle(client.authenticatedGCS, dest).NewWriter(context.Background())
-	remoteWriter.ObjectAttrs.StorageClass = client.config.StorageClass
+func (client *GCSBlobstore) putOnce(src io.ReadSeeker, dest string) (int64, error) {
+	remoteWriter := client.newWriter(dest, nil)
+	client.sendSingleShot(remoteWriter, src)
 
-	if _, err := io.Copy(remoteWriter, src); err != nil {
+	written, err := client.copyData(remoteWriter, src)
+	if err != nil {
 		remoteWriter.CloseWithError(err) //nolint:errcheck,staticcheck
-		return err
+		return written, err
 	}
 
-	return remoteWriter.Close()
+	return written, remoteWriter.Close()
 }
 
 // Delete removes a blob from from the GCS blobstore.
@@ -189,65 +939,447 @@ func (client *GCSBlobstore) Delete(dest string) error {
 		return ErrInvalidROWriteOperation
 	}
 
-	err := client.getObjectHandle(client.authenticatedGCS, dest).Delete(context.Background())
-	if err == storage.ErrObjectNotExist {
-		return nil
+	_, err := client.deleteObject(client.ctx, dest)
+	return err
+}
+
+// deleteObject deletes dest and reports whether it existed. Deleting an
+// object which does not exist is not an error.
+func (client *GCSBlobstore) deleteObject(ctx context.Context, dest string) (bool, error) {
+	err := client.getObjectHandle(client.authenticatedGCS, dest).Delete(ctx)
+	existed := err != storage.ErrObjectNotExist
+	if !existed {
+		err = nil
+	}
+	if err != nil {
+		err = heldError(err, dest)
+	}
+	client.record("delete", dest, "", 0, err)
+	return existed, err
+}
+
+// ErrMetagenerationMismatch is returned by DeleteIf and UpdateMetadata when
+// the object is not at the required metageneration, i.e. its metadata
+// changed since it was read.
+var ErrMetagenerationMismatch = errors.New("object metageneration does not match")
+
+// DeleteIf deletes dest like Delete, provided that conds hold.
+//
+// If conds.MetagenerationMatch is set and the object is at another
+// metageneration, an error wrapping ErrMetagenerationMismatch is returned,
+// and if conds.GenerationMatch is set and it is at another generation, one
+// wrapping ErrGenerationMismatch. The object is not deleted in either case.
+// Unlike Delete, an object which does not exist is an error wrapping
+// ErrObjectNotFound, since it cannot have been at the metageneration the
+// caller observed.
+func (client *GCSBlobstore) DeleteIf(dest string, conds storage.Conditions) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	handle := client.getObjectHandle(client.authenticatedGCS, dest)
+	if conds != (storage.Conditions{}) {
+		handle = handle.If(conds)
+	}
+	err := handle.Delete(client.ctx)
+	var apiErr *googleapi.Error
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		err = fmt.Errorf("%w: '%s'", ErrObjectNotFound, dest)
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed && conds.MetagenerationMatch != 0:
+		err = fmt.Errorf("%w: '%s' changed since metageneration %d", ErrMetagenerationMismatch, dest, conds.MetagenerationMatch)
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed:
+		err = fmt.Errorf("%w: '%s' is not at generation %d", ErrGenerationMismatch, dest, conds.GenerationMatch)
+	case err != nil:
+		err = heldError(err, dest)
+	}
+	client.record("delete", dest, "", 0, err)
+	return err
+}
+
+// Copy duplicates the blob src as dst server-side, so its content never
+// passes through the client. The copy keeps the source's metadata and
+// storage class and is verified against the source's CRC32C. With an
+// encryption key configured, the source is decrypted and the copy encrypted
+// with it.
+func (client *GCSBlobstore) Copy(src, dst string) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	attrs, err := client.Stat(src)
+	if errors.Is(err, ErrObjectNotFound) {
+		err = fmt.Errorf("copy source: %w", err)
+	}
+	if err == nil {
+		_, err = client.copyVerified(client.ctx, attrs, client.getObjectHandle(client.authenticatedGCS, dst))
+	}
+
+	var size int64
+	if attrs != nil {
+		size = attrs.Size
+	}
+	client.record("copy", src, dst, size, err)
+	return err
+}
+
+// DryRunCopy logs what Copy, or Move if deleteSource is set, would do
+// without modifying any object. src is looked up, failing as the real
+// operation would if it does not exist, and so is dst, to report whether it
+// would be overwritten.
+func (client *GCSBlobstore) DryRunCopy(src, dst string, deleteSource bool) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	attrs, err := client.Stat(src)
+	if errors.Is(err, ErrObjectNotFound) && deleteSource {
+		return fmt.Errorf("move source: %w", err)
+	} else if errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("copy source: %w", err)
+	} else if err != nil {
+		return err
+	}
+	existing, err := client.Stat(dst)
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		log.Printf("INFO: Would copy '%s' (%d bytes) to '%s'\n", src, attrs.Size, dst)
+	case err == nil:
+		log.Printf("INFO: Would copy '%s' (%d bytes) to '%s', overwriting generation %d\n", src, attrs.Size, dst, existing.Generation)
+	default:
+		return err
+	}
+	if deleteSource {
+		log.Printf("INFO: Would delete '%s' at generation %d\n", src, attrs.Generation)
+	}
+	return nil
+}
+
+// ErrSourceNotDeleted is returned by Move when the object was copied but its
+// source could not be deleted, leaving both in place.
+var ErrSourceNotDeleted = errors.New("source not deleted")
+
+// Move renames the blob src to dst: it is copied server-side as by Copy, and
+// src is only deleted once the copy is verified. The delete is conditional
+// on the generation that was copied, so a source replaced in the meantime
+// is kept.
+//
+// If the copy succeeds but the delete fails, the error wraps
+// ErrSourceNotDeleted.
+func (client *GCSBlobstore) Move(src, dst string) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+	if src == dst {
+		return fmt.Errorf("cannot move '%s' onto itself", src)
+	}
+
+	attrs, err := client.Stat(src)
+	if errors.Is(err, ErrObjectNotFound) {
+		err = fmt.Errorf("move source: %w", err)
 	}
+	if err == nil {
+		_, err = client.copyVerified(client.ctx, attrs, client.getObjectHandle(client.authenticatedGCS, dst))
+	}
+	if err == nil {
+		if deleteErr := client.deleteCopied(client.ctx, attrs); deleteErr != nil {
+			err = fmt.Errorf("%w: '%s' was copied to '%s', but %v", ErrSourceNotDeleted, src, dst, deleteErr)
+		}
+	}
+
+	var size int64
+	if attrs != nil {
+		size = attrs.Size
+	}
+	client.record("move", src, dst, size, err)
 	return err
 }
 
 // Exists checks if a blob exists in the GCS blobstore.
+//
+// Only an object GCS reports as not existing yields false and a nil error.
+// Any other failure to look it up, such as a network error once retries
+// are exhausted, is returned, since whether the object exists is then
+// unknown.
 func (client *GCSBlobstore) Exists(dest string) (exists bool, err error) {
-	if exists, err = client.exists(client.publicGCS, dest); err == nil {
+	return client.existsAny(client.ctx, dest)
+}
+
+// existsAny reports whether dest exists, looking it up with the public
+// client first.
+func (client *GCSBlobstore) existsAny(ctx context.Context, dest string) (exists bool, err error) {
+	if exists, err = client.exists(ctx, client.publicGCS, dest); err == nil {
 		return exists, nil
 	}
 
 	// If the public client fails, try using it as an authenticated actor
 	if client.authenticatedGCS != nil {
-		return client.exists(client.authenticatedGCS, dest)
+		return client.exists(ctx, client.authenticatedGCS, dest)
 	}
 
 	return
 }
 
-func (client *GCSBlobstore) exists(gcs *storage.Client, dest string) (bool, error) {
-	_, err := client.getObjectHandle(gcs, dest).Attrs(context.Background())
+func (client *GCSBlobstore) exists(ctx context.Context, gcs *storage.Client, dest string) (bool, error) {
+	_, cached := client.attrs.get(dest)
+	var err error
+	if !cached {
+		var attrs *storage.ObjectAttrs
+		if attrs, err = client.getObjectHandle(gcs, dest).Attrs(ctx); err == nil {
+			client.attrs.put(dest, client.trimPrefix(attrs))
+		}
+	}
 	if err == nil {
-		log.Printf("File '%s' exists in bucket '%s'\n", dest, client.config.BucketName)
+		log.Printf("INFO: File '%s' exists in bucket '%s'\n", dest, client.config.BucketName)
 		return true, nil
-	} else if err == storage.ErrObjectNotExist {
-		log.Printf("File '%s' does not exist in bucket '%s'\n", dest, client.config.BucketName)
+	} else if errors.Is(err, storage.ErrObjectNotExist) {
+		log.Printf("INFO: File '%s' does not exist in bucket '%s'\n", dest, client.config.BucketName)
 		return false, nil
 	}
 	return false, err
 }
 
+// Stat returns the attributes of a blob in the GCS blobstore.
+//
+// If the object does not exist, an error matching ErrObjectNotFound is
+// returned.
+func (client *GCSBlobstore) Stat(dest string) (*storage.ObjectAttrs, error) {
+	if attrs, ok := client.attrs.get(dest); ok {
+		return attrs, nil
+	}
+
+	attrs, err := client.getObjectHandle(client.publicGCS, dest).Attrs(client.ctx)
+
+	// If the public client fails, try using it as an authenticated actor
+	if err != nil && client.authenticatedGCS != nil {
+		attrs, err = client.getObjectHandle(client.authenticatedGCS, dest).Attrs(client.ctx)
+	}
+	if err != nil {
+		return nil, wrapNotFound(dest, err)
+	}
+	attrs = client.trimPrefix(attrs)
+	client.attrs.put(dest, attrs)
+	return attrs, nil
+}
+
+// ComponentCount returns the number of objects the composite object dest
+// was composed from, or 0 for an object which is not composite.
+//
+// The storage library does not expose the component count, so it is read
+// through the JSON API.
+func (client *GCSBlobstore) ComponentCount(dest string) (int64, error) {
+	get := func(api *raw.Service) (*raw.Object, error) {
+		call := api.Objects.Get(client.config.BucketName, client.objectName(dest)).Fields("componentCount").Context(client.ctx)
+		if client.config.UserProject != "" {
+			call = call.UserProject(client.config.UserProject)
+		}
+		return call.Do()
+	}
+
+	obj, err := get(client.publicAPI)
+	// If the public client fails, try using it as an authenticated actor
+	if err != nil && client.authenticatedAPI != nil {
+		obj, err = get(client.authenticatedAPI)
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return 0, notFoundError{name: dest}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return obj.ComponentCount, nil
+}
+
+// SourceModTimeMetadataKey is the custom metadata key recording the
+// modification time of the local file an object was uploaded from.
+const SourceModTimeMetadataKey = "source-mtime"
+
+// SHA256MetadataKey is the custom metadata key recording the hex SHA-256
+// of the content an object was uploaded from, before any compression.
+const SHA256MetadataKey = "sha256"
+
+// RemoteOlderThan reports whether the blob dest is absent or was last
+// modified before modTime.
+//
+// GCS does not keep the modification time of the uploaded file, so the
+// source-mtime metadata written by the CLI is preferred when present.
+// Otherwise the object's Updated time, i.e. when it was uploaded, is used.
+func (client *GCSBlobstore) RemoteOlderThan(dest string, modTime time.Time) (bool, error) {
+	attrs, err := client.Stat(dest)
+	if errors.Is(err, ErrObjectNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	remote := attrs.Updated
+	if recorded, ok := attrs.Metadata[SourceModTimeMetadataKey]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, recorded); err == nil {
+			remote = t
+		}
+	}
+	return modTime.After(remote), nil
+}
+
 func (client *GCSBlobstore) readOnly() bool {
 	return client.authenticatedGCS == nil
 }
 
-func (client *GCSBlobstore) Sign(id string, action string, expiry time.Duration) (string, error) {
-	token, err := google.JWTConfigFromJSON([]byte(client.config.ServiceAccountFile), storage.ScopeFullControl)
-	if err != nil {
-		return "", err
+// Sign returns a V4 signed URL granting action on the blob id until expiry
+// has elapsed.
+//
+// headers are additional canonical headers, in "name: value" form, which are
+// included in the signature and so must be sent by users of the URL.
+func (client *GCSBlobstore) Sign(id string, action string, expiry time.Duration, headers ...string) (string, error) {
+	return client.SignAt(id, action, time.Now().Add(expiry), headers...)
+}
+
+// MaxV4Expiry is the longest GCS accepts a V4 signed URL to be valid for.
+const MaxV4Expiry = 7 * 24 * time.Hour
+
+// ErrExpiryTooLong is returned by Sign when a V4 signed URL would be valid
+// for longer than MaxV4Expiry.
+var ErrExpiryTooLong = errors.New("V4 signed urls expire after at most 7 days")
+
+// ErrExpiryNotInFuture is returned by Sign when a signed URL would already
+// have expired, e.g. for a negative expiry or a time in the past.
+var ErrExpiryNotInFuture = errors.New("signed urls must expire in the future")
+
+// SignAt is like Sign but generates a url which expires at the given time.
+//
+// A "content-type" header among headers requires uploads through the url to
+// send that Content-Type.
+func (client *GCSBlobstore) SignAt(id string, action string, expires time.Time, headers ...string) (string, error) {
+	v2 := client.config.SigningVersion == config.SigningVersionV2
+	validFor := time.Until(expires)
+	if validFor <= 0 {
+		return "", fmt.Errorf("%w, got %s", ErrExpiryNotInFuture, expires.UTC().Format(time.RFC3339))
 	}
+	if !v2 && validFor > MaxV4Expiry {
+		return "", fmt.Errorf("%w: use an expiry of at most 168h, got %s", ErrExpiryTooLong, validFor.Round(time.Second))
+	}
+
 	options := storage.SignedURLOptions{
-		Method:         action,
-		Expires:        time.Now().Add(expiry),
-		PrivateKey:     token.PrivateKey,
-		GoogleAccessID: token.Email,
-		Scheme:         storage.SigningSchemeV4,
+		Method:  action,
+		Expires: expires,
+		Scheme:  storage.SigningSchemeV4,
+	}
+	if err := client.signWith(&options); err != nil {
+		return "", err
+	}
+	// The V2 scheme signs the content type separately from the other
+	// headers, and V4 accepts it in either place.
+	for _, header := range client.SignHeaders(action, headers...) {
+		if strings.HasPrefix(header, "content-type: ") {
+			options.ContentType = strings.TrimPrefix(header, "content-type: ")
+			continue
+		}
+		options.Headers = append(options.Headers, header)
+	}
+	if v2 {
+		if client.config.EmulatorInsecure {
+			return "", errors.New("signing_version 'v2' cannot sign urls for an emulator")
+		}
+		options.Scheme = storage.SigningSchemeV2
 	}
+	id = client.objectName(id)
+	if client.config.SignS3SafeNames || client.config.SignS3Compat {
+		if err := ValidateObjectName(id); err != nil {
+			return "", err
+		}
+	}
+	switch {
+	case client.config.SigningHost != "":
+		options.Style = storage.BucketBoundHostname(client.config.SigningHost)
+	case client.config.EmulatorInsecure:
+		// URLs for an emulator must point at it over plain HTTP. They are
+		// path-style, i.e. signed for the object bucket/id on the emulator
+		// host.
+		endpoint, err := url.Parse(client.config.Endpoint)
+		if err != nil {
+			return "", err
+		}
+		options.Style = storage.BucketBoundHostname(endpoint.Host)
+		options.Insecure = endpoint.Scheme == "http"
+		return storage.SignedURL(client.config.BucketName, client.config.BucketName+"/"+id, &options)
+	case client.config.SignS3Compat:
+		options.Style = storage.PathStyle()
+	}
+	return storage.SignedURL(client.config.BucketName, id, &options)
+}
 
-	// GET/PUT to the resultant signed url must include, in addition to the below:
-	// 'x-goog-encryption-key' and 'x-goog-encryption-key-sha256'
-	willEncrypt := len(client.config.EncryptionKey) > 0
+// SignHeaders returns every header users of a URL returned by Sign for
+// action with the given additional headers must send.
+//
+// With an encryption key configured, these include the headers giving the
+// key, which are part of the signature: the url only works along with the
+// key it was signed for. Deleting an object does not take its key, so a
+// DELETE url does not require them.
+func (client *GCSBlobstore) SignHeaders(action string, headers ...string) []string {
+	willEncrypt := len(client.config.EncryptionKey) > 0 && action != http.MethodDelete
 	if willEncrypt {
-		options.Headers = []string{
+		headers = append([]string{
 			"x-goog-encryption-algorithm: AES256",
 			fmt.Sprintf("x-goog-encryption-key: %s", client.config.EncryptionKeyEncoded),
 			fmt.Sprintf("x-goog-encryption-key-sha256: %s", client.config.EncryptionKeySha256),
+		}, headers...)
+	}
+	return headers
+}
+
+// ChecksumHeader returns the x-goog-hash header which makes GCS reject an
+// upload whose content does not match the given base64 encoded CRC32C
+// and/or MD5 checksums.
+func ChecksumHeader(crc32c, md5 string) (string, error) {
+	var hashes []string
+	if crc32c != "" {
+		if b, err := base64.StdEncoding.DecodeString(crc32c); err != nil || len(b) != 4 {
+			return "", fmt.Errorf("crc32c must be a base64 encoded 4 byte checksum, got %q", crc32c)
 		}
+		hashes = append(hashes, "crc32c="+crc32c)
 	}
-	return storage.SignedURL(client.config.BucketName, id, &options)
+	if md5 != "" {
+		if b, err := base64.StdEncoding.DecodeString(md5); err != nil || len(b) != 16 {
+			return "", fmt.Errorf("md5 must be a base64 encoded 16 byte checksum, got %q", md5)
+		}
+		hashes = append(hashes, "md5="+md5)
+	}
+	if len(hashes) == 0 {
+		return "", errors.New("no checksum given")
+	}
+	return "x-goog-hash: " + strings.Join(hashes, ","), nil
+}
+
+// reservedSignHeaders are set by Sign or the HTTP client itself and cannot
+// be given as additional signed headers.
+var reservedSignHeaders = map[string]bool{
+	"host":                         true,
+	"content-length":               true,
+	"x-goog-encryption-algorithm":  true,
+	"x-goog-encryption-key":        true,
+	"x-goog-encryption-key-sha256": true,
+}
+
+// ParseSignHeader parses a header in "name:value" form to be included in
+// the signature of a URL returned by Sign, such as "x-goog-meta-owner:ci".
+// The header is returned in the canonical "name: value" form Sign accepts.
+func ParseSignHeader(spec string) (string, error) {
+	name, value, ok := strings.Cut(spec, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid header %q: expected name:value", spec)
+	}
+	name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+
+	if !httpguts.ValidHeaderFieldName(name) {
+		return "", fmt.Errorf("invalid header %q: %q is not a valid header name", spec, name)
+	}
+	if !httpguts.ValidHeaderFieldValue(value) {
+		return "", fmt.Errorf("invalid header %q: value contains control characters", spec)
+	}
+	if reservedSignHeaders[name] {
+		return "", fmt.Errorf("invalid header %q: %s is set by the client", spec, name)
+	}
+	return name + ": " + value, nil
 }
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestClient(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Client Suite")
+}
+
+// tempDirs are the directories created by tempDir for the current spec.
+var tempDirs []string
+
+// tempDir returns a new temporary directory, removed once the current spec
+// ends. Ginkgo v1 does not implement GinkgoT().TempDir, which returns "".
+func tempDir() string {
+	dir, err := os.MkdirTemp("", "bosh-gcscli-test")
+	Expect(err).ToNot(HaveOccurred())
+	tempDirs = append(tempDirs, dir)
+	return dir
+}
+
+var _ = AfterEach(func() {
+	for _, dir := range tempDirs {
+		os.RemoveAll(dir)
+	}
+	tempDirs = nil
+})
+
+// newEmulatorBlobstore returns a blobstore for the bucket some-bucket
+// sending its requests to server without TLS or credentials, as to an
+// emulator. configure, if non-nil, sets any other configuration.
+func newEmulatorBlobstore(server *httptest.Server, configure func(*config.GCSCli)) *GCSBlobstore {
+	return newEmulatorBlobstoreWithContext(context.Background(), server, configure)
+}
+
+// newEmulatorBlobstoreWithContext is newEmulatorBlobstore for a blobstore
+// whose operations are bounded by ctx.
+func newEmulatorBlobstoreWithContext(ctx context.Context, server *httptest.Server, configure func(*config.GCSCli)) *GCSBlobstore {
+	cfg := &config.GCSCli{
+		BucketName:       "some-bucket",
+		Endpoint:         server.URL,
+		EmulatorInsecure: true,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	blobstore, err := New(ctx, cfg)
+	Expect(err).ToNot(HaveOccurred())
+	return blobstore
+}
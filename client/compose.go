@@ -0,0 +1,78 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+)
+
+// MaxComposeSources is the largest number of objects GCS composes into one
+// in a single request.
+const MaxComposeSources = 32
+
+// ErrTooManyComposeSources is returned by Compose when given more than
+// MaxComposeSources parts.
+var ErrTooManyComposeSources = errors.New("at most 32 objects can be composed at once")
+
+// Compose concatenates the objects parts, in order, into dst server-side,
+// e.g. to assemble the chunks of a file uploaded in parallel. The parts are
+// kept.
+//
+// dst is created with the configured content type, storage class, metadata
+// and Cloud KMS key. With an encryption key configured, the parts must be
+// encrypted with it, and so is dst.
+func (client *GCSBlobstore) Compose(dst string, parts []string) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+	if len(parts) == 0 {
+		return errors.New("compose requires at least one part")
+	}
+	if len(parts) > MaxComposeSources {
+		return fmt.Errorf("%w, got %d", ErrTooManyComposeSources, len(parts))
+	}
+
+	// The key of dst decrypts the sources too; the library refuses
+	// sources with a key of their own.
+	sources := make([]*storage.ObjectHandle, len(parts))
+	for i, part := range parts {
+		sources[i] = client.bucketHandle(client.authenticatedGCS).Object(client.objectName(part))
+	}
+	composer := client.getObjectHandle(client.authenticatedGCS, dst).ComposerFrom(sources...)
+	composer.ContentType = client.config.ContentType
+	if composer.ContentType == "" {
+		composer.ContentType = defaultContentType
+	}
+	composer.StorageClass = client.config.StorageClass
+	composer.KMSKeyName = client.config.KMSKeyName
+	composer.Metadata = client.config.Metadata
+
+	attrs, err := composer.Run(client.ctx)
+	if err != nil {
+		err = fmt.Errorf("composing '%s': %w", dst, err)
+	}
+
+	var size int64
+	if attrs != nil {
+		size = attrs.Size
+	}
+	client.record("compose", dst, "", size, err)
+	return err
+}
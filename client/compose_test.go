@@ -0,0 +1,144 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// composeRequest is the body of a request to compose objects.
+type composeRequest struct {
+	SourceObjects []struct{ Name string }
+	Destination   struct {
+		ContentType  string
+		StorageClass string
+	}
+}
+
+var _ = Describe("Composing objects", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var composed []composeRequest
+	var encryptionKeys []string
+
+	BeforeEach(func() {
+		composed, encryptionKeys = nil, nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			Expect(r.URL.Path).To(Equal("/storage/v1/b/some-bucket/o/dst/compose"))
+			var req composeRequest
+			Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+			composed = append(composed, req)
+			encryptionKeys = append(encryptionKeys, r.Header.Get("X-Goog-Encryption-Key"))
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"bucket": "some-bucket", "name": "dst", "size": "6"}`)) //nolint:errcheck
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.StorageClass = "NEARLINE"
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("composes the parts in order with the configured storage class", func() {
+		Expect(blobstore.Compose("dst", []string{"part-2", "part-1"})).To(Succeed())
+
+		Expect(composed).To(HaveLen(1))
+		Expect(composed[0].SourceObjects).To(HaveLen(2))
+		Expect(composed[0].SourceObjects[0].Name).To(Equal("part-2"))
+		Expect(composed[0].SourceObjects[1].Name).To(Equal("part-1"))
+		Expect(composed[0].Destination.StorageClass).To(Equal("NEARLINE"))
+		Expect(composed[0].Destination.ContentType).To(Equal("application/octet-stream"))
+		Expect(encryptionKeys).To(Equal([]string{""}))
+	})
+
+	It("encrypts the composite with the configured encryption key", func() {
+		var encryptionKey string
+		encrypted := newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.SetEncryptionKey(make([]byte, 32))
+			encryptionKey = cfg.EncryptionKeyEncoded
+		})
+
+		Expect(encrypted.Compose("dst", []string{"part-1"})).To(Succeed())
+		Expect(encryptionKeys).To(Equal([]string{encryptionKey}))
+	})
+
+	It("composes up to 32 parts but not more", func() {
+		parts := make([]string, MaxComposeSources+1)
+		for i := range parts {
+			parts[i] = fmt.Sprintf("part-%d", i)
+		}
+
+		Expect(blobstore.Compose("dst", parts[:MaxComposeSources])).To(Succeed())
+		err := blobstore.Compose("dst", parts)
+		Expect(err).To(MatchError(ErrTooManyComposeSources))
+		Expect(err).To(MatchError(ContainSubstring("got 33")))
+		Expect(composed).To(HaveLen(1))
+	})
+
+	It("requires at least one part", func() {
+		Expect(blobstore.Compose("dst", nil)).ToNot(Succeed())
+		Expect(composed).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Counting the components of an object", func() {
+	var emulator *gcsEmulator
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		blobstore = newEmulatorBlobstore(emulator.Server, nil)
+		emulator.put("part-1", "abc", nil)
+		emulator.put("part-2", "def", nil)
+	})
+
+	AfterEach(func() {
+		emulator.Close()
+	})
+
+	It("counts the objects a composite object was composed from", func() {
+		Expect(blobstore.Compose("composed", []string{"part-1", "part-2"})).To(Succeed())
+		Expect(blobstore.Compose("nested", []string{"composed", "part-1"})).To(Succeed())
+
+		Expect(blobstore.ComponentCount("composed")).To(Equal(int64(2)))
+		Expect(blobstore.ComponentCount("nested")).To(Equal(int64(3)))
+	})
+
+	It("counts none for an object which is not composite", func() {
+		Expect(blobstore.ComponentCount("part-1")).To(BeZero())
+	})
+
+	It("fails with ErrObjectNotFound for a missing object", func() {
+		_, err := blobstore.ComponentCount("missing")
+		Expect(err).To(MatchError(ErrObjectNotFound))
+	})
+})
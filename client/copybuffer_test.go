@@ -0,0 +1,128 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeRecorder is a destination which records the largest write to it.
+// Its ReadFrom would let io.Copy skip its own buffer.
+type writeRecorder struct {
+	bytes.Buffer
+	largest int
+}
+
+func (r *writeRecorder) Write(p []byte) (int, error) {
+	if len(p) > r.largest {
+		r.largest = len(p)
+	}
+	return r.Buffer.Write(p)
+}
+
+func (r *writeRecorder) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{r}, src)
+}
+
+var _ = Describe("Copy buffer size", func() {
+	content := strings.Repeat("0123456789", 10000)
+
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli)))
+	crc := base64.StdEncoding.EncodeToString(sum)
+
+	var server *httptest.Server
+	var bufferSize int64
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		bufferSize = 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			if strings.Contains(r.URL.Path, "/b/some-bucket/o/") {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"bucket": "some-bucket", "name": "obj", "generation": "7", "size": "%d", "crc32c": %q}`, len(content), crc)
+				return
+			}
+			w.Header().Set("X-Goog-Generation", "7")
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+				w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(content[start : end+1])) //nolint:errcheck
+				return
+			}
+			w.Write([]byte(content)) //nolint:errcheck
+		}))
+	})
+
+	JustBeforeEach(func() {
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+			cfg.CopyBufferSize = bufferSize
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("when it is not set", func() {
+		It("copies downloads through io.Copy's 32KiB buffer", func() {
+			var out writeRecorder
+			Expect(blobstore.Get("obj", &out)).To(Succeed())
+			Expect(out.String()).To(Equal(content))
+			Expect(out.largest).To(BeNumerically("<=", 32<<10))
+		})
+	})
+
+	Describe("when it is set", func() {
+		BeforeEach(func() {
+			bufferSize = config.MinCopyBufferSize
+		})
+
+		It("copies downloads through the buffer", func() {
+			var out writeRecorder
+			Expect(blobstore.Get("obj", &out)).To(Succeed())
+			Expect(out.String()).To(Equal(content))
+			Expect(out.largest).To(BeNumerically("<=", config.MinCopyBufferSize))
+		})
+
+		It("copies byte ranges through the buffer", func() {
+			var out writeRecorder
+			Expect(blobstore.GetRange("obj", ByteRange{Start: 5, End: 50004}, &out)).To(Succeed())
+			Expect(out.String()).To(Equal(content[5:50005]))
+			Expect(out.largest).To(BeNumerically("<=", config.MinCopyBufferSize))
+		})
+	})
+})
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Service account keys from the environment", func() {
+	serviceAccountJSON := func(email string) string {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		serviceAccount, err := json.Marshal(map[string]string{
+			"type":         "service_account",
+			"client_email": email,
+			"private_key":  string(pemKey),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return string(serviceAccount)
+	}
+
+	// signer returns the email of the service account a url signed by
+	// blobstore names.
+	signer := func(blobstore *GCSBlobstore) string {
+		signed, err := blobstore.Sign("blob", "GET", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		u, err := url.Parse(signed)
+		Expect(err).ToNot(HaveOccurred())
+		email, _, _ := strings.Cut(u.Query().Get("X-Goog-Credential"), "/")
+		return email
+	}
+
+	newBlobstore := func(source, inlineKey string) *GCSBlobstore {
+		blobstore, err := New(context.Background(), &config.GCSCli{
+			BucketName:         "some-bucket",
+			CredentialsSource:  source,
+			ServiceAccountFile: inlineKey,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return blobstore
+	}
+
+	var keyFile string
+
+	BeforeEach(func() {
+		keyFile = filepath.Join(tempDir(), "key.json")
+		Expect(os.WriteFile(keyFile, []byte(serviceAccountJSON("file@example.iam.gserviceaccount.com")), 0600)).To(Succeed())
+		os.Setenv(config.ApplicationCredentialsEnv, keyFile)
+		os.Setenv(config.ServiceAccountJSONEnv, serviceAccountJSON("env@example.iam.gserviceaccount.com"))
+	})
+
+	AfterEach(func() {
+		os.Unsetenv(config.ApplicationCredentialsEnv)
+		os.Unsetenv(config.ServiceAccountJSONEnv)
+	})
+
+	It("prefers json_key over the environment", func() {
+		blobstore := newBlobstore(config.ServiceAccountFileCredentialsSource, serviceAccountJSON("inline@example.iam.gserviceaccount.com"))
+		Expect(signer(blobstore)).To(Equal("inline@example.iam.gserviceaccount.com"))
+	})
+
+	It("prefers the JSON in the environment over the application credentials file", func() {
+		Expect(signer(newBlobstore(config.ServiceAccountFileCredentialsSource, ""))).To(Equal("env@example.iam.gserviceaccount.com"))
+		Expect(signer(newBlobstore(config.DefaultCredentialsSource, ""))).To(Equal("env@example.iam.gserviceaccount.com"))
+	})
+
+	It("reads the application credentials file without JSON in the environment", func() {
+		os.Unsetenv(config.ServiceAccountJSONEnv)
+		Expect(signer(newBlobstore(config.ServiceAccountFileCredentialsSource, ""))).To(Equal("file@example.iam.gserviceaccount.com"))
+	})
+
+	It("returns an error for JSON in the environment which is not valid", func() {
+		os.Setenv(config.ServiceAccountJSONEnv, "{not json")
+		_, err := New(context.Background(), &config.GCSCli{
+			BucketName:        "some-bucket",
+			CredentialsSource: config.ServiceAccountFileCredentialsSource,
+		})
+		Expect(err).To(MatchError(ContainSubstring(config.ServiceAccountJSONEnv)))
+	})
+})
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Deleting objects", func() {
+	var emulator *gcsEmulator
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		blobstore = newEmulatorBlobstore(emulator.Server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+		emulator.put("a", "a", nil)
+		emulator.put("b", "b", nil)
+	})
+
+	AfterEach(func() {
+		emulator.Close()
+	})
+
+	It("counts an object which does not exist as deleted", func() {
+		result, err := blobstore.DeleteObjects([]string{"a", "missing", "b"}, BulkOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Err()).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(ConsistOf("a", "missing", "b"))
+		Expect(emulator.names()).To(BeEmpty())
+	})
+
+	It("fails an object which does not exist with MissingFails", func() {
+		result, err := blobstore.DeleteObjects([]string{"a", "missing", "b"}, BulkOptions{MissingFails: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(ConsistOf("a", "b"))
+		Expect(result.Failed).To(HaveKey("missing"))
+		Expect(result.Failed["missing"]).To(MatchError(ErrObjectNotFound))
+		Expect(result.Err()).To(MatchError(ErrObjectNotFound))
+		Expect(emulator.names()).To(BeEmpty())
+	})
+
+	It("reports the objects which failed to delete and deletes the others", func() {
+		emulator.put("held", "held", nil)
+		emulator.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method != http.MethodDelete || !strings.HasSuffix(r.URL.Path, "/o/held") {
+				return false
+			}
+			writeError(w, http.StatusPreconditionFailed, "Object is under active Event-Based hold.")
+			return true
+		}
+
+		result, err := blobstore.DeleteObjects([]string{"a", "held", "b"}, BulkOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(ConsistOf("a", "b"))
+		Expect(result.Skipped).To(BeEmpty())
+		Expect(result.Failed).To(HaveLen(1))
+		Expect(result.Failed).To(HaveKey("held"))
+		Expect(result.Err()).To(MatchError(ContainSubstring("1 of 3 objects failed, e.g. 'held'")))
+		Expect(emulator.names()).To(Equal([]string{"held"}))
+	})
+
+	Describe("with FailFast", func() {
+		failing := func(code int) func(w http.ResponseWriter, r *http.Request) bool {
+			return func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodDelete || !strings.HasSuffix(r.URL.Path, "/o/b") {
+					return false
+				}
+				writeError(w, code, http.StatusText(code))
+				return true
+			}
+		}
+
+		BeforeEach(func() {
+			emulator.put("c", "c", nil)
+			emulator.put("d", "d", nil)
+		})
+
+		It("stops after the first failure and skips the remaining objects", func() {
+			emulator.intercept = failing(http.StatusBadRequest)
+
+			result, err := blobstore.DeleteObjects([]string{"a", "b", "c", "d"}, BulkOptions{Concurrency: 1, FailFast: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Succeeded).To(Equal([]string{"a"}))
+			Expect(result.Failed).To(HaveKey("b"))
+			Expect(result.Skipped).To(Equal([]string{"c", "d"}))
+			Expect(result.Err()).To(HaveOccurred())
+			Expect(emulator.names()).To(Equal([]string{"b", "c", "d"}))
+		})
+
+		It("carries on after a transient failure", func() {
+			emulator.intercept = failing(http.StatusServiceUnavailable)
+
+			result, err := blobstore.DeleteObjects([]string{"a", "b", "c", "d"}, BulkOptions{Concurrency: 1, FailFast: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Succeeded).To(Equal([]string{"a", "c", "d"}))
+			Expect(result.Failed).To(HaveKey("b"))
+			Expect(result.Skipped).To(BeEmpty())
+		})
+
+		It("carries on after any failure without it", func() {
+			emulator.intercept = failing(http.StatusBadRequest)
+
+			result, err := blobstore.DeleteObjects([]string{"a", "b", "c", "d"}, BulkOptions{Concurrency: 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Succeeded).To(Equal([]string{"a", "c", "d"}))
+			Expect(result.Skipped).To(BeEmpty())
+			Expect(emulator.names()).To(Equal([]string{"b"}))
+		})
+	})
+
+	It("fails an object which does not exist with MissingFails on a dry run", func() {
+		result, err := blobstore.DeleteObjects([]string{"a", "missing"}, BulkOptions{MissingFails: true, DryRun: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(Equal([]string{"a"}))
+		Expect(result.Failed["missing"]).To(MatchError(ErrObjectNotFound))
+		Expect(emulator.names()).To(Equal([]string{"a", "b"}))
+	})
+})
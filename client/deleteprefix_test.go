@@ -0,0 +1,119 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Deleting a prefix", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var mu sync.Mutex
+	var deletes map[string]string
+
+	BeforeEach(func() {
+		deletes = map[string]string{}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/b/some-bucket/o"):
+				Expect(r.URL.Query().Get("prefix")).To(Equal("releases/1.2/"))
+				fmt.Fprint(w, `{"items": [
+					{"name": "releases/1.2/a.tgz", "generation": "1", "size": "10"},
+					{"name": "releases/1.2/gone.tgz", "generation": "2", "size": "20"},
+					{"name": "releases/1.2/replaced.tgz", "generation": "3", "size": "30"},
+					{"name": "releases/1.2/notes.txt", "generation": "4", "size": "40"}
+				]}`)
+			case r.Method == http.MethodDelete:
+				name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/some-bucket/o/")
+				mu.Lock()
+				deletes[name] = r.URL.Query().Get("ifGenerationMatch")
+				mu.Unlock()
+				switch name {
+				case "releases/1.2/gone.tgz":
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error": {"code": 404, "message": "No such object"}}`)
+				case "releases/1.2/replaced.tgz":
+					w.WriteHeader(http.StatusPreconditionFailed)
+					fmt.Fprint(w, `{"error": {"code": 412, "message": "Precondition Failed"}}`)
+				default:
+					w.WriteHeader(http.StatusNoContent)
+				}
+			default:
+				Fail("unexpected request " + r.Method + " " + r.URL.Path)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("deletes the listed generation of each matching object", func() {
+		result, err := blobstore.DeletePrefix("releases/1.2/", BulkOptions{Concurrency: 2, MinConcurrency: 1, Match: regexp.MustCompile(`\.tgz$`)})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(deletes).To(Equal(map[string]string{
+			"releases/1.2/a.tgz":        "1",
+			"releases/1.2/gone.tgz":     "2",
+			"releases/1.2/replaced.tgz": "3",
+		}))
+		Expect(result.Succeeded).To(ConsistOf("releases/1.2/a.tgz", "releases/1.2/gone.tgz"))
+		Expect(result.Failed).To(HaveKey("releases/1.2/replaced.tgz"))
+	})
+
+	It("fails an object deleted since it was listed with MissingFails", func() {
+		result, err := blobstore.DeletePrefix("releases/1.2/", BulkOptions{Concurrency: 1, MinConcurrency: 1, MissingFails: true, Match: regexp.MustCompile(`\.tgz$`)})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(result.Succeeded).To(Equal([]string{"releases/1.2/a.tgz"}))
+		Expect(result.Failed).To(HaveLen(2))
+		Expect(result.Failed["releases/1.2/gone.tgz"]).To(MatchError(ErrObjectNotFound))
+	})
+
+	It("deletes nothing on a dry run", func() {
+		result, err := blobstore.DeletePrefix("releases/1.2/", BulkOptions{Concurrency: 1, MinConcurrency: 1, DryRun: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(HaveLen(4))
+		Expect(deletes).To(BeEmpty())
+	})
+
+	It("deletes nothing when more objects match than the limit", func() {
+		_, err := blobstore.DeletePrefix("releases/1.2/", BulkOptions{Concurrency: 1, MinConcurrency: 1, ObjectCountLimit: 3})
+		Expect(errors.Is(err, ErrTooManyObjects)).To(BeTrue())
+		Expect(deletes).To(BeEmpty())
+	})
+})
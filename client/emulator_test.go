@@ -0,0 +1,499 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// gcsEmulator is an in-memory bucket named some-bucket served over the
+// JSON API, for specs which write, copy and delete objects rather than
+// answer a few fixed requests.
+type gcsEmulator struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	objects    map[string]*emulatedObject
+	generation int64
+	// operations are the writes, copies, deletes and downloads made, in
+	// order, such as "upload obj" or "copy src dst".
+	operations []string
+	// intercept, if set, is called with every request first, and handles it
+	// instead of the emulator if it returns true.
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+	sessions  map[string]*uploadSession
+}
+
+// emulatedObject is an object stored by a gcsEmulator.
+type emulatedObject struct {
+	data []byte
+	// resource is the object's JSON API resource.
+	resource map[string]interface{}
+}
+
+// uploadSession is a resumable upload in progress.
+type uploadSession struct {
+	attrs map[string]interface{}
+	query string
+	data  []byte
+}
+
+const emulatedBucketPath = "/storage/v1/b/some-bucket"
+
+// newGCSEmulator starts an empty emulated bucket, to be closed by the spec.
+func newGCSEmulator() *gcsEmulator {
+	e := &gcsEmulator{objects: map[string]*emulatedObject{}, sessions: map[string]*uploadSession{}}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serve))
+	return e
+}
+
+// put stores data as the object name with the JSON API attributes attrs,
+// which may be nil, and returns its generation.
+func (e *gcsEmulator) put(name, data string, attrs map[string]interface{}) int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.store(name, []byte(data), attrs)
+}
+
+// object returns the object name, or nil if it does not exist.
+func (e *gcsEmulator) object(name string) *emulatedObject {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.objects[name]
+}
+
+// names returns the names of the objects in the bucket, in order.
+func (e *gcsEmulator) names() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var names []string
+	for name := range e.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ops returns the operations made so far.
+func (e *gcsEmulator) ops() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.operations...)
+}
+
+// rewriteUploads makes the emulator store uploads as usual but answer with
+// the resource of the new object as changed by rewrite, e.g. to report
+// checksums of other content.
+func (e *gcsEmulator) rewriteUploads(rewrite func(resource map[string]interface{})) {
+	e.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasPrefix(r.URL.Path, "/upload/") {
+			return false
+		}
+
+		recorder := httptest.NewRecorder()
+		e.mu.Lock()
+		e.upload(recorder, r)
+		e.mu.Unlock()
+
+		body := recorder.Body.Bytes()
+		var resource map[string]interface{}
+		if recorder.Code == http.StatusOK && json.Unmarshal(body, &resource) == nil {
+			rewrite(resource)
+			var err error
+			body, err = json.Marshal(resource)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(recorder.Code)
+		w.Write(body) //nolint:errcheck
+		return true
+	}
+}
+
+// emulatedCRC32C returns the CRC32C of data as the JSON API encodes it.
+func emulatedCRC32C(data []byte) string {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// store writes the object name as a new generation. e.mu must be held.
+func (e *gcsEmulator) store(name string, data []byte, attrs map[string]interface{}) int64 {
+	e.generation++
+	resource := map[string]interface{}{"storageClass": "STANDARD"}
+	for key, value := range attrs {
+		resource[key] = value
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	md5Hash := md5.Sum(data)
+	for key, value := range map[string]interface{}{
+		"bucket":         "some-bucket",
+		"name":           name,
+		"generation":     strconv.FormatInt(e.generation, 10),
+		"metageneration": "1",
+		"size":           strconv.Itoa(len(data)),
+		"crc32c":         emulatedCRC32C(data),
+		"md5Hash":        base64.StdEncoding.EncodeToString(md5Hash[:]),
+		"timeCreated":    now,
+		"updated":        now,
+	} {
+		resource[key] = value
+	}
+	e.objects[name] = &emulatedObject{data: data, resource: resource}
+	return e.generation
+}
+
+func (e *gcsEmulator) serve(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+
+	if e.intercept != nil && e.intercept(w, r) {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch path := r.URL.Path; {
+	case path == emulatedBucketPath:
+		fmt.Fprint(w, `{"name": "some-bucket"}`)
+	case strings.HasPrefix(path, "/upload"+emulatedBucketPath+"/o"):
+		e.upload(w, r)
+	case path == emulatedBucketPath+"/o":
+		e.list(w, r)
+	case strings.HasPrefix(path, emulatedBucketPath+"/o/"):
+		name := strings.TrimPrefix(path, emulatedBucketPath+"/o/")
+		src, dst, isCopy := strings.Cut(name, "/rewriteTo/b/some-bucket/o/")
+		switch {
+		case isCopy:
+			e.copy(w, r, src, dst)
+		case r.Method == http.MethodPost && strings.HasSuffix(name, "/compose"):
+			e.compose(w, r, strings.TrimSuffix(name, "/compose"))
+		case r.Method == http.MethodGet && r.URL.Query().Get("alt") == "media":
+			e.download(w, name)
+		case r.Method == http.MethodGet:
+			if obj := e.find(w, name); obj != nil {
+				writeJSON(w, obj.resource)
+			}
+		case r.Method == http.MethodPatch:
+			e.patch(w, r, name)
+		case r.Method == http.MethodDelete:
+			e.remove(w, r, name)
+		default:
+			Fail("unexpected request " + r.Method + " " + path)
+		}
+	case strings.HasPrefix(path, "/some-bucket/"):
+		e.download(w, strings.TrimPrefix(path, "/some-bucket/"))
+	default:
+		Fail("unexpected request " + r.Method + " " + path)
+	}
+}
+
+// find returns the object name, or responds 404 and returns nil.
+func (e *gcsEmulator) find(w http.ResponseWriter, name string) *emulatedObject {
+	obj := e.objects[name]
+	if obj == nil {
+		writeError(w, http.StatusNotFound, "No such object: some-bucket/"+name)
+	}
+	return obj
+}
+
+// preconditionsHold checks the generation preconditions of query against
+// the object name, responding 412 if one fails.
+func (e *gcsEmulator) preconditionsHold(w http.ResponseWriter, query, name string) bool {
+	values, err := url.ParseQuery(query)
+	Expect(err).ToNot(HaveOccurred())
+
+	var generation, metageneration string = "0", "0"
+	if obj := e.objects[name]; obj != nil {
+		generation, metageneration = obj.resource["generation"].(string), obj.resource["metageneration"].(string)
+	}
+	for param, current := range map[string]string{"ifGenerationMatch": generation, "ifMetagenerationMatch": metageneration} {
+		if want := values.Get(param); want != "" && want != current {
+			writeError(w, http.StatusPreconditionFailed, "Precondition Failed")
+			return false
+		}
+	}
+	return true
+}
+
+func (e *gcsEmulator) upload(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Query().Get("upload_id") != "":
+		// The chunks of a resumable upload are sent to its session.
+		session := e.sessions[r.URL.Query().Get("upload_id")]
+		Expect(session).ToNot(BeNil())
+		data, err := io.ReadAll(r.Body)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Content-Range is "bytes first-last/total", with * for an unknown
+		// total or no bytes.
+		var first int
+		byteRange, total, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/")
+		if byteRange != "*" {
+			first, err = strconv.Atoi(strings.Split(byteRange, "-")[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first).To(BeNumerically("<=", len(session.data)))
+			session.data = append(session.data[:first], data...)
+		}
+		if total != "*" && total == strconv.Itoa(len(session.data)) {
+			e.finishUpload(w, session.query, session.attrs, session.data)
+			return
+		}
+		if len(session.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+		}
+		// Clients asking not to be sent a 308, as the storage library
+		// does, are sent a 200 overridden to it.
+		if r.Header.Get("X-GUploader-No-308") == "yes" {
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			return
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+	case r.Method == http.MethodPost && r.URL.Query().Get("uploadType") == "resumable":
+		var attrs map[string]interface{}
+		Expect(json.NewDecoder(r.Body).Decode(&attrs)).To(Succeed())
+		id := strconv.Itoa(len(e.sessions) + 1)
+		e.sessions[id] = &uploadSession{attrs: attrs, query: r.URL.RawQuery}
+		w.Header().Set("Location", e.URL+"/upload"+emulatedBucketPath+"/o?uploadType=resumable&upload_id="+id)
+	case r.Method == http.MethodPost:
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		Expect(err).ToNot(HaveOccurred())
+		parts := multipart.NewReader(r.Body, params["boundary"])
+		part, err := parts.NextPart()
+		Expect(err).ToNot(HaveOccurred())
+		var attrs map[string]interface{}
+		Expect(json.NewDecoder(part).Decode(&attrs)).To(Succeed())
+		part, err = parts.NextPart()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := io.ReadAll(part)
+		Expect(err).ToNot(HaveOccurred())
+		e.finishUpload(w, r.URL.RawQuery, attrs, data)
+	default:
+		Fail("unexpected upload " + r.Method)
+	}
+}
+
+// finishUpload stores an uploaded object, checking the hashes the client
+// sent as GCS does.
+func (e *gcsEmulator) finishUpload(w http.ResponseWriter, query string, attrs map[string]interface{}, data []byte) {
+	name := attrs["name"].(string)
+	if !e.preconditionsHold(w, query, name) {
+		return
+	}
+	md5Hash := md5.Sum(data)
+	if sent, ok := attrs["crc32c"]; ok && sent != emulatedCRC32C(data) {
+		writeError(w, http.StatusBadRequest, "Provided CRC32C doesn't match calculated CRC32C.")
+		return
+	}
+	if sent, ok := attrs["md5Hash"]; ok && sent != base64.StdEncoding.EncodeToString(md5Hash[:]) {
+		writeError(w, http.StatusBadRequest, "Provided MD5 hash doesn't match calculated MD5 hash.")
+		return
+	}
+	delete(attrs, "bucket")
+	e.store(name, data, attrs)
+	e.operations = append(e.operations, "upload "+name)
+	writeJSON(w, e.objects[name].resource)
+}
+
+func (e *gcsEmulator) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	items := []interface{}{}
+	for _, name := range e.sortedNames() {
+		if strings.HasPrefix(name, prefix) {
+			items = append(items, e.objects[name].resource)
+		}
+	}
+	writeJSON(w, map[string]interface{}{"items": items})
+}
+
+// sortedNames is names with e.mu held.
+func (e *gcsEmulator) sortedNames() []string {
+	names := make([]string, 0, len(e.objects))
+	for name := range e.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *gcsEmulator) download(w http.ResponseWriter, name string) {
+	obj := e.find(w, name)
+	if obj == nil {
+		return
+	}
+	e.operations = append(e.operations, "download "+name)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Goog-Generation", obj.resource["generation"].(string))
+	w.Header().Set("X-Goog-Metageneration", obj.resource["metageneration"].(string))
+	w.Header().Set("X-Goog-Hash", "crc32c="+obj.resource["crc32c"].(string))
+	w.Header().Set("X-Goog-Stored-Content-Length", obj.resource["size"].(string))
+	w.Write(obj.data) //nolint:errcheck
+}
+
+// copy serves a rewrite of src to dst. As in GCS, the copy only keeps the
+// source's metadata if no destination attributes are given.
+func (e *gcsEmulator) copy(w http.ResponseWriter, r *http.Request, src, dst string) {
+	obj := e.find(w, src)
+	if obj == nil || !e.preconditionsHold(w, r.URL.RawQuery, dst) {
+		return
+	}
+	if generation := r.URL.Query().Get("sourceGeneration"); generation != "" && generation != obj.resource["generation"] {
+		writeError(w, http.StatusNotFound, "No such object: some-bucket/"+src)
+		return
+	}
+
+	var attrs map[string]interface{}
+	Expect(json.NewDecoder(r.Body).Decode(&attrs)).To(Succeed())
+	delete(attrs, "name")
+	delete(attrs, "bucket")
+	if len(attrs) == 0 {
+		for _, key := range []string{"contentType", "contentEncoding", "cacheControl", "metadata", "storageClass"} {
+			if value, ok := obj.resource[key]; ok {
+				attrs[key] = value
+			}
+		}
+	}
+	e.store(dst, obj.data, attrs)
+	e.operations = append(e.operations, "copy "+src+" "+dst)
+	writeJSON(w, map[string]interface{}{"kind": "storage#rewriteResponse", "done": true, "resource": e.objects[dst].resource})
+}
+
+// compose serves the composition of dst. Like GCS, the composite has a
+// component count but no MD5.
+func (e *gcsEmulator) compose(w http.ResponseWriter, r *http.Request, dst string) {
+	var req struct {
+		SourceObjects []struct{ Name string }
+		Destination   map[string]interface{}
+	}
+	Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+	if !e.preconditionsHold(w, r.URL.RawQuery, dst) {
+		return
+	}
+
+	var data []byte
+	components := 0
+	for _, source := range req.SourceObjects {
+		obj := e.find(w, source.Name)
+		if obj == nil {
+			return
+		}
+		data = append(data, obj.data...)
+		count, ok := obj.resource["componentCount"].(int)
+		if !ok {
+			count = 1
+		}
+		components += count
+	}
+	attrs := req.Destination
+	if attrs == nil {
+		attrs = map[string]interface{}{}
+	}
+	delete(attrs, "name")
+	delete(attrs, "bucket")
+	attrs["componentCount"] = components
+	e.store(dst, data, attrs)
+	delete(e.objects[dst].resource, "md5Hash")
+	e.operations = append(e.operations, "compose "+dst)
+	writeJSON(w, e.objects[dst].resource)
+}
+
+// patch updates the metadata of name. As in the JSON API, a null value
+// clears a field or a key of the custom metadata.
+func (e *gcsEmulator) patch(w http.ResponseWriter, r *http.Request, name string) {
+	obj := e.find(w, name)
+	if obj == nil || !e.preconditionsHold(w, r.URL.RawQuery, name) {
+		return
+	}
+	var update map[string]interface{}
+	Expect(json.NewDecoder(r.Body).Decode(&update)).To(Succeed())
+	for key, value := range update {
+		switch {
+		case key == "metadata" && value != nil:
+			metadata, _ := obj.resource["metadata"].(map[string]interface{})
+			merged := map[string]interface{}{}
+			for k, v := range metadata {
+				merged[k] = v
+			}
+			for k, v := range value.(map[string]interface{}) {
+				if v == nil {
+					delete(merged, k)
+				} else {
+					merged[k] = v
+				}
+			}
+			obj.resource["metadata"] = merged
+		case value == nil:
+			delete(obj.resource, key)
+		default:
+			obj.resource[key] = value
+		}
+	}
+	metageneration, err := strconv.Atoi(obj.resource["metageneration"].(string))
+	Expect(err).ToNot(HaveOccurred())
+	obj.resource["metageneration"] = strconv.Itoa(metageneration + 1)
+	obj.resource["updated"] = time.Now().UTC().Format(time.RFC3339Nano)
+	e.operations = append(e.operations, "patch "+name)
+	writeJSON(w, obj.resource)
+}
+
+// remove deletes name, unless it is under a hold, which GCS refuses with
+// 403 Forbidden.
+func (e *gcsEmulator) remove(w http.ResponseWriter, r *http.Request, name string) {
+	obj := e.find(w, name)
+	if obj == nil || !e.preconditionsHold(w, r.URL.RawQuery, name) {
+		return
+	}
+	if obj.resource["temporaryHold"] == true || obj.resource["eventBasedHold"] == true {
+		writeError(w, http.StatusForbidden, "Object '"+name+"' is under active Temporary hold and cannot be deleted, overwritten or archived until hold is removed.")
+		return
+	}
+	delete(e.objects, name)
+	e.operations = append(e.operations, "delete "+name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	Expect(json.NewEncoder(w).Encode(v)).To(Succeed())
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, code, message)
+}
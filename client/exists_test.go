@@ -0,0 +1,91 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checking many objects exist", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/some-bucket/o/")
+			w.Header().Set("Content-Type", "application/json")
+			switch name {
+			case "missing":
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error": {"code": 404, "message": "Not Found"}}`)
+			case "unavailable":
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, `{"error": {"code": 503, "message": "Backend Error"}}`)
+			case "denied":
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"error": {"code": 403, "message": "Forbidden"}}`)
+			default:
+				fmt.Fprintf(w, `{"bucket": "some-bucket", "name": %q}`, name)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("reports whether each distinct name exists", func() {
+		found, result := blobstore.ExistsObjects([]string{"present", "missing", "present"}, BulkOptions{Concurrency: 2})
+		Expect(result.Err()).ToNot(HaveOccurred())
+		Expect(found).To(Equal(map[string]bool{"present": true, "missing": false}))
+		Expect(result.Succeeded).To(ConsistOf("present", "missing"))
+	})
+
+	It("returns an error rather than false when an object cannot be looked up", func() {
+		exists, err := blobstore.Exists("unavailable")
+		Expect(err).To(HaveOccurred())
+		Expect(storage.ShouldRetry(err)).To(BeTrue())
+		Expect(exists).To(BeFalse())
+
+		exists, err = blobstore.Exists("missing")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeFalse())
+	})
+
+	It("leaves names which could not be looked up out of the map", func() {
+		found, result := blobstore.ExistsObjects([]string{"present", "denied"}, BulkOptions{Concurrency: 2})
+		Expect(found).To(Equal(map[string]bool{"present": true}))
+		Expect(result.Failed).To(HaveKey("denied"))
+		Expect(result.Err()).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,1318 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fakeclient provides an in-memory implementation of client.Client,
+// for testing code which uses the client without access to GCS.
+package fakeclient
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/cloudfoundry/bosh-gcscli/client"
+)
+
+// defaultContentType is the content type GCS gives an object uploaded
+// without one.
+const defaultContentType = "application/octet-stream"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Client is a bucket held in memory. Every generation of each object is
+// kept, as on a bucket with object versioning. It is safe for concurrent
+// use.
+//
+// The fake implements the semantics of the operations, including their
+// preconditions and the errors they return, but not those of GCS itself:
+// nothing is encrypted, compressed objects are never decompressed, and
+// signed URLs are not signed.
+type Client struct {
+	// ReadOnly makes every write fail with client.ErrInvalidROWriteOperation,
+	// as for a client without credentials.
+	ReadOnly bool
+	// Unversioned makes Undelete fail as for a bucket without object
+	// versioning. Every generation is still kept.
+	Unversioned bool
+
+	bucketName string
+
+	mu          sync.Mutex
+	objects     map[string]*object
+	generations map[string]map[int64]*object
+	generation  int64
+	buckets     map[string]*Client
+	lookupErrs  map[string]error
+	removed     bool
+}
+
+// object is a generation of an object: its content and attributes.
+type object struct {
+	data  []byte
+	attrs storage.ObjectAttrs
+	// components is the component count of a composite object, and 0 for
+	// any other.
+	components int64
+}
+
+// New returns an empty fake of the bucket named bucketName.
+func New(bucketName string) *Client {
+	return &Client{
+		bucketName:  bucketName,
+		objects:     map[string]*object{},
+		generations: map[string]map[int64]*object{},
+		buckets:     map[string]*Client{},
+		lookupErrs:  map[string]error{},
+	}
+}
+
+var _ client.Client = (*Client)(nil)
+
+// Bucket returns the fake of another bucket, which MigratePrefix copies
+// objects into. It is created empty the first time it is asked for.
+func (c *Client) Bucket(name string) *Client {
+	if name == c.bucketName {
+		return c
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	other, ok := c.buckets[name]
+	if !ok {
+		other = New(name)
+		c.buckets[name] = other
+	}
+	return other
+}
+
+// Object returns the content of the current generation of the object name,
+// and whether it exists.
+func (c *Client) Object(name string) ([]byte, bool) {
+	obj, ok := c.lookup(name)
+	if !ok {
+		return nil, false
+	}
+	return obj.data, true
+}
+
+// FailLookups makes Exists, ExistsObjects and Stat of the object name fail
+// with err, e.g. a transient error, whether or not it exists. A nil err
+// clears it.
+func (c *Client) FailLookups(name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.lookupErrs, name)
+		return
+	}
+	c.lookupErrs[name] = err
+}
+
+// lookupErr returns the error FailLookups set for the object name.
+func (c *Client) lookupErr(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookupErrs[name]
+}
+
+// notFoundError is returned for the object name which does not exist. Like
+// the errors of GCSBlobstore, it matches both client.ErrObjectNotFound and
+// storage.ErrObjectNotExist.
+type notFoundError struct {
+	name string
+}
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("object '%s' not found", e.name)
+}
+
+func (e notFoundError) Is(target error) bool { return target == client.ErrObjectNotFound }
+func (e notFoundError) Unwrap() error        { return storage.ErrObjectNotExist }
+
+// lookup returns a copy of the current generation of the object name.
+func (c *Client) lookup(name string) (*object, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.objects[name]
+	if !ok {
+		return nil, false
+	}
+	return obj.clone(), true
+}
+
+func (obj *object) clone() *object {
+	clone := &object{data: obj.data, attrs: obj.attrs, components: obj.components}
+	if obj.attrs.Metadata != nil {
+		clone.attrs.Metadata = make(map[string]string, len(obj.attrs.Metadata))
+		for k, v := range obj.attrs.Metadata {
+			clone.attrs.Metadata[k] = v
+		}
+	}
+	return clone
+}
+
+// store makes obj the new current generation of its object, provided conds,
+// if non-nil, hold. The generation, checksums and times of obj are set.
+func (c *Client) store(obj *object, conds *storage.Conditions) (*storage.ObjectAttrs, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := obj.attrs.Name
+	current, exists := c.objects[name]
+	if conds != nil {
+		if conds.DoesNotExist && exists {
+			return nil, fmt.Errorf("%w: '%s'", client.ErrObjectExists, name)
+		}
+		if conds.GenerationMatch != 0 && (!exists || current.attrs.Generation != conds.GenerationMatch) {
+			return nil, fmt.Errorf("%w: '%s' is not at generation %d", client.ErrGenerationMismatch, name, conds.GenerationMatch)
+		}
+	}
+
+	c.generation++
+	now := time.Now()
+	obj.attrs.Bucket = c.bucketName
+	obj.attrs.Generation = c.generation
+	obj.attrs.Metageneration = 1
+	obj.attrs.Size = int64(len(obj.data))
+	obj.attrs.CRC32C = crc32.Checksum(obj.data, crc32cTable)
+	if obj.components == 0 {
+		// As for GCS, a composite object has no MD5.
+		sum := md5.Sum(obj.data)
+		obj.attrs.MD5 = sum[:]
+	}
+	obj.attrs.Created = now
+	obj.attrs.Updated = now
+	if obj.attrs.ContentType == "" {
+		obj.attrs.ContentType = defaultContentType
+	}
+	if obj.attrs.StorageClass == "" {
+		obj.attrs.StorageClass = "STANDARD"
+	}
+
+	c.objects[name] = obj
+	if c.generations[name] == nil {
+		c.generations[name] = map[int64]*object{}
+	}
+	c.generations[name][obj.attrs.Generation] = obj
+	attrs := obj.clone().attrs
+	return &attrs, nil
+}
+
+// remove deletes the current generation of the object name, provided it is
+// at generation, if non-zero, and reports whether it existed.
+func (c *Client) remove(name string, generation int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, ok := c.objects[name]
+	if !ok || (generation != 0 && current.attrs.Generation != generation) {
+		return false
+	}
+	delete(c.objects, name)
+	return true
+}
+
+// sortedObjects returns a copy of the current generation of every object
+// under prefix, in name order.
+func (c *Client) sortedObjects(prefix string) []*object {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var objects []*object
+	for name, obj := range c.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, obj.clone())
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].attrs.Name < objects[j].attrs.Name })
+	return objects
+}
+
+func (c *Client) put(src io.Reader, dest string, opts client.PutOptions, conds *storage.Conditions) (*storage.ObjectAttrs, error) {
+	if c.ReadOnly {
+		return nil, client.ErrInvalidROWriteOperation
+	}
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if sum := md5.Sum(data); opts.MD5 != nil && !bytes.Equal(sum[:], opts.MD5) {
+		return nil, fmt.Errorf("%w: '%s' has MD5 %x, expected %x", client.ErrContentMD5Mismatch, dest, sum, opts.MD5)
+	}
+	obj := &object{data: data, attrs: storage.ObjectAttrs{
+		Name:               dest,
+		ContentType:        opts.ContentType,
+		StorageClass:       opts.StorageClass,
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		TemporaryHold:      opts.TemporaryHold,
+		EventBasedHold:     opts.EventBasedHold,
+	}}
+	if len(opts.Metadata) > 0 {
+		obj.attrs.Metadata = make(map[string]string, len(opts.Metadata))
+		for k, v := range opts.Metadata {
+			obj.attrs.Metadata[k] = v
+		}
+	}
+	if opts.GzipEncoded {
+		obj.attrs.ContentEncoding = "gzip"
+	}
+	return c.store(obj, conds)
+}
+
+// Put uploads src to dest.
+func (c *Client) Put(src io.ReadSeeker, dest string) error {
+	_, err := c.put(src, dest, client.PutOptions{}, nil)
+	return err
+}
+
+// Put2 uploads src to dest, marked gzip-encoded if compressed is set.
+func (c *Client) Put2(src io.Reader, dest string, compressed bool) error {
+	_, err := c.put(src, dest, client.PutOptions{GzipEncoded: compressed}, nil)
+	return err
+}
+
+// PutWithOptions uploads src to dest with the attributes in opts.
+func (c *Client) PutWithOptions(src io.Reader, dest string, opts client.PutOptions) error {
+	_, err := c.put(src, dest, opts, nil)
+	return err
+}
+
+// PutGeneration uploads src to dest and returns its generation.
+func (c *Client) PutGeneration(src io.Reader, dest string, opts client.PutOptions) (int64, error) {
+	attrs, err := c.put(src, dest, opts, nil)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
+// PutIf uploads src to dest provided conds hold, and returns its
+// generation. conds.DoesNotExist and conds.GenerationMatch are supported.
+func (c *Client) PutIf(src io.Reader, dest string, opts client.PutOptions, conds storage.Conditions) (int64, error) {
+	attrs, err := c.put(src, dest, opts, &conds)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
+// PutBuffered uploads src to dest. Uploads to the fake never fail midway,
+// so nothing is buffered and maxSize is ignored.
+func (c *Client) PutBuffered(src io.Reader, dest string, opts client.PutOptions, maxSize int64) error {
+	_, err := c.put(src, dest, opts, nil)
+	return err
+}
+
+// PutAtomic uploads src to dest and returns its generation. Uploads to the
+// fake are always atomic.
+func (c *Client) PutAtomic(src io.Reader, dest string, opts client.PutOptions) (int64, error) {
+	attrs, err := c.put(src, dest, opts, nil)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
+// PutVerified uploads src to dest. Uploads to the fake are never corrupt.
+func (c *Client) PutVerified(src io.Reader, dest string, opts client.PutOptions) error {
+	_, err := c.put(src, dest, opts, nil)
+	return err
+}
+
+// PutMarker creates dest as an empty object, unless it exists and noClobber
+// is set, in which case client.ErrObjectExists is returned.
+func (c *Client) PutMarker(dest string, noClobber bool) error {
+	var conds *storage.Conditions
+	if noClobber {
+		conds = &storage.Conditions{DoesNotExist: true}
+	}
+	_, err := c.put(bytes.NewReader(nil), dest, client.PutOptions{}, conds)
+	if errors.Is(err, client.ErrObjectExists) {
+		return client.ErrObjectExists
+	}
+	return err
+}
+
+// Get writes the content of the object src to dest.
+func (c *Client) Get(src string, dest io.Writer) error {
+	obj, ok := c.lookup(src)
+	if !ok {
+		return notFoundError{name: src}
+	}
+	_, err := dest.Write(obj.data)
+	return err
+}
+
+// GetParallel writes the content of the object src to dest, truncated to
+// its size. The fake has no parts to download at once, so parts is
+// ignored.
+func (c *Client) GetParallel(src string, dest client.ParallelDestination, parts int) error {
+	obj, ok := c.lookup(src)
+	if !ok {
+		return notFoundError{name: src}
+	}
+	if err := dest.Truncate(int64(len(obj.data))); err != nil {
+		return err
+	}
+	_, err := dest.WriteAt(obj.data, 0)
+	return err
+}
+
+// GetGeneration writes the content of the given generation of the object
+// src to dest, which may have been replaced or deleted since.
+func (c *Client) GetGeneration(src string, generation int64, dest io.Writer) error {
+	c.mu.Lock()
+	obj, ok := c.generations[src][generation]
+	_, exists := c.objects[src]
+	c.mu.Unlock()
+	if !ok {
+		if !exists {
+			return notFoundError{name: src}
+		}
+		return fmt.Errorf("%w: '%s' has no generation %d", client.ErrGenerationNotFound, src, generation)
+	}
+	_, err := dest.Write(obj.data)
+	return err
+}
+
+// GetRange writes the bytes of the object src within r to dest.
+func (c *Client) GetRange(src string, r client.ByteRange, dest io.Writer) error {
+	obj, ok := c.lookup(src)
+	if !ok {
+		return notFoundError{name: src}
+	}
+	size := int64(len(obj.data))
+	if r.Start < 0 || r.Start >= size || r.End < r.Start {
+		return fmt.Errorf("range %s of '%s' is not satisfiable: it has %d bytes", r, src, size)
+	}
+	end := r.End + 1
+	if end > size {
+		end = size
+	}
+	_, err := dest.Write(obj.data[r.Start:end])
+	return err
+}
+
+// Delete deletes the object dest. Deleting an object which does not exist
+// is not an error; deleting one under a hold is.
+func (c *Client) Delete(dest string) error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	if obj, ok := c.lookup(dest); ok && (obj.attrs.TemporaryHold || obj.attrs.EventBasedHold) {
+		return fmt.Errorf("%w: '%s' has a hold, which must be released before it can be deleted", client.ErrObjectHeld, dest)
+	}
+	c.remove(dest, 0)
+	return nil
+}
+
+// DeleteIf deletes the object dest provided conds hold.
+// conds.GenerationMatch and conds.MetagenerationMatch are supported.
+func (c *Client) DeleteIf(dest string, conds storage.Conditions) error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	obj, ok := c.lookup(dest)
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: '%s'", client.ErrObjectNotFound, dest)
+	case conds.GenerationMatch != 0 && obj.attrs.Generation != conds.GenerationMatch:
+		return fmt.Errorf("%w: '%s' is not at generation %d", client.ErrGenerationMismatch, dest, conds.GenerationMatch)
+	case conds.MetagenerationMatch != 0 && obj.attrs.Metageneration != conds.MetagenerationMatch:
+		return fmt.Errorf("%w: '%s' changed since metageneration %d", client.ErrMetagenerationMismatch, dest, conds.MetagenerationMatch)
+	}
+	return c.Delete(dest)
+}
+
+// Exists reports whether the object dest exists.
+func (c *Client) Exists(dest string) (bool, error) {
+	if err := c.lookupErr(dest); err != nil {
+		return false, err
+	}
+	_, ok := c.lookup(dest)
+	return ok, nil
+}
+
+// Stat returns the attributes of the object dest.
+func (c *Client) Stat(dest string) (*storage.ObjectAttrs, error) {
+	if err := c.lookupErr(dest); err != nil {
+		return nil, err
+	}
+	obj, ok := c.lookup(dest)
+	if !ok {
+		return nil, notFoundError{name: dest}
+	}
+	return &obj.attrs, nil
+}
+
+// RemoteOlderThan reports whether the object dest is absent or was last
+// modified before modTime, preferring its source-mtime metadata to the time
+// it was uploaded.
+func (c *Client) RemoteOlderThan(dest string, modTime time.Time) (bool, error) {
+	obj, ok := c.lookup(dest)
+	if !ok {
+		return true, nil
+	}
+	remote := obj.attrs.Updated
+	if recorded, ok := obj.attrs.Metadata[client.SourceModTimeMetadataKey]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, recorded); err == nil {
+			remote = t
+		}
+	}
+	return modTime.After(remote), nil
+}
+
+// copyObject copies the object src to dst in the bucket into, keeping its
+// attributes, and returns the attributes of the source that was copied.
+func (c *Client) copyObject(src string, into *Client, dst string) (*storage.ObjectAttrs, error) {
+	obj, ok := c.lookup(src)
+	if !ok {
+		return nil, notFoundError{name: src}
+	}
+	copied := obj.clone()
+	copied.attrs.Name = dst
+	if _, err := into.store(copied, nil); err != nil {
+		return nil, err
+	}
+	return &obj.attrs, nil
+}
+
+// Copy copies the object src to dst.
+func (c *Client) Copy(src, dst string) error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	if _, err := c.copyObject(src, c, dst); err != nil {
+		return fmt.Errorf("copy source: %w", err)
+	}
+	return nil
+}
+
+// DryRunCopy checks that the object src exists, as Copy, or Move if
+// deleteSource is set, requires, without modifying any object.
+func (c *Client) DryRunCopy(src, dst string, deleteSource bool) error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	if _, ok := c.lookup(src); !ok {
+		if deleteSource {
+			return fmt.Errorf("move source: %w", notFoundError{name: src})
+		}
+		return fmt.Errorf("copy source: %w", notFoundError{name: src})
+	}
+	return nil
+}
+
+// Move renames the object src to dst. The source is only deleted if it is
+// still at the generation that was copied.
+func (c *Client) Move(src, dst string) error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	if src == dst {
+		return fmt.Errorf("cannot move '%s' onto itself", src)
+	}
+	attrs, err := c.copyObject(src, c, dst)
+	if err != nil {
+		return fmt.Errorf("move source: %w", err)
+	}
+	if !c.remove(src, attrs.Generation) {
+		return fmt.Errorf("%w: '%s' was copied to '%s', but it was replaced in the meantime", client.ErrSourceNotDeleted, src, dst)
+	}
+	return nil
+}
+
+// Compose concatenates the objects parts, in order, into dst.
+func (c *Client) Compose(dst string, parts []string) error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	if len(parts) == 0 {
+		return errors.New("compose requires at least one part")
+	}
+	if len(parts) > client.MaxComposeSources {
+		return fmt.Errorf("%w, got %d", client.ErrTooManyComposeSources, len(parts))
+	}
+
+	var data []byte
+	var components int64
+	for _, part := range parts {
+		obj, ok := c.lookup(part)
+		if !ok {
+			return fmt.Errorf("composing '%s': %w", dst, notFoundError{name: part})
+		}
+		data = append(data, obj.data...)
+		if obj.components > 0 {
+			components += obj.components
+		} else {
+			components++
+		}
+	}
+	_, err := c.store(&object{data: data, attrs: storage.ObjectAttrs{Name: dst}, components: components}, nil)
+	return err
+}
+
+// ComponentCount returns the number of objects the composite object dest
+// was composed from, or 0 for an object which is not composite.
+func (c *Client) ComponentCount(dest string) (int64, error) {
+	obj, ok := c.lookup(dest)
+	if !ok {
+		return 0, notFoundError{name: dest}
+	}
+	return obj.components, nil
+}
+
+// UpdateMetadata changes the content type, custom metadata and holds of
+// the object dest, keeping its generation, provided it is at
+// conds.GenerationMatch and conds.MetagenerationMatch if set.
+func (c *Client) UpdateMetadata(dest string, update client.MetadataUpdate, conds storage.Conditions) (*storage.ObjectAttrs, error) {
+	if c.ReadOnly {
+		return nil, client.ErrInvalidROWriteOperation
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj, ok := c.objects[dest]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", client.ErrObjectNotFound, dest)
+	}
+	if conds.GenerationMatch != 0 && obj.attrs.Generation != conds.GenerationMatch {
+		return nil, fmt.Errorf("%w: '%s' is not at generation %d", client.ErrGenerationMismatch, dest, conds.GenerationMatch)
+	}
+	if conds.MetagenerationMatch != 0 && obj.attrs.Metageneration != conds.MetagenerationMatch {
+		return nil, fmt.Errorf("%w: '%s' changed since metageneration %d", client.ErrMetagenerationMismatch, dest, conds.MetagenerationMatch)
+	}
+
+	updated := obj.clone()
+	if update.ContentType != "" {
+		updated.attrs.ContentType = update.ContentType
+	}
+	if len(update.Metadata) > 0 && updated.attrs.Metadata == nil {
+		updated.attrs.Metadata = map[string]string{}
+	}
+	for k, v := range update.Metadata {
+		updated.attrs.Metadata[k] = v
+	}
+	for _, key := range update.Unset {
+		delete(updated.attrs.Metadata, key)
+	}
+	if update.TemporaryHold != nil {
+		updated.attrs.TemporaryHold = *update.TemporaryHold
+	}
+	if update.EventBasedHold != nil {
+		updated.attrs.EventBasedHold = *update.EventBasedHold
+	}
+	updated.attrs.Metageneration++
+	updated.attrs.Updated = time.Now()
+
+	c.objects[dest] = updated
+	c.generations[dest][updated.attrs.Generation] = updated
+	attrs := updated.clone().attrs
+	return &attrs, nil
+}
+
+// HoldUntil places a temporary hold on the object dest and records until
+// in its metadata.
+func (c *Client) HoldUntil(dest string, until time.Time) error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	return c.setHold(dest, true, until.UTC().Format(time.RFC3339))
+}
+
+// SetHold places the hold kind on the object dest if on is set, and
+// releases it otherwise.
+func (c *Client) SetHold(dest string, kind client.HoldKind, on bool) error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.objects[dest]
+	if !ok {
+		return notFoundError{name: dest}
+	}
+	switch kind {
+	case client.HoldTemporary:
+		obj.attrs.TemporaryHold = on
+	case client.HoldEventBased:
+		obj.attrs.EventBasedHold = on
+	default:
+		return fmt.Errorf("unknown hold %q", kind)
+	}
+	obj.attrs.Metageneration++
+	return nil
+}
+
+// setHold places or releases the temporary hold of the object dest,
+// recording holdUntil, if non-empty, in its metadata.
+func (c *Client) setHold(dest string, hold bool, holdUntil string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.objects[dest]
+	if !ok {
+		return notFoundError{name: dest}
+	}
+	obj.attrs.TemporaryHold = hold
+	if holdUntil != "" {
+		if obj.attrs.Metadata == nil {
+			obj.attrs.Metadata = map[string]string{}
+		}
+		obj.attrs.Metadata[client.HoldUntilMetadataKey] = holdUntil
+	}
+	obj.attrs.Metageneration++
+	return nil
+}
+
+// ClearExpiredHolds releases the temporary hold of every object under
+// prefix whose hold-until time has passed, and returns their names.
+func (c *Client) ClearExpiredHolds(prefix string) ([]string, error) {
+	if c.ReadOnly {
+		return nil, client.ErrInvalidROWriteOperation
+	}
+	now := time.Now()
+	var released []string
+	for _, obj := range c.sortedObjects(prefix) {
+		until, err := time.Parse(time.RFC3339, obj.attrs.Metadata[client.HoldUntilMetadataKey])
+		if !obj.attrs.TemporaryHold || err != nil || until.After(now) {
+			continue
+		}
+		if err := c.setHold(obj.attrs.Name, false, ""); err != nil {
+			return released, err
+		}
+		released = append(released, obj.attrs.Name)
+	}
+	return released, nil
+}
+
+// RotateKey rewrites the object dest as a new generation. Objects are not
+// encrypted in the fake, so oldKey is ignored.
+func (c *Client) RotateKey(dest string, oldKey []byte) error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	obj, ok := c.lookup(dest)
+	if !ok {
+		return notFoundError{name: dest}
+	}
+	_, err := c.store(obj, &storage.Conditions{GenerationMatch: obj.attrs.Generation})
+	return err
+}
+
+// Undelete restores a noncurrent generation of the object dest as a new
+// generation: the given one, or with generation 0 the most recent, provided
+// dest is deleted.
+func (c *Client) Undelete(dest string, generation int64) (int64, error) {
+	if c.ReadOnly {
+		return 0, client.ErrInvalidROWriteOperation
+	}
+	if c.Unversioned {
+		return 0, fmt.Errorf("%w on bucket '%s', so deleted objects are not kept", client.ErrVersioningDisabled, c.bucketName)
+	}
+
+	c.mu.Lock()
+	var liveGen int64
+	if live, ok := c.objects[dest]; ok {
+		liveGen = live.attrs.Generation
+	}
+	var restore *object
+	for gen, obj := range c.generations[dest] {
+		switch {
+		case gen == liveGen:
+		case generation != 0:
+			if gen == generation {
+				restore = obj.clone()
+			}
+		case restore == nil || gen > restore.attrs.Generation:
+			restore = obj.clone()
+		}
+	}
+	c.mu.Unlock()
+
+	switch {
+	case generation != 0 && liveGen == generation:
+		return generation, nil
+	case generation != 0 && restore == nil:
+		return 0, fmt.Errorf("%w: '%s' has no noncurrent generation %d", client.ErrGenerationNotFound, dest, generation)
+	case liveGen != 0 && generation == 0:
+		return 0, fmt.Errorf("%w: '%s' is not deleted; give the generation to restore over it", client.ErrObjectExists, dest)
+	case restore == nil:
+		return 0, fmt.Errorf("%w: '%s' has no noncurrent generation", client.ErrNoDeletedGeneration, dest)
+	}
+
+	conds := &storage.Conditions{DoesNotExist: true}
+	if liveGen != 0 {
+		conds = &storage.Conditions{GenerationMatch: liveGen}
+	}
+	attrs, err := c.store(restore, conds)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
+// Sign returns a fake URL for action on the object id until expiry has
+// elapsed.
+func (c *Client) Sign(id string, action string, expiry time.Duration, headers ...string) (string, error) {
+	return c.SignAt(id, action, time.Now().Add(expiry), headers...)
+}
+
+// SignAt returns a fake URL for action on the object id until expires. The
+// expiry is validated as for a V4 signed URL, but the URL is not signed.
+func (c *Client) SignAt(id string, action string, expires time.Time, headers ...string) (string, error) {
+	validFor := time.Until(expires)
+	if validFor <= 0 {
+		return "", fmt.Errorf("%w, got %s", client.ErrExpiryNotInFuture, expires.UTC().Format(time.RFC3339))
+	}
+	if validFor > client.MaxV4Expiry {
+		return "", fmt.Errorf("%w: use an expiry of at most 168h, got %s", client.ErrExpiryTooLong, validFor.Round(time.Second))
+	}
+
+	query := url.Values{}
+	query.Set("X-Fake-Method", action)
+	query.Set("X-Fake-Expires", strconv.FormatInt(expires.Unix(), 10))
+	if len(headers) > 0 {
+		query.Set("X-Fake-SignedHeaders", strings.Join(headers, "\n"))
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     "storage.googleapis.com",
+		Path:     "/" + c.bucketName + "/" + id,
+		RawQuery: query.Encode(),
+	}
+	return u.String(), nil
+}
+
+// SignHeaders returns headers: objects are not encrypted in the fake, so
+// no other header is required.
+func (c *Client) SignHeaders(action string, headers ...string) []string {
+	return headers
+}
+
+// List returns the attributes of every object under prefix whose name match
+// matches, in name order. A nil match matches every object.
+func (c *Client) List(prefix string, match *regexp.Regexp) ([]*storage.ObjectAttrs, error) {
+	var objects []*storage.ObjectAttrs
+	for _, obj := range c.sortedObjects(prefix) {
+		if match == nil || match.MatchString(obj.attrs.Name) {
+			attrs := obj.attrs
+			objects = append(objects, &attrs)
+		}
+	}
+	return objects, nil
+}
+
+// WalkObjects calls fn, in name order, for each object under prefix
+// selected by opts, and each prefix collapsed by opts.Delimiter. The
+// listing is always serial.
+func (c *Client) WalkObjects(prefix string, opts client.ListOptions, fn func(*storage.ObjectAttrs) error) error {
+	seen := map[string]bool{}
+	for _, obj := range c.sortedObjects(prefix) {
+		attrs := obj.attrs
+		if opts.Delimiter != "" {
+			if i := strings.Index(attrs.Name[len(prefix):], opts.Delimiter); i >= 0 {
+				collapsed := attrs.Name[:len(prefix)+i+len(opts.Delimiter)]
+				if seen[collapsed] {
+					continue
+				}
+				seen[collapsed] = true
+				if opts.Match == nil || opts.Match.MatchString(collapsed) {
+					if err := fn(&storage.ObjectAttrs{Prefix: collapsed}); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+		}
+		if attrs.Generation <= opts.SinceGeneration || (opts.Match != nil && !opts.Match.MatchString(attrs.Name)) {
+			continue
+		}
+		if err := fn(&attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StorageClasses returns the number and total size of the objects under
+// prefix whose name match matches, per storage class.
+func (c *Client) StorageClasses(prefix string, match *regexp.Regexp) ([]client.StorageClassUsage, error) {
+	objects, err := c.List(prefix, match)
+	if err != nil {
+		return nil, err
+	}
+	byClass := map[string]*client.StorageClassUsage{}
+	for _, attrs := range objects {
+		usage, ok := byClass[attrs.StorageClass]
+		if !ok {
+			usage = &client.StorageClassUsage{StorageClass: attrs.StorageClass}
+			byClass[attrs.StorageClass] = usage
+		}
+		usage.Objects++
+		usage.Bytes += attrs.Size
+	}
+
+	report := make([]client.StorageClassUsage, 0, len(byClass))
+	for _, usage := range byClass {
+		report = append(report, *usage)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].StorageClass < report[j].StorageClass })
+	return report, nil
+}
+
+// bulk applies fn to each of names, unless opts.DryRun is set, and
+// summarises the outcome. opts.FailFast skips the names after a failure.
+func bulk(names []string, opts client.BulkOptions, fn func(name string) error) *client.BulkResult {
+	result := &client.BulkResult{Failed: map[string]error{}}
+	for _, name := range names {
+		if opts.FailFast && len(result.Failed) > 0 {
+			result.Skipped = append(result.Skipped, name)
+			continue
+		}
+		if !opts.DryRun {
+			if err := fn(name); err != nil {
+				result.Failed[name] = err
+				continue
+			}
+		}
+		result.Succeeded = append(result.Succeeded, name)
+	}
+	return result
+}
+
+// selectObjects returns the names of the objects under prefix whose name
+// opts.Match matches, or an error if there are more than
+// opts.ObjectCountLimit.
+func (c *Client) selectObjects(prefix string, opts client.BulkOptions) ([]string, error) {
+	objects, err := c.List(prefix, opts.Match)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ObjectCountLimit > 0 && len(objects) > opts.ObjectCountLimit {
+		return nil, fmt.Errorf("%w: %d objects under '%s' exceed the limit of %d", client.ErrTooManyObjects, len(objects), prefix, opts.ObjectCountLimit)
+	}
+	names := make([]string, len(objects))
+	for i, attrs := range objects {
+		names[i] = attrs.Name
+	}
+	return names, nil
+}
+
+// RenamePrefix moves every object under oldPrefix to the same path under
+// newPrefix.
+func (c *Client) RenamePrefix(oldPrefix, newPrefix string, opts client.BulkOptions) (*client.BulkResult, error) {
+	if c.ReadOnly {
+		return nil, client.ErrInvalidROWriteOperation
+	}
+	names, err := c.selectObjects(oldPrefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	return bulk(names, opts, func(name string) error {
+		return c.Move(name, newPrefix+strings.TrimPrefix(name, oldPrefix))
+	}), nil
+}
+
+// DeleteObjects deletes each of names. An object which does not exist
+// counts as deleted.
+func (c *Client) DeleteObjects(names []string, opts client.BulkOptions) (*client.BulkResult, error) {
+	if c.ReadOnly {
+		return nil, client.ErrInvalidROWriteOperation
+	}
+	remove := c.Delete
+	if opts.MissingFails {
+		remove = func(name string) error {
+			return c.DeleteIf(name, storage.Conditions{})
+		}
+	}
+	if opts.DryRun && opts.MissingFails {
+		// bulk skips remove in a dry run, so missing objects are found here.
+		result := &client.BulkResult{Failed: map[string]error{}}
+		for _, name := range distinct(names) {
+			if _, ok := c.lookup(name); ok {
+				result.Succeeded = append(result.Succeeded, name)
+			} else {
+				result.Failed[name] = notFoundError{name: name}
+			}
+		}
+		return result, nil
+	}
+	return bulk(distinct(names), opts, remove), nil
+}
+
+// DeletePrefix deletes every object under prefix whose name opts.Match
+// matches.
+func (c *Client) DeletePrefix(prefix string, opts client.BulkOptions) (*client.BulkResult, error) {
+	if c.ReadOnly {
+		return nil, client.ErrInvalidROWriteOperation
+	}
+	names, err := c.selectObjects(prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	return bulk(names, opts, c.Delete), nil
+}
+
+// ExistsObjects reports whether each of names exists.
+func (c *Client) ExistsObjects(names []string, opts client.BulkOptions) (map[string]bool, *client.BulkResult) {
+	found := map[string]bool{}
+	opts.DryRun = false
+	result := bulk(distinct(names), opts, func(name string) error {
+		exists, err := c.Exists(name)
+		if err == nil {
+			found[name] = exists
+		}
+		return err
+	})
+	return found, result
+}
+
+// distinct returns names without duplicates, in their first order.
+func distinct(names []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// MigratePrefix copies every object under srcPrefix to the same path under
+// dstPrefix in the fake returned by Bucket(dstBucket), deleting each source
+// object once copied if deleteSource is set.
+func (c *Client) MigratePrefix(srcPrefix, dstBucket, dstPrefix string, deleteSource bool, opts client.BulkOptions) (*client.BulkResult, error) {
+	if c.ReadOnly {
+		return nil, client.ErrInvalidROWriteOperation
+	}
+	names, err := c.selectObjects(srcPrefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	into := c.Bucket(dstBucket)
+	return bulk(names, opts, func(name string) error {
+		attrs, err := c.copyObject(name, into, dstPrefix+strings.TrimPrefix(name, srcPrefix))
+		if err != nil || !deleteSource {
+			return err
+		}
+		if !c.remove(name, attrs.Generation) {
+			return fmt.Errorf("%w: '%s' was replaced in the meantime", client.ErrSourceNotDeleted, name)
+		}
+		return nil
+	}), nil
+}
+
+// SyncDirectory uploads the regular files below localDir whose object under
+// prefix is missing or differs, with the metadata of their entry in
+// opts.Metadata, and deletes the objects under prefix without a local file
+// if opts.DeleteRemote is set. opts.Dedupe makes no difference: the objects
+// stored are the same either way. The objects of opts.Completed are skipped
+// and the others recorded in opts.Manifest, and opts.Plan and opts.PlanOnly
+// are honoured, as SyncDirectory does.
+func (c *Client) SyncDirectory(localDir, prefix string, opts client.SyncOptions) (*client.SyncResult, error) {
+	if c.ReadOnly {
+		return nil, client.ErrInvalidROWriteOperation
+	}
+
+	files := map[string]string{}
+	err := filepath.WalkDir(localDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, path)
+		if err != nil {
+			return err
+		}
+		name := prefix + filepath.ToSlash(rel)
+		if opts.Match == nil || opts.Match.MatchString(name) {
+			files[name] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var toDelete []string
+	if opts.DeleteRemote {
+		for _, obj := range c.sortedObjects(prefix) {
+			if _, ok := files[obj.attrs.Name]; !ok && (opts.Match == nil || opts.Match.MatchString(obj.attrs.Name)) {
+				toDelete = append(toDelete, obj.attrs.Name)
+			}
+		}
+		if opts.ObjectCountLimit > 0 && len(toDelete) > opts.ObjectCountLimit {
+			return nil, fmt.Errorf("%w: %d objects under '%s' exceed the limit of %d", client.ErrTooManyObjects, len(toDelete), prefix, opts.ObjectCountLimit)
+		}
+	}
+
+	plan := &client.SyncPlan{Uploads: []client.SyncAction{}, Skips: []client.SyncAction{}, Deletes: []client.SyncAction{}}
+	var toUpload, unchanged, resumed []string
+	for name, path := range files {
+		entry, completed := opts.Completed[name]
+		if completed && !opts.VerifyCompleted {
+			resumed = append(resumed, name)
+			plan.Skips = append(plan.Skips, client.SyncAction{Object: name, File: path, Reason: "completed"})
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if completed && entry.Matches(int64(len(data)), crc32.Checksum(data, crc32cTable)) {
+			resumed = append(resumed, name)
+			plan.Skips = append(plan.Skips, client.SyncAction{Object: name, File: path, Reason: "completed"})
+			continue
+		}
+		needed, err := c.NeedsUpload(path, name)
+		if err != nil {
+			return nil, err
+		}
+		if needed {
+			toUpload = append(toUpload, name)
+			reason := "crc32c-differs"
+			if obj, ok := c.lookup(name); !ok {
+				reason = "missing"
+			} else if obj.attrs.ContentEncoding == "gzip" {
+				reason = "gzip-encoded"
+			} else if obj.attrs.Size != int64(len(data)) {
+				reason = "size-differs"
+			}
+			plan.Uploads = append(plan.Uploads, client.SyncAction{Object: name, File: path, Reason: reason})
+		} else {
+			unchanged = append(unchanged, name)
+			plan.Skips = append(plan.Skips, client.SyncAction{Object: name, File: path, Reason: "unchanged"})
+			if !opts.DryRun && !opts.PlanOnly {
+				opts.Manifest.Record(client.NewManifestEntry(name, int64(len(data)), crc32.Checksum(data, crc32cTable)))
+			}
+		}
+	}
+	sort.Strings(toUpload)
+	sort.Strings(unchanged)
+	sort.Strings(resumed)
+	for _, name := range toDelete {
+		plan.Deletes = append(plan.Deletes, client.SyncAction{Object: name, Reason: "no-local-file"})
+	}
+	sort.Slice(plan.Uploads, func(i, j int) bool { return plan.Uploads[i].Object < plan.Uploads[j].Object })
+	sort.Slice(plan.Skips, func(i, j int) bool { return plan.Skips[i].Object < plan.Skips[j].Object })
+
+	if opts.Plan != nil {
+		if err := opts.Plan(plan); err != nil {
+			return nil, err
+		}
+	}
+	result := &client.SyncResult{Unchanged: unchanged, Resumed: resumed}
+	if opts.PlanOnly {
+		result.Uploads = &client.BulkResult{Failed: map[string]error{}, Skipped: toUpload}
+		if opts.DeleteRemote {
+			result.Deletes = &client.BulkResult{Failed: map[string]error{}, Skipped: toDelete}
+		}
+		return result, nil
+	}
+	result.Uploads = bulk(toUpload, opts.BulkOptions, func(name string) error {
+		data, err := os.ReadFile(files[name])
+		if err != nil {
+			return err
+		}
+		var putOpts client.PutOptions
+		opts.Metadata[name].Apply(&putOpts)
+		if _, err := c.put(bytes.NewReader(data), name, putOpts, nil); err != nil {
+			return err
+		}
+		opts.Manifest.Record(client.NewManifestEntry(name, int64(len(data)), crc32.Checksum(data, crc32cTable)))
+		return nil
+	})
+	if !opts.DeleteRemote || result.Uploads.Err() != nil {
+		return result, nil
+	}
+	result.Deletes = bulk(toDelete, opts.BulkOptions, c.Delete)
+	return result, nil
+}
+
+// NeedsUpload reports whether the object remoteName is missing, stored
+// gzip-encoded, or differs in size or CRC32C from the file at localPath.
+func (c *Client) NeedsUpload(localPath, remoteName string) (bool, error) {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return false, err
+	}
+	obj, ok := c.lookup(remoteName)
+	if !ok {
+		return true, nil
+	}
+	return obj.attrs.ContentEncoding == "gzip" || obj.attrs.Size != int64(len(data)) ||
+		obj.attrs.CRC32C != crc32.Checksum(data, crc32cTable), nil
+}
+
+// Verify returns an error wrapping client.ErrVerifyMismatch unless the
+// object remoteName, as stored, has the size and CRC32C of the file at
+// localPath.
+func (c *Client) Verify(remoteName, localPath string) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	attrs, err := c.Stat(remoteName)
+	if err != nil {
+		return err
+	}
+	if attrs.Size != int64(len(data)) || attrs.CRC32C != crc32.Checksum(data, crc32cTable) {
+		return fmt.Errorf("%w: '%s' differs from '%s'", client.ErrVerifyMismatch, remoteName, localPath)
+	}
+	return nil
+}
+
+// EnsureBucket does nothing: the fake bucket always exists.
+func (c *Client) EnsureBucket() error {
+	return nil
+}
+
+// CheckAccess does nothing: the fake bucket is always accessible.
+func (c *Client) CheckAccess() error {
+	return nil
+}
+
+// BucketInfo returns the attributes of the fake bucket, a bucket in US with
+// the STANDARD storage class and uniform bucket-level access, versioned
+// unless Unversioned is set. It fails with storage.ErrBucketNotExist once
+// RemoveBucket removed the bucket.
+func (c *Client) BucketInfo() (*storage.BucketAttrs, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.removed {
+		return nil, fmt.Errorf("bucket '%s' not found: %w", c.bucketName, storage.ErrBucketNotExist)
+	}
+	return &storage.BucketAttrs{
+		Name:              c.bucketName,
+		Location:          "US",
+		LocationType:      "multi-region",
+		StorageClass:      "STANDARD",
+		VersioningEnabled: !c.Unversioned,
+		UniformBucketLevelAccess: storage.UniformBucketLevelAccess{
+			Enabled: true,
+		},
+	}, nil
+}
+
+// Close does nothing: the fake writes to no files.
+func (c *Client) Close() error {
+	return nil
+}
+
+// CreateBucket fails with client.ErrBucketExists, unless RemoveBucket
+// removed the fake bucket, in which case it exists again.
+func (c *Client) CreateBucket() error {
+	if c.ReadOnly {
+		return client.ErrInvalidROWriteOperation
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.removed {
+		return fmt.Errorf("%w: '%s'", client.ErrBucketExists, c.bucketName)
+	}
+	c.removed = false
+	return nil
+}
+
+// RemoveBucket marks the fake bucket removed, see Removed. It fails with
+// client.ErrBucketNotEmpty while any generation of any object is kept,
+// unless force deletes them first. A held generation is not deleted, and
+// the bucket is then kept.
+func (c *Client) RemoveBucket(force bool, opts client.BulkOptions) (*client.BulkResult, error) {
+	if c.ReadOnly {
+		return nil, client.ErrInvalidROWriteOperation
+	}
+	c.mu.Lock()
+	removed := c.removed
+	var keys []string
+	for name, generations := range c.generations {
+		for generation := range generations {
+			keys = append(keys, name+"#"+strconv.FormatInt(generation, 10))
+		}
+	}
+	c.mu.Unlock()
+	if removed {
+		return nil, storage.ErrBucketNotExist
+	}
+	sort.Strings(keys)
+
+	var result *client.BulkResult
+	if force {
+		result = bulk(keys, opts, c.deleteGeneration)
+		if err := result.Err(); err != nil {
+			return result, fmt.Errorf("bucket '%s' kept: %w", c.bucketName, err)
+		}
+		if opts.DryRun {
+			return result, nil
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.generations) > 0 {
+		return result, fmt.Errorf("%w: '%s'", client.ErrBucketNotEmpty, c.bucketName)
+	}
+	c.removed = true
+	return result, nil
+}
+
+// deleteGeneration deletes the generation of an object named by key, as
+// <name>#<generation>, unless it is held.
+func (c *Client) deleteGeneration(key string) error {
+	i := strings.LastIndex(key, "#")
+	name := key[:i]
+	generation, _ := strconv.ParseInt(key[i+1:], 10, 64)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.generations[name][generation]
+	if !ok {
+		return nil
+	}
+	if obj.attrs.TemporaryHold || obj.attrs.EventBasedHold {
+		return fmt.Errorf("%w: '%s' has a hold, which must be released before it can be deleted", client.ErrObjectHeld, key)
+	}
+	delete(c.generations[name], generation)
+	if len(c.generations[name]) == 0 {
+		delete(c.generations, name)
+	}
+	if current, ok := c.objects[name]; ok && current.attrs.Generation == generation {
+		delete(c.objects, name)
+	}
+	return nil
+}
+
+// Removed reports whether RemoveBucket removed the fake bucket. The other
+// methods keep working regardless.
+func (c *Client) Removed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removed
+}
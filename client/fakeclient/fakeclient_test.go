@@ -0,0 +1,143 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fakeclient_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/client/fakeclient"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("The in-memory client", func() {
+	var fake *fakeclient.Client
+
+	BeforeEach(func() {
+		fake = fakeclient.New("some-bucket")
+	})
+
+	It("reads back what was uploaded", func() {
+		Expect(fake.PutWithOptions(strings.NewReader("content"), "obj", client.PutOptions{ContentType: "text/plain"})).To(Succeed())
+
+		var buf bytes.Buffer
+		Expect(fake.Get("obj", &buf)).To(Succeed())
+		Expect(buf.String()).To(Equal("content"))
+
+		attrs, err := fake.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Size).To(BeEquivalentTo(len("content")))
+		Expect(attrs.ContentType).To(Equal("text/plain"))
+		Expect(attrs.Bucket).To(Equal("some-bucket"))
+	})
+
+	It("reports missing objects as the real client does", func() {
+		exists, err := fake.Exists("missing")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeFalse())
+
+		err = fake.Get("missing", &bytes.Buffer{})
+		Expect(err).To(MatchError(client.ErrObjectNotFound))
+		Expect(err).To(MatchError(storage.ErrObjectNotExist))
+
+		Expect(fake.Delete("missing")).To(Succeed())
+	})
+
+	It("fails lookups with an injected error", func() {
+		Expect(fake.PutMarker("obj", false)).To(Succeed())
+		transient := errors.New("connection reset by peer")
+		fake.FailLookups("obj", transient)
+
+		exists, err := fake.Exists("obj")
+		Expect(err).To(MatchError(transient))
+		Expect(exists).To(BeFalse())
+
+		found, result := fake.ExistsObjects([]string{"obj", "missing"}, client.BulkOptions{})
+		Expect(found).To(Equal(map[string]bool{"missing": false}))
+		Expect(result.Failed).To(HaveKeyWithValue("obj", transient))
+
+		fake.FailLookups("obj", nil)
+		Expect(fake.Exists("obj")).To(BeTrue())
+	})
+
+	It("honours upload preconditions", func() {
+		generation, err := fake.PutIf(strings.NewReader("first"), "obj", client.PutOptions{}, storage.Conditions{DoesNotExist: true})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = fake.PutIf(strings.NewReader("second"), "obj", client.PutOptions{}, storage.Conditions{DoesNotExist: true})
+		Expect(err).To(MatchError(client.ErrObjectExists))
+
+		_, err = fake.PutIf(strings.NewReader("second"), "obj", client.PutOptions{}, storage.Conditions{GenerationMatch: generation + 1})
+		Expect(err).To(MatchError(client.ErrGenerationMismatch))
+
+		_, err = fake.PutIf(strings.NewReader("second"), "obj", client.PutOptions{}, storage.Conditions{GenerationMatch: generation})
+		Expect(err).ToNot(HaveOccurred())
+
+		var buf bytes.Buffer
+		Expect(fake.GetGeneration("obj", generation, &buf)).To(Succeed())
+		Expect(buf.String()).To(Equal("first"))
+	})
+
+	It("moves objects", func() {
+		Expect(fake.PutWithOptions(strings.NewReader("content"), "src", client.PutOptions{})).To(Succeed())
+		Expect(fake.Move("src", "dst")).To(Succeed())
+
+		_, ok := fake.Object("src")
+		Expect(ok).To(BeFalse())
+		data, ok := fake.Object("dst")
+		Expect(ok).To(BeTrue())
+		Expect(string(data)).To(Equal("content"))
+	})
+
+	It("lists one level with a delimiter", func() {
+		for _, name := range []string{"a/x", "a/b/y", "c/z", "top"} {
+			Expect(fake.PutWithOptions(strings.NewReader(name), name, client.PutOptions{})).To(Succeed())
+		}
+
+		var listed []string
+		err := fake.WalkObjects("", client.ListOptions{Delimiter: "/"}, func(attrs *storage.ObjectAttrs) error {
+			listed = append(listed, attrs.Name+attrs.Prefix)
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(listed).To(Equal([]string{"a/", "c/", "top"}))
+	})
+
+	It("refuses writes when read-only", func() {
+		fake.ReadOnly = true
+		Expect(fake.PutMarker("marker", false)).To(MatchError(client.ErrInvalidROWriteOperation))
+		Expect(fake.Delete("marker")).To(MatchError(client.ErrInvalidROWriteOperation))
+	})
+
+	It("validates the expiry of signed urls", func() {
+		_, err := fake.Sign("obj", "GET", -time.Minute)
+		Expect(err).To(MatchError(client.ErrExpiryNotInFuture))
+		_, err = fake.Sign("obj", "GET", 8*24*time.Hour)
+		Expect(err).To(MatchError(client.ErrExpiryTooLong))
+
+		signed, err := fake.Sign("obj", "GET", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signed).To(HavePrefix("https://storage.googleapis.com/some-bucket/obj?"))
+	})
+})
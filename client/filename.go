@@ -0,0 +1,88 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+)
+
+// OriginalFilenameMetadataKey is the custom metadata key recording the name
+// of the local file a compressed object was uploaded from.
+const OriginalFilenameMetadataKey = "original-filename"
+
+// OriginalFilename returns the file name recorded in an object's
+// original-filename metadata.
+//
+// The name comes from the bucket and so cannot be trusted: anything that is
+// not a plain file name, such as a path or "..", is rejected rather than
+// being allowed to write outside the destination directory.
+func OriginalFilename(attrs *storage.ObjectAttrs) (string, error) {
+	name, ok := attrs.Metadata[OriginalFilenameMetadataKey]
+	if !ok || name == "" {
+		return "", fmt.Errorf("object '%s' has no %s metadata", attrs.Name, OriginalFilenameMetadataKey)
+	}
+	if err := ValidateFilename(name); err != nil {
+		return "", fmt.Errorf("object '%s' has an unsafe %s: %v", attrs.Name, OriginalFilenameMetadataKey, err)
+	}
+	return name, nil
+}
+
+// ValidateFilename returns an error unless name is a plain file name that
+// refers to an entry directly inside a directory.
+func ValidateFilename(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("%q is not a file name", name)
+	case strings.ContainsAny(name, "/\\"):
+		return fmt.Errorf("%q contains a path separator", name)
+	case strings.ContainsRune(name, 0):
+		return fmt.Errorf("%q contains a NUL byte", name)
+	}
+	return nil
+}
+
+// maxObjectNameLength is the longest object name, in bytes, GCS accepts.
+const maxObjectNameLength = 1024
+
+// ValidateObjectName returns an error unless name is an object name that
+// S3 clients, which address objects by path, can sign and request
+// reliably.
+//
+// See https://cloud.google.com/storage/docs/objects#naming
+func ValidateObjectName(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("%q is not a valid object name", name)
+	case len(name) > maxObjectNameLength:
+		return fmt.Errorf("object name is %d bytes, longer than %d", len(name), maxObjectNameLength)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("object name %q is not valid UTF-8", name)
+	case strings.ContainsAny(name, "\r\n"):
+		return fmt.Errorf("object name %q contains a carriage return or line feed", name)
+	case strings.HasPrefix(name, ".well-known/acme-challenge/"):
+		return fmt.Errorf("object name %q is reserved", name)
+	case strings.Contains(name, "//"), strings.HasPrefix(name, "/"):
+		// S3 clients commonly collapse repeated slashes, which would
+		// address a different object than the one signed.
+		return fmt.Errorf("object name %q contains an empty path segment", name)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"cloud.google.com/go/storage"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Original filename", func() {
+	withName := func(name string) *storage.ObjectAttrs {
+		return &storage.ObjectAttrs{
+			Name:     "blob",
+			Metadata: map[string]string{OriginalFilenameMetadataKey: name},
+		}
+	}
+
+	It("returns the stored name", func() {
+		name, err := OriginalFilename(withName("release.tgz"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(name).To(Equal("release.tgz"))
+	})
+
+	It("returns an error when no name is stored", func() {
+		_, err := OriginalFilename(&storage.ObjectAttrs{Name: "blob"})
+		Expect(err).To(MatchError(ContainSubstring("no original-filename")))
+	})
+
+	It("rejects names which could escape the destination directory", func() {
+		for _, name := range []string{".", "..", "../etc/passwd", "/etc/passwd", "dir/file", `..\file`, "a\x00b"} {
+			_, err := OriginalFilename(withName(name))
+			Expect(err).To(MatchError(ContainSubstring("unsafe")), name)
+		}
+	})
+})
+
+var _ = Describe("Object names for path-style urls", func() {
+	It("accepts names with nested paths and characters needing escaping", func() {
+		for _, name := range []string{"blob", "releases/cf/1.0.tgz", "with space+plus?.tgz"} {
+			Expect(ValidateObjectName(name)).To(Succeed(), name)
+		}
+	})
+
+	It("rejects names which cannot be addressed reliably", func() {
+		for _, name := range []string{"", ".", "..", "a\nb", "\xff", "/leading", "double//slash", ".well-known/acme-challenge/x"} {
+			Expect(ValidateObjectName(name)).ToNot(Succeed(), name)
+		}
+	})
+})
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fetching a generation", func() {
+	// The bucket holds generations 1 and 3 of "versioned".
+	generations := map[string]string{"1": "first", "3": "third"}
+
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			generation := r.URL.Query().Get("generation")
+			if generation == "" {
+				generation = "3"
+			}
+			content, ok := generations[generation]
+			if !strings.HasSuffix(r.URL.Path, "/versioned") || !ok {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": {"code": 404, "message": "No such object"}}`)) //nolint:errcheck
+				return
+			}
+
+			if !strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+				w.Header().Set("X-Goog-Generation", generation)
+				w.Write([]byte(content)) //nolint:errcheck
+				return
+			}
+			crc := make([]byte, 4)
+			binary.BigEndian.PutUint32(crc, crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli)))
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"bucket": "some-bucket", "name": "versioned", "generation": %q, "size": "%d", "crc32c": %q}`,
+				generation, len(content), base64.StdEncoding.EncodeToString(crc))
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("writes the content of that generation", func() {
+		var out bytes.Buffer
+		Expect(blobstore.GetGeneration("versioned", 1, &out)).To(Succeed())
+		Expect(out.String()).To(Equal("first"))
+	})
+
+	It("reports a missing generation of an existing object", func() {
+		err := blobstore.GetGeneration("versioned", 2, &bytes.Buffer{})
+		Expect(errors.Is(err, ErrGenerationNotFound)).To(BeTrue())
+		Expect(errors.Is(err, ErrObjectNotFound)).To(BeFalse())
+		Expect(err).To(MatchError("generation not found: 'versioned' has no generation 2"))
+	})
+
+	It("reports a missing object as not found", func() {
+		err := blobstore.GetGeneration("missing", 1, &bytes.Buffer{})
+		Expect(errors.Is(err, ErrObjectNotFound)).To(BeTrue())
+		Expect(errors.Is(err, ErrGenerationNotFound)).To(BeFalse())
+	})
+})
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// HoldUntilMetadataKey is the custom metadata key recording when a
+// temporary hold placed by HoldUntil may be released.
+const HoldUntilMetadataKey = "hold-until"
+
+// HoldKind is one of the holds GCS can place on an object. An object under
+// either hold cannot be deleted or replaced until it is released.
+type HoldKind string
+
+const (
+	// HoldTemporary is a temporary hold, which only keeps the object until
+	// it is released.
+	HoldTemporary HoldKind = "temporary"
+	// HoldEventBased is an event-based hold. Once it is released, the
+	// object is also kept for the bucket's retention period, if any.
+	HoldEventBased HoldKind = "event-based"
+)
+
+// ParseHoldKind returns the HoldKind named s.
+func ParseHoldKind(s string) (HoldKind, error) {
+	switch kind := HoldKind(s); kind {
+	case HoldTemporary, HoldEventBased:
+		return kind, nil
+	}
+	return "", fmt.Errorf("unknown hold %q, expected %s or %s", s, HoldTemporary, HoldEventBased)
+}
+
+// ErrObjectHeld is returned when an object cannot be deleted because it is
+// under a hold.
+var ErrObjectHeld = errors.New("object is under a hold")
+
+// SetHold places the hold kind on the object named dest if on is set, and
+// releases it otherwise. The object keeps its generation.
+func (client *GCSBlobstore) SetHold(dest string, kind HoldKind, on bool) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	var toUpdate storage.ObjectAttrsToUpdate
+	switch kind {
+	case HoldTemporary:
+		toUpdate.TemporaryHold = on
+	case HoldEventBased:
+		toUpdate.EventBasedHold = on
+	default:
+		return fmt.Errorf("unknown hold %q", kind)
+	}
+
+	_, err := client.getObjectHandle(client.authenticatedGCS, dest).Update(client.ctx, toUpdate)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		err = fmt.Errorf("%w: '%s'", ErrObjectNotFound, dest)
+	}
+	op := "hold"
+	if !on {
+		op = "release-hold"
+	}
+	client.record(op, dest, "", 0, err)
+	return err
+}
+
+// heldError translates err, GCS refusing to delete dest, into an error
+// wrapping ErrObjectHeld if it was refused because of a hold. GCS reports
+// it as a 403, which would otherwise read as a lack of permission.
+func heldError(err error, dest string) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return err
+	}
+	message := strings.ToLower(apiErr.Message)
+	switch {
+	case strings.Contains(message, "temporary hold"):
+		return fmt.Errorf("%w: '%s' has a %s hold, which must be released before it can be deleted", ErrObjectHeld, dest, HoldTemporary)
+	case strings.Contains(message, "event-based hold"), strings.Contains(message, "event based hold"):
+		return fmt.Errorf("%w: '%s' has an %s hold, which must be released before it can be deleted", ErrObjectHeld, dest, HoldEventBased)
+	case strings.Contains(message, "hold"):
+		return fmt.Errorf("%w: '%s' has a hold, which must be released before it can be deleted", ErrObjectHeld, dest)
+	}
+	return err
+}
+
+// HoldUntil places a temporary hold on the object named dest and records
+// until in its metadata.
+//
+// GCS temporary holds never expire on their own. The recorded time is only
+// honoured by ClearExpiredHolds, so the expiry is enforced by this client
+// rather than by GCS.
+func (client *GCSBlobstore) HoldUntil(dest string, until time.Time) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	_, err := client.getObjectHandle(client.authenticatedGCS, dest).Update(client.ctx, storage.ObjectAttrsToUpdate{
+		TemporaryHold: true,
+		Metadata: map[string]string{
+			HoldUntilMetadataKey: until.UTC().Format(time.RFC3339),
+		},
+	})
+	client.record("hold", dest, "", 0, err)
+	return err
+}
+
+// ClearExpiredHolds releases the temporary hold of every object under prefix
+// whose hold-until time has passed. Objects without a hold-until time are
+// left untouched, as are holds placed by other tools.
+//
+// The names of the released objects are returned.
+func (client *GCSBlobstore) ClearExpiredHolds(prefix string) ([]string, error) {
+	if client.readOnly() {
+		return nil, ErrInvalidROWriteOperation
+	}
+
+	ctx := client.ctx
+	now := time.Now()
+
+	var released []string
+	it := client.objects(ctx, client.authenticatedGCS, storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return released, nil
+		}
+		if err != nil {
+			return released, err
+		}
+
+		if !attrs.TemporaryHold {
+			continue
+		}
+		until := attrs.Metadata[HoldUntilMetadataKey]
+		if until == "" {
+			continue
+		}
+		expiry, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return released, fmt.Errorf("parsing %s of %s: %v", HoldUntilMetadataKey, attrs.Name, err)
+		}
+		if expiry.After(now) {
+			continue
+		}
+
+		// Metadata is patched key by key and a single key cannot be removed,
+		// so the hold-until time is blanked out instead.
+		_, err = client.getObjectHandle(client.authenticatedGCS, attrs.Name).Update(ctx, storage.ObjectAttrsToUpdate{
+			TemporaryHold: false,
+			Metadata:      map[string]string{HoldUntilMetadataKey: ""},
+		})
+		client.record("release-hold", attrs.Name, "", 0, err)
+		if err != nil {
+			return released, fmt.Errorf("releasing hold on %s: %v", attrs.Name, err)
+		}
+		released = append(released, attrs.Name)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Holds", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var patches []map[string]interface{}
+	var deleteMessage string
+
+	BeforeEach(func() {
+		patches = nil
+		deleteMessage = ""
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			switch r.Method {
+			case http.MethodPatch:
+				var body map[string]interface{}
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				patches = append(patches, body)
+				fmt.Fprint(w, `{"bucket": "some-bucket", "name": "obj", "generation": "7", "metageneration": "4"}`)
+			case http.MethodDelete:
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, `{"error": {"code": 403, "message": %q}}`, deleteMessage)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("places and releases holds of either kind", func() {
+		Expect(blobstore.SetHold("obj", HoldEventBased, true)).To(Succeed())
+		Expect(blobstore.SetHold("obj", HoldTemporary, false)).To(Succeed())
+
+		Expect(patches).To(HaveLen(2))
+		Expect(patches[0]).To(HaveKeyWithValue("eventBasedHold", true))
+		Expect(patches[0]).ToNot(HaveKey("temporaryHold"))
+		Expect(patches[1]).To(HaveKeyWithValue("temporaryHold", false))
+		Expect(patches[1]).ToNot(HaveKey("eventBasedHold"))
+	})
+
+	It("parses the kinds of hold", func() {
+		kind, err := ParseHoldKind("event-based")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kind).To(Equal(HoldEventBased))
+
+		_, err = ParseHoldKind("legal")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("explains a delete refused because of a hold", func() {
+		deleteMessage = "Object 'some-bucket/obj' is under active Temporary hold and cannot be deleted, overwritten or archived until hold is removed."
+
+		err := blobstore.Delete("obj")
+		Expect(errors.Is(err, ErrObjectHeld)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("'obj' has a temporary hold, which must be released"))
+	})
+
+	It("leaves other refused deletes as they are", func() {
+		deleteMessage = "caller does not have storage.objects.delete access"
+
+		err := blobstore.Delete("obj")
+		Expect(errors.Is(err, ErrObjectHeld)).To(BeFalse())
+		Expect(err.Error()).To(ContainSubstring("storage.objects.delete"))
+	})
+})
+
+var _ = Describe("Clearing expired holds", func() {
+	var emulator *gcsEmulator
+	var blobstore *GCSBlobstore
+
+	putHeld := func(name string, metadata map[string]interface{}) {
+		emulator.put(name, "content", map[string]interface{}{"temporaryHold": true, "metadata": metadata})
+	}
+
+	holdUntil := func(t time.Time) map[string]interface{} {
+		return map[string]interface{}{HoldUntilMetadataKey: t.UTC().Format(time.RFC3339)}
+	}
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		blobstore = newEmulatorBlobstore(emulator.Server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+	})
+
+	AfterEach(func() {
+		emulator.Close()
+	})
+
+	It("releases the holds which expired and keeps the others", func() {
+		putHeld("held/expired", holdUntil(time.Now().Add(-time.Hour)))
+		putHeld("held/unexpired", holdUntil(time.Now().Add(time.Hour)))
+		putHeld("held/forever", map[string]interface{}{"owner": "ci"})
+		putHeld("other/expired", holdUntil(time.Now().Add(-time.Hour)))
+
+		released, err := blobstore.ClearExpiredHolds("held/")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(Equal([]string{"held/expired"}))
+		Expect(emulator.ops()).To(Equal([]string{"patch held/expired"}))
+
+		expired := emulator.object("held/expired").resource
+		Expect(expired["temporaryHold"]).To(BeFalse())
+		Expect(expired["metadata"]).To(HaveKeyWithValue(HoldUntilMetadataKey, ""))
+		for _, name := range []string{"held/unexpired", "held/forever", "other/expired"} {
+			Expect(emulator.object(name).resource["temporaryHold"]).To(BeTrue(), name)
+		}
+	})
+
+	It("leaves an object with an expiry but no hold alone", func() {
+		emulator.put("held/released", "content", map[string]interface{}{"metadata": holdUntil(time.Now().Add(-time.Hour))})
+
+		released, err := blobstore.ClearExpiredHolds("held/")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(BeEmpty())
+		Expect(emulator.ops()).To(BeEmpty())
+	})
+
+	It("fails on an expiry it cannot parse", func() {
+		putHeld("held/invalid", map[string]interface{}{HoldUntilMetadataKey: "tomorrow"})
+
+		_, err := blobstore.ClearExpiredHolds("held/")
+		Expect(err).To(MatchError(ContainSubstring("parsing " + HoldUntilMetadataKey + " of held/invalid")))
+		Expect(emulator.object("held/invalid").resource["temporaryHold"]).To(BeTrue())
+	})
+})
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"io"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Client is the set of operations on a bucket provided by GCSBlobstore, so
+// that code using it can be tested against a fake, such as the in-memory
+// one of the fakeclient package, rather than GCS. The methods are
+// documented on GCSBlobstore.
+type Client interface {
+	// Uploads.
+	Put(src io.ReadSeeker, dest string) error
+	Put2(src io.Reader, dest string, compressed bool) error
+	PutWithOptions(src io.Reader, dest string, opts PutOptions) error
+	PutGeneration(src io.Reader, dest string, opts PutOptions) (int64, error)
+	PutIf(src io.Reader, dest string, opts PutOptions, conds storage.Conditions) (int64, error)
+	PutBuffered(src io.Reader, dest string, opts PutOptions, maxSize int64) error
+	PutAtomic(src io.Reader, dest string, opts PutOptions) (int64, error)
+	PutVerified(src io.Reader, dest string, opts PutOptions) error
+	PutMarker(dest string, noClobber bool) error
+
+	// Downloads.
+	Get(src string, dest io.Writer) error
+	GetGeneration(src string, generation int64, dest io.Writer) error
+	GetRange(src string, r ByteRange, dest io.Writer) error
+	GetParallel(src string, dest ParallelDestination, parts int) error
+
+	// Single objects.
+	Delete(dest string) error
+	DeleteIf(dest string, conds storage.Conditions) error
+	Exists(dest string) (bool, error)
+	Stat(dest string) (*storage.ObjectAttrs, error)
+	ComponentCount(dest string) (int64, error)
+	RemoteOlderThan(dest string, modTime time.Time) (bool, error)
+	Copy(src, dst string) error
+	DryRunCopy(src, dst string, deleteSource bool) error
+	Move(src, dst string) error
+	Compose(dst string, parts []string) error
+	UpdateMetadata(dest string, update MetadataUpdate, conds storage.Conditions) (*storage.ObjectAttrs, error)
+	HoldUntil(dest string, until time.Time) error
+	SetHold(dest string, kind HoldKind, on bool) error
+	RotateKey(dest string, oldKey []byte) error
+	Undelete(dest string, generation int64) (int64, error)
+
+	// Signed URLs.
+	Sign(id string, action string, expiry time.Duration, headers ...string) (string, error)
+	SignAt(id string, action string, expires time.Time, headers ...string) (string, error)
+	SignHeaders(action string, headers ...string) []string
+
+	// Listings and many objects.
+	List(prefix string, match *regexp.Regexp) ([]*storage.ObjectAttrs, error)
+	WalkObjects(prefix string, opts ListOptions, fn func(*storage.ObjectAttrs) error) error
+	StorageClasses(prefix string, match *regexp.Regexp) ([]StorageClassUsage, error)
+	ClearExpiredHolds(prefix string) ([]string, error)
+	RenamePrefix(oldPrefix, newPrefix string, opts BulkOptions) (*BulkResult, error)
+	DeleteObjects(names []string, opts BulkOptions) (*BulkResult, error)
+	DeletePrefix(prefix string, opts BulkOptions) (*BulkResult, error)
+	ExistsObjects(names []string, opts BulkOptions) (map[string]bool, *BulkResult)
+	MigratePrefix(srcPrefix, dstBucket, dstPrefix string, deleteSource bool, opts BulkOptions) (*BulkResult, error)
+	SyncDirectory(localDir, prefix string, opts SyncOptions) (*SyncResult, error)
+	NeedsUpload(localPath, remoteName string) (bool, error)
+	Verify(remoteName, localPath string) error
+
+	// The bucket.
+	EnsureBucket() error
+	CreateBucket() error
+	RemoveBucket(force bool, opts BulkOptions) (*BulkResult, error)
+	CheckAccess() error
+	BucketInfo() (*storage.BucketAttrs, error)
+
+	Close() error
+}
+
+var _ Client = (*GCSBlobstore)(nil)
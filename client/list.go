@@ -0,0 +1,162 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ListOptions controls which objects WalkObjects lists and how.
+type ListOptions struct {
+	// Match, if non-nil, restricts the listing to the objects whose name it
+	// matches.
+	Match *regexp.Regexp
+	// SinceGeneration restricts the listing to the objects whose generation
+	// is greater than it.
+	SinceGeneration int64
+	// Concurrency is the number of first-level prefixes listed at once.
+	// If left empty or 1, the listing is serial.
+	Concurrency int
+	// Delimiter, if set, lists a single level below the prefix, like a
+	// directory: the names which continue past the delimiter after the
+	// prefix are collapsed into one entry per distinct prefix up to and
+	// including the delimiter, which only has ObjectAttrs.Prefix set.
+	// A listing with a Delimiter is always serial.
+	Delimiter string
+}
+
+func (opts ListOptions) matches(attrs *storage.ObjectAttrs) bool {
+	if attrs.Prefix != "" {
+		// Collapsed prefixes have no generation.
+		return opts.Match == nil || opts.Match.MatchString(attrs.Prefix)
+	}
+	return attrs.Generation > opts.SinceGeneration &&
+		(opts.Match == nil || opts.Match.MatchString(attrs.Name))
+}
+
+// WalkObjects calls fn for each object under prefix selected by opts, as the
+// objects are listed. fn is never called concurrently.
+//
+// GCS can only filter by prefix, so every object under prefix is listed and
+// the other filters are applied here: the cost of a listing grows with the
+// number of objects under prefix, not the number selected.
+//
+// A serial listing calls fn in name order. With a Concurrency above 1, the
+// prefixes one level below prefix, up to the next "/", are discovered first
+// and then listed concurrently, and fn is called in no particular order.
+func (client *GCSBlobstore) WalkObjects(prefix string, opts ListOptions, fn func(*storage.ObjectAttrs) error) error {
+	ctx, cancel := context.WithCancel(client.ctx)
+	defer cancel()
+
+	if opts.Concurrency <= 1 || opts.Delimiter != "" {
+		return client.walkPrefix(ctx, prefix, opts, fn)
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	emit := func(attrs *storage.ObjectAttrs) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr != nil {
+			return firstErr
+		}
+		if err := fn(attrs); err != nil {
+			firstErr = err
+			cancel()
+			return err
+		}
+		return nil
+	}
+
+	// Objects directly under prefix are listed along with the prefixes.
+	var prefixes []string
+	it := client.objects(ctx, client.listClient(), storage.Query{Prefix: prefix, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("listing prefixes under '%s': %v", prefix, err)
+		}
+		if attrs.Prefix != "" {
+			prefixes = append(prefixes, attrs.Prefix)
+		} else if opts.matches(attrs) {
+			if err := emit(attrs); err != nil {
+				return err
+			}
+		}
+	}
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sub := range work {
+				if err := client.walkPrefix(ctx, sub, opts, emit); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, sub := range prefixes {
+		select {
+		case work <- sub:
+			continue
+		case <-ctx.Done():
+		}
+		break
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// walkPrefix calls fn, in name order, for each object under prefix selected
+// by opts, and each prefix collapsed by opts.Delimiter.
+func (client *GCSBlobstore) walkPrefix(ctx context.Context, prefix string, opts ListOptions, fn func(*storage.ObjectAttrs) error) error {
+	it := client.objects(ctx, client.listClient(), storage.Query{Prefix: prefix, Delimiter: opts.Delimiter})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("listing objects under '%s': %v", prefix, err)
+		}
+		if !opts.matches(attrs) {
+			continue
+		}
+		if err := fn(attrs); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Listing objects with a delimiter", func() {
+	// names is a nested layout, in name order as GCS lists it.
+	names := []string{
+		"dir/a/deep.txt",
+		"dir/b.txt",
+		"dir/c/d/deeper.txt",
+		"dir/sub/e.txt",
+		"dir2/f.txt",
+		"top.txt",
+	}
+
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/storage/v1/b/some-bucket/o" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			prefix := r.URL.Query().Get("prefix")
+			delimiter := r.URL.Query().Get("delimiter")
+
+			type item struct {
+				Name       string `json:"name"`
+				Generation string `json:"generation"`
+			}
+			response := struct {
+				Items    []item   `json:"items"`
+				Prefixes []string `json:"prefixes"`
+			}{}
+			seen := map[string]bool{}
+			for _, name := range names {
+				if !strings.HasPrefix(name, prefix) {
+					continue
+				}
+				if delimiter != "" {
+					if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+						collapsed := name[:len(prefix)+i+len(delimiter)]
+						if !seen[collapsed] {
+							seen[collapsed] = true
+							response.Prefixes = append(response.Prefixes, collapsed)
+						}
+						continue
+					}
+				}
+				response.Items = append(response.Items, item{Name: name, Generation: "1"})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	walk := func(prefix string, opts ListOptions) (objects, prefixes []string) {
+		err := blobstore.WalkObjects(prefix, opts, func(attrs *storage.ObjectAttrs) error {
+			if attrs.Prefix != "" {
+				prefixes = append(prefixes, attrs.Prefix)
+			} else {
+				objects = append(objects, attrs.Name)
+			}
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return objects, prefixes
+	}
+
+	It("lists every object recursively without a delimiter", func() {
+		objects, prefixes := walk("", ListOptions{})
+		Expect(objects).To(Equal(names))
+		Expect(prefixes).To(BeEmpty())
+	})
+
+	It("only lists the top level of the bucket with a delimiter", func() {
+		objects, prefixes := walk("", ListOptions{Delimiter: "/"})
+		Expect(objects).To(Equal([]string{"top.txt"}))
+		Expect(prefixes).To(Equal([]string{"dir/", "dir2/"}))
+	})
+
+	It("only lists the level below the prefix with a delimiter", func() {
+		objects, prefixes := walk("dir/", ListOptions{Delimiter: "/"})
+		Expect(objects).To(Equal([]string{"dir/b.txt"}))
+		Expect(prefixes).To(Equal([]string{"dir/a/", "dir/c/", "dir/sub/"}))
+	})
+
+	It("applies the name filter to the collapsed prefixes", func() {
+		objects, prefixes := walk("dir/", ListOptions{Delimiter: "/", Match: regexp.MustCompile(`/(b|sub)`)})
+		Expect(objects).To(Equal([]string{"dir/b.txt"}))
+		Expect(prefixes).To(Equal([]string{"dir/sub/"}))
+	})
+
+	It("lists serially with a delimiter whatever the concurrency", func() {
+		objects, prefixes := walk("", ListOptions{Delimiter: "/", Concurrency: 4})
+		Expect(objects).To(Equal([]string{"top.txt"}))
+		Expect(prefixes).To(Equal([]string{"dir/", "dir2/"}))
+	})
+})
+
+var _ = Describe("Listing objects written since a generation", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var listed []string
+	// listedBeforeSecondPage is the number of objects passed on before the
+	// second page of the listing was requested.
+	var listedBeforeSecondPage int
+
+	BeforeEach(func() {
+		listed, listedBeforeSecondPage = nil, -1
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			page := `{"items": [{"name": "a", "generation": "5"}, {"name": "b", "generation": "12"}], "nextPageToken": "second"}`
+			if r.URL.Query().Get("pageToken") == "second" {
+				listedBeforeSecondPage = len(listed)
+				page = `{"items": [{"name": "c", "generation": "10"}, {"name": "d", "generation": "11"}]}`
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(page)) //nolint:errcheck
+		}))
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("passes on the newer objects of every page as each page is listed", func() {
+		err := blobstore.WalkObjects("", ListOptions{SinceGeneration: 10}, func(attrs *storage.ObjectAttrs) error {
+			listed = append(listed, attrs.Name)
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(listed).To(Equal([]string{"b", "d"}))
+		Expect(listedBeforeSecondPage).To(Equal(1))
+	})
+})
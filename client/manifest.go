@@ -0,0 +1,143 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ManifestEntry is a line of a sync manifest, recording an object a sync
+// brought up to date with its local file.
+type ManifestEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// CRC32C is the base64 big-endian CRC32C of the object, as GCS
+	// encodes it.
+	CRC32C string `json:"crc32c"`
+}
+
+// NewManifestEntry returns the entry for the object name synced from a file
+// of size bytes with the given CRC32C.
+func NewManifestEntry(name string, size int64, crc32c uint32) ManifestEntry {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32c)
+	return ManifestEntry{Name: name, Size: size, CRC32C: base64.StdEncoding.EncodeToString(crc)}
+}
+
+// Matches reports whether a file of size bytes with the given CRC32C still
+// has the content the entry recorded.
+func (e ManifestEntry) Matches(size int64, crc32c uint32) bool {
+	return e == NewManifestEntry(e.Name, size, crc32c)
+}
+
+// Manifest maps the names of the objects recorded in a sync manifest to
+// their entry, as loaded by LoadManifest.
+type Manifest map[string]ManifestEntry
+
+// ErrInvalidManifest is returned by LoadManifest for a file which is not a
+// sync manifest.
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// LoadManifest reads the sync manifest at path, one JSON ManifestEntry per
+// line. An incomplete last line, as left by a sync killed while recording
+// an object, is ignored; that object is synced again. A later entry for
+// the same object replaces an earlier one.
+func LoadManifest(path string) (Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := Manifest{}
+	scanner := bufio.NewScanner(f)
+	var invalid error
+	for line := 1; scanner.Scan(); line++ {
+		if invalid != nil {
+			return nil, invalid
+		}
+		var entry ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Name == "" {
+			invalid = fmt.Errorf("%w %s: line %d is not an entry", ErrInvalidManifest, path, line)
+			continue
+		}
+		manifest[entry.Name] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ManifestWriter appends the entries of a sync manifest to a file, one
+// line per entry, as each object is synced. Every entry is written as soon
+// as it is recorded, so an interrupted sync leaves a manifest of what it
+// completed. A nil *ManifestWriter discards every entry.
+type ManifestWriter struct {
+	mu  sync.Mutex
+	out *os.File
+	err error
+}
+
+// NewManifestWriter opens the manifest at path for appending, creating it if
+// necessary.
+func NewManifestWriter(path string) (*ManifestWriter, error) {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening manifest: %v", err)
+	}
+	return &ManifestWriter{out: out}, nil
+}
+
+// Record appends entry to the manifest. The first failure to write is kept
+// and returned by Close.
+func (w *ManifestWriter) Record(entry ManifestEntry) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		// A single write per entry keeps lines whole.
+		_, err = w.out.Write(append(line, '\n'))
+	}
+	w.err = err
+}
+
+// Close closes the manifest file, returning the first error writing to it,
+// if any.
+func (w *ManifestWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	err := w.out.Close()
+	if w.err != nil {
+		return fmt.Errorf("writing manifest: %v", w.err)
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func md5Of(content string) []byte {
+	sum := md5.Sum([]byte(content))
+	return sum[:]
+}
+
+var _ = Describe("Expected MD5 of uploads", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var sentMD5s []string
+
+	BeforeEach(func() {
+		sentMD5s = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, `{"name": "some-bucket"}`)
+				return
+			}
+
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			Expect(err).ToNot(HaveOccurred())
+			parts := multipart.NewReader(r.Body, params["boundary"])
+			part, err := parts.NextPart()
+			Expect(err).ToNot(HaveOccurred())
+			var attrs struct{ MD5Hash string }
+			Expect(json.NewDecoder(part).Decode(&attrs)).To(Succeed())
+			sentMD5s = append(sentMD5s, attrs.MD5Hash)
+			part, err = parts.NextPart()
+			Expect(err).ToNot(HaveOccurred())
+			content, err := io.ReadAll(part)
+			Expect(err).ToNot(HaveOccurred())
+
+			// As GCS does, the object is only committed if the content
+			// matches the MD5 sent.
+			computed := base64.StdEncoding.EncodeToString(md5Of(string(content)))
+			if attrs.MD5Hash != "" && attrs.MD5Hash != computed {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{"error": {"code": 400, "message": "Provided MD5 hash \"%s\" doesn't match calculated MD5 hash \"%s\"."}}`, attrs.MD5Hash, computed)
+				return
+			}
+			fmt.Fprintf(w, `{"name": "obj", "bucket": "some-bucket", "generation": "1", "md5Hash": %q}`, computed)
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+			cfg.SingleShotMaxSize = config.MinChunkSize
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("sends the expected MD5 with the upload", func() {
+		Expect(blobstore.PutWithOptions(strings.NewReader("content"), "obj", PutOptions{MD5: md5Of("content")})).To(Succeed())
+		Expect(sentMD5s).To(Equal([]string{base64.StdEncoding.EncodeToString(md5Of("content"))}))
+	})
+
+	It("fails when GCS rejects the content for not matching it", func() {
+		err := blobstore.PutWithOptions(strings.NewReader("corrupt"), "obj", PutOptions{MD5: md5Of("content")})
+		Expect(errors.Is(err, ErrContentMD5Mismatch)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("doesn't match calculated MD5 hash"))
+	})
+
+	It("computes the MD5 of a buffered upload", func() {
+		opts := PutOptions{ComputeMD5: true}
+		Expect(blobstore.PutBuffered(io.MultiReader(strings.NewReader("content")), "obj", opts, 1024)).To(Succeed())
+		Expect(sentMD5s).To(Equal([]string{base64.StdEncoding.EncodeToString(md5Of("content"))}))
+
+		err := blobstore.PutBuffered(io.MultiReader(strings.NewReader("content")), "obj", opts, 4)
+		Expect(err).To(MatchError(ContainSubstring("cannot compute the MD5")))
+		Expect(sentMD5s).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Verifying the MD5 of an upload", func() {
+	var emulator *gcsEmulator
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		blobstore = newEmulatorBlobstore(emulator.Server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+	})
+
+	AfterEach(func() {
+		emulator.Close()
+	})
+
+	// corruptMD5 makes the emulator answer uploads with the MD5 of other
+	// content, as if the bytes had been corrupted on the way.
+	corruptMD5 := func() {
+		emulator.rewriteUploads(func(resource map[string]interface{}) {
+			resource["md5Hash"] = base64.StdEncoding.EncodeToString(md5Of("corrupt"))
+		})
+	}
+
+	It("succeeds when GCS computed the MD5 of the bytes sent", func() {
+		Expect(blobstore.Put2(strings.NewReader("content"), "obj", false)).To(Succeed())
+		Expect(string(emulator.object("obj").data)).To(Equal("content"))
+	})
+
+	It("fails with ErrUploadChecksumMismatch when GCS computed another MD5", func() {
+		corruptMD5()
+
+		err := blobstore.Put2(strings.NewReader("content"), "obj", false)
+		Expect(err).To(MatchError(ErrUploadChecksumMismatch))
+		Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("sent %s for 'obj', GCS computed %s",
+			base64.StdEncoding.EncodeToString(md5Of("content")), base64.StdEncoding.EncodeToString(md5Of("corrupt")))))
+
+		// The corrupt object is left in place.
+		Expect(emulator.names()).To(Equal([]string{"obj"}))
+	})
+
+	It("fails a conditional upload in the same way", func() {
+		corruptMD5()
+
+		_, err := blobstore.PutIf(strings.NewReader("content"), "obj", PutOptions{}, storage.Conditions{DoesNotExist: true})
+		Expect(err).To(MatchError(ErrUploadChecksumMismatch))
+	})
+})
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+)
+
+// ObjectMetadata is the metadata a metadata file gives the object an upload
+// replaces or creates.
+type ObjectMetadata struct {
+	// ContentType is the object's content type.
+	ContentType string `json:"content_type,omitempty"`
+	// CacheControl is the Cache-Control header GCS serves the object with.
+	CacheControl string `json:"cache_control,omitempty"`
+	// Metadata is the object's custom metadata.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Apply overrides the content type, cache control and custom metadata opts
+// upload an object with by those of m which are set. Custom metadata is
+// merged into that of opts, m taking precedence for the same key.
+func (m ObjectMetadata) Apply(opts *PutOptions) {
+	if m.ContentType != "" {
+		opts.ContentType = m.ContentType
+	}
+	if m.CacheControl != "" {
+		opts.CacheControl = m.CacheControl
+	}
+	if len(m.Metadata) > 0 {
+		metadata := make(map[string]string, len(opts.Metadata)+len(m.Metadata))
+		for k, v := range opts.Metadata {
+			metadata[k] = v
+		}
+		for k, v := range m.Metadata {
+			metadata[k] = v
+		}
+		opts.Metadata = metadata
+	}
+}
+
+// MetadataFile maps the names of objects to the metadata uploads to them
+// are given, as loaded by LoadMetadataFile. Names are those given to put
+// and sync, before any configured prefix.
+type MetadataFile map[string]ObjectMetadata
+
+// ErrInvalidMetadataFile is returned by LoadMetadataFile for a file which
+// is not a JSON object mapping object names to ObjectMetadata.
+var ErrInvalidMetadataFile = errors.New("invalid metadata file")
+
+// LoadMetadataFile reads the metadata file at path, a JSON object such as
+//
+//	{"releases/app.tgz": {"content_type": "application/gzip", "cache_control": "no-cache", "metadata": {"owner": "ci"}}}
+//
+// An entry with a field other than those of ObjectMetadata, or setting none
+// of them, an empty object name or metadata key, or a content type which is
+// not a media type, fails with ErrInvalidMetadataFile, so that a typo does
+// not silently leave objects without their metadata.
+func LoadMetadataFile(path string) (MetadataFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file MetadataFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrInvalidMetadataFile, path, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w %s: data after the top-level object", ErrInvalidMetadataFile, path)
+	}
+	if file == nil {
+		return nil, fmt.Errorf("%w %s: expected an object mapping object names to their metadata", ErrInvalidMetadataFile, path)
+	}
+
+	for name, entry := range file {
+		if name == "" {
+			return nil, fmt.Errorf("%w %s: empty object name", ErrInvalidMetadataFile, path)
+		}
+		if entry.ContentType == "" && entry.CacheControl == "" && len(entry.Metadata) == 0 {
+			return nil, fmt.Errorf("%w %s: '%s' sets none of content_type, cache_control and metadata", ErrInvalidMetadataFile, path, name)
+		}
+		if entry.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(entry.ContentType); err != nil {
+				return nil, fmt.Errorf("%w %s: content_type %q of '%s': %v", ErrInvalidMetadataFile, path, entry.ContentType, name, err)
+			}
+		}
+		for key := range entry.Metadata {
+			if key == "" {
+				return nil, fmt.Errorf("%w %s: empty metadata key for '%s'", ErrInvalidMetadataFile, path, name)
+			}
+		}
+	}
+	return file, nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metadata files", func() {
+	load := func(content string) (MetadataFile, error) {
+		path := filepath.Join(tempDir(), "metadata.json")
+		Expect(os.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		return LoadMetadataFile(path)
+	}
+
+	It("loads the metadata of each object", func() {
+		file, err := load(`{
+			"app.tgz": {"content_type": "application/gzip", "cache_control": "no-cache", "metadata": {"owner": "ci"}},
+			"index.html": {"content_type": "text/html; charset=utf-8"}
+		}`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(file).To(Equal(MetadataFile{
+			"app.tgz":    {ContentType: "application/gzip", CacheControl: "no-cache", Metadata: map[string]string{"owner": "ci"}},
+			"index.html": {ContentType: "text/html; charset=utf-8"},
+		}))
+	})
+
+	It("applies an entry over the options of an upload", func() {
+		opts := PutOptions{ContentType: "text/plain", CacheControl: "public", Metadata: map[string]string{"owner": "me", "build": "1"}}
+		ObjectMetadata{ContentType: "application/gzip", Metadata: map[string]string{"owner": "ci"}}.Apply(&opts)
+		Expect(opts).To(Equal(PutOptions{ContentType: "application/gzip", CacheControl: "public", Metadata: map[string]string{"owner": "ci", "build": "1"}}))
+	})
+
+	It("rejects an invalid file", func() {
+		invalid := []struct{ content, message string }{
+			{`{"app.tgz": {"content-type": "application/gzip"}}`, `unknown field "content-type"`},
+			{`{"app.tgz": {}}`, "'app.tgz' sets none of"},
+			{`{"app.tgz": {"content_type": "gzip/"}}`, `content_type "gzip/" of 'app.tgz'`},
+			{`{"": {"cache_control": "no-cache"}}`, "empty object name"},
+			{`{"app.tgz": {"metadata": {"": "ci"}}}`, "empty metadata key for 'app.tgz'"},
+			{`{"app.tgz": {"metadata": {"build": 42}}}`, "cannot unmarshal number"},
+			{`[{"content_type": "application/gzip"}]`, "cannot unmarshal array"},
+			{`null`, "expected an object"},
+			{`{} {}`, "data after the top-level object"},
+		}
+		for _, c := range invalid {
+			_, err := load(c.content)
+			Expect(errors.Is(err, ErrInvalidMetadataFile)).To(BeTrue(), c.content)
+			Expect(err).To(MatchError(ContainSubstring(c.message)), c.content)
+		}
+	})
+
+	It("fails for a missing file", func() {
+		_, err := LoadMetadataFile(filepath.Join(tempDir(), "missing.json"))
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+	})
+})
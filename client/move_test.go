@@ -0,0 +1,104 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Moving objects", func() {
+	const source = `{"bucket": "some-bucket", "name": "src", "generation": "5", "crc32c": "AAAAAQ=="}`
+
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var copyStatus, deleteStatus int
+	var deletes []string
+
+	BeforeEach(func() {
+		copyStatus, deleteStatus = http.StatusOK, http.StatusNoContent
+		deletes = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodGet:
+				w.Write([]byte(source)) //nolint:errcheck
+			case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/rewriteTo/"):
+				w.WriteHeader(copyStatus)
+				if copyStatus == http.StatusOK {
+					w.Write([]byte(`{"done": true, "resource": {"bucket": "some-bucket", "name": "dst", "generation": "1", "crc32c": "AAAAAQ=="}}`)) //nolint:errcheck
+				} else {
+					w.Write([]byte(`{"error": {"code": 403, "message": "Forbidden"}}`)) //nolint:errcheck
+				}
+			case r.Method == http.MethodDelete:
+				deletes = append(deletes, r.URL.Path+"?"+r.URL.Query().Get("ifGenerationMatch"))
+				w.WriteHeader(deleteStatus)
+				if deleteStatus != http.StatusNoContent {
+					w.Write([]byte(`{"error": {"code": 403, "message": "Forbidden"}}`)) //nolint:errcheck
+				}
+			default:
+				Fail("unexpected request " + r.Method + " " + r.URL.Path)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("deletes the source at the copied generation after copying it", func() {
+		Expect(blobstore.Move("src", "dst")).To(Succeed())
+		Expect(deletes).To(Equal([]string{"/storage/v1/b/some-bucket/o/src?5"}))
+	})
+
+	It("keeps the source if the copy fails", func() {
+		copyStatus = http.StatusForbidden
+		err := blobstore.Move("src", "dst")
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Is(err, ErrSourceNotDeleted)).To(BeFalse())
+		Expect(deletes).To(BeEmpty())
+	})
+
+	It("reports a copy whose source could not be deleted", func() {
+		deleteStatus = http.StatusForbidden
+		err := blobstore.Move("src", "dst")
+		Expect(errors.Is(err, ErrSourceNotDeleted)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("'src' was copied to 'dst'")))
+	})
+
+	It("only looks objects up in a dry run", func() {
+		copyStatus = http.StatusForbidden
+		Expect(blobstore.DryRunCopy("src", "dst", true)).To(Succeed())
+		Expect(deletes).To(BeEmpty())
+	})
+
+	It("refuses to move an object onto itself", func() {
+		Expect(blobstore.Move("src", "src")).To(MatchError(ContainSubstring("onto itself")))
+		Expect(deletes).To(BeEmpty())
+	})
+})
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"cloud.google.com/go/storage"
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Missing objects", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "No such object"}}`)) //nolint:errcheck
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("are reported by Stat as ErrObjectNotFound", func() {
+		_, err := blobstore.Stat("missing")
+		Expect(errors.Is(err, ErrObjectNotFound)).To(BeTrue())
+		Expect(errors.Is(err, storage.ErrObjectNotExist)).To(BeTrue())
+		Expect(err).To(MatchError("object 'missing' not found"))
+	})
+
+	It("are reported by Get as ErrObjectNotFound", func() {
+		err := blobstore.Get("missing", &bytes.Buffer{})
+		Expect(errors.Is(err, ErrObjectNotFound)).To(BeTrue())
+	})
+
+	It("are reported by GetRange as ErrObjectNotFound", func() {
+		err := blobstore.GetRange("missing", ByteRange{Start: 0, End: 9}, &bytes.Buffer{})
+		Expect(errors.Is(err, ErrObjectNotFound)).To(BeTrue())
+	})
+
+	It("are reported by Copy as ErrObjectNotFound", func() {
+		err := blobstore.Copy("missing", "copy")
+		Expect(errors.Is(err, ErrObjectNotFound)).To(BeTrue())
+	})
+})
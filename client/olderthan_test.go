@@ -0,0 +1,80 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"time"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Comparing the age of an object", func() {
+	var emulator *gcsEmulator
+	var blobstore *GCSBlobstore
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	putWithModTime := func(name string, t time.Time) {
+		emulator.put(name, "content", map[string]interface{}{
+			"metadata": map[string]interface{}{SourceModTimeMetadataKey: t.Format(time.RFC3339Nano)},
+		})
+	}
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		blobstore = newEmulatorBlobstore(emulator.Server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+	})
+
+	AfterEach(func() {
+		emulator.Close()
+	})
+
+	It("reports an object whose recorded modification time is older", func() {
+		putWithModTime("obj", modTime.Add(-time.Hour))
+		Expect(blobstore.RemoteOlderThan("obj", modTime)).To(BeTrue())
+	})
+
+	It("does not report an object whose recorded modification time is newer or the same", func() {
+		putWithModTime("newer", modTime.Add(time.Hour))
+		Expect(blobstore.RemoteOlderThan("newer", modTime)).To(BeFalse())
+
+		putWithModTime("same", modTime)
+		Expect(blobstore.RemoteOlderThan("same", modTime)).To(BeFalse())
+	})
+
+	It("reports an object which does not exist", func() {
+		Expect(blobstore.RemoteOlderThan("missing", modTime)).To(BeTrue())
+	})
+
+	It("uses the time the object was updated without a recorded modification time", func() {
+		emulator.put("obj", "content", nil)
+		Expect(blobstore.RemoteOlderThan("obj", time.Now().Add(time.Hour))).To(BeTrue())
+		Expect(blobstore.RemoteOlderThan("obj", time.Now().Add(-time.Hour))).To(BeFalse())
+	})
+
+	It("uses the time the object was updated when the recorded time is invalid", func() {
+		emulator.put("obj", "content", map[string]interface{}{
+			"metadata": map[string]interface{}{SourceModTimeMetadataKey: "yesterday"},
+		})
+		Expect(blobstore.RemoteOlderThan("obj", time.Now().Add(-time.Hour))).To(BeFalse())
+	})
+})
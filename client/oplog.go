@@ -0,0 +1,119 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// operationRecord is a line of the operation log.
+type operationRecord struct {
+	Time time.Time `json:"time"`
+	// RunID identifies the invocation of the CLI the operation belongs to.
+	RunID string `json:"run_id"`
+	// RequestID identifies the operation within the log. It is generated by
+	// the client and is not a GCS request identifier.
+	RequestID   string `json:"request_id"`
+	Operation   string `json:"operation"`
+	Bucket      string `json:"bucket"`
+	Object      string `json:"object"`
+	Destination string `json:"destination,omitempty"`
+	Bytes       int64  `json:"bytes"`
+	Result      string `json:"result"`
+	Error       string `json:"error,omitempty"`
+}
+
+// operationLog appends a JSON record of every mutating operation to a file.
+//
+// Records never include credentials or encryption keys. A nil
+// *operationLog discards every record.
+type operationLog struct {
+	bucket string
+	runID  string
+
+	mu  sync.Mutex
+	seq int64
+	out *os.File
+}
+
+// newOperationLog opens path for appending, creating it if necessary.
+func newOperationLog(path, bucket string) (*operationLog, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generating run id: %v", err)
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening operation log: %v", err)
+	}
+	return &operationLog{bucket: bucket, runID: hex.EncodeToString(id), out: out}, nil
+}
+
+// close closes the file of the log.
+func (l *operationLog) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.out.Close()
+}
+
+// record logs the outcome of operation on object, which moved size bytes.
+// dest is the object written to by operations which have one, such as a
+// rename, and is otherwise empty.
+func (l *operationLog) record(operation, object, dest string, size int64, opErr error) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	rec := operationRecord{
+		Time:        time.Now().UTC(),
+		RunID:       l.runID,
+		RequestID:   fmt.Sprintf("%s-%d", l.runID, l.seq),
+		Operation:   operation,
+		Bucket:      l.bucket,
+		Object:      object,
+		Destination: dest,
+		Bytes:       size,
+		Result:      "ok",
+	}
+	if opErr != nil {
+		rec.Result = "error"
+		rec.Error = opErr.Error()
+	}
+
+	line, err := json.Marshal(rec)
+	if err == nil {
+		// A single write per record keeps lines whole when several
+		// processes append to the same log.
+		_, err = l.out.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Printf("WARN: writing operation log failed: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("The operation log", func() {
+	var emulator *gcsEmulator
+	var blobstore *GCSBlobstore
+	var logPath string
+
+	// records returns the records of the operation log, one per line.
+	records := func() []map[string]interface{} {
+		file, err := os.Open(logPath)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+
+		var records []map[string]interface{}
+		lines := bufio.NewScanner(file)
+		for lines.Scan() {
+			var record map[string]interface{}
+			Expect(json.Unmarshal(lines.Bytes(), &record)).To(Succeed(), lines.Text())
+			records = append(records, record)
+		}
+		Expect(lines.Err()).ToNot(HaveOccurred())
+		return records
+	}
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		logPath = filepath.Join(tempDir(), "operations.log")
+		blobstore = newEmulatorBlobstore(emulator.Server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+			cfg.OperationLogPath = logPath
+		})
+	})
+
+	AfterEach(func() {
+		Expect(blobstore.Close()).To(Succeed())
+		emulator.Close()
+	})
+
+	It("records a put and a delete", func() {
+		Expect(blobstore.Put(strings.NewReader("content"), "obj")).To(Succeed())
+		Expect(blobstore.Delete("obj")).To(Succeed())
+
+		logged := records()
+		Expect(logged).To(HaveLen(2))
+		for i, operation := range []string{"put", "delete"} {
+			Expect(logged[i]).To(HaveKeyWithValue("operation", operation))
+			Expect(logged[i]).To(HaveKeyWithValue("bucket", "some-bucket"))
+			Expect(logged[i]).To(HaveKeyWithValue("object", "obj"))
+			Expect(logged[i]).To(HaveKeyWithValue("result", "ok"))
+			Expect(logged[i]).To(HaveKeyWithValue("run_id", logged[0]["run_id"]))
+			Expect(logged[i]).To(HaveKey("request_id"))
+			Expect(logged[i]).ToNot(HaveKey("destination"))
+			Expect(logged[i]).ToNot(HaveKey("error"))
+		}
+		Expect(logged[0]).To(HaveKeyWithValue("bytes", BeNumerically("==", len("content"))))
+		Expect(logged[1]).To(HaveKeyWithValue("bytes", BeNumerically("==", 0)))
+		Expect(logged[1]["request_id"]).ToNot(Equal(logged[0]["request_id"]))
+
+		recorded, err := time.Parse(time.RFC3339Nano, logged[0]["time"].(string))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(recorded).To(BeTemporally("~", time.Now(), time.Minute))
+	})
+
+	It("records the error of a failed operation", func() {
+		emulator.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Method != http.MethodDelete {
+				return false
+			}
+			writeError(w, http.StatusBadRequest, "Invalid argument.")
+			return true
+		}
+		emulator.put("obj", "content", nil)
+
+		Expect(blobstore.Delete("obj")).ToNot(Succeed())
+
+		logged := records()
+		Expect(logged).To(HaveLen(1))
+		Expect(logged[0]).To(HaveKeyWithValue("operation", "delete"))
+		Expect(logged[0]).To(HaveKeyWithValue("result", "error"))
+		Expect(logged[0]).To(HaveKeyWithValue("error", ContainSubstring("Invalid argument.")))
+	})
+
+	It("records nothing for reads", func() {
+		emulator.put("obj", "content", nil)
+
+		_, err := blobstore.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(records()).To(BeEmpty())
+	})
+})
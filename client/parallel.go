@@ -0,0 +1,215 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// MinParallelDownloadSize is the size below which GetParallel downloads an
+// object in a single stream: the requests for several parts would cost
+// more than they gain.
+const MinParallelDownloadSize = 64 << 20
+
+// ParallelDestination is what GetParallel downloads into, such as an
+// *os.File. It is truncated to the size of the object and each part is
+// written at its offset as it arrives.
+type ParallelDestination interface {
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// GetParallel fetches the blob src into dest like Get, but as parts byte
+// ranges of about the same size downloaded at once, which can make better
+// use of the bandwidth than a single stream for a large object. Every part
+// is read from the same generation, and unless no_verify is configured,
+// the CRC32C of the assembled parts is compared with the object's.
+//
+// An object smaller than MinParallelDownloadSize, one GCS decompresses on
+// the way down, which cannot be read in ranges, or a parts of 1 or less
+// are downloaded in a single stream instead, as is any object when
+// cache_dir is configured.
+//
+// If a part fails, the others are stopped and the error of the first is
+// returned. dest has then received part of the object and should be
+// discarded.
+func (client *GCSBlobstore) GetParallel(src string, dest ParallelDestination, parts int) error {
+	if client.config.CacheDir != "" {
+		return client.getCached(src, &offsetWriter{w: dest})
+	}
+
+	attrs, err := client.Stat(src)
+	if err != nil {
+		return err
+	}
+	decompressed := !client.config.NoDecompress && attrs.ContentEncoding == "gzip"
+	if parts <= 1 || attrs.Size < MinParallelDownloadSize || decompressed {
+		return client.getUncached(src, attrs, &offsetWriter{w: dest})
+	}
+
+	if err := dest.Truncate(attrs.Size); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(client.ctx)
+	defer cancel()
+
+	partSize := (attrs.Size + int64(parts) - 1) / int64(parts)
+	var ranges []ByteRange
+	for start := int64(0); start < attrs.Size; start += partSize {
+		end := start + partSize - 1
+		if end >= attrs.Size {
+			end = attrs.Size - 1
+		}
+		ranges = append(ranges, ByteRange{Start: start, End: end})
+	}
+
+	crcs := make([]uint32, len(ranges))
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r ByteRange) {
+			defer wg.Done()
+			crc, err := client.getPart(ctx, src, attrs.Generation, r, dest)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("fetching part %s of '%s': %w", r, src, err)
+				cancel()
+			}
+			crcs[i] = crc
+		}(i, r)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if client.config.NoVerify {
+		return nil
+	}
+	crc := crcs[0]
+	for i, r := range ranges[1:] {
+		crc = crc32cCombine(crc, crcs[i+1], r.Length())
+	}
+	return verifyCRC32C(src, attrs, crc, false)
+}
+
+// getPart downloads the bytes of generation of src covered by r to their
+// offset in dest and returns their CRC32C.
+func (client *GCSBlobstore) getPart(ctx context.Context, src string, generation int64, r ByteRange, dest io.WriterAt) (uint32, error) {
+	reader, err := client.getReadHandle(client.publicGCS, src).Generation(generation).NewRangeReader(ctx, r.Start, r.Length())
+	if err != nil && client.authenticatedGCS != nil {
+		reader, err = client.getReadHandle(client.authenticatedGCS, src).Generation(generation).NewRangeReader(ctx, r.Start, r.Length())
+	}
+	if err != nil {
+		return 0, wrapNotFound(src, err)
+	}
+	defer reader.Close()
+
+	if reader.Attrs.StartOffset != r.Start {
+		return 0, fmt.Errorf("%w: '%s' was served from byte %d rather than %d", ErrRangeIgnored, src, reader.Attrs.StartOffset, r.Start)
+	}
+	hash := crc32.New(crc32cTable)
+	written, err := client.copyData(io.MultiWriter(&offsetWriter{w: dest, off: r.Start}, hash), io.LimitReader(reader, r.Length()))
+	if err != nil {
+		return 0, err
+	}
+	if written != r.Length() {
+		return 0, fmt.Errorf("%w: wrote %d of %d bytes", ErrShortDownload, written, r.Length())
+	}
+	return hash.Sum32(), nil
+}
+
+// offsetWriter writes to w sequentially from the offset off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// crc32cCombine returns the CRC32C of the concatenation of two blocks of
+// bytes from crc1, the CRC32C of the first, and crc2, that of the second,
+// len2 bytes long, as zlib's crc32_combine does. Each part of a parallel
+// download is hashed on its own, and the parts' CRC32C combined into the
+// object's.
+func crc32cCombine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+
+	// odd is the operator appending one zero bit to a CRC, even that
+	// appending two, and squaring either doubles the bits appended.
+	var even, odd [32]uint32
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(&even, &odd)
+	gf2MatrixSquare(&odd, &even)
+
+	// Append len2 zero bytes to crc1, a bit of len2 at a time, starting
+	// with the operator for one zero byte.
+	for {
+		gf2MatrixSquare(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat *[32]uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Parallel downloads", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var content []byte
+	var crc uint32
+	var failRange string
+
+	var mu sync.Mutex
+	var ranges []string
+
+	setContent := func(size int) {
+		content = make([]byte, size)
+		rand.New(rand.NewSource(1)).Read(content) //nolint:errcheck
+		crc = crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli))
+	}
+
+	BeforeEach(func() {
+		setContent(MinParallelDownloadSize + 12345)
+		failRange = ""
+		ranges = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			if strings.Contains(r.URL.Path, "/b/some-bucket/o/") {
+				sum := make([]byte, 4)
+				binary.BigEndian.PutUint32(sum, crc)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"bucket": "some-bucket", "name": "obj", "generation": "7", "size": "%d", "crc32c": %q}`, len(content), base64.StdEncoding.EncodeToString(sum))
+				return
+			}
+			Expect(r.URL.Query().Get("generation")).To(Equal("7"))
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+			if r.Header.Get("Range") != "" && r.Header.Get("Range") == failRange {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			w.Header().Set("X-Goog-Generation", "7")
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+				w.Header().Set("Content-Length", fmt.Sprint(end-start+1))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[start : end+1]) //nolint:errcheck
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content) //nolint:errcheck
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	download := func(parts int) (string, error) {
+		path := filepath.Join(tempDir(), "dst")
+		file, err := os.Create(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+		return path, blobstore.GetParallel("obj", file, parts)
+	}
+
+	It("downloads the parts of a large object at their offsets", func() {
+		path, err := download(4)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(path)).To(Equal(content))
+
+		partSize := (len(content) + 3) / 4
+		Expect(ranges).To(ConsistOf(
+			fmt.Sprintf("bytes=0-%d", partSize-1),
+			fmt.Sprintf("bytes=%d-%d", partSize, 2*partSize-1),
+			fmt.Sprintf("bytes=%d-%d", 2*partSize, 3*partSize-1),
+			fmt.Sprintf("bytes=%d-%d", 3*partSize, len(content)-1),
+		))
+	})
+
+	It("compares the CRC32C of the assembled parts with the object's", func() {
+		crc++
+		_, err := download(4)
+		Expect(errors.Is(err, ErrChecksumMismatch)).To(BeTrue())
+	})
+
+	It("fails if any part fails", func() {
+		partSize := (len(content) + 3) / 4
+		failRange = fmt.Sprintf("bytes=%d-%d", partSize, 2*partSize-1)
+		_, err := download(4)
+		Expect(err).To(MatchError(ContainSubstring(fmt.Sprintf("fetching part %d-%d of 'obj'", partSize, 2*partSize-1))))
+	})
+
+	It("downloads a small object in a single stream", func() {
+		setContent(1000)
+		path, err := download(4)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(path)).To(Equal(content))
+		Expect(ranges).To(Equal([]string{""}))
+	})
+})
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// generationServer accepts multipart uploads, numbering the generations of
+// each object and enforcing ifGenerationMatch as GCS does. Every GET is
+// answered with the bucket's attributes.
+func generationServer() *httptest.Server {
+	var mu sync.Mutex
+	generations := map[string]int64{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer GinkgoRecover()
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"name": "some-bucket"}`)) //nolint:errcheck
+			return
+		}
+
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		Expect(err).ToNot(HaveOccurred())
+		part, err := multipart.NewReader(r.Body, params["boundary"]).NextPart()
+		Expect(err).ToNot(HaveOccurred())
+		var attrs struct{ Name string }
+		Expect(json.NewDecoder(part).Decode(&attrs)).To(Succeed())
+
+		mu.Lock()
+		defer mu.Unlock()
+		current := generations[attrs.Name]
+		if match := r.URL.Query().Get("ifGenerationMatch"); match != "" && match != strconv.FormatInt(current, 10) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`{"error": {"code": 412, "message": "Precondition Failed"}}`)) //nolint:errcheck
+			return
+		}
+		generations[attrs.Name] = current + 1
+		fmt.Fprintf(w, `{"name": %q, "bucket": "some-bucket", "generation": "%d"}`, attrs.Name, current+1)
+	}))
+}
+
+var _ = Describe("Conditional uploads", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		server = generationServer()
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("only creates an object which does not exist", func() {
+		generation, err := blobstore.PutIf(strings.NewReader("first"), "obj", PutOptions{}, storage.Conditions{DoesNotExist: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation).To(Equal(int64(1)))
+
+		_, err = blobstore.PutIf(strings.NewReader("second"), "obj", PutOptions{}, storage.Conditions{DoesNotExist: true})
+		Expect(errors.Is(err, ErrObjectExists)).To(BeTrue())
+	})
+
+	It("replaces an object at the generation returned by a prior put", func() {
+		generation, err := blobstore.PutIf(strings.NewReader("first"), "obj", PutOptions{}, storage.Conditions{DoesNotExist: true})
+		Expect(err).ToNot(HaveOccurred())
+
+		next, err := blobstore.PutIf(strings.NewReader("second"), "obj", PutOptions{}, storage.Conditions{GenerationMatch: generation})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(next).To(Equal(generation + 1))
+
+		_, err = blobstore.PutIf(strings.NewReader("stale"), "obj", PutOptions{}, storage.Conditions{GenerationMatch: generation})
+		Expect(errors.Is(err, ErrGenerationMismatch)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("is not at generation 1")))
+	})
+})
+
+var _ = Describe("Conditional deletes", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var metageneration int64
+	var deleted bool
+
+	BeforeEach(func() {
+		metageneration = 3
+		deleted = false
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if deleted {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": {"code": 404, "message": "Not Found"}}`)) //nolint:errcheck
+				return
+			}
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, `{"name": "obj", "bucket": "some-bucket", "generation": "1", "metageneration": "%d"}`, metageneration)
+				return
+			}
+			if match := r.URL.Query().Get("ifMetagenerationMatch"); match != "" && match != strconv.FormatInt(metageneration, 10) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				w.Write([]byte(`{"error": {"code": 412, "message": "Precondition Failed"}}`)) //nolint:errcheck
+				return
+			}
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("deletes an object at the metageneration returned by stat", func() {
+		attrs, err := blobstore.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Metageneration).To(Equal(int64(3)))
+
+		Expect(blobstore.DeleteIf("obj", storage.Conditions{MetagenerationMatch: attrs.Metageneration})).To(Succeed())
+		Expect(deleted).To(BeTrue())
+	})
+
+	It("leaves an object whose metadata changed since stat alone", func() {
+		attrs, err := blobstore.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		metageneration++
+
+		err = blobstore.DeleteIf("obj", storage.Conditions{MetagenerationMatch: attrs.Metageneration})
+		Expect(errors.Is(err, ErrMetagenerationMismatch)).To(BeTrue())
+		Expect(err).To(MatchError("object metageneration does not match: 'obj' changed since metageneration 3"))
+		Expect(deleted).To(BeFalse())
+	})
+
+	It("fails for an object which no longer exists", func() {
+		deleted = true
+
+		err := blobstore.DeleteIf("obj", storage.Conditions{MetagenerationMatch: 3})
+		Expect(errors.Is(err, ErrObjectNotFound)).To(BeTrue())
+	})
+})
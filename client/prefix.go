@@ -0,0 +1,68 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// objectName returns the name in the bucket of the object callers know as
+// id: id under the configured prefix, if any. The prefix is normalized to
+// end with a slash, so a leading slash of id is dropped rather than
+// doubled.
+func (client *GCSBlobstore) objectName(id string) string {
+	if client.config.Prefix == "" {
+		return id
+	}
+	return client.config.Prefix + strings.TrimLeft(id, "/")
+}
+
+// trimPrefix strips the configured prefix from the name of attrs, as
+// returned by GCS, leaving the id callers know the object as.
+func (client *GCSBlobstore) trimPrefix(attrs *storage.ObjectAttrs) *storage.ObjectAttrs {
+	if client.config.Prefix != "" && attrs != nil {
+		attrs.Name = strings.TrimPrefix(attrs.Name, client.config.Prefix)
+		attrs.Prefix = strings.TrimPrefix(attrs.Prefix, client.config.Prefix)
+	}
+	return attrs
+}
+
+// objectIterator lists objects as storage.ObjectIterator does, with the
+// configured prefix stripped from their names.
+type objectIterator struct {
+	client *GCSBlobstore
+	it     *storage.ObjectIterator
+}
+
+func (it *objectIterator) Next() (*storage.ObjectAttrs, error) {
+	attrs, err := it.it.Next()
+	return it.client.trimPrefix(attrs), err
+}
+
+// objects lists the objects of the bucket with gcs as query selects them.
+// The prefix of query is an id prefix, which the configured prefix is
+// prepended to.
+func (client *GCSBlobstore) objects(ctx context.Context, gcs *storage.Client, query storage.Query) *objectIterator {
+	query.Prefix = client.objectName(query.Prefix)
+	return &objectIterator{
+		client: client,
+		it:     client.bucketHandle(gcs).Objects(ctx, &query),
+	}
+}
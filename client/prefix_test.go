@@ -0,0 +1,107 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"cloud.google.com/go/storage"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("An object name prefix", func() {
+	var server *httptest.Server
+	var requests []string
+
+	newBlobstore := func(prefix string) *GCSBlobstore {
+		return newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.Prefix = prefix
+		})
+	}
+
+	BeforeEach(func() {
+		requests = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Path == "/storage/v1/b/some-bucket/o" {
+				prefix := r.URL.Query().Get("prefix")
+				requests = append(requests, "LIST "+prefix)
+				fmt.Fprintf(w, `{"items": [{"name": "%sobj", "generation": "1"}], "prefixes": ["%sdir/"]}`, prefix, prefix)
+				return
+			}
+			name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/some-bucket/o/")
+			requests = append(requests, r.Method+" "+name)
+			if r.Method == http.MethodDelete {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"bucket": "some-bucket", "name": name, "generation": "1"})
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("is prepended to the object callers name", func() {
+		blobstore := newBlobstore("staging/")
+
+		Expect(blobstore.Exists("obj")).To(BeTrue())
+		attrs, err := blobstore.Stat("/obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Name).To(Equal("obj"))
+		Expect(blobstore.Delete("obj")).To(Succeed())
+
+		Expect(requests).To(ContainElements("GET staging/obj", "DELETE staging/obj"))
+		Expect(requests).ToNot(ContainElement(ContainSubstring("//")))
+	})
+
+	It("is stripped from the names listed", func() {
+		blobstore := newBlobstore("staging/")
+
+		var names []string
+		err := blobstore.WalkObjects("", ListOptions{Delimiter: "/"}, func(attrs *storage.ObjectAttrs) error {
+			names = append(names, attrs.Name+attrs.Prefix)
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names).To(Equal([]string{"obj", "dir/"}))
+		Expect(requests).To(Equal([]string{"LIST staging/"}))
+	})
+
+	It("changes nothing when empty", func() {
+		blobstore := newBlobstore("")
+
+		attrs, err := blobstore.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Name).To(Equal("obj"))
+
+		objects, err := blobstore.List("sub/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects[0].Name).To(Equal("sub/obj"))
+		Expect(requests).To(Equal([]string{"GET obj", "LIST sub/"}))
+	})
+})
@@ -0,0 +1,281 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// uploadedAttrs are the attributes of an object as sent in the metadata
+// part of an upload.
+type uploadedAttrs struct {
+	Name               string
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	StorageClass       string
+	Metadata           map[string]string
+}
+
+var _ = Describe("Upload options", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var uploaded uploadedAttrs
+	var uploadedKMSKey string
+
+	BeforeEach(func() {
+		uploaded = uploadedAttrs{}
+		uploadedKMSKey = ""
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`{"name": "some-bucket"}`)) //nolint:errcheck
+				return
+			}
+
+			uploadedKMSKey = r.URL.Query().Get("kmsKeyName")
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			Expect(err).ToNot(HaveOccurred())
+			part, err := multipart.NewReader(r.Body, params["boundary"]).NextPart()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.NewDecoder(part).Decode(&uploaded)).To(Succeed())
+			w.Write([]byte(`{"name": "obj", "bucket": "some-bucket", "generation": "1"}`)) //nolint:errcheck
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.StorageClass = "STANDARD"
+			cfg.Metadata = map[string]string{"team": "storage", "env": "dev"}
+			cfg.SingleShotMaxSize = config.MinChunkSize
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("overrides the configured attributes and adds to the configured metadata", func() {
+		err := blobstore.PutWithOptions(strings.NewReader("content"), "obj", PutOptions{
+			ContentType:  "text/plain",
+			StorageClass: "NEARLINE",
+			Metadata:     map[string]string{"env": "prod"},
+			GzipEncoded:  true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uploaded).To(Equal(uploadedAttrs{
+			Name:            "obj",
+			ContentType:     "text/plain",
+			ContentEncoding: "gzip",
+			StorageClass:    "NEARLINE",
+			Metadata:        map[string]string{"team": "storage", "env": "prod"},
+		}))
+	})
+
+	It("overrides the configured storage class whichever way the object is uploaded", func() {
+		opts := PutOptions{StorageClass: "NEARLINE"}
+
+		_, err := blobstore.PutIf(strings.NewReader("content"), "obj", opts, storage.Conditions{DoesNotExist: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uploaded.StorageClass).To(Equal("NEARLINE"))
+
+		uploaded = uploadedAttrs{}
+		Expect(blobstore.PutBuffered(strings.NewReader("content"), "obj", opts, 1024)).To(Succeed())
+		Expect(uploaded.StorageClass).To(Equal("NEARLINE"))
+	})
+
+	It("returns the generation of the new object", func() {
+		generation, err := blobstore.PutGeneration(strings.NewReader("content"), "obj", PutOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation).To(Equal(int64(1)))
+	})
+
+	It("fails rather than return a zero generation", func() {
+		noGeneration := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name": "obj", "bucket": "some-bucket"}`)) //nolint:errcheck
+		}))
+		defer noGeneration.Close()
+
+		noGenerationBlobstore := newEmulatorBlobstore(noGeneration, func(cfg *config.GCSCli) {
+			cfg.SingleShotMaxSize = config.MinChunkSize
+		})
+
+		_, err := noGenerationBlobstore.PutGeneration(strings.NewReader("content"), "obj", PutOptions{})
+		Expect(err).To(MatchError("no generation returned for 'obj'"))
+	})
+
+	It("keeps the configured attributes with Put2", func() {
+		Expect(blobstore.Put2(strings.NewReader("content"), "obj", false)).To(Succeed())
+		Expect(uploaded).To(Equal(uploadedAttrs{
+			Name:         "obj",
+			ContentType:  "application/octet-stream",
+			StorageClass: "STANDARD",
+			Metadata:     map[string]string{"team": "storage", "env": "dev"},
+		}))
+
+		Expect(blobstore.Put2(strings.NewReader("content"), "obj", true)).To(Succeed())
+		Expect(uploaded.ContentEncoding).To(Equal("gzip"))
+	})
+
+	It("sets the caching and download file name headers", func() {
+		err := blobstore.PutWithOptions(strings.NewReader("content"), "obj", PutOptions{
+			CacheControl:       "public, max-age=3600",
+			ContentDisposition: `attachment; filename="release.tgz"`,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uploaded.CacheControl).To(Equal("public, max-age=3600"))
+		Expect(uploaded.ContentDisposition).To(Equal(`attachment; filename="release.tgz"`))
+	})
+
+	It("encrypts uploads with the configured Cloud KMS key", func() {
+		const keyName = "projects/p/locations/l/keyRings/r/cryptoKeys/k"
+		kmsBlobstore := newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.KMSKeyName = keyName
+		})
+
+		Expect(kmsBlobstore.PutWithOptions(strings.NewReader("content"), "obj", PutOptions{})).To(Succeed())
+		Expect(uploadedKMSKey).To(Equal(keyName))
+	})
+
+	It("refuses to create a marker in a bucket without a customer-managed key when one is required", func() {
+		cmekBlobstore := newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.RequireCMEK = true
+		})
+
+		Expect(cmekBlobstore.PutMarker("obj", false)).To(MatchError(ErrBucketNotCMEK))
+		Expect(uploaded.Name).To(BeEmpty())
+	})
+
+	Describe("when uploaded_by is set", func() {
+		var provenanceBlobstore *GCSBlobstore
+		var noProvenance bool
+
+		BeforeEach(func() {
+			noProvenance = false
+		})
+
+		JustBeforeEach(func() {
+			provenanceBlobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+				cfg.Metadata = map[string]string{"team": "storage"}
+				cfg.UploadedBy = "bosh-gcscli/1.2.3"
+				cfg.NoProvenance = noProvenance
+				cfg.SingleShotMaxSize = config.MinChunkSize
+			})
+		})
+
+		It("records the tool and upload time in the metadata", func() {
+			before := time.Now().Truncate(time.Second)
+			Expect(provenanceBlobstore.Put2(strings.NewReader("content"), "obj", false)).To(Succeed())
+			Expect(uploaded.Metadata).To(HaveKeyWithValue("team", "storage"))
+			Expect(uploaded.Metadata).To(HaveKeyWithValue(UploadedByMetadataKey, "bosh-gcscli/1.2.3"))
+			uploadedAt, err := time.Parse(time.RFC3339, uploaded.Metadata[UploadedAtMetadataKey])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(uploadedAt).To(BeTemporally(">=", before))
+		})
+
+		It("keeps the metadata given for the upload", func() {
+			err := provenanceBlobstore.PutWithOptions(strings.NewReader("content"), "obj", PutOptions{
+				Metadata: map[string]string{UploadedByMetadataKey: "pipeline"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(uploaded.Metadata).To(HaveKeyWithValue(UploadedByMetadataKey, "pipeline"))
+			Expect(uploaded.Metadata).To(HaveKey(UploadedAtMetadataKey))
+		})
+
+		Describe("with no_provenance", func() {
+			BeforeEach(func() {
+				noProvenance = true
+			})
+
+			It("records nothing", func() {
+				Expect(provenanceBlobstore.Put2(strings.NewReader("content"), "obj", false)).To(Succeed())
+				Expect(uploaded.Metadata).To(Equal(map[string]string{"team": "storage"}))
+			})
+		})
+	})
+})
+
+var _ = Describe("Retrying uploads", func() {
+	var server *httptest.Server
+	var uploads int
+
+	BeforeEach(func() {
+		uploads = 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body) //nolint:errcheck
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`{"name": "some-bucket"}`)) //nolint:errcheck
+				return
+			}
+			uploads++
+			if uploads == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"error": {"code": 503, "message": "Service Unavailable"}}`)) //nolint:errcheck
+				return
+			}
+			w.Write([]byte(`{"name": "obj", "bucket": "some-bucket", "generation": "1"}`)) //nolint:errcheck
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newBlobstore := func(retryMode string) *GCSBlobstore {
+		return newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.RetryMode = retryMode
+			cfg.MaxAttempts = 3
+			cfg.RetryBaseDelayMs = 1
+		})
+	}
+
+	It("does not retry an unconditional upload in strict mode", func() {
+		err := newBlobstore(config.RetryModeStrict).PutWithOptions(strings.NewReader("content"), "obj", PutOptions{})
+		Expect(err).To(MatchError(ContainSubstring("503")))
+		Expect(uploads).To(Equal(1))
+	})
+
+	It("retries an unconditional upload in always mode", func() {
+		err := newBlobstore(config.RetryModeAlways).PutWithOptions(strings.NewReader("content"), "obj", PutOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uploads).To(Equal(2))
+	})
+
+	It("retries an upload made idempotent by a precondition in strict mode", func() {
+		_, err := newBlobstore(config.RetryModeStrict).PutIf(strings.NewReader("content"), "obj", PutOptions{}, storage.Conditions{DoesNotExist: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uploads).To(Equal(2))
+	})
+})
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ByteRange is an inclusive range of bytes within an object,
+// as used by the HTTP Range header.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// Length returns the number of bytes covered by the range.
+func (r ByteRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// ParseByteRange parses a single range of the form "start-end".
+func ParseByteRange(spec string) (ByteRange, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+	if len(parts) != 2 {
+		return ByteRange{}, fmt.Errorf("invalid range %q: expected start-end", spec)
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return ByteRange{}, fmt.Errorf("invalid range %q: start must be a non-negative integer", spec)
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || end < start {
+		return ByteRange{}, fmt.Errorf("invalid range %q: end must be an integer not less than start", spec)
+	}
+	return ByteRange{Start: start, End: end}, nil
+}
+
+// ParseByteRanges parses a comma separated list of ranges such as
+// "0-1023,4096-8191". The ranges are returned in the order given.
+//
+// Overlapping ranges are rejected unless allowOverlap is set.
+func ParseByteRanges(spec string, allowOverlap bool) ([]ByteRange, error) {
+	var ranges []ByteRange
+	for _, part := range strings.Split(spec, ",") {
+		r, err := ParseByteRange(part)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+
+	if !allowOverlap {
+		sorted := make([]ByteRange, len(ranges))
+		copy(sorted, ranges)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+		for i := 1; i < len(sorted); i++ {
+			if sorted[i].Start <= sorted[i-1].End {
+				return nil, fmt.Errorf("ranges %s and %s overlap", sorted[i-1], sorted[i])
+			}
+		}
+	}
+	return ranges, nil
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Byte ranges", func() {
+	Describe("when a list of disjoint ranges is given", func() {
+		It("returns the ranges in the given order", func() {
+			ranges, err := ParseByteRanges("4096-8191,0-1023", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ranges).To(Equal([]ByteRange{{Start: 4096, End: 8191}, {Start: 0, End: 1023}}))
+			Expect(ranges[1].Length()).To(Equal(int64(1024)))
+		})
+	})
+
+	Describe("when ranges overlap", func() {
+		It("returns an error", func() {
+			_, err := ParseByteRanges("0-1023,1023-2047", false)
+			Expect(err).To(MatchError(ContainSubstring("overlap")))
+		})
+
+		It("accepts them with allowOverlap", func() {
+			ranges, err := ParseByteRanges("0-1023,1023-2047", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ranges).To(HaveLen(2))
+		})
+	})
+
+	Describe("when a range is malformed", func() {
+		It("returns an error", func() {
+			for _, spec := range []string{"", "10", "a-b", "-1-4", "10-5"} {
+				_, err := ParseByteRanges(spec, false)
+				Expect(err).To(HaveOccurred(), spec)
+			}
+		})
+	})
+})
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// These specs are in package client to give the client token sources of
+// their own.
+var _ = Describe("Reauthenticating on 401", func() {
+	var server *httptest.Server
+	var mu sync.Mutex
+	var authorizations []string
+	var bodies []map[string]interface{}
+	var renewals int
+
+	// newTokenSource returns a source of a new token each time it is called,
+	// as a refreshed source would.
+	newTokenSource := func() (oauth2.TokenSource, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		renewals++
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: fmt.Sprintf("token-%d", renewals)}), nil
+	}
+
+	newClient := func(reauth bool) *storage.Client {
+		cfg := &config.GCSCli{BucketName: "some-bucket", Endpoint: server.URL, ReauthOn401: reauth, MaxAttempts: 1}
+		source, err := newTokenSource()
+		Expect(err).ToNot(HaveOccurred())
+		gcs, _, err := newAuthenticatedClient(context.Background(), cfg, http.DefaultTransport, source, newTokenSource)
+		Expect(err).ToNot(HaveOccurred())
+		return gcs
+	}
+
+	BeforeEach(func() {
+		authorizations, bodies, renewals = nil, nil, 0
+
+		// Only the second token is accepted, as if the first had expired.
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			mu.Lock()
+			authorizations = append(authorizations, r.Header.Get("Authorization"))
+			if r.Method == http.MethodPatch {
+				var body map[string]interface{}
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				bodies = append(bodies, body)
+			}
+			mu.Unlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			if r.Header.Get("Authorization") != "Bearer token-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"error": {"code": 401, "message": "Invalid Credentials"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"bucket": "some-bucket", "name": "obj", "generation": "1", "metageneration": "2", "size": "7"}`)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("refreshes the token and retries a request rejected with 401", func() {
+		attrs, err := newClient(true).Bucket("some-bucket").Object("obj").Attrs(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Size).To(Equal(int64(7)))
+
+		Expect(renewals).To(Equal(2))
+		Expect(authorizations).To(Equal([]string{"Bearer token-1", "Bearer token-2"}))
+	})
+
+	It("replays the body of a retried request", func() {
+		_, err := newClient(true).Bucket("some-bucket").Object("obj").Update(context.Background(), storage.ObjectAttrsToUpdate{
+			Metadata: map[string]string{"owner": "ci"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(authorizations).To(HaveLen(2))
+		Expect(bodies).To(HaveLen(2))
+		Expect(bodies[1]).To(Equal(bodies[0]))
+		Expect(bodies[1]).To(HaveKeyWithValue("metadata", HaveKeyWithValue("owner", "ci")))
+	})
+
+	It("fails with the 401 without reauth_on_401", func() {
+		_, err := newClient(false).Bucket("some-bucket").Object("obj").Attrs(context.Background())
+		var apiErr *googleapi.Error
+		Expect(errors.As(err, &apiErr)).To(BeTrue())
+		Expect(apiErr.Code).To(Equal(http.StatusUnauthorized))
+
+		Expect(renewals).To(Equal(1))
+		Expect(authorizations).To(Equal([]string{"Bearer token-1"}))
+	})
+})
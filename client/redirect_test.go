@@ -0,0 +1,90 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redirects", func() {
+	var server, other *httptest.Server
+	var otherRequests int
+
+	serveObject := func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"bucket": "some-bucket", "name": %q}`, name)
+	}
+
+	newBlobstore := func(noCrossHostRedirect bool) *GCSBlobstore {
+		return newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+			cfg.NoCrossHostRedirect = noCrossHostRedirect
+		})
+	}
+
+	BeforeEach(func() {
+		otherRequests = 0
+		other = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			otherRequests++
+			serveObject(w, r)
+		}))
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/cross"):
+				http.Redirect(w, r, other.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			case strings.HasSuffix(r.URL.Path, "/same"):
+				http.Redirect(w, r, strings.TrimSuffix(r.URL.Path, "same")+"moved?"+r.URL.RawQuery, http.StatusTemporaryRedirect)
+			default:
+				serveObject(w, r)
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		other.Close()
+	})
+
+	It("follows redirects to another host by default", func() {
+		attrs, err := newBlobstore(false).Stat("cross")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Name).To(Equal("cross"))
+		Expect(otherRequests).To(Equal(1))
+	})
+
+	It("refuses redirects to another host with no_cross_host_redirect", func() {
+		_, err := newBlobstore(true).Stat("cross")
+		Expect(err).To(MatchError(ErrCrossHostRedirect))
+		Expect(otherRequests).To(BeZero())
+	})
+
+	It("still follows redirects on the same host with no_cross_host_redirect", func() {
+		attrs, err := newBlobstore(true).Stat("same")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Name).To(Equal("moved"))
+	})
+})
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Renaming a prefix", func() {
+	var emulator *gcsEmulator
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		blobstore = newEmulatorBlobstore(emulator.Server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+		emulator.put("old/a", "a", map[string]interface{}{"contentType": "text/plain", "metadata": map[string]interface{}{"owner": "ci"}})
+		emulator.put("old/sub/b", "b", nil)
+		emulator.put("other/c", "c", nil)
+	})
+
+	AfterEach(func() {
+		emulator.Close()
+	})
+
+	It("moves every object under the prefix and deletes the originals", func() {
+		result, err := blobstore.RenamePrefix("old/", "new/", BulkOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Err()).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(Equal([]string{"old/a", "old/sub/b"}))
+
+		Expect(emulator.names()).To(Equal([]string{"new/a", "new/sub/b", "other/c"}))
+		Expect(emulator.object("new/a").data).To(Equal([]byte("a")))
+		Expect(emulator.object("new/a").resource["contentType"]).To(Equal("text/plain"))
+		Expect(emulator.object("new/a").resource["metadata"]).To(HaveKeyWithValue("owner", "ci"))
+		Expect(emulator.object("new/sub/b").data).To(Equal([]byte("b")))
+	})
+
+	It("reports an object which failed to copy and keeps it", func() {
+		emulator.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+			if !strings.Contains(r.URL.Path, "/o/old/sub/b/rewriteTo/") {
+				return false
+			}
+			writeError(w, http.StatusBadRequest, "Invalid argument.")
+			return true
+		}
+
+		result, err := blobstore.RenamePrefix("old/", "new/", BulkOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(Equal([]string{"old/a"}))
+		Expect(result.Failed).To(HaveLen(1))
+		Expect(result.Failed["old/sub/b"]).To(MatchError(ContainSubstring("copying to 'new/sub/b'")))
+		Expect(result.Err()).To(MatchError(ContainSubstring("1 of 2 objects failed, e.g. 'old/sub/b'")))
+
+		Expect(emulator.names()).To(Equal([]string{"new/a", "old/sub/b", "other/c"}))
+	})
+
+	It("renames nothing on a dry run", func() {
+		result, err := blobstore.RenamePrefix("old/", "new/", BulkOptions{DryRun: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Succeeded).To(Equal([]string{"old/a", "old/sub/b"}))
+		Expect(emulator.names()).To(Equal([]string{"old/a", "old/sub/b", "other/c"}))
+	})
+})
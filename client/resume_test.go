@@ -0,0 +1,109 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resuming downloads", func() {
+	const content = "0123456789"
+
+	var server *httptest.Server
+	var ranges []string
+	// failedReopens is the number of range requests failed with a 503
+	// before one is served, outlasting the storage library's own reopen.
+	var failedReopens int
+
+	newBlobstore := func(maxAttempts int) *GCSBlobstore {
+		return newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = maxAttempts
+			cfg.RetryBaseDelayMs = 1
+		})
+	}
+
+	BeforeEach(func() {
+		ranges = nil
+		failedReopens = 2
+		crc := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc, crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli)))
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			if strings.Contains(r.URL.Path, "/b/some-bucket/o/") {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"bucket": "some-bucket", "name": "obj", "generation": "7", "size": "%d", "crc32c": %q}`,
+					len(content), base64.StdEncoding.EncodeToString(crc))
+				return
+			}
+			Expect(r.URL.Query().Get("generation")).To(Equal("7"))
+
+			var start int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err != nil {
+				// The first request is cut off half-way.
+				conn, buf, err := w.(http.Hijacker).Hijack()
+				Expect(err).ToNot(HaveOccurred())
+				fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nX-Goog-Generation: 7\r\n\r\n%s", len(content), content[:5])
+				buf.Flush()
+				conn.Close()
+				return
+			}
+			ranges = append(ranges, r.Header.Get("Range"))
+			if failedReopens > 0 {
+				failedReopens--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+			w.Header().Set("X-Goog-Generation", "7")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(content[start:])) //nolint:errcheck
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("resumes a dropped download from the bytes already written", func() {
+		var out bytes.Buffer
+		Expect(newBlobstore(2).Get("obj", &out)).To(Succeed())
+		Expect(out.String()).To(Equal(content))
+		Expect(ranges).To(Equal([]string{"bytes=5-", "bytes=5-", "bytes=5-"}))
+	})
+
+	It("fails once the attempts are used up", func() {
+		var out bytes.Buffer
+		Expect(newBlobstore(1).Get("obj", &out)).ToNot(Succeed())
+		Expect(out.String()).To(Equal(content[:5]))
+		Expect(ranges).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// chunkRetrier bounds the number of retries spent on a single chunk of a
+// resumable upload.
+//
+// The storage library retries every chunk of a resumable session on its own,
+// so a failed chunk never restarts the upload. The retry budget is reset each
+// time the library reports progress, which happens once a chunk is committed.
+type chunkRetrier struct {
+	ctx        context.Context
+	dest       string
+	maxRetries int
+
+	mu       sync.Mutex
+	offset   int64
+	attempts int
+}
+
+func newChunkRetrier(ctx context.Context, dest string, maxRetries int) *chunkRetrier {
+	return &chunkRetrier{ctx: ctx, dest: dest, maxRetries: maxRetries}
+}
+
+// progress records the number of bytes committed so far and resets the retry
+// budget for the next chunk. It is intended to be used as a Writer.ProgressFunc.
+func (r *chunkRetrier) progress(offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.offset = offset
+	r.attempts = 0
+}
+
+// shouldRetry reports whether the chunk which failed with err should be
+// attempted again. It is intended to be used with storage.WithErrorFunc.
+func (r *chunkRetrier) shouldRetry(err error) bool {
+	if !storage.ShouldRetry(err) {
+		return false
+	}
+
+	r.mu.Lock()
+	if r.attempts >= r.maxRetries {
+		r.mu.Unlock()
+		return false
+	}
+	r.attempts++
+	offset, attempt := r.offset, r.attempts
+	r.mu.Unlock()
+
+	if !waitRetryAfter(r.ctx, err) {
+		return false
+	}
+	log.Printf("DEBUG: retrying chunk at offset %d for %s, attempt %d/%d: %v\n",
+		offset, r.dest, attempt, r.maxRetries, err)
+	return true
+}
+
+// maxRetryDelay caps the exponential backoff between retries of a request
+// when retry_base_delay_ms is configured.
+const maxRetryDelay = 32 * time.Second
+
+// requestRetrier bounds the number of retries spent on the requests made
+// through a single object handle, such as a download or a delete.
+//
+// Only errors the storage library considers transient are retried: 429 Too
+// Many Requests, 5xx responses and network errors such as timeouts and
+// connection resets. A 404 or an authorization failure is returned at once.
+// A 429 is retried no sooner than its Retry-After header asks, if it has
+// one.
+type requestRetrier struct {
+	ctx        context.Context
+	object     string
+	maxRetries int
+
+	mu       sync.Mutex
+	attempts int
+}
+
+func newRequestRetrier(ctx context.Context, object string, maxRetries int) *requestRetrier {
+	return &requestRetrier{ctx: ctx, object: object, maxRetries: maxRetries}
+}
+
+// shouldRetry reports whether the request which failed with err should be
+// attempted again. It is intended to be used with storage.WithErrorFunc.
+func (r *requestRetrier) shouldRetry(err error) bool {
+	if !storage.ShouldRetry(err) {
+		return false
+	}
+
+	r.mu.Lock()
+	if r.attempts >= r.maxRetries {
+		r.mu.Unlock()
+		return false
+	}
+	r.attempts++
+	attempt := r.attempts
+	r.mu.Unlock()
+
+	if !waitRetryAfter(r.ctx, err) {
+		return false
+	}
+	log.Printf("DEBUG: retrying request for %s, attempt %d/%d: %v\n",
+		r.object, attempt, r.maxRetries, err)
+	return true
+}
+
+// maxRetryAfter is the longest delay asked for by a Retry-After header which
+// is waited for. A request asked to wait longer fails rather than hanging.
+const maxRetryAfter = 5 * time.Minute
+
+// retryAfter returns the delay the Retry-After header of err, a 429 Too Many
+// Requests from GCS, asks for before the next request, given either in
+// seconds or as an HTTP date, or 0 if err has no such header.
+func retryAfter(err error, now time.Time) time.Duration {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusTooManyRequests {
+		return 0
+	}
+	value := strings.TrimSpace(apiErr.Header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// waitRetryAfter waits for the delay the Retry-After header of err asks for,
+// if any, before the failed request is retried, on top of the backoff the
+// storage library then waits. It reports false, without waiting, if the
+// delay is longer than maxRetryAfter or outlasts the deadline of ctx, set by
+// -timeout, so that the request fails at once rather than being retried too
+// late.
+func waitRetryAfter(ctx context.Context, err error) bool {
+	delay := retryAfter(err, time.Now())
+	if delay <= 0 {
+		return true
+	}
+	if deadline, ok := ctx.Deadline(); delay > maxRetryAfter || ok && time.Until(deadline) < delay {
+		log.Printf("DEBUG: not retrying: GCS asked to wait %s before retrying, longer than allowed\n", delay)
+		return false
+	}
+	log.Printf("DEBUG: waiting %s before retrying, as asked by GCS\n", delay)
+	return gax.Sleep(ctx, delay) == nil
+}
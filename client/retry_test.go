@@ -0,0 +1,161 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+	"google.golang.org/api/googleapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retrying rate limited requests", func() {
+	var server *httptest.Server
+	var retryAfter string
+	var limited int
+	var requests []time.Time
+
+	BeforeEach(func() {
+		limited, requests = 1, nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, time.Now())
+			w.Header().Set("Content-Type", "application/json")
+			if len(requests) <= limited {
+				w.Header().Set("Retry-After", retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprint(w, `{"error": {"code": 429, "message": "rate limited"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"name": "obj", "size": "7"}`)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newBlobstore := func(ctx context.Context) *GCSBlobstore {
+		return newEmulatorBlobstoreWithContext(ctx, server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 3
+			cfg.RetryBaseDelayMs = 1
+		})
+	}
+
+	It("waits as many seconds as Retry-After asks", func() {
+		retryAfter = "1"
+		_, err := newBlobstore(context.Background()).Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[1].Sub(requests[0])).To(BeNumerically(">=", time.Second))
+	})
+
+	It("waits until the HTTP date of Retry-After", func() {
+		retryAfter = time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)
+		_, err := newBlobstore(context.Background()).Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(requests).To(HaveLen(2))
+		// The date has a resolution of a second.
+		Expect(requests[1].Sub(requests[0])).To(BeNumerically(">=", time.Second))
+	})
+
+	It("retries at once without a usable Retry-After", func() {
+		retryAfter = "soon"
+		_, err := newBlobstore(context.Background()).Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[1].Sub(requests[0])).To(BeNumerically("<", time.Second))
+	})
+
+	It("fails rather than waiting beyond the timeout", func() {
+		retryAfter, limited = "60", 10
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		_, err := newBlobstore(ctx).Stat("obj")
+		var apiErr *googleapi.Error
+		Expect(errors.As(err, &apiErr)).To(BeTrue())
+		Expect(apiErr.Code).To(Equal(http.StatusTooManyRequests))
+		// Stat tries without credentials first, then with them: each
+		// request fails at once.
+		Expect(requests).To(HaveLen(2))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+})
+
+var _ = Describe("Retrying failed chunks of a resumable upload", func() {
+	var emulator *gcsEmulator
+	var logs bytes.Buffer
+	var failed int
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		logs.Reset()
+		log.SetOutput(&logs)
+
+		// The second chunk fails once with a 503.
+		failed = 0
+		emulator.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+			if r.URL.Query().Get("upload_id") == "" || !strings.HasPrefix(r.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", config.MinChunkSize)) || failed > 0 {
+				return false
+			}
+			failed++
+			io.Copy(io.Discard, r.Body) //nolint:errcheck
+			writeError(w, http.StatusServiceUnavailable, "backend error")
+			return true
+		}
+	})
+
+	AfterEach(func() {
+		log.SetOutput(os.Stderr)
+		emulator.Close()
+	})
+
+	It("retries only the failed chunk, without using up the retries of the operation", func() {
+		blobstore := newEmulatorBlobstore(emulator.Server, func(cfg *config.GCSCli) {
+			cfg.ChunkSize = config.MinChunkSize
+			cfg.ChunkRetry = 1
+			// No retries are left for the operation as a whole.
+			cfg.MaxAttempts = 1
+			cfg.RetryBaseDelayMs = 1
+		})
+		data := bytes.Repeat([]byte("0123456789abcdef"), 3*config.MinChunkSize/16)
+
+		Expect(blobstore.Put(bytes.NewReader(data), "obj")).To(Succeed())
+		Expect(failed).To(Equal(1))
+		Expect(emulator.object("obj").data).To(Equal(data))
+		Expect(emulator.ops()).To(Equal([]string{"upload obj"}))
+
+		Expect(logs.String()).To(ContainSubstring(fmt.Sprintf("DEBUG: retrying chunk at offset %d for obj, attempt 1/1", config.MinChunkSize)))
+		Expect(logs.String()).ToNot(ContainSubstring("upload failed"))
+		Expect(logs.String()).ToNot(ContainSubstring("retrying request"))
+	})
+})
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+)
+
+// ErrNoEncryptionKey is returned by RotateKey when no encryption_key is
+// configured to re-encrypt the object with.
+var ErrNoEncryptionKey = errors.New("rotating requires an encryption_key to re-encrypt with")
+
+// ErrKeyNotRotated is returned by RotateKey when the object can still be
+// read with the old key or cannot be read with the new one after the
+// rewrite.
+var ErrKeyNotRotated = errors.New("encryption key not rotated")
+
+// RotateKey re-encrypts the object dest, currently encrypted with the
+// Customer-Supplied key oldKey, with the configured encryption_key. The
+// object is rewritten in place server-side, keeping its metadata and
+// storage class, and only if it was not replaced since it was looked up.
+//
+// The rotation is verified by reading the object's attributes with both
+// keys: the new key must be accepted and the old one rejected.
+func (client *GCSBlobstore) RotateKey(dest string, oldKey []byte) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+	if client.config.EncryptionKey == nil {
+		return ErrNoEncryptionKey
+	}
+
+	ctx := client.ctx
+	src := client.getObjectHandle(client.authenticatedGCS, dest).Key(oldKey)
+	attrs, err := src.Attrs(ctx)
+	if err != nil {
+		err = fmt.Errorf("reading '%s' with the old key: %w", dest, wrapNotFound(dest, err))
+	}
+
+	if err == nil {
+		dst := client.getObjectHandle(client.authenticatedGCS, dest).If(storage.Conditions{GenerationMatch: attrs.Generation})
+		copier := dst.CopierFrom(src)
+		copier.ObjectAttrs = copyAttrs(attrs)
+		var rotated *storage.ObjectAttrs
+		if rotated, err = copier.Run(ctx); err != nil {
+			err = fmt.Errorf("rewriting '%s': %w", dest, err)
+		} else if rotated.CRC32C != attrs.CRC32C {
+			err = fmt.Errorf("%w: rewritten '%s' has CRC32C %d, expected %d", ErrKeyNotRotated, dest, rotated.CRC32C, attrs.CRC32C)
+		}
+	}
+
+	if err == nil {
+		if _, statErr := client.getObjectHandle(client.authenticatedGCS, dest).Attrs(ctx); statErr != nil {
+			err = fmt.Errorf("%w: '%s' cannot be read with the new key: %v", ErrKeyNotRotated, dest, statErr)
+		} else if _, statErr := src.Attrs(ctx); statErr == nil {
+			err = fmt.Errorf("%w: '%s' can still be read with the old key", ErrKeyNotRotated, dest)
+		}
+	}
+
+	var size int64
+	if attrs != nil {
+		size = attrs.Size
+	}
+	client.record("rotate-key", dest, "", size, err)
+	return err
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func keySha256(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+var _ = Describe("Rotating encryption keys", func() {
+	const object = `{"bucket": "some-bucket", "name": "blob", "generation": "3", "crc32c": "AAAAAQ=="}`
+
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var currentKey string
+	var rewrites []string
+
+	keyError := func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": {"code": 400, "message": "The provided encryption key is incorrect"}}`)) //nolint:errcheck
+	}
+
+	BeforeEach(func() {
+		currentKey = keySha256(oldKey)
+		rewrites = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodGet:
+				if r.Header.Get("X-Goog-Encryption-Key-Sha256") != currentKey {
+					keyError(w)
+					return
+				}
+				w.Write([]byte(object)) //nolint:errcheck
+			case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/rewriteTo/"):
+				if r.Header.Get("X-Goog-Copy-Source-Encryption-Key-Sha256") != currentKey {
+					keyError(w)
+					return
+				}
+				rewrites = append(rewrites, r.URL.Query().Get("ifGenerationMatch"))
+				currentKey = r.Header.Get("X-Goog-Encryption-Key-Sha256")
+				w.Write([]byte(`{"done": true, "resource": ` + object + `}`)) //nolint:errcheck
+			default:
+				Fail("unexpected request " + r.Method + " " + r.URL.Path)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.SetEncryptionKey(newKey)
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("rewrites the object with the configured key at the current generation", func() {
+		Expect(blobstore.RotateKey("blob", oldKey)).To(Succeed())
+		Expect(rewrites).To(Equal([]string{"3"}))
+		Expect(currentKey).To(Equal(keySha256(newKey)))
+	})
+
+	It("does not rewrite an object the old key does not decrypt", func() {
+		err := blobstore.RotateKey("blob", bytes.Repeat([]byte{3}, 32))
+		Expect(err).To(MatchError(ContainSubstring("with the old key")))
+		Expect(rewrites).To(BeEmpty())
+	})
+
+	It("fails if the object is still readable with the old key", func() {
+		sameKey := newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.SetEncryptionKey(oldKey)
+		})
+
+		err := sameKey.RotateKey("blob", oldKey)
+		Expect(errors.Is(err, ErrKeyNotRotated)).To(BeTrue())
+	})
+})
@@ -18,8 +18,18 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 
 	"google.golang.org/api/option"
@@ -28,27 +38,284 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/cloudfoundry/bosh-gcscli/config"
+	raw "google.golang.org/api/storage/v1"
 )
 
-const uaString = "bosh-gcscli"
+// Version is the version of bosh-gcscli requests identify themselves with
+// in their User-Agent, as bosh-gcscli/<version>. main sets it to its own.
+var Version = "dev"
 
-func newStorageClients(ctx context.Context, cfg *config.GCSCli) (*storage.Client, *storage.Client, error) {
-	publicClient, err := storage.NewClient(ctx, option.WithUserAgent(uaString), option.WithHTTPClient(http.DefaultClient))
-	var authenticatedClient *storage.Client
+// storageClients are the clients a GCSBlobstore sends its requests with.
+// Each storage client has a client of the JSON API created with the same
+// options, for the fields of objects the storage library does not expose.
+type storageClients struct {
+	authenticated, public       *storage.Client
+	authenticatedAPI, publicAPI *raw.Service
+}
+
+// newStorageClient returns a storage client, and a client of the JSON API,
+// created with opts.
+func newStorageClient(ctx context.Context, opts []option.ClientOption) (*storage.Client, *raw.Service, error) {
+	gcs, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	api, err := raw.NewService(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcs, api, nil
+}
+
+// newStorageClients returns the authenticated and public clients, sending
+// requests through transport, or the default transport if nil. The
+// authenticated ones are nil without credentials.
+func newStorageClients(ctx context.Context, cfg *config.GCSCli, transport http.RoundTripper) (*storageClients, error) {
+	publicHTTPClient := newHTTPClient(cfg, transport)
+	if cfg.PrivateAccess != "" {
+		// Access tokens are requested from oauth2.googleapis.com, which
+		// must be reached through the VIP too.
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	}
+	// Skipping credential discovery, as for no_auth_probe below, is implied
+	// by an insecure emulator.
+	if cfg.EmulatorInsecure {
+		log.Printf("WARN: sending requests to %s without TLS or credentials\n", cfg.Endpoint)
+		emulatorClient, emulatorAPI, err := newStorageClient(ctx, clientOptions(cfg, option.WithHTTPClient(publicHTTPClient), option.WithCredentials(&google.Credentials{})))
+		return &storageClients{authenticated: emulatorClient, public: emulatorClient, authenticatedAPI: emulatorAPI, publicAPI: emulatorAPI}, err
+	}
+
+	// Without json_key, the key of a service account may be given by the
+	// environment. It is then used for signing urls, and authenticates
+	// 'static' credentials and, unless read from the file Application
+	// Default Credentials would use anyway, 'default' ones.
+	keyFromEnv := false
+	if cfg.ServiceAccountFile == "" && cfg.CredentialsSource != config.NoneCredentialsSource {
+		key, fromFile, err := config.ServiceAccountFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServiceAccountFile, keyFromEnv = key, key != "" && !fromFile
+	}
+
+	publicOptions := clientOptions(cfg, option.WithHTTPClient(publicHTTPClient))
+	if cfg.NoAuthProbe {
+		// The storage library looks for Application Default Credentials even
+		// when given an HTTP client, probing the metadata server if none are
+		// found locally. Explicitly empty credentials skip that search.
+		publicOptions = append(publicOptions, option.WithCredentials(&google.Credentials{}))
+	} else if cfg.CredentialsSource == config.NoneCredentialsSource {
+		publicOptions = append(publicOptions, option.WithoutAuthentication())
+	}
+	clients := &storageClients{}
+	var err error
+	clients.public, clients.publicAPI, err = newStorageClient(ctx, publicOptions)
 
 	switch cfg.CredentialsSource {
 	case config.NoneCredentialsSource:
 		// no-op
 	case config.DefaultCredentialsSource:
-		if tokenSource, err := google.DefaultTokenSource(ctx, storage.ScopeFullControl); err == nil {
-			authenticatedClient, err = storage.NewClient(ctx, option.WithUserAgent(uaString), option.WithTokenSource(tokenSource)) //nolint:ineffassign,staticcheck
+		newTokenSource := func() (oauth2.TokenSource, error) {
+			if keyFromEnv {
+				creds, err := google.CredentialsFromJSON(ctx, []byte(cfg.ServiceAccountFile), storage.ScopeFullControl)
+				if err != nil {
+					return nil, err
+				}
+				return creds.TokenSource, nil
+			}
+			return google.DefaultTokenSource(ctx, storage.ScopeFullControl)
+		}
+		if tokenSource, err := newTokenSource(); err == nil {
+			clients.authenticated, clients.authenticatedAPI, err = newAuthenticatedClient(ctx, cfg, transport, tokenSource, newTokenSource) //nolint:ineffassign,staticcheck
 		}
 	case config.ServiceAccountFileCredentialsSource:
 		if token, err := google.JWTConfigFromJSON([]byte(cfg.ServiceAccountFile), storage.ScopeFullControl); err == nil {
-			authenticatedClient, err = storage.NewClient(ctx, option.WithUserAgent(uaString), option.WithTokenSource(token.TokenSource(ctx))) //nolint:ineffassign,staticcheck
+			newTokenSource := func() (oauth2.TokenSource, error) {
+				return token.TokenSource(ctx), nil
+			}
+			clients.authenticated, clients.authenticatedAPI, err = newAuthenticatedClient(ctx, cfg, transport, token.TokenSource(ctx), newTokenSource) //nolint:ineffassign,staticcheck
 		}
 	default:
-		return nil, nil, errors.New("unknown credentials_source in configuration")
+		return nil, errors.New("unknown credentials_source in configuration")
+	}
+	return clients, err
+}
+
+// userAgent returns the User-Agent requests identify themselves with,
+// bosh-gcscli/<version> followed by user_agent if configured.
+func userAgent(cfg *config.GCSCli) string {
+	return strings.TrimSpace("bosh-gcscli/" + Version + " " + cfg.UserAgent)
+}
+
+// clientOptions returns the options every storage client is created with,
+// followed by opts.
+func clientOptions(cfg *config.GCSCli, opts ...option.ClientOption) []option.ClientOption {
+	common := []option.ClientOption{option.WithUserAgent(userAgent(cfg))}
+	if cfg.Endpoint != "" {
+		common = append(common, option.WithEndpoint(strings.TrimSuffix(cfg.Endpoint, "/")+"/storage/v1/"))
+	}
+	return append(common, opts...)
+}
+
+// newTransport returns the transport requests to GCS are sent through,
+// or nil if the storage library's default transport should be used, and
+// the request dump file it writes to, if any, which the caller must close.
+//
+// Like the default transport, requests honor the HTTPS_PROXY, HTTP_PROXY
+// and NO_PROXY environment variables unless a proxy is configured.
+// Credentials in the proxy URL are sent to the proxy in a
+// Proxy-Authorization header, including for the CONNECT of https requests.
+func newTransport(cfg *config.GCSCli) (http.RoundTripper, io.Closer, error) {
+	var transport http.RoundTripper
+	var dump io.Closer
+
+	base := http.DefaultTransport
+	if cfg.MaxConnsPerHost > 0 || cfg.MaxIdleConns > 0 || cfg.InsecureSkipTLSVerify || cfg.Proxy != "" || cfg.CACertPath != "" || cfg.PrivateAccess != "" {
+		custom := http.DefaultTransport.(*http.Transport).Clone()
+		if cfg.PrivateAccess != "" {
+			log.Printf("DEBUG: connecting to Google APIs through %s\n", privateAccessVIPs[cfg.PrivateAccess][0])
+			custom.DialContext = dialPrivateAccess(cfg.PrivateAccess, custom.DialContext)
+		}
+		if cfg.Proxy != "" {
+			proxy, err := url.Parse(cfg.Proxy)
+			if err != nil {
+				return nil, nil, errors.New("parsing proxy url: malformed url")
+			}
+			log.Printf("DEBUG: sending requests through proxy %s\n", proxy.Redacted())
+			custom.Proxy = http.ProxyURL(proxy)
+		}
+		if cfg.MaxConnsPerHost > 0 {
+			custom.MaxConnsPerHost = cfg.MaxConnsPerHost
+			custom.MaxIdleConnsPerHost = cfg.MaxConnsPerHost
+		}
+		if cfg.MaxIdleConns > 0 {
+			// Every request goes to the one GCS host.
+			custom.MaxIdleConns = cfg.MaxIdleConns
+			custom.MaxIdleConnsPerHost = cfg.MaxIdleConns
+		}
+		if cfg.CACertPath != "" || cfg.InsecureSkipTLSVerify {
+			custom.TLSClientConfig = &tls.Config{}
+		}
+		if cfg.CACertPath != "" {
+			roots, err := loadCACerts(cfg.CACertPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			custom.TLSClientConfig.RootCAs = roots
+		}
+		if cfg.InsecureSkipTLSVerify {
+			log.Printf("WARN: not verifying the TLS certificate of %s\n", cfg.Endpoint)
+			custom.TLSClientConfig.InsecureSkipVerify = true //nolint:gosec
+		}
+		base, transport = custom, custom
+	}
+
+	if cfg.DumpRequestPath != "" {
+		out, err := os.OpenFile(cfg.DumpRequestPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening request dump file: %v", err)
+		}
+		dump = out
+		transport = &dumpTransport{base: base, out: out}
+	}
+
+	if cfg.DebugHTTP {
+		if transport != nil {
+			base = transport
+		}
+		transport = &traceTransport{base: base, out: os.Stderr}
+	}
+
+	if cfg.RequestTimeoutSeconds > 0 {
+		if transport != nil {
+			base = transport
+		}
+		// Timed out requests are recorded by the dump transport too.
+		transport = &timeoutTransport{timeout: time.Duration(cfg.RequestTimeoutSeconds) * time.Second, base: base}
+	}
+
+	return transport, dump, nil
+}
+
+// loadCACerts returns the system's certificate pool with the PEM
+// certificates in the file at path added to it.
+func loadCACerts(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading ca_cert: %v", err)
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("ca_cert '%s' does not contain any PEM certificates", path)
+	}
+	return roots, nil
+}
+
+// newAuthenticatedClient returns a storage client, and a client of the JSON
+// API, authenticating with tokenSource and sending requests through
+// transport, if non-nil.
+//
+// If reauth_on_401 is configured, newTokenSource is used to obtain a new
+// token whenever a request is rejected as unauthorized, e.g. because a
+// long-running operation outlived its access token.
+func newAuthenticatedClient(ctx context.Context, cfg *config.GCSCli, transport http.RoundTripper, tokenSource oauth2.TokenSource, newTokenSource func() (oauth2.TokenSource, error)) (*storage.Client, *raw.Service, error) {
+	if transport == nil && !cfg.ReauthOn401 && !cfg.NoCrossHostRedirect {
+		return newStorageClient(ctx, clientOptions(cfg, option.WithTokenSource(tokenSource)))
+	}
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if cfg.ReauthOn401 {
+		transport = &reauthTransport{
+			source: &refreshableTokenSource{current: tokenSource, renew: newTokenSource},
+			base:   transport,
+		}
+	} else {
+		transport = &oauth2.Transport{Source: tokenSource, Base: transport}
+	}
+	return newStorageClient(ctx, clientOptions(cfg, option.WithHTTPClient(newHTTPClient(cfg, transport))))
+}
+
+// newHTTPClient returns the http client requests are sent with through
+// transport, or the default transport if nil.
+//
+// The storage library only sets the User-Agent of clientOptions on requests
+// through a transport of its own, so the client appends it itself.
+func newHTTPClient(cfg *config.GCSCli, transport http.RoundTripper) *http.Client {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	httpClient := &http.Client{Transport: &userAgentTransport{userAgent: userAgent(cfg), base: transport}}
+	if cfg.NoCrossHostRedirect {
+		httpClient.CheckRedirect = refuseCrossHostRedirect
+	}
+	return httpClient
+}
+
+// ErrCrossHostRedirect is returned when no_cross_host_redirect is
+// configured and a response redirects to another host.
+var ErrCrossHostRedirect = errors.New("refusing to follow a redirect to another host")
+
+// maxRedirects is the number of redirects the Go http client follows by
+// default, which refuseCrossHostRedirect keeps.
+const maxRedirects = 10
+
+// refuseCrossHostRedirect is an http.Client CheckRedirect which refuses to
+// follow req, a redirect of the requests via, to another host or from
+// https to http. Following it would send the other host the query of the
+// original request, which for a signed url grants access to the object.
+func refuseCrossHostRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	original := via[0].URL
+	if req.URL.Host != original.Host || (original.Scheme == "https" && req.URL.Scheme != "https") {
+		return fmt.Errorf("%w: %s://%s redirected to %s://%s", ErrCrossHostRedirect, original.Scheme, original.Host, req.URL.Scheme, req.URL.Host)
 	}
-	return authenticatedClient, publicClient, err
+	return nil
 }
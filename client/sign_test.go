@@ -0,0 +1,404 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signed headers", func() {
+	It("returns the header in canonical form", func() {
+		header, err := ParseSignHeader("X-Goog-Meta-Owner: ci pipeline ")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(header).To(Equal("x-goog-meta-owner: ci pipeline"))
+	})
+
+	It("rejects malformed headers", func() {
+		for _, spec := range []string{"x-goog-meta-owner", ":value", "bad name:value", "x-goog-meta-owner:a\nb"} {
+			_, err := ParseSignHeader(spec)
+			Expect(err).To(HaveOccurred(), spec)
+		}
+	})
+
+	It("rejects headers set by the client", func() {
+		_, err := ParseSignHeader("Host:example.com")
+		Expect(err).To(MatchError(ContainSubstring("set by the client")))
+	})
+})
+
+var _ = Describe("Signed urls", func() {
+	newServiceAccount := func() string {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		serviceAccount, err := json.Marshal(map[string]string{
+			"type":         "service_account",
+			"client_email": "signer@example.iam.gserviceaccount.com",
+			"private_key":  string(pemKey),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return string(serviceAccount)
+	}
+
+	newSigningClientWithPrefix := func(version, prefix string) *GCSBlobstore {
+		blobstore, err := New(context.Background(), &config.GCSCli{
+			BucketName:         "some-bucket",
+			CredentialsSource:  config.NoneCredentialsSource,
+			ServiceAccountFile: newServiceAccount(),
+			SigningVersion:     version,
+			Prefix:             prefix,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return blobstore
+	}
+	newSigningClient := func(version string) *GCSBlobstore {
+		return newSigningClientWithPrefix(version, "")
+	}
+
+	It("signs the object under the configured prefix", func() {
+		signed, err := newSigningClientWithPrefix(config.SigningVersionV4, "staging/").Sign("/blob", "GET", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+
+		u, err := url.Parse(signed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(u.Path).To(Equal("/some-bucket/staging/blob"))
+	})
+
+	It("only validates the object name with sign_s3_safe_names", func() {
+		blobstore, err := New(context.Background(), &config.GCSCli{
+			BucketName:         "some-bucket",
+			CredentialsSource:  config.NoneCredentialsSource,
+			ServiceAccountFile: newServiceAccount(),
+			SigningHost:        "downloads.example.com",
+			SignS3SafeNames:    true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = blobstore.Sign("a//blob", "GET", time.Hour)
+		Expect(err).To(MatchError(ContainSubstring("empty path segment")))
+
+		signed, err := blobstore.Sign("a/blob", "GET", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		u, err := url.Parse(signed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(u.Host).To(Equal("downloads.example.com"))
+		Expect(u.Path).To(Equal("/a/blob"))
+	})
+
+	It("signs path-style urls on storage.googleapis.com with sign_s3_compat", func() {
+		blobstore, err := New(context.Background(), &config.GCSCli{
+			BucketName:         "some-bucket",
+			CredentialsSource:  config.NoneCredentialsSource,
+			ServiceAccountFile: newServiceAccount(),
+			SignS3Compat:       true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = blobstore.Sign("a//blob", "GET", time.Hour)
+		Expect(err).To(MatchError(ContainSubstring("empty path segment")))
+
+		signed, err := blobstore.Sign("a/blob", "GET", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		u, err := url.Parse(signed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(u.Host).To(Equal("storage.googleapis.com"))
+		Expect(u.Path).To(Equal("/some-bucket/a/blob"))
+	})
+
+	It("includes a required content type in the signed headers", func() {
+		signed, err := newSigningClient(config.SigningVersionV4).Sign("blob", "PUT", time.Hour, "content-type: application/gzip")
+		Expect(err).ToNot(HaveOccurred())
+
+		u, err := url.Parse(signed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(u.Query().Get("X-Goog-SignedHeaders")).To(Equal("content-type;host"))
+	})
+
+	It("rejects V4 urls valid for more than 7 days", func() {
+		_, err := newSigningClient(config.SigningVersionV4).Sign("blob", "GET", MaxV4Expiry+time.Hour)
+		Expect(err).To(MatchError(ErrExpiryTooLong))
+		Expect(err).To(MatchError(ContainSubstring("at most 168h")))
+	})
+
+	It("signs V4 urls valid for exactly 7 days but not a second longer", func() {
+		blobstore := newSigningClient(config.SigningVersionV4)
+		_, err := blobstore.Sign("blob", "GET", MaxV4Expiry)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = blobstore.SignAt("blob", "GET", time.Now().Add(MaxV4Expiry))
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = blobstore.Sign("blob", "GET", MaxV4Expiry+time.Second)
+		Expect(err).To(MatchError(ErrExpiryTooLong))
+		_, err = blobstore.SignAt("blob", "GET", time.Now().Add(MaxV4Expiry+time.Second))
+		Expect(err).To(MatchError(ErrExpiryTooLong))
+	})
+
+	It("rejects urls which have already expired", func() {
+		for _, version := range []string{config.SigningVersionV4, config.SigningVersionV2} {
+			blobstore := newSigningClient(version)
+			_, err := blobstore.Sign("blob", "GET", 0)
+			Expect(err).To(MatchError(ErrExpiryNotInFuture), version)
+			_, err = blobstore.Sign("blob", "GET", -time.Hour)
+			Expect(err).To(MatchError(ErrExpiryNotInFuture), version)
+			_, err = blobstore.SignAt("blob", "GET", time.Now().Add(-time.Minute))
+			Expect(err).To(MatchError(ErrExpiryNotInFuture), version)
+		}
+	})
+
+	It("signs V2 urls valid for more than 7 days", func() {
+		signed, err := newSigningClient(config.SigningVersionV2).Sign("blob", "GET", MaxV4Expiry+time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+
+		u, err := url.Parse(signed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(u.Query().Get("GoogleAccessId")).To(Equal("signer@example.iam.gserviceaccount.com"))
+	})
+
+	It("signs offline with the private key of json_key, sending no request", func() {
+		requests := 0
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer proxy.Close()
+
+		blobstore, err := New(context.Background(), &config.GCSCli{
+			BucketName:         "some-bucket",
+			CredentialsSource:  config.ServiceAccountFileCredentialsSource,
+			ServiceAccountFile: newServiceAccount(),
+			Proxy:              proxy.URL,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		signed, err := blobstore.Sign("blob", "GET", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signed).To(ContainSubstring("X-Goog-Credential=signer%40example.iam.gserviceaccount.com"))
+		Expect(requests).To(BeZero())
+	})
+
+	It("fails clearly without a private key or credentials to sign with", func() {
+		newClient := func(serviceAccountFile string) *GCSBlobstore {
+			blobstore, err := New(context.Background(), &config.GCSCli{
+				BucketName:         "some-bucket",
+				CredentialsSource:  config.NoneCredentialsSource,
+				ServiceAccountFile: serviceAccountFile,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return blobstore
+		}
+
+		_, err := newClient("").Sign("blob", "GET", time.Hour)
+		Expect(errors.Is(err, ErrNoSigner)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("no json_key, and there are no default credentials to sign with the IAM Credentials API")))
+
+		_, err = newClient(`{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`).Sign("blob", "GET", time.Hour)
+		Expect(errors.Is(err, ErrNoSigner)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("json_key is not a service account key")))
+	})
+})
+
+var _ = Describe("Requests through signed urls", func() {
+	var key *rsa.PrivateKey
+	var server *httptest.Server
+	var objects map[string]string
+	var encryptionKey []byte
+
+	// validSignature reports whether r carries a V4 signature of the
+	// request it is, made with key, as GCS checks it: over the method,
+	// path, query and the values of the signed headers r was sent with.
+	validSignature := func(r *http.Request) bool {
+		query := r.URL.Query()
+		signature, err := hex.DecodeString(query.Get("X-Goog-Signature"))
+		if err != nil {
+			return false
+		}
+		query.Del("X-Goog-Signature")
+
+		signedHeaders := query.Get("X-Goog-SignedHeaders")
+		var headers []string
+		for _, name := range strings.Split(signedHeaders, ";") {
+			value := r.Header.Get(name)
+			if name == "host" {
+				// The storage library signs the host without its port,
+				// which GCS hosts do not have.
+				value, _, _ = strings.Cut(r.Host, ":")
+			}
+			headers = append(headers, name+":"+strings.Join(strings.Fields(value), " "))
+		}
+		canonical := strings.Join([]string{
+			r.Method,
+			r.URL.EscapedPath(),
+			strings.ReplaceAll(query.Encode(), "+", "%20"),
+			strings.Join(headers, "\n") + "\n",
+			signedHeaders,
+			"UNSIGNED-PAYLOAD",
+		}, "\n")
+		canonicalSum := sha256.Sum256([]byte(canonical))
+
+		_, scope, _ := strings.Cut(query.Get("X-Goog-Credential"), "/")
+		stringToSign := "GOOG4-RSA-SHA256\n" + query.Get("X-Goog-Date") + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+		sum := sha256.Sum256([]byte(stringToSign))
+		return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], signature) == nil
+	}
+
+	newSigningClient := func() *GCSBlobstore {
+		pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		serviceAccount, err := json.Marshal(map[string]string{
+			"type":         "service_account",
+			"client_email": "signer@example.iam.gserviceaccount.com",
+			"private_key":  string(pemKey),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		return newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.ServiceAccountFile = string(serviceAccount)
+			if encryptionKey != nil {
+				cfg.SetEncryptionKey(encryptionKey)
+			}
+		})
+	}
+
+	// send makes a request through the url signed for action on blob,
+	// with the headers it requires unless withoutHeaders is set.
+	send := func(blobstore *GCSBlobstore, method, action, blob, body string, withoutHeaders bool) *http.Response {
+		signed, err := blobstore.Sign(blob, action, time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+
+		req, err := http.NewRequest(method, signed, strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		if !withoutHeaders {
+			for _, header := range blobstore.SignHeaders(action) {
+				name, value, _ := strings.Cut(header, ": ")
+				req.Header.Set(name, value)
+			}
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		return resp
+	}
+
+	BeforeEach(func() {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		objects = map[string]string{}
+		encryptionKey = nil
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			if !validSignature(r) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			data, ok := objects[r.URL.Path]
+			switch r.Method {
+			case http.MethodPut:
+				body, err := io.ReadAll(r.Body)
+				Expect(err).ToNot(HaveOccurred())
+				objects[r.URL.Path] = string(body)
+			case http.MethodGet, http.MethodHead:
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Write([]byte(data)) //nolint:errcheck
+			case http.MethodDelete:
+				delete(objects, r.URL.Path)
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("uploads, downloads, checks and deletes an object", func() {
+		blobstore := newSigningClient()
+
+		Expect(send(blobstore, "PUT", "PUT", "blob", "content", false).StatusCode).To(Equal(http.StatusOK))
+
+		resp := send(blobstore, "GET", "GET", "blob", "", false)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(Equal("content"))
+
+		resp = send(blobstore, "HEAD", "HEAD", "blob", "", false)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.ContentLength).To(Equal(int64(len("content"))))
+
+		Expect(send(blobstore, "DELETE", "DELETE", "blob", "", false).StatusCode).To(Equal(http.StatusNoContent))
+		Expect(send(blobstore, "HEAD", "HEAD", "blob", "", false).StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("is rejected for another method than it was signed for", func() {
+		blobstore := newSigningClient()
+		Expect(send(blobstore, "PUT", "GET", "blob", "content", false).StatusCode).To(Equal(http.StatusForbidden))
+		Expect(send(blobstore, "GET", "HEAD", "blob", "", false).StatusCode).To(Equal(http.StatusForbidden))
+	})
+
+	Describe("with an encryption key", func() {
+		BeforeEach(func() {
+			encryptionKey = []byte("01234567890123456789012345678901")
+		})
+
+		It("signs the headers giving the key, which must be sent", func() {
+			blobstore := newSigningClient()
+			signed, err := blobstore.Sign("blob", "PUT", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			u, err := url.Parse(signed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(u.Query().Get("X-Goog-SignedHeaders")).To(Equal("host;x-goog-encryption-algorithm;x-goog-encryption-key;x-goog-encryption-key-sha256"))
+
+			Expect(send(blobstore, "PUT", "PUT", "blob", "content", true).StatusCode).To(Equal(http.StatusForbidden))
+			Expect(send(blobstore, "PUT", "PUT", "blob", "content", false).StatusCode).To(Equal(http.StatusOK))
+			Expect(send(blobstore, "GET", "GET", "blob", "", true).StatusCode).To(Equal(http.StatusForbidden))
+			Expect(send(blobstore, "GET", "GET", "blob", "", false).StatusCode).To(Equal(http.StatusOK))
+			Expect(send(blobstore, "HEAD", "HEAD", "blob", "", false).StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("does not require the key to delete", func() {
+			blobstore := newSigningClient()
+			Expect(blobstore.SignHeaders("DELETE")).To(BeEmpty())
+			Expect(send(blobstore, "DELETE", "DELETE", "blob", "", true).StatusCode).To(Equal(http.StatusNoContent))
+		})
+	})
+})
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+	"github.com/googleapis/gax-go/v2"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+// ErrNoSigner is returned by Sign when there is neither a private key to
+// sign urls with offline nor credentials to sign them with through the IAM
+// Credentials API.
+var ErrNoSigner = errors.New("cannot sign urls")
+
+// signWith sets the GoogleAccessID options are signed as, and the private
+// key or sign function they are signed with.
+//
+// The private key of json_key, or of a service account key given by the
+// environment, signs urls offline, without any request, e.g. in air-gapped
+// environments. Only without one are urls signed through the IAM
+// Credentials API, as the configured signing_account or the service account
+// of the VM, which the credentials must be allowed to sign as.
+func (client *GCSBlobstore) signWith(options *storage.SignedURLOptions) error {
+	noKey := errors.New("no json_key")
+	if client.config.ServiceAccountFile != "" {
+		token, err := google.JWTConfigFromJSON([]byte(client.config.ServiceAccountFile), storage.ScopeFullControl)
+		if err == nil && len(token.PrivateKey) > 0 {
+			options.GoogleAccessID = token.Email
+			options.PrivateKey = token.PrivateKey
+			return nil
+		}
+		noKey = errors.New("json_key holds no service account private key")
+		if err != nil {
+			noKey = fmt.Errorf("json_key is not a service account key: %v", err)
+		}
+	}
+
+	if client.readOnly() || client.config.EmulatorInsecure || client.config.CredentialsSource != config.DefaultCredentialsSource {
+		return fmt.Errorf("%w: %v, and there are no default credentials to sign with the IAM Credentials API", ErrNoSigner, noKey)
+	}
+	account, err := client.signingAccount()
+	if err != nil {
+		return fmt.Errorf("%w: %v, and %v", ErrNoSigner, noKey, err)
+	}
+	log.Printf("DEBUG: signing as %s through the IAM Credentials API: %v\n", account, noKey)
+	options.GoogleAccessID = account
+	options.SignBytes = client.iamSignBytes(account)
+	return nil
+}
+
+// signingAccount returns the service account urls are signed as through the
+// IAM Credentials API: signing_account, or else the default service account
+// of the VM when running on GCE.
+func (client *GCSBlobstore) signingAccount() (string, error) {
+	if client.config.SigningAccount != "" {
+		return client.config.SigningAccount, nil
+	}
+	if !metadata.OnGCE() {
+		return "", errors.New("not on GCE; set signing_account to the service account to sign as")
+	}
+	account, err := metadata.Email("default")
+	if err != nil {
+		return "", fmt.Errorf("looking up the service account of the VM: %v", err)
+	}
+	return account, nil
+}
+
+// iamSignBytes returns a function signing its input as account through the
+// IAM Credentials API, as SignedURLOptions.SignBytes. Transient failures
+// are retried as requests to GCS are.
+func (client *GCSBlobstore) iamSignBytes(account string) func([]byte) ([]byte, error) {
+	return func(payload []byte) ([]byte, error) {
+		service, err := client.iamService()
+		if err != nil {
+			return nil, fmt.Errorf("%w: creating IAM Credentials client: %v", ErrNoSigner, err)
+		}
+
+		maxRetries := math.MaxInt32
+		if client.config.MaxAttempts > 0 {
+			maxRetries = client.config.MaxAttempts - 1
+		}
+		retrier := newRequestRetrier(client.ctx, "the signature of a url", maxRetries)
+		backoff := gax.Backoff{Initial: time.Second, Max: maxRetryDelay, Multiplier: 2}
+		if client.config.RetryBaseDelayMs > 0 {
+			backoff.Initial = time.Duration(client.config.RetryBaseDelayMs) * time.Millisecond
+		}
+
+		name := "projects/-/serviceAccounts/" + account
+		request := &iamcredentials.SignBlobRequest{Payload: base64.StdEncoding.EncodeToString(payload)}
+		for {
+			resp, err := service.Projects.ServiceAccounts.SignBlob(name, request).Context(client.ctx).Do()
+			if err == nil {
+				return base64.StdEncoding.DecodeString(resp.SignedBlob)
+			}
+			if !retrier.shouldRetry(err) {
+				return nil, fmt.Errorf("signing as %s through the IAM Credentials API: %w", account, err)
+			}
+			if err := gax.Sleep(client.ctx, backoff.Pause()); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// iamService returns the client of the IAM Credentials API, creating it on
+// the first call, so signing many urls authenticates once.
+func (client *GCSBlobstore) iamService() (*iamcredentials.Service, error) {
+	client.iamOnce.Do(func() {
+		client.iam, client.iamErr = client.newIAMService()
+	})
+	return client.iam, client.iamErr
+}
+
+// newIAMService returns a client of the IAM Credentials API authenticated
+// by the default credentials, sending requests through the same transport
+// as requests to GCS, e.g. a proxy or Private Google Access.
+func (client *GCSBlobstore) newIAMService() (*iamcredentials.Service, error) {
+	transport := client.transport
+	ctx := client.ctx
+	if transport == nil {
+		transport = http.DefaultTransport
+	} else {
+		// Access tokens are requested through the transport too.
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	}
+	// The token for GCS is scoped to storage only, which signing is not.
+	tokenSource, err := google.DefaultTokenSource(ctx, iamcredentials.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := newHTTPClient(client.config, &oauth2.Transport{Source: tokenSource, Base: transport})
+	return iamcredentials.NewService(ctx, option.WithHTTPClient(httpClient))
+}
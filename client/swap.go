@@ -0,0 +1,156 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrConcurrentUpdate is returned by PutAtomic when the destination object
+// was written by someone else while the upload was in progress.
+var ErrConcurrentUpdate = errors.New("object was updated concurrently")
+
+// PutAtomic uploads src to a temporary object next to dest, verifies its
+// CRC32C and then copies it over dest server-side, so that readers of dest
+// only ever see the previous or the complete new content. The temporary
+// object is deleted afterwards.
+//
+// The copy is conditional on dest still being the generation seen before
+// the upload started, or still not existing. If it was written in the
+// meantime, ErrConcurrentUpdate is returned and dest is left untouched.
+//
+// The generation of the new dest is returned.
+func (client *GCSBlobstore) PutAtomic(src io.Reader, dest string, opts PutOptions) (int64, error) {
+	if client.readOnly() {
+		return 0, ErrInvalidROWriteOperation
+	}
+
+	if err := client.validateRemoteConfig(); err != nil {
+		return 0, err
+	}
+
+	attrs, err := client.putAtomic(src, dest, opts)
+	if err != nil {
+		client.record("put-atomic", dest, "", 0, err)
+		return 0, err
+	}
+	client.record("put-atomic", dest, "", attrs.Size, nil)
+	return attrs.Generation, nil
+}
+
+func (client *GCSBlobstore) putAtomic(src io.Reader, dest string, opts PutOptions) (*storage.ObjectAttrs, error) {
+	ctx := client.ctx
+
+	cond := storage.Conditions{DoesNotExist: true}
+	current, err := client.Stat(dest)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return nil, err
+	}
+	if current != nil {
+		cond = storage.Conditions{GenerationMatch: current.Generation}
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	temp := fmt.Sprintf("%s.tmp-%s", dest, hex.EncodeToString(suffix))
+
+	uploaded, err := client.putVerified(src, temp, opts, &storage.Conditions{DoesNotExist: true})
+	if err != nil {
+		return nil, fmt.Errorf("uploading to '%s': %w", temp, err)
+	}
+	defer func() {
+		if err := client.deleteCopied(ctx, uploaded); err != nil {
+			log.Printf("WARN: %v\n", err)
+		}
+	}()
+
+	copied, err := client.copyVerified(ctx, uploaded, client.getObjectHandle(client.authenticatedGCS, dest).If(cond))
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return nil, fmt.Errorf("%w: '%s' changed during the upload", ErrConcurrentUpdate, dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// PutVerified uploads src to dest like PutWithOptions, computing the CRC32C of the
+// bytes read from src as they are streamed. Once the upload completes, the
+// CRC32C GCS computed is compared with it and, if they differ, the new
+// object is deleted and an error is returned.
+//
+// GCS can only validate an upload itself if given its checksum before the
+// upload starts, which is not possible for a stream. The object is
+// therefore briefly visible before a mismatch is detected.
+func (client *GCSBlobstore) PutVerified(src io.Reader, dest string, opts PutOptions) error {
+	if client.readOnly() {
+		return ErrInvalidROWriteOperation
+	}
+
+	if err := client.validateRemoteConfig(); err != nil {
+		return err
+	}
+
+	attrs, err := client.putVerified(src, dest, opts, nil)
+	if err != nil {
+		client.record("put", dest, "", 0, err)
+		return err
+	}
+	client.record("put", dest, "", attrs.Size, nil)
+	return nil
+}
+
+// putVerified uploads src to dest under conds, if non-nil, and returns the
+// attributes of the new object, or an error unless its CRC32C matches the
+// bytes read from src.
+func (client *GCSBlobstore) putVerified(src io.Reader, dest string, opts PutOptions, conds *storage.Conditions) (*storage.ObjectAttrs, error) {
+	remoteWriter := client.newWriter(dest, conds)
+	client.sendSingleShot(remoteWriter, src)
+	opts.apply(&remoteWriter.ObjectAttrs)
+
+	hash := crc32.New(crc32cTable)
+	if _, err := client.copyData(io.MultiWriter(remoteWriter, hash), src); err != nil {
+		remoteWriter.CloseWithError(err) //nolint:errcheck,staticcheck
+		return nil, err
+	}
+	if err := remoteWriter.Close(); err != nil {
+		return nil, md5Rejected(dest, opts, err)
+	}
+
+	attrs := client.trimPrefix(remoteWriter.Attrs())
+	if attrs.CRC32C != hash.Sum32() {
+		mismatched := client.getObjectHandle(client.authenticatedGCS, dest).If(storage.Conditions{GenerationMatch: attrs.Generation})
+		if err := mismatched.Delete(client.ctx); err != nil {
+			log.Printf("WARN: deleting '%s' after CRC32C mismatch: %v\n", dest, err)
+		}
+		return nil, fmt.Errorf("uploaded CRC32C %d does not match local CRC32C %d", attrs.CRC32C, hash.Sum32())
+	}
+	return attrs, nil
+}
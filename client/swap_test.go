@@ -0,0 +1,223 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Atomic uploads", func() {
+	type object struct {
+		data       string
+		generation int64
+	}
+
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var objects map[string]object
+	var generation int64
+	var deleted []string
+	// onUpload is called with the name of each object uploaded, before it
+	// is stored.
+	var onUpload func(name string)
+
+	write := func(name, data string) object {
+		generation++
+		objects[name] = object{data: data, generation: generation}
+		return objects[name]
+	}
+
+	resource := func(name string, obj object) string {
+		crc := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc, crc32.Checksum([]byte(obj.data), crc32.MakeTable(crc32.Castagnoli)))
+		return fmt.Sprintf(`{"bucket": "some-bucket", "name": %q, "generation": "%d", "size": "%d", "crc32c": %q}`,
+			name, obj.generation, len(obj.data), base64.StdEncoding.EncodeToString(crc))
+	}
+
+	// preconditionFailed reports whether the ifGenerationMatch of r does
+	// not match the generation of name, 0 if it does not exist.
+	preconditionFailed := func(r *http.Request, name string) bool {
+		match := r.URL.Query().Get("ifGenerationMatch")
+		return match != "" && match != strconv.FormatInt(objects[name].generation, 10)
+	}
+
+	BeforeEach(func() {
+		objects, generation, deleted, onUpload = map[string]object{}, 0, nil, func(string) {}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			const objectsPath = "/storage/v1/b/some-bucket/o/"
+			switch {
+			case r.URL.Path == "/storage/v1/b/some-bucket":
+				w.Write([]byte(`{"name": "some-bucket"}`)) //nolint:errcheck
+			case r.URL.Path == "/upload/storage/v1/b/some-bucket/o":
+				_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+				Expect(err).ToNot(HaveOccurred())
+				parts := multipart.NewReader(r.Body, params["boundary"])
+				part, err := parts.NextPart()
+				Expect(err).ToNot(HaveOccurred())
+				var attrs struct{ Name string }
+				Expect(json.NewDecoder(part).Decode(&attrs)).To(Succeed())
+				part, err = parts.NextPart()
+				Expect(err).ToNot(HaveOccurred())
+				data, err := io.ReadAll(part)
+				Expect(err).ToNot(HaveOccurred())
+
+				onUpload(attrs.Name)
+				if preconditionFailed(r, attrs.Name) {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+				w.Write([]byte(resource(attrs.Name, write(attrs.Name, string(data))))) //nolint:errcheck
+			case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/rewriteTo/"):
+				src, dst, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, objectsPath), "/rewriteTo/b/some-bucket/o/")
+				if preconditionFailed(r, dst) {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					w.Write([]byte(`{"error": {"code": 412, "message": "Precondition Failed"}}`)) //nolint:errcheck
+					return
+				}
+				fmt.Fprintf(w, `{"done": true, "resource": %s}`, resource(dst, write(dst, objects[src].data)))
+			case r.Method == http.MethodGet || r.Method == http.MethodDelete:
+				name := strings.TrimPrefix(r.URL.Path, objectsPath)
+				obj, ok := objects[name]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte(`{"error": {"code": 404, "message": "Not Found"}}`)) //nolint:errcheck
+					return
+				}
+				if r.Method == http.MethodGet {
+					w.Write([]byte(resource(name, obj))) //nolint:errcheck
+					return
+				}
+				Expect(preconditionFailed(r, name)).To(BeFalse())
+				delete(objects, name)
+				deleted = append(deleted, name)
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				Fail("unexpected request " + r.Method + " " + r.URL.Path)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("replaces the object and returns its new generation", func() {
+		write("obj", "old")
+
+		newGeneration, err := blobstore.PutAtomic(strings.NewReader("new"), "obj", PutOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects["obj"]).To(Equal(object{data: "new", generation: newGeneration}))
+		Expect(newGeneration).To(Equal(generation))
+	})
+
+	It("creates an object which does not exist", func() {
+		newGeneration, err := blobstore.PutAtomic(strings.NewReader("new"), "obj", PutOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects["obj"]).To(Equal(object{data: "new", generation: newGeneration}))
+	})
+
+	It("leaves the object untouched when it was written during the upload", func() {
+		write("obj", "old")
+		var theirs object
+		onUpload = func(name string) {
+			if strings.HasPrefix(name, "obj.tmp-") {
+				theirs = write("obj", "theirs")
+			}
+		}
+
+		_, err := blobstore.PutAtomic(strings.NewReader("new"), "obj", PutOptions{})
+		Expect(errors.Is(err, ErrConcurrentUpdate)).To(BeTrue())
+		Expect(objects["obj"]).To(Equal(theirs))
+	})
+
+	It("deletes the temporary object whether or not the swap succeeded", func() {
+		_, err := blobstore.PutAtomic(strings.NewReader("new"), "obj", PutOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(deleted).To(HaveLen(1))
+		Expect(deleted[0]).To(HavePrefix("obj.tmp-"))
+
+		deleted = nil
+		onUpload = func(name string) {
+			if strings.HasPrefix(name, "obj.tmp-") {
+				write("obj", "theirs")
+			}
+		}
+		_, err = blobstore.PutAtomic(strings.NewReader("newer"), "obj", PutOptions{})
+		Expect(errors.Is(err, ErrConcurrentUpdate)).To(BeTrue())
+		Expect(deleted).To(HaveLen(1))
+		Expect(deleted[0]).To(HavePrefix("obj.tmp-"))
+
+		Expect(objects).To(HaveLen(1))
+		Expect(objects).To(HaveKey("obj"))
+	})
+})
+
+var _ = Describe("Verified uploads", func() {
+	var emulator *gcsEmulator
+	var blobstore *GCSBlobstore
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		blobstore = newEmulatorBlobstore(emulator.Server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+	})
+
+	AfterEach(func() {
+		emulator.Close()
+	})
+
+	It("uploads a stream whose CRC32C GCS confirms", func() {
+		Expect(blobstore.PutVerified(io.MultiReader(strings.NewReader("content")), "obj", PutOptions{})).To(Succeed())
+		Expect(string(emulator.object("obj").data)).To(Equal("content"))
+		Expect(emulator.ops()).To(Equal([]string{"upload obj"}))
+	})
+
+	It("deletes the object and fails when GCS computed another CRC32C", func() {
+		emulator.rewriteUploads(func(resource map[string]interface{}) {
+			resource["crc32c"] = emulatedCRC32C([]byte("corrupt"))
+		})
+
+		err := blobstore.PutVerified(io.MultiReader(strings.NewReader("content")), "obj", PutOptions{})
+		Expect(err).To(MatchError(ContainSubstring("does not match local CRC32C")))
+		Expect(emulator.names()).To(BeEmpty())
+		Expect(emulator.ops()).To(Equal([]string{"upload obj", "delete obj"}))
+	})
+})
@@ -0,0 +1,607 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// SyncResult summarises a SyncDirectory.
+type SyncResult struct {
+	// Uploads summarises the upload of the local files, by the names of
+	// their objects. Files whose object already has the same CRC32C are
+	// listed in Unchanged rather than Uploads.Succeeded.
+	Uploads *BulkResult
+	// Unchanged are the names of the objects which already matched their
+	// local file.
+	Unchanged []string
+	// Resumed are the names of the objects skipped as completed by an
+	// earlier sync, see SyncOptions.Completed.
+	Resumed []string
+	// Deletes summarises the deletion of objects without a local file, and
+	// is nil unless deletion was requested.
+	Deletes *BulkResult
+}
+
+// SyncPlan is what a SyncDirectory is about to do, as computed before it
+// changes anything.
+type SyncPlan struct {
+	// Uploads are the objects to be uploaded or, with Dedupe, copied.
+	Uploads []SyncAction `json:"uploads"`
+	// Skips are the objects left as they are.
+	Skips []SyncAction `json:"skips"`
+	// Deletes are the objects to be deleted, with DeleteRemote.
+	Deletes []SyncAction `json:"deletes"`
+}
+
+// SyncAction is an object a SyncPlan uploads, skips or deletes, in name
+// order within each list.
+type SyncAction struct {
+	Object string `json:"object"`
+	// File is the local file synced to the object, if there is one.
+	File string `json:"file,omitempty"`
+	// Source is the object a copy is made from.
+	Source string `json:"source,omitempty"`
+	// Reason is why the object is uploaded, skipped or deleted:
+	//
+	//   - an upload's object is "missing", "gzip-encoded", has a different
+	//     size ("size-differs") or CRC32C ("crc32c-differs"), or is a
+	//     "duplicate" copied from Source;
+	//   - a skipped object is "unchanged", "completed" by an earlier sync,
+	//     has a file which could not be hashed ("hash-failed"), was
+	//     "cancelled" by FailFast, or is an object without a local file not
+	//     deleted as some file will not be synced ("sync-incomplete");
+	//   - a deleted object has "no-local-file".
+	Reason string `json:"reason"`
+}
+
+// Err returns a non-nil error summarising the failures, if any.
+func (r *SyncResult) Err() error {
+	if err := r.Uploads.Err(); err != nil {
+		return fmt.Errorf("uploading: %w", err)
+	}
+	if r.Deletes != nil {
+		if err := r.Deletes.Err(); err != nil {
+			return fmt.Errorf("deleting: %w", err)
+		}
+	}
+	return nil
+}
+
+// SyncOptions controls SyncDirectory.
+type SyncOptions struct {
+	BulkOptions
+	// DeleteRemote deletes the objects under the prefix without a local
+	// file once every upload has succeeded. ObjectCountLimit then bounds the
+	// number of objects deleted rather than the number synced.
+	DeleteRemote bool
+	// Metadata gives each uploaded object with an entry its content type,
+	// cache control and custom metadata. An object which already matches
+	// its file is left as it is, whatever its entry.
+	Metadata MetadataFile
+	// Dedupe copies an object server-side, rather than uploading its file,
+	// when an object with the same content already exists under the prefix
+	// or is uploaded by the same sync, so each distinct content is sent
+	// once. Content is the same if the size, CRC32C and MD5 all match.
+	Dedupe bool
+	// Manifest, if non-nil, records each object as it is brought up to
+	// date, whether uploaded, copied or already unchanged, so that an
+	// interrupted sync can be resumed from it. Nothing is recorded in a dry
+	// run.
+	Manifest *ManifestWriter
+	// Completed are the objects recorded in the manifest of an earlier
+	// sync. Their files are skipped without being hashed or compared with
+	// their object, unless VerifyCompleted is set.
+	Completed Manifest
+	// VerifyCompleted hashes the files of the Completed objects too, and
+	// only skips those whose size and CRC32C still match their entry.
+	VerifyCompleted bool
+	// Plan, if non-nil, is called with the plan of the sync once it is
+	// computed, before anything is uploaded, copied or deleted. An error
+	// stops the sync and is returned by SyncDirectory.
+	Plan func(*SyncPlan) error
+	// PlanOnly stops the sync once it is planned, without recording
+	// anything in Manifest. The uploads and deletes planned are returned as
+	// skipped.
+	PlanOnly bool
+}
+
+// SyncDirectory mirrors the regular files below localDir to the objects
+// under prefix, naming each object prefix followed by the file's path
+// relative to localDir. A file is only uploaded if its object is missing
+// or has a different CRC32C.
+//
+// Every file is hashed before anything is uploaded, so that with
+// opts.Dedupe the files sharing content are known up front: the first of
+// them in name order is uploaded, unless an object under prefix already has
+// its content, and the others are copied from that object. A copy is given
+// the attributes uploading its file would, not those of its source.
+func (client *GCSBlobstore) SyncDirectory(localDir, prefix string, opts SyncOptions) (*SyncResult, error) {
+	if client.readOnly() {
+		return nil, ErrInvalidROWriteOperation
+	}
+
+	if err := client.validateRemoteConfig(); err != nil {
+		return nil, err
+	}
+
+	ctx := client.ctx
+	objects, err := client.listObjects(ctx, client.authenticatedGCS, prefix, opts.Match)
+	if err != nil {
+		return nil, fmt.Errorf("listing objects under '%s': %v", prefix, err)
+	}
+	remote := make(map[string]*storage.ObjectAttrs, len(objects))
+	for _, attrs := range objects {
+		remote[attrs.Name] = attrs
+	}
+
+	files, err := localFiles(localDir, prefix, opts.BulkOptions)
+	if err != nil {
+		return nil, fmt.Errorf("walking '%s': %v", localDir, err)
+	}
+
+	var stale []*storage.ObjectAttrs
+	if opts.DeleteRemote {
+		for _, attrs := range objects {
+			if _, ok := files[attrs.Name]; !ok {
+				stale = append(stale, attrs)
+			}
+		}
+		if err := opts.checkObjectCount(prefix, len(stale)); err != nil {
+			return nil, err
+		}
+	}
+
+	var resumed []string
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if _, ok := opts.Completed[name]; ok && !opts.VerifyCompleted {
+			resumed = append(resumed, name)
+			continue
+		}
+		names = append(names, name)
+	}
+
+	var mu sync.Mutex
+	digests := make(map[string]fileDigest, len(files))
+	hashes := runPool(ctx, names, opts.BulkOptions, func(ctx context.Context, name string) error {
+		digest, err := digestFile(files[name], opts.Dedupe)
+		if err == nil {
+			mu.Lock()
+			digests[name] = digest
+			mu.Unlock()
+		}
+		return err
+	})
+
+	result := &SyncResult{Uploads: &BulkResult{Failed: hashes.Failed, Skipped: hashes.Skipped}, Resumed: resumed}
+	var changed []string
+	for _, name := range hashes.Succeeded {
+		digest := digests[name]
+		if entry, ok := opts.Completed[name]; ok && entry.Matches(digest.size, digest.crc) {
+			result.Resumed = append(result.Resumed, name)
+		} else if differs(remote[name], digest.size, digest.crc) {
+			changed = append(changed, name)
+		} else {
+			result.Unchanged = append(result.Unchanged, name)
+			if !opts.DryRun && !opts.PlanOnly {
+				opts.Manifest.Record(NewManifestEntry(name, digest.size, digest.crc))
+			}
+		}
+	}
+	if len(hashes.Skipped) > 0 {
+		// Hashing was cancelled by FailFast, so nothing is uploaded either.
+		result.Uploads.Skipped = append(result.Uploads.Skipped, changed...)
+		changed = nil
+	}
+
+	// sources maps the content of the objects which a sync can copy from to
+	// their name. Objects which are about to be replaced cannot be.
+	sources := map[fileDigest]syncSource{}
+	if opts.Dedupe {
+		replaced := make(map[string]bool, len(changed))
+		for _, name := range changed {
+			replaced[name] = true
+		}
+		for _, attrs := range objects {
+			if !replaced[attrs.Name] && attrs.ContentEncoding != "gzip" && len(attrs.MD5) > 0 {
+				digest := fileDigest{size: attrs.Size, crc: attrs.CRC32C, md5: string(attrs.MD5)}
+				if _, ok := sources[digest]; !ok {
+					sources[digest] = syncSource{name: attrs.Name, generation: attrs.Generation}
+				}
+			}
+		}
+	}
+
+	// Uploads are queued before copies, so every upload a copy waits for
+	// is already in flight, and is closed in uploaded once it is done.
+	var uploads, copies []string
+	copyFrom := map[string]syncSource{}
+	uploaded := map[string]chan struct{}{}
+	for _, name := range changed {
+		if source, ok := sources[digests[name]]; ok {
+			copies = append(copies, name)
+			copyFrom[name] = source
+			continue
+		}
+		uploads = append(uploads, name)
+		if opts.Dedupe {
+			sources[digests[name]] = syncSource{name: name}
+			uploaded[name] = make(chan struct{})
+		}
+	}
+	failedUploads := map[string]bool{}
+
+	if opts.Plan != nil {
+		plan := planSync(files, remote, digests, result, uploads, copies, copyFrom, stale)
+		if err := opts.Plan(plan); err != nil {
+			return nil, err
+		}
+	}
+	if opts.PlanOnly {
+		result.Uploads.Skipped = append(result.Uploads.Skipped, append(uploads, copies...)...)
+		sort.Strings(result.Uploads.Skipped)
+		sort.Strings(result.Unchanged)
+		sort.Strings(result.Resumed)
+		if opts.DeleteRemote {
+			result.Deletes = &BulkResult{Failed: map[string]error{}, Skipped: sortedNames(stale)}
+		}
+		return result, nil
+	}
+
+	upload := func(ctx context.Context, name string) error {
+		path, digest := files[name], digests[name]
+		var putOpts PutOptions
+		opts.Metadata[name].Apply(&putOpts)
+
+		if source, ok := copyFrom[name]; ok {
+			if done := uploaded[source.name]; done != nil {
+				select {
+				case <-done:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			mu.Lock()
+			sourceFailed := failedUploads[source.name]
+			mu.Unlock()
+			if !sourceFailed {
+				if opts.DryRun {
+					log.Printf("INFO: Would copy '%s' to '%s' for '%s'\n", source.name, name, path)
+					return nil
+				}
+				err := client.copyFileContent(ctx, source, name, path, digest, putOpts)
+				client.record("copy", source.name, name, digest.size, err)
+				if err == nil {
+					opts.Manifest.Record(NewManifestEntry(name, digest.size, digest.crc))
+					log.Printf("INFO: Copied '%s' to '%s' for '%s'\n", source.name, name, path)
+				}
+				return err
+			}
+		}
+
+		if done := uploaded[name]; done != nil {
+			defer close(done)
+		}
+		if opts.DryRun {
+			log.Printf("INFO: Would upload '%s' to '%s'\n", path, name)
+			return nil
+		}
+		size, err := client.uploadFile(path, name, digest.crc, putOpts)
+		client.record("put", name, "", size, err)
+		if err != nil {
+			mu.Lock()
+			failedUploads[name] = true
+			mu.Unlock()
+			return err
+		}
+		opts.Manifest.Record(NewManifestEntry(name, digest.size, digest.crc))
+		log.Printf("INFO: Uploaded '%s' to '%s'\n", path, name)
+		return nil
+	}
+
+	sort.Strings(uploads)
+	sort.Strings(copies)
+	written := runPool(ctx, append(uploads, copies...), opts.BulkOptions, upload)
+	result.Uploads.Succeeded = written.Succeeded
+	result.Uploads.Skipped = append(result.Uploads.Skipped, written.Skipped...)
+	sort.Strings(result.Uploads.Skipped)
+	for name, err := range written.Failed {
+		result.Uploads.Failed[name] = err
+	}
+	sort.Strings(result.Unchanged)
+	sort.Strings(result.Resumed)
+
+	if !opts.DeleteRemote {
+		return result, nil
+	}
+	if result.Uploads.Err() != nil || len(result.Uploads.Skipped) > 0 {
+		// A file which failed to upload may be about to replace an object
+		// which is deleted, so nothing is deleted unless every upload
+		// succeeded.
+		result.Deletes = &BulkResult{Failed: map[string]error{}, Skipped: sortedNames(stale)}
+		return result, nil
+	}
+
+	remove := func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		if opts.DryRun {
+			log.Printf("INFO: Would delete '%s'\n", attrs.Name)
+			return nil
+		}
+
+		// As for a rename, an object replaced in the meantime is kept.
+		handle := client.getObjectHandle(client.authenticatedGCS, attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+		err := handle.Delete(ctx)
+		client.record("delete", attrs.Name, "", attrs.Size, err)
+		if err == nil {
+			log.Printf("INFO: Deleted '%s'\n", attrs.Name)
+		}
+		return err
+	}
+	result.Deletes = runBulk(ctx, stale, opts.BulkOptions, remove)
+	return result, nil
+}
+
+// planSync returns the plan of a sync of files to remote, once the files
+// have been hashed into digests, sorted into those to upload, copy or skip,
+// and result records the files which could not be hashed.
+func planSync(files map[string]string, remote map[string]*storage.ObjectAttrs, digests map[string]fileDigest, result *SyncResult,
+	uploads, copies []string, copyFrom map[string]syncSource, stale []*storage.ObjectAttrs) *SyncPlan {
+	plan := &SyncPlan{Uploads: []SyncAction{}, Skips: []SyncAction{}, Deletes: []SyncAction{}}
+	for _, name := range uploads {
+		plan.Uploads = append(plan.Uploads, SyncAction{Object: name, File: files[name], Reason: uploadReason(remote[name], digests[name])})
+	}
+	for _, name := range copies {
+		plan.Uploads = append(plan.Uploads, SyncAction{Object: name, File: files[name], Source: copyFrom[name].name, Reason: "duplicate"})
+	}
+
+	skip := func(names []string, reason string) {
+		for _, name := range names {
+			plan.Skips = append(plan.Skips, SyncAction{Object: name, File: files[name], Reason: reason})
+		}
+	}
+	skip(result.Unchanged, "unchanged")
+	skip(result.Resumed, "completed")
+	failed := make([]string, 0, len(result.Uploads.Failed))
+	for name := range result.Uploads.Failed {
+		failed = append(failed, name)
+	}
+	skip(failed, "hash-failed")
+	skip(result.Uploads.Skipped, "cancelled")
+	if len(result.Uploads.Failed) > 0 || len(result.Uploads.Skipped) > 0 {
+		skip(sortedNames(stale), "sync-incomplete")
+	} else {
+		for _, name := range sortedNames(stale) {
+			plan.Deletes = append(plan.Deletes, SyncAction{Object: name, Reason: "no-local-file"})
+		}
+	}
+
+	sortActions := func(actions []SyncAction) {
+		sort.Slice(actions, func(i, j int) bool { return actions[i].Object < actions[j].Object })
+	}
+	sortActions(plan.Uploads)
+	sortActions(plan.Skips)
+	return plan
+}
+
+// uploadReason returns why the object attrs, or nil if it is missing, is
+// replaced by a file with digest, as listed in a SyncPlan.
+func uploadReason(attrs *storage.ObjectAttrs, digest fileDigest) string {
+	switch {
+	case attrs == nil:
+		return "missing"
+	case attrs.ContentEncoding == "gzip":
+		return "gzip-encoded"
+	case attrs.Size != digest.size:
+		return "size-differs"
+	default:
+		return "crc32c-differs"
+	}
+}
+
+// syncSource is an object SyncDirectory copies content from.
+type syncSource struct {
+	name string
+	// generation is the generation of an existing object, so that the
+	// content copied is the one its digest was taken from, or 0 for an
+	// object uploaded by the sync.
+	generation int64
+}
+
+// copyFileContent creates dest as a server-side copy of source, which has
+// the content of the file at path, giving it the attributes uploadFile
+// would. The copy must have the file's size and CRC32C.
+func (client *GCSBlobstore) copyFileContent(ctx context.Context, source syncSource, dest, path string, digest fileDigest, opts PutOptions) error {
+	src := client.getObjectHandle(client.authenticatedGCS, source.name)
+	if source.generation != 0 {
+		src = src.Generation(source.generation)
+	}
+	copier := client.getObjectHandle(client.authenticatedGCS, dest).CopierFrom(src)
+	client.setUploadAttrs(&copier.ObjectAttrs)
+	setFileAttrs(&copier.ObjectAttrs, path, client.config.ContentType == "", opts)
+	copier.DestinationKMSKeyName = client.config.KMSKeyName
+
+	copied, err := copier.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("copying '%s' to '%s': %w", source.name, dest, err)
+	}
+	if copied.Size != digest.size || copied.CRC32C != digest.crc {
+		return fmt.Errorf("copy '%s' of '%s' has CRC32C %d, expected %d", dest, source.name, copied.CRC32C, digest.crc)
+	}
+	return nil
+}
+
+// localFiles returns the paths of the regular files below dir, keyed by the
+// name of the object each is synced to under prefix. Files whose object
+// name is not matched by opts.Match are left out, and other entries, such
+// as symlinks, are skipped with a warning.
+func localFiles(dir, prefix string, opts BulkOptions) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			log.Printf("WARN: skipping '%s': not a regular file\n", path)
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := prefix + filepath.ToSlash(rel)
+		if opts.Match == nil || opts.Match.MatchString(name) {
+			files[name] = path
+		}
+		return nil
+	})
+	return files, err
+}
+
+// NeedsUpload reports whether the file at localPath has to be uploaded to
+// remoteName to bring the object up to date: if the object is missing, or
+// its size or CRC32C differ from the file's.
+//
+// An object stored with gzip content-encoding has the size and CRC32C of
+// its compressed bytes, which cannot be compared with the file, so it is
+// always reported as needing an upload.
+func (client *GCSBlobstore) NeedsUpload(localPath, remoteName string) (bool, error) {
+	size, crc, err := fileCRC32C(localPath)
+	if err != nil {
+		return false, err
+	}
+
+	attrs, err := client.Stat(remoteName)
+	if errors.Is(err, ErrObjectNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return differs(attrs, size, crc), nil
+}
+
+// differs reports whether the object described by attrs, or a missing
+// object if attrs is nil, differs from a local file of size bytes with the
+// given CRC32C.
+func differs(attrs *storage.ObjectAttrs, size int64, crc uint32) bool {
+	return attrs == nil || attrs.ContentEncoding == "gzip" || attrs.Size != size || attrs.CRC32C != crc
+}
+
+// fileCRC32C returns the size and CRC32C of the file at path.
+func fileCRC32C(path string) (int64, uint32, error) {
+	digest, err := digestFile(path, false)
+	return digest.size, digest.crc, err
+}
+
+// fileDigest identifies the content of a file or object.
+type fileDigest struct {
+	size int64
+	crc  uint32
+	// md5 is the raw MD5, if it was computed.
+	md5 string
+}
+
+// digestFile returns the size and CRC32C of the file at path, and its MD5
+// if withMD5 is set, reading the file once.
+func digestFile(path string, withMD5 bool) (fileDigest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileDigest{}, err
+	}
+	defer f.Close()
+
+	crcHash := crc32.New(crc32cTable)
+	var w io.Writer = crcHash
+	md5Hash := md5.New()
+	if withMD5 {
+		w = io.MultiWriter(crcHash, md5Hash)
+	}
+	size, err := io.Copy(w, f)
+	if err != nil {
+		return fileDigest{}, err
+	}
+	digest := fileDigest{size: size, crc: crcHash.Sum32()}
+	if withMD5 {
+		digest.md5 = string(md5Hash.Sum(nil))
+	}
+	return digest, nil
+}
+
+// uploadFile uploads the file at path to dest and returns the number of
+// bytes sent. GCS rejects the upload unless the object's CRC32C is crc, so
+// a file modified while it is read is never stored.
+//
+// Without a configured content type, the type is derived from the file's
+// extension. opts override both.
+func (client *GCSBlobstore) uploadFile(path, dest string, crc uint32, opts PutOptions) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	remoteWriter := client.newWriter(dest, nil)
+	setFileAttrs(&remoteWriter.ObjectAttrs, path, client.config.ContentType == "", opts)
+	remoteWriter.CRC32C = crc
+	remoteWriter.SendCRC32C = true
+	client.sendSingleShot(remoteWriter, f)
+
+	written, err := client.copyData(remoteWriter, f)
+	if err != nil {
+		remoteWriter.CloseWithError(err) //nolint:errcheck,staticcheck
+		return written, err
+	}
+	return written, remoteWriter.Close()
+}
+
+// setFileAttrs sets the attributes of an object uploaded from the file at
+// path on attrs: the content type derived from the file's extension, if
+// detectType is set, overridden by opts.
+func setFileAttrs(attrs *storage.ObjectAttrs, path string, detectType bool, opts PutOptions) {
+	if detectType {
+		if detected := mime.TypeByExtension(filepath.Ext(path)); detected != "" {
+			attrs.ContentType = detected
+		}
+	}
+	opts.apply(attrs)
+}
+
+// sortedNames returns the names of objects in order.
+func sortedNames(objects []*storage.ObjectAttrs) []string {
+	names := make([]string, 0, len(objects))
+	for _, attrs := range objects {
+		names = append(names, attrs.Name)
+	}
+	sort.Strings(names)
+	return names
+}
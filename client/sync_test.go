@@ -0,0 +1,438 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Comparing a local file with an object", func() {
+	const content = "some content"
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var localPath string
+
+	crc32c := func(s string) string {
+		sum := make([]byte, 4)
+		binary.BigEndian.PutUint32(sum, crc32.Checksum([]byte(s), crc32.MakeTable(crc32.Castagnoli)))
+		return base64.StdEncoding.EncodeToString(sum)
+	}
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/some-bucket/o/")
+			w.Header().Set("Content-Type", "application/json")
+			switch name {
+			case "same":
+				fmt.Fprintf(w, `{"name": "same", "size": "%d", "crc32c": %q}`, len(content), crc32c(content))
+			case "changed":
+				fmt.Fprintf(w, `{"name": "changed", "size": "%d", "crc32c": %q}`, len(content), crc32c("same length!!"))
+			case "gzipped":
+				fmt.Fprintf(w, `{"name": "gzipped", "size": "%d", "crc32c": %q, "contentEncoding": "gzip"}`, len(content), crc32c(content))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error": {"code": 404, "message": "Not Found"}}`)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+
+		localPath = filepath.Join(tempDir(), "file")
+		Expect(os.WriteFile(localPath, []byte(content), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("does not upload a file matching the object", func() {
+		Expect(blobstore.NeedsUpload(localPath, "same")).To(BeFalse())
+	})
+
+	It("uploads a file whose CRC32C differs", func() {
+		Expect(blobstore.NeedsUpload(localPath, "changed")).To(BeTrue())
+	})
+
+	It("uploads a file whose object is missing", func() {
+		Expect(blobstore.NeedsUpload(localPath, "missing")).To(BeTrue())
+	})
+
+	It("uploads a file whose object is gzip-encoded", func() {
+		Expect(blobstore.NeedsUpload(localPath, "gzipped")).To(BeTrue())
+	})
+
+	It("fails for a missing local file", func() {
+		_, err := blobstore.NeedsUpload(filepath.Join(filepath.Dir(localPath), "missing"), "same")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Syncing a directory", func() {
+	var emulator *gcsEmulator
+	var blobstore *GCSBlobstore
+	var localDir string
+
+	writeFiles := func(files map[string]string) {
+		for name, content := range files {
+			path := filepath.Join(localDir, filepath.FromSlash(name))
+			Expect(os.MkdirAll(filepath.Dir(path), 0700)).To(Succeed())
+			Expect(os.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		emulator = newGCSEmulator()
+		blobstore = newEmulatorBlobstore(emulator.Server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+		localDir = tempDir()
+	})
+
+	AfterEach(func() {
+		emulator.Close()
+	})
+
+	It("uploads new and changed files and skips unchanged ones", func() {
+		emulator.put("sync/same.txt", "same", nil)
+		emulator.put("sync/changed.txt", "old content", nil)
+		emulator.put("sync/resized.txt", "short", nil)
+		writeFiles(map[string]string{"same.txt": "same", "changed.txt": "new content", "resized.txt": "longer", "sub/new.txt": "new"})
+
+		result, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Err()).ToNot(HaveOccurred())
+		Expect(result.Unchanged).To(Equal([]string{"sync/same.txt"}))
+		Expect(result.Uploads.Succeeded).To(Equal([]string{"sync/changed.txt", "sync/resized.txt", "sync/sub/new.txt"}))
+		Expect(result.Deletes).To(BeNil())
+
+		Expect(emulator.ops()).To(ConsistOf("upload sync/changed.txt", "upload sync/resized.txt", "upload sync/sub/new.txt"))
+		Expect(string(emulator.object("sync/changed.txt").data)).To(Equal("new content"))
+		Expect(string(emulator.object("sync/sub/new.txt").data)).To(Equal("new"))
+	})
+
+	It("uploads nothing when run again", func() {
+		writeFiles(map[string]string{"a.txt": "a", "b/c.txt": "c"})
+		_, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{})
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Uploads.Succeeded).To(BeEmpty())
+		Expect(result.Unchanged).To(Equal([]string{"sync/a.txt", "sync/b/c.txt"}))
+		Expect(emulator.ops()).To(ConsistOf("upload sync/a.txt", "upload sync/b/c.txt"))
+	})
+
+	It("deletes the objects without a local file with DeleteRemote", func() {
+		emulator.put("sync/kept.txt", "kept", nil)
+		emulator.put("sync/stale.txt", "stale", nil)
+		emulator.put("sync/sub/stale.txt", "stale", nil)
+		emulator.put("other/stale.txt", "stale", nil)
+		writeFiles(map[string]string{"kept.txt": "kept"})
+
+		result, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{DeleteRemote: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Err()).ToNot(HaveOccurred())
+		Expect(result.Unchanged).To(Equal([]string{"sync/kept.txt"}))
+		Expect(result.Deletes.Succeeded).To(Equal([]string{"sync/stale.txt", "sync/sub/stale.txt"}))
+		Expect(emulator.names()).To(Equal([]string{"other/stale.txt", "sync/kept.txt"}))
+	})
+
+	It("keeps the objects without a local file without DeleteRemote", func() {
+		emulator.put("sync/stale.txt", "stale", nil)
+		writeFiles(map[string]string{"a.txt": "a"})
+
+		_, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(emulator.names()).To(Equal([]string{"sync/a.txt", "sync/stale.txt"}))
+	})
+
+	It("reports a file which failed to upload", func() {
+		writeFiles(map[string]string{"a.txt": "a", "b.txt": "b"})
+		emulator.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+			if !strings.HasPrefix(r.URL.Path, "/upload/") || !strings.Contains(r.URL.RawQuery, "name=sync%2Fb.txt") {
+				return false
+			}
+			writeError(w, http.StatusBadRequest, "Invalid argument.")
+			return true
+		}
+
+		result, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Uploads.Succeeded).To(Equal([]string{"sync/a.txt"}))
+		Expect(result.Uploads.Failed).To(HaveKey("sync/b.txt"))
+		Expect(result.Err()).To(HaveOccurred())
+		Expect(emulator.names()).To(Equal([]string{"sync/a.txt"}))
+	})
+
+	Describe("with Dedupe", func() {
+		dedupe := SyncOptions{Dedupe: true}
+
+		It("uploads each distinct content once and copies the other files from it", func() {
+			writeFiles(map[string]string{"a.txt": "same", "b/c.txt": "same", "d.txt": "other"})
+
+			result, err := blobstore.SyncDirectory(localDir, "sync/", dedupe)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Err()).ToNot(HaveOccurred())
+			Expect(result.Uploads.Succeeded).To(Equal([]string{"sync/a.txt", "sync/b/c.txt", "sync/d.txt"}))
+
+			Expect(emulator.ops()).To(ConsistOf("upload sync/a.txt", "upload sync/d.txt", "copy sync/a.txt sync/b/c.txt"))
+			Expect(string(emulator.object("sync/b/c.txt").data)).To(Equal("same"))
+		})
+
+		It("copies a file whose content an object under the prefix already has", func() {
+			emulator.put("sync/old.txt", "same", nil)
+			writeFiles(map[string]string{"new.txt": "same"})
+
+			result, err := blobstore.SyncDirectory(localDir, "sync/", dedupe)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Uploads.Succeeded).To(Equal([]string{"sync/new.txt"}))
+			Expect(emulator.ops()).To(Equal([]string{"copy sync/old.txt sync/new.txt"}))
+		})
+
+		It("gives a copy the attributes of its own file", func() {
+			writeFiles(map[string]string{"a.txt": "{}", "b.json": "{}"})
+
+			_, err := blobstore.SyncDirectory(localDir, "sync/", dedupe)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(emulator.ops()).To(ContainElement("copy sync/a.txt sync/b.json"))
+			Expect(emulator.object("sync/b.json").resource).To(HaveKeyWithValue("contentType", "application/json"))
+		})
+
+		It("does not copy from an object the sync replaces", func() {
+			emulator.put("sync/a.txt", "same", nil)
+			writeFiles(map[string]string{"a.txt": "changed", "b.txt": "same"})
+
+			_, err := blobstore.SyncDirectory(localDir, "sync/", dedupe)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(emulator.ops()).To(ConsistOf("upload sync/a.txt", "upload sync/b.txt"))
+		})
+
+		It("uploads every file without Dedupe", func() {
+			writeFiles(map[string]string{"a.txt": "same", "b.txt": "same"})
+
+			_, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(emulator.ops()).To(ConsistOf("upload sync/a.txt", "upload sync/b.txt"))
+		})
+	})
+
+	Describe("with a plan", func() {
+		It("plans each upload, skip and delete with its reason before making it", func() {
+			emulator.put("sync/same.txt", "same", nil)
+			emulator.put("sync/longer.txt", "short", nil)
+			emulator.put("sync/crc.txt", "abc", nil)
+			emulator.put("sync/stale.txt", "stale", nil)
+			emulator.put("sync/existing.txt", "dup", nil)
+			writeFiles(map[string]string{
+				"same.txt": "same", "longer.txt": "much longer", "crc.txt": "xyz", "new.txt": "new",
+				"dup.txt": "dup", "done.txt": "done",
+			})
+
+			var plan *SyncPlan
+			opts := SyncOptions{
+				DeleteRemote: true,
+				Dedupe:       true,
+				Completed:    Manifest{"sync/done.txt": {Name: "sync/done.txt"}},
+				Plan: func(p *SyncPlan) error {
+					Expect(emulator.ops()).To(BeEmpty())
+					plan = p
+					return nil
+				},
+			}
+			result, err := blobstore.SyncDirectory(localDir, "sync/", opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Err()).ToNot(HaveOccurred())
+
+			file := func(name string) string { return filepath.Join(localDir, name) }
+			Expect(plan.Uploads).To(Equal([]SyncAction{
+				{Object: "sync/crc.txt", File: file("crc.txt"), Reason: "crc32c-differs"},
+				{Object: "sync/dup.txt", File: file("dup.txt"), Source: "sync/existing.txt", Reason: "duplicate"},
+				{Object: "sync/longer.txt", File: file("longer.txt"), Reason: "size-differs"},
+				{Object: "sync/new.txt", File: file("new.txt"), Reason: "missing"},
+			}))
+			Expect(plan.Skips).To(Equal([]SyncAction{
+				{Object: "sync/done.txt", File: file("done.txt"), Reason: "completed"},
+				{Object: "sync/same.txt", File: file("same.txt"), Reason: "unchanged"},
+			}))
+			Expect(plan.Deletes).To(Equal([]SyncAction{
+				{Object: "sync/existing.txt", Reason: "no-local-file"},
+				{Object: "sync/stale.txt", Reason: "no-local-file"},
+			}))
+			Expect(emulator.names()).ToNot(ContainElement("sync/stale.txt"))
+		})
+
+		It("changes nothing with PlanOnly", func() {
+			emulator.put("sync/stale.txt", "stale", nil)
+			writeFiles(map[string]string{"new.txt": "new"})
+			manifestPath := filepath.Join(tempDir(), "manifest.jsonl")
+			manifest, err := NewManifestWriter(manifestPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			planned := false
+			result, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{
+				DeleteRemote: true,
+				PlanOnly:     true,
+				Manifest:     manifest,
+				Plan:         func(*SyncPlan) error { planned = true; return nil },
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.Close()).To(Succeed())
+			Expect(planned).To(BeTrue())
+			Expect(result.Uploads.Skipped).To(Equal([]string{"sync/new.txt"}))
+			Expect(result.Deletes.Skipped).To(Equal([]string{"sync/stale.txt"}))
+			Expect(emulator.ops()).To(BeEmpty())
+			Expect(os.ReadFile(manifestPath)).To(BeEmpty())
+		})
+
+		It("stops the sync when the plan fails", func() {
+			writeFiles(map[string]string{"new.txt": "new"})
+
+			_, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{
+				Plan: func(*SyncPlan) error { return errors.New("disk full") },
+			})
+			Expect(err).To(MatchError("disk full"))
+			Expect(emulator.ops()).To(BeEmpty())
+		})
+	})
+
+	Describe("with a manifest", func() {
+		var manifestPath string
+
+		BeforeEach(func() {
+			manifestPath = filepath.Join(tempDir(), "manifest.jsonl")
+		})
+
+		// interruptedSync syncs localDir one file at a time and cancels the
+		// sync as the second upload starts, as if it were killed.
+		interruptedSync := func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			uploads := 0
+			emulator.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+				if !strings.HasPrefix(r.URL.Path, "/upload/") {
+					return false
+				}
+				if uploads++; uploads < 2 {
+					return false
+				}
+				cancel()
+				writeError(w, http.StatusServiceUnavailable, "interrupted")
+				return true
+			}
+			interrupted := newEmulatorBlobstoreWithContext(ctx, emulator.Server, func(cfg *config.GCSCli) {
+				cfg.MaxAttempts = 1
+			})
+
+			manifest, err := NewManifestWriter(manifestPath)
+			Expect(err).ToNot(HaveOccurred())
+			opts := SyncOptions{Manifest: manifest}
+			opts.Concurrency = 1
+			result, err := interrupted.SyncDirectory(localDir, "sync/", opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Err()).To(HaveOccurred())
+			Expect(manifest.Close()).To(Succeed())
+			emulator.intercept = nil
+		}
+
+		resume := func(verify bool) *SyncResult {
+			completed, err := LoadManifest(manifestPath)
+			Expect(err).ToNot(HaveOccurred())
+			manifest, err := NewManifestWriter(manifestPath)
+			Expect(err).ToNot(HaveOccurred())
+			defer func() { Expect(manifest.Close()).To(Succeed()) }()
+
+			result, err := blobstore.SyncDirectory(localDir, "sync/", SyncOptions{Manifest: manifest, Completed: completed, VerifyCompleted: verify})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Err()).ToNot(HaveOccurred())
+			return result
+		}
+
+		It("resumes an interrupted sync without uploading what it completed", func() {
+			writeFiles(map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"})
+			interruptedSync()
+			Expect(emulator.names()).To(Equal([]string{"sync/a.txt"}))
+
+			completed, err := LoadManifest(manifestPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(completed).To(Equal(Manifest{"sync/a.txt": {Name: "sync/a.txt", Size: 1, CRC32C: emulatedCRC32C([]byte("a"))}}))
+
+			emulator.operations = nil
+			result := resume(false)
+			Expect(result.Resumed).To(Equal([]string{"sync/a.txt"}))
+			Expect(result.Uploads.Succeeded).To(Equal([]string{"sync/b.txt", "sync/c.txt"}))
+			Expect(emulator.ops()).To(ConsistOf("upload sync/b.txt", "upload sync/c.txt"))
+
+			completed, err = LoadManifest(manifestPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(completed).To(HaveLen(3))
+		})
+
+		It("uploads a completed file which changed only when verifying it", func() {
+			writeFiles(map[string]string{"a.txt": "a", "b.txt": "b"})
+			interruptedSync()
+			writeFiles(map[string]string{"a.txt": "changed"})
+
+			emulator.operations = nil
+			result := resume(false)
+			Expect(result.Resumed).To(Equal([]string{"sync/a.txt"}))
+			Expect(emulator.ops()).To(ConsistOf("upload sync/b.txt"))
+			Expect(string(emulator.object("sync/a.txt").data)).To(Equal("a"))
+
+			emulator.operations = nil
+			result = resume(true)
+			Expect(result.Resumed).To(Equal([]string{"sync/b.txt"}))
+			Expect(result.Uploads.Succeeded).To(Equal([]string{"sync/a.txt"}))
+			Expect(string(emulator.object("sync/a.txt").data)).To(Equal("changed"))
+		})
+
+		It("records unchanged objects but nothing in a dry run", func() {
+			emulator.put("sync/a.txt", "a", nil)
+			writeFiles(map[string]string{"a.txt": "a", "b.txt": "b"})
+
+			manifest, err := NewManifestWriter(manifestPath)
+			Expect(err).ToNot(HaveOccurred())
+			opts := SyncOptions{Manifest: manifest}
+			opts.DryRun = true
+			_, err = blobstore.SyncDirectory(localDir, "sync/", opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.Close()).To(Succeed())
+			Expect(os.ReadFile(manifestPath)).To(BeEmpty())
+
+			Expect(resume(false).Unchanged).To(Equal([]string{"sync/a.txt"}))
+			completed, err := LoadManifest(manifestPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(completed).To(HaveKey("sync/a.txt"))
+			Expect(completed).To(HaveKey("sync/b.txt"))
+		})
+	})
+})
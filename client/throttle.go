@@ -0,0 +1,113 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// throttleWindow is the time after reducing the concurrency of a bulk
+// operation during which further 429s and 503s are attributed to requests already in
+// flight and do not reduce it again.
+const throttleWindow = time.Second
+
+// concurrencyLimiter bounds the number of objects a bulk operation works on
+// at once, adapting to rate limiting by GCS.
+//
+// The limit is halved, down to min, whenever a request is rejected with 429
+// Too Many Requests or 503 Service Unavailable, and grows by one, up to max, after each full round of
+// successes. This is the additive-increase/multiplicative-decrease scheme
+// used by TCP congestion control.
+type concurrencyLimiter struct {
+	min, max int
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	limit        int
+	active       int
+	successes    int
+	lastDecrease time.Time
+}
+
+func newConcurrencyLimiter(min, max int) *concurrencyLimiter {
+	if min <= 0 {
+		min = 1
+	}
+	if min > max {
+		min = max
+	}
+	l := &concurrencyLimiter{min: min, max: max, limit: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until fewer than the current limit of objects are being
+// worked on.
+func (l *concurrencyLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// release records the outcome of work started with acquire and adjusts the
+// limit accordingly.
+func (l *concurrencyLimiter) release(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	defer l.cond.Broadcast()
+
+	switch {
+	case isRateLimited(err):
+		l.successes = 0
+		if l.limit == l.min || time.Since(l.lastDecrease) < throttleWindow {
+			return
+		}
+		l.limit /= 2
+		if l.limit < l.min {
+			l.limit = l.min
+		}
+		l.lastDecrease = time.Now()
+		log.Printf("DEBUG: rate limited by GCS, reducing concurrency to %d\n", l.limit)
+	case err == nil:
+		l.successes++
+		if l.successes < l.limit || l.limit == l.max {
+			return
+		}
+		l.successes = 0
+		l.limit++
+		log.Printf("DEBUG: increasing concurrency to %d\n", l.limit)
+	}
+}
+
+// isRateLimited reports whether err is a 429 Too Many Requests or a 503
+// Service Unavailable from GCS, which it answers with when overloaded.
+func isRateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusTooManyRequests || apiErr.Code == http.StatusServiceUnavailable)
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// These specs are in package client to drive the limiter directly.
+var _ = Describe("Adapting the concurrency of a bulk operation", func() {
+	rateLimited := &googleapi.Error{Code: http.StatusTooManyRequests}
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	// throttle releases work started on l which failed with err, as if
+	// outside the window of the previous decrease.
+	throttle := func(l *concurrencyLimiter, err error) {
+		l.lastDecrease = time.Time{}
+		l.acquire()
+		l.release(err)
+	}
+
+	succeed := func(l *concurrencyLimiter, n int) {
+		for i := 0; i < n; i++ {
+			l.acquire()
+			l.release(nil)
+		}
+	}
+
+	It("starts at the maximum", func() {
+		Expect(newConcurrencyLimiter(2, 8).limit).To(Equal(8))
+	})
+
+	It("halves the limit on a 429 or a 503", func() {
+		for _, err := range []error{rateLimited, unavailable} {
+			l := newConcurrencyLimiter(1, 8)
+			throttle(l, err)
+			Expect(l.limit).To(Equal(4), err.Error())
+			throttle(l, err)
+			Expect(l.limit).To(Equal(2), err.Error())
+		}
+	})
+
+	It("halves the limit only once within the throttle window", func() {
+		l := newConcurrencyLimiter(1, 8)
+		throttle(l, rateLimited)
+		l.acquire()
+		l.release(rateLimited)
+		Expect(l.limit).To(Equal(4))
+	})
+
+	It("leaves the limit alone on other errors", func() {
+		l := newConcurrencyLimiter(1, 8)
+		throttle(l, &googleapi.Error{Code: http.StatusNotFound})
+		throttle(l, errors.New("connection reset"))
+		Expect(l.limit).To(Equal(8))
+	})
+
+	It("grows the limit by one after each full round of successes", func() {
+		l := newConcurrencyLimiter(1, 8)
+		throttle(l, rateLimited)
+		Expect(l.limit).To(Equal(4))
+
+		succeed(l, 3)
+		Expect(l.limit).To(Equal(4))
+		succeed(l, 1)
+		Expect(l.limit).To(Equal(5))
+		succeed(l, 5)
+		Expect(l.limit).To(Equal(6))
+	})
+
+	It("restarts the round of successes after a 429", func() {
+		l := newConcurrencyLimiter(1, 8)
+		throttle(l, rateLimited)
+		succeed(l, 3)
+		l.acquire()
+		l.release(rateLimited)
+		succeed(l, 3)
+		Expect(l.limit).To(Equal(4))
+	})
+
+	It("keeps the limit between the minimum and the maximum", func() {
+		l := newConcurrencyLimiter(3, 8)
+		for i := 0; i < 10; i++ {
+			throttle(l, rateLimited)
+			Expect(l.limit).To(BeNumerically(">=", 3))
+		}
+		Expect(l.limit).To(Equal(3))
+
+		succeed(l, 100)
+		Expect(l.limit).To(Equal(8))
+	})
+
+	It("bounds the minimum by the maximum", func() {
+		l := newConcurrencyLimiter(0, 4)
+		Expect(l.min).To(Equal(1))
+		l = newConcurrencyLimiter(8, 4)
+		Expect(l.min).To(Equal(4))
+		throttle(l, rateLimited)
+		Expect(l.limit).To(Equal(4))
+	})
+
+	It("blocks acquire while the limit of objects are worked on", func() {
+		l := newConcurrencyLimiter(1, 1)
+		l.acquire()
+
+		acquired := make(chan struct{})
+		go func() {
+			l.acquire()
+			close(acquired)
+		}()
+		Consistently(acquired, 100*time.Millisecond).ShouldNot(BeClosed())
+
+		l.release(nil)
+		Eventually(acquired).Should(BeClosed())
+		l.release(nil)
+	})
+})
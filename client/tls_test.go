@@ -0,0 +1,89 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CA certificates", func() {
+	var server *httptest.Server
+	var dir string
+
+	newBlobstore := func(caCert string) (*GCSBlobstore, error) {
+		return New(context.Background(), &config.GCSCli{
+			BucketName:       "some-bucket",
+			Endpoint:         server.URL,
+			EmulatorInsecure: true,
+			CACertPath:       caCert,
+			MaxAttempts:      1,
+		})
+	}
+
+	BeforeEach(func() {
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"bucket": "some-bucket", "name": "blob", "size": "3"}`)) //nolint:errcheck
+		}))
+		dir = tempDir()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("trusts the certificates in the ca_cert file", func() {
+		path := filepath.Join(dir, "ca.pem")
+		bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		Expect(os.WriteFile(path, bundle, 0600)).To(Succeed())
+
+		blobstore, err := newBlobstore(path)
+		Expect(err).ToNot(HaveOccurred())
+		attrs, err := blobstore.Stat("blob")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Size).To(Equal(int64(3)))
+	})
+
+	It("rejects an untrusted certificate without ca_cert", func() {
+		blobstore, err := newBlobstore("")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = blobstore.Stat("blob")
+		Expect(err).To(MatchError(ContainSubstring("certificate")))
+	})
+
+	It("returns an error for a file without PEM certificates", func() {
+		path := filepath.Join(dir, "ca.pem")
+		Expect(os.WriteFile(path, []byte("not a certificate"), 0600)).To(Succeed())
+
+		_, err := newBlobstore(path)
+		Expect(err).To(MatchError(ContainSubstring("does not contain any PEM certificates")))
+
+		_, err = newBlobstore(filepath.Join(dir, "missing.pem"))
+		Expect(err).To(MatchError(ContainSubstring("reading ca_cert")))
+	})
+})
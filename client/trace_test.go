@@ -0,0 +1,135 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP tracing", func() {
+	var server *httptest.Server
+	var stderr *os.File
+	var trace *os.File
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body) //nolint:errcheck
+			if r.URL.Query().Get("uploadType") == "resumable" && r.URL.Query().Get("upload_id") == "" {
+				w.Header().Set("Location", "http://"+r.Host+r.URL.Path+"?uploadType=resumable&upload_id=secret-session")
+				return
+			}
+			if sent := r.Header.Get("Content-Range"); strings.HasSuffix(sent, "/*") {
+				// More chunks follow, which GCS reports as a 308 in a header
+				// when asked to by the storage library.
+				w.Header().Set("Range", "bytes="+strings.TrimSuffix(strings.TrimPrefix(sent, "bytes "), "/*"))
+				w.Header().Set("X-Http-Status-Code-Override", "308")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"bucket": "some-bucket", "name": "blob", "size": "7"}`)) //nolint:errcheck
+		}))
+
+		// The trace is written to stderr, which is replaced while the
+		// blobstore is created.
+		var err error
+		trace, err = os.CreateTemp(tempDir(), "trace")
+		Expect(err).ToNot(HaveOccurred())
+		stderr = os.Stderr
+		os.Stderr = trace
+	})
+
+	AfterEach(func() {
+		os.Stderr = stderr
+		trace.Close()
+		server.Close()
+	})
+
+	newBlobstore := func() *GCSBlobstore {
+		return newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.DebugHTTP = true
+			cfg.MaxAttempts = 1
+			cfg.ChunkSize = config.MinChunkSize
+		})
+	}
+
+	traced := func() string {
+		content, err := os.ReadFile(trace.Name())
+		Expect(err).ToNot(HaveOccurred())
+		return string(content)
+	}
+
+	It("writes the method, url, status and latency of every request", func() {
+		_, err := newBlobstore().Stat("blob")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(traced()).To(MatchRegexp(`http: GET http://127\.0\.0\.1:\d+/storage/v1/b/some-bucket/o/blob\?\S+: 200 OK in \d+\S*s \(no authorization\)\n$`))
+	})
+
+	It("redacts the upload session of a resumable upload", func() {
+		// Uploads larger than a chunk start an upload session.
+		content := strings.Repeat("x", config.MinChunkSize+1)
+		err := newBlobstore().PutWithOptions(io.MultiReader(strings.NewReader(content)), "blob", PutOptions{})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(traced()).To(ContainSubstring("upload_id=REDACTED"))
+		Expect(traced()).ToNot(ContainSubstring("secret-session"))
+	})
+})
+
+var _ = Describe("Request dumps", func() {
+	var server *httptest.Server
+	var dumpPath string
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"bucket": "some-bucket", "name": "blob", "size": "7"}`)) //nolint:errcheck
+		}))
+		dumpPath = filepath.Join(tempDir(), "dump")
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("closes the dump file once the client is closed", func() {
+		blobstore := newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.DumpRequestPath = dumpPath
+			cfg.MaxAttempts = 1
+		})
+		_, err := blobstore.Stat("blob")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(blobstore.Close()).To(Succeed())
+		Expect(blobstore.Close()).To(MatchError(os.ErrClosed))
+
+		dump, err := os.ReadFile(dumpPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(dump)).To(ContainSubstring("/storage/v1/b/some-bucket/o/blob"))
+	})
+})
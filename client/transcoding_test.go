@@ -0,0 +1,96 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Byte range reads", func() {
+	const content = "0123456789"
+
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var honorRange bool
+
+	BeforeEach(func() {
+		honorRange = true
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || !honorRange {
+				// As GCS does when decompressing a gzip-encoded object.
+				w.Header().Set("X-Goog-Stored-Content-Encoding", "gzip")
+				w.Write([]byte(content)) //nolint:errcheck
+				return
+			}
+			if end >= len(content) {
+				end = len(content) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(content[start : end+1])) //nolint:errcheck
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("writes the requested bytes", func() {
+		var out bytes.Buffer
+		Expect(blobstore.GetRange("obj", ByteRange{Start: 2, End: 4}, &out)).To(Succeed())
+		Expect(out.String()).To(Equal("234"))
+
+		out.Reset()
+		Expect(blobstore.GetRange("obj", ByteRange{Start: 8, End: 20}, &out)).To(Succeed())
+		Expect(out.String()).To(Equal("89"))
+	})
+
+	It("writes the first bytes of the object", func() {
+		var out bytes.Buffer
+		Expect(blobstore.GetRange("obj", ByteRange{Start: 0, End: 3}, &out)).To(Succeed())
+		Expect(out.String()).To(Equal("0123"))
+
+		out.Reset()
+		Expect(blobstore.GetRange("obj", ByteRange{Start: 0, End: 99}, &out)).To(Succeed())
+		Expect(out.String()).To(Equal(content))
+	})
+
+	It("fails when the whole object is served instead of a range", func() {
+		honorRange = false
+
+		var out bytes.Buffer
+		err := blobstore.GetRange("obj", ByteRange{Start: 2, End: 4}, &out)
+		Expect(errors.Is(err, ErrRangeIgnored)).To(BeTrue())
+		Expect(out.Len()).To(BeZero())
+
+		err = blobstore.GetRange("obj", ByteRange{Start: 0, End: 4}, &out)
+		Expect(errors.Is(err, ErrRangeIgnored)).To(BeTrue())
+		Expect(out.Len()).To(BeZero())
+	})
+})
@@ -0,0 +1,339 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/cloudfoundry/bosh-gcscli/config"
+)
+
+// refreshableTokenSource is an oauth2.TokenSource whose cached token can be
+// discarded on demand.
+//
+// The token sources returned by the oauth2 packages refresh a token once it
+// expires but offer no way to drop a token the server has already rejected.
+// Renewing replaces the underlying source with a fresh one, which has no
+// token cached.
+type refreshableTokenSource struct {
+	renew func() (oauth2.TokenSource, error)
+
+	mu      sync.Mutex
+	current oauth2.TokenSource
+}
+
+func (s *refreshableTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+
+	return current.Token()
+}
+
+func (s *refreshableTokenSource) invalidate() error {
+	source, err := s.renew()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.current = source
+	s.mu.Unlock()
+	return nil
+}
+
+// reauthTransport authenticates requests using source and, when a request is
+// rejected with 401 Unauthorized, refreshes the token and retries it once.
+//
+// Requests whose body cannot be replayed are not retried.
+type reauthTransport struct {
+	source *refreshableTokenSource
+	base   http.RoundTripper
+}
+
+func (t *reauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authenticated := &oauth2.Transport{Source: t.source, Base: t.base}
+
+	resp, err := authenticated.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	log.Printf("DEBUG: %s %s returned 401, refreshing token and retrying\n", req.Method, redactURL(req.URL))
+	if err := t.source.invalidate(); err != nil {
+		log.Printf("WARN: refreshing token failed: %v", err)
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return authenticated.RoundTrip(retry)
+}
+
+// redactedHeaders are never written by dumpTransport as they carry
+// credentials or encryption keys.
+var redactedHeaders = map[string]bool{
+	"Authorization":                     true,
+	"Proxy-Authorization":               true,
+	"X-Goog-Encryption-Key":             true,
+	"X-Goog-Copy-Source-Encryption-Key": true,
+	"X-Goog-Api-Key":                    true,
+}
+
+// redactedParams are the query parameters redactURL hides, in lower case.
+// Each of them grants access on its own: the signature of a signed url, an
+// access token or API key, and the id of a resumable upload session, which
+// anyone can upload to.
+var redactedParams = map[string]bool{
+	"x-goog-signature": true,
+	"signature":        true,
+	"access_token":     true,
+	"key":              true,
+	"upload_id":        true,
+}
+
+// redactURL returns u as a string with any password and the values of
+// redactedParams replaced.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	query := redacted.Query()
+	changed := false
+	for name := range query {
+		if redactedParams[strings.ToLower(name)] {
+			query[name] = []string{"REDACTED"}
+			changed = true
+		}
+	}
+	if changed {
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.Redacted()
+}
+
+// dumpTransport records every request sent through base to out: the method,
+// URL, headers and size of the request and the status and size of its
+// response. Secret headers and query parameters are redacted.
+type dumpTransport struct {
+	base http.RoundTripper
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (t *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "> %s %s\n", req.Method, redactURL(req.URL))
+	writeHeaders(&buf, "> ", req.Header)
+	fmt.Fprintf(&buf, "> (%d bytes)\n", req.ContentLength)
+	if err != nil {
+		fmt.Fprintf(&buf, "< error after %s: %v\n\n", elapsed, err)
+	} else {
+		fmt.Fprintf(&buf, "< %s\n", resp.Status)
+		writeHeaders(&buf, "< ", resp.Header)
+		fmt.Fprintf(&buf, "< (%d bytes, %s)\n\n", resp.ContentLength, elapsed)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, werr := t.out.Write(buf.Bytes()); werr != nil {
+		log.Printf("WARN: writing request dump failed: %v", werr)
+	}
+	return resp, err
+}
+
+func writeHeaders(w io.Writer, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			value = "[REDACTED]"
+		}
+		fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+	}
+}
+
+// traceTransport writes a line to out for every request sent through base,
+// with the method, URL, status and latency and whether and how the request
+// was authorized. Credentials are never written and the URL is redacted
+// as for dumpTransport.
+type traceTransport struct {
+	base http.RoundTripper
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	auth := "no authorization"
+	if scheme, _, ok := strings.Cut(req.Header.Get("Authorization"), " "); ok {
+		auth = "authorization: " + scheme + " [REDACTED]"
+	}
+	outcome := fmt.Sprintf("error %v", err)
+	if err == nil {
+		outcome = resp.Status
+	}
+	line := fmt.Sprintf("%s http: %s %s: %s in %s (%s)\n",
+		start.Format("2006/01/02 15:04:05"), req.Method, redactURL(req.URL), outcome, elapsed, auth)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	io.WriteString(t.out, line) //nolint:errcheck
+	return resp, err
+}
+
+// errRequestTimeout is returned by timeoutTransport when no response to a
+// request arrives in time.
+//
+// It reports itself as temporary so that the storage library retries the
+// request as it would any other transient network error.
+type errRequestTimeout struct {
+	timeout time.Duration
+}
+
+func (e errRequestTimeout) Error() string {
+	return fmt.Sprintf("no response within %s", e.timeout)
+}
+
+func (e errRequestTimeout) Timeout() bool   { return true }
+func (e errRequestTimeout) Temporary() bool { return true }
+
+// timeoutTransport cancels requests sent through base which have not
+// received a response within timeout.
+//
+// Unlike http.Client.Timeout, the timeout covers sending the request and
+// receiving the response headers but not reading the response body, so
+// large downloads are not cut off. For a resumable upload, each chunk is a
+// separate request and is given the full timeout.
+type timeoutTransport struct {
+	timeout time.Duration
+	base    http.RoundTripper
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		cancel()
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, errRequestTimeout{timeout: t.timeout}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the context of a request once its response body
+// is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// userAgentTransport appends userAgent to the User-Agent header of every
+// request sent through base, keeping the storage library's own
+// identification in front of it.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ua := t.userAgent
+	if existing := req.Header.Get("User-Agent"); existing != "" {
+		ua = existing + " " + ua
+	}
+
+	// A RoundTripper must not modify the request it is given.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", ua)
+	return t.base.RoundTrip(req)
+}
+
+// privateAccessVIPs are the host and address range of the Private Google
+// Access VIP of each private_access setting.
+var privateAccessVIPs = map[string][2]string{
+	config.PrivateAccessPrivate:    {"private.googleapis.com", "199.36.153.8/30"},
+	config.PrivateAccessRestricted: {"restricted.googleapis.com", "199.36.153.4/30"},
+}
+
+// dialPrivateAccess returns a DialContext which connects through dial to
+// the VIP of access in place of any *.googleapis.com host. Requests keep
+// their host, which TLS verifies the VIP's certificate against, so only
+// where they are sent changes.
+func dialPrivateAccess(access string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	vip := privateAccessVIPs[access]
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || !strings.HasSuffix(host, ".googleapis.com") {
+			return dial(ctx, network, addr)
+		}
+		conn, err := dial(ctx, network, net.JoinHostPort(vip[0], port))
+		if err != nil {
+			return nil, fmt.Errorf("connecting to %s through %s (%s) for private_access %s: %w; "+
+				"the VPC needs a route to %s through its default internet gateway, and %s must resolve to it",
+				host, vip[0], vip[1], access, err, vip[1], vip[0])
+		}
+		return conn, nil
+	}
+}
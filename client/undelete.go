@@ -0,0 +1,112 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ErrVersioningDisabled is returned by Undelete for a bucket without object
+// versioning, which keeps no generation of a deleted object.
+var ErrVersioningDisabled = errors.New("object versioning is not enabled")
+
+// ErrNoDeletedGeneration is returned by Undelete when no noncurrent
+// generation of the object is kept to restore.
+var ErrNoDeletedGeneration = errors.New("no deleted generation to restore")
+
+// Undelete restores a noncurrent generation of the object dest, as kept on
+// a bucket with object versioning once it is deleted or replaced, by
+// copying it server-side to the live object, and returns the generation of
+// the restored object. Its metadata and storage class are kept.
+//
+// With generation 0, the most recent noncurrent generation is restored,
+// provided dest was deleted: if it is live the error wraps ErrObjectExists.
+// Otherwise that generation is restored, replacing the live dest, if any.
+// Either way the restore only happens if dest was not written since its
+// generations were listed.
+func (client *GCSBlobstore) Undelete(dest string, generation int64) (int64, error) {
+	if client.readOnly() {
+		return 0, ErrInvalidROWriteOperation
+	}
+
+	ctx := client.ctx
+	bucket, err := client.bucketHandle(client.authenticatedGCS).Attrs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("reading bucket '%s': %w", client.config.BucketName, err)
+	}
+	if !bucket.VersioningEnabled {
+		return 0, fmt.Errorf("%w on bucket '%s', so deleted objects are not kept", ErrVersioningDisabled, client.config.BucketName)
+	}
+
+	var live, restore *storage.ObjectAttrs
+	it := client.objects(ctx, client.authenticatedGCS, storage.Query{Prefix: dest, Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("listing generations of '%s': %w", dest, err)
+		}
+		if client.objectName(attrs.Name) != client.objectName(dest) {
+			continue
+		}
+		switch {
+		case attrs.Deleted.IsZero():
+			live = attrs
+		case generation != 0:
+			if attrs.Generation == generation {
+				restore = attrs
+			}
+		case restore == nil || attrs.Generation > restore.Generation:
+			restore = attrs
+		}
+	}
+
+	switch {
+	case generation != 0 && live != nil && live.Generation == generation:
+		return generation, nil
+	case generation != 0 && restore == nil:
+		return 0, fmt.Errorf("%w: '%s' has no noncurrent generation %d", ErrGenerationNotFound, dest, generation)
+	case live != nil && generation == 0:
+		return 0, fmt.Errorf("%w: '%s' is not deleted; give the generation to restore over it", ErrObjectExists, dest)
+	case restore == nil:
+		return 0, fmt.Errorf("%w: '%s' has no noncurrent generation", ErrNoDeletedGeneration, dest)
+	}
+
+	conds := storage.Conditions{DoesNotExist: true}
+	if live != nil {
+		conds = storage.Conditions{GenerationMatch: live.Generation}
+	}
+	src := client.getObjectHandle(client.authenticatedGCS, dest).Generation(restore.Generation)
+	copier := client.getObjectHandle(client.authenticatedGCS, dest).If(conds).CopierFrom(src)
+	copier.ObjectAttrs = copyAttrs(restore)
+	copier.DestinationKMSKeyName = client.config.KMSKeyName
+	restored, err := copier.Run(ctx)
+	if err != nil {
+		err = fmt.Errorf("restoring generation %d of '%s': %w", restore.Generation, dest, err)
+	}
+	client.record("undelete", dest, "", restore.Size, err)
+	if err != nil {
+		return 0, err
+	}
+	return restored.Generation, nil
+}
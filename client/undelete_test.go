@@ -0,0 +1,118 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Undeleting objects", func() {
+	const deletedAt = "2024-01-02T03:04:05Z"
+
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var versioning bool
+	var generations []string
+	var rewrites []url.Values
+
+	BeforeEach(func() {
+		versioning = true
+		generations = []string{
+			`{"name": "blob", "generation": "3", "timeDeleted": "` + deletedAt + `", "metadata": {"release": "cf"}}`,
+			`{"name": "blob", "generation": "5", "timeDeleted": "` + deletedAt + `", "metadata": {"release": "cf"}}`,
+			`{"name": "blob-other", "generation": "9", "timeDeleted": "` + deletedAt + `"}`,
+		}
+		rewrites = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/b/some-bucket"):
+				fmt.Fprintf(w, `{"name": "some-bucket", "versioning": {"enabled": %t}}`, versioning)
+			case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/b/some-bucket/o"):
+				Expect(r.URL.Query().Get("versions")).To(Equal("true"))
+				Expect(r.URL.Query().Get("prefix")).To(Equal("blob"))
+				fmt.Fprintf(w, `{"items": [%s]}`, strings.Join(generations, ","))
+			case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/rewriteTo/"):
+				rewrites = append(rewrites, r.URL.Query())
+				fmt.Fprint(w, `{"done": true, "resource": {"name": "blob", "generation": "10"}}`)
+			default:
+				Fail("unexpected request " + r.Method + " " + r.URL.Path)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("restores the most recent deleted generation, only if the object is still deleted", func() {
+		generation, err := blobstore.Undelete("blob", 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation).To(Equal(int64(10)))
+
+		Expect(rewrites).To(HaveLen(1))
+		Expect(rewrites[0].Get("sourceGeneration")).To(Equal("5"))
+		Expect(rewrites[0].Get("ifGenerationMatch")).To(Equal("0"))
+	})
+
+	It("restores the given generation over the live object", func() {
+		generations = append(generations, `{"name": "blob", "generation": "7"}`)
+
+		_, err := blobstore.Undelete("blob", 0)
+		Expect(errors.Is(err, ErrObjectExists)).To(BeTrue())
+		Expect(rewrites).To(BeEmpty())
+
+		generation, err := blobstore.Undelete("blob", 3)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation).To(Equal(int64(10)))
+		Expect(rewrites).To(HaveLen(1))
+		Expect(rewrites[0].Get("sourceGeneration")).To(Equal("3"))
+		Expect(rewrites[0].Get("ifGenerationMatch")).To(Equal("7"))
+	})
+
+	It("fails without a generation to restore", func() {
+		_, err := blobstore.Undelete("blob", 4)
+		Expect(errors.Is(err, ErrGenerationNotFound)).To(BeTrue())
+
+		generations = nil
+		_, err = blobstore.Undelete("blob", 0)
+		Expect(errors.Is(err, ErrNoDeletedGeneration)).To(BeTrue())
+		Expect(rewrites).To(BeEmpty())
+	})
+
+	It("fails on a bucket without object versioning", func() {
+		versioning = false
+		_, err := blobstore.Undelete("blob", 0)
+		Expect(errors.Is(err, ErrVersioningDisabled)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("bucket 'some-bucket'"))
+		Expect(rewrites).To(BeEmpty())
+	})
+})
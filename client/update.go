@@ -0,0 +1,140 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// MetadataUpdate is a change UpdateMetadata makes to the attributes of an
+// object. Fields left empty are not changed.
+type MetadataUpdate struct {
+	// ContentType replaces the object's content type.
+	ContentType string
+	// Metadata is custom metadata added to the object's, replacing the
+	// value of an existing key.
+	Metadata map[string]string
+	// Unset are the keys of custom metadata removed from the object.
+	Unset []string
+	// TemporaryHold, if set, places or releases the object's temporary
+	// hold.
+	TemporaryHold *bool
+	// EventBasedHold, if set, places or releases the object's event-based
+	// hold.
+	EventBasedHold *bool
+}
+
+// UpdateMetadata changes the content type, custom metadata and holds of the
+// object named dest server-side, without transferring its content, and
+// returns its new attributes. The object keeps its generation.
+//
+// The update is conditional on the object's metadata not having changed
+// since it was read, and on conds, such as a GenerationMatch. If either
+// does not hold, an error wrapping ErrConcurrentUpdate or
+// ErrGenerationMismatch is returned. If conds.MetagenerationMatch is set
+// and the object is at another metageneration, an error wrapping
+// ErrMetagenerationMismatch is returned.
+//
+// GCS merges the custom metadata of an update into the object's, so keys
+// can only be removed by clearing all of it first. Removing keys therefore
+// takes two requests, between which the object briefly has no custom
+// metadata.
+func (client *GCSBlobstore) UpdateMetadata(dest string, update MetadataUpdate, conds storage.Conditions) (*storage.ObjectAttrs, error) {
+	if client.readOnly() {
+		return nil, ErrInvalidROWriteOperation
+	}
+
+	attrs, err := client.updateMetadata(dest, update, conds)
+	client.record("update", dest, "", 0, err)
+	return attrs, err
+}
+
+func (client *GCSBlobstore) updateMetadata(dest string, update MetadataUpdate, conds storage.Conditions) (*storage.ObjectAttrs, error) {
+	handle := client.getObjectHandle(client.authenticatedGCS, dest)
+	current, err := handle.Attrs(client.ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%w: '%s'", ErrObjectNotFound, dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.trimPrefix(current)
+	if conds.GenerationMatch != 0 && current.Generation != conds.GenerationMatch {
+		return nil, fmt.Errorf("%w: '%s' is not at generation %d", ErrGenerationMismatch, dest, conds.GenerationMatch)
+	}
+	if conds.MetagenerationMatch != 0 && current.Metageneration != conds.MetagenerationMatch {
+		return nil, fmt.Errorf("%w: '%s' changed since metageneration %d", ErrMetagenerationMismatch, dest, conds.MetagenerationMatch)
+	}
+
+	var toUpdate storage.ObjectAttrsToUpdate
+	if update.ContentType != "" {
+		toUpdate.ContentType = update.ContentType
+	}
+	toUpdate.Metadata = update.Metadata
+	if update.TemporaryHold != nil {
+		toUpdate.TemporaryHold = *update.TemporaryHold
+	}
+	if update.EventBasedHold != nil {
+		toUpdate.EventBasedHold = *update.EventBasedHold
+	}
+
+	removing := false
+	for _, key := range update.Unset {
+		if _, ok := current.Metadata[key]; ok {
+			removing = true
+		}
+	}
+	if removing {
+		kept := make(map[string]string, len(current.Metadata)+len(update.Metadata))
+		for k, v := range current.Metadata {
+			kept[k] = v
+		}
+		for _, key := range update.Unset {
+			delete(kept, key)
+		}
+		for k, v := range update.Metadata {
+			kept[k] = v
+		}
+
+		// An empty map clears the custom metadata.
+		cleared := toUpdate
+		cleared.Metadata = map[string]string{}
+		current, err = client.patch(handle, current, cleared, conds)
+		if err != nil || len(kept) == 0 {
+			return current, err
+		}
+		toUpdate = storage.ObjectAttrsToUpdate{Metadata: kept}
+	}
+	return client.patch(handle, current, toUpdate, conds)
+}
+
+// patch applies toUpdate to the object handle refers to, provided it is
+// still at the metageneration of current and conds hold.
+func (client *GCSBlobstore) patch(handle *storage.ObjectHandle, current *storage.ObjectAttrs, toUpdate storage.ObjectAttrsToUpdate, conds storage.Conditions) (*storage.ObjectAttrs, error) {
+	conds.MetagenerationMatch = current.Metageneration
+	updated, err := handle.If(conds).Update(client.ctx, toUpdate)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return nil, fmt.Errorf("%w: '%s' changed since it was read", ErrConcurrentUpdate, current.Name)
+	}
+	return client.trimPrefix(updated), err
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"cloud.google.com/go/storage"
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// patch is a metadata update as received by GCS.
+type patch struct {
+	Body                  map[string]interface{}
+	IfMetagenerationMatch string
+}
+
+var _ = Describe("Updating metadata", func() {
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var patches []patch
+	var conflict bool
+
+	BeforeEach(func() {
+		patches = nil
+		conflict = false
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			w.Header().Set("Content-Type", "application/json")
+			metageneration := 3 + len(patches)
+			if r.Method == http.MethodPatch {
+				var body map[string]interface{}
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				patches = append(patches, patch{Body: body, IfMetagenerationMatch: r.URL.Query().Get("ifMetagenerationMatch")})
+				if conflict {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					fmt.Fprint(w, `{"error": {"code": 412, "message": "Precondition Failed"}}`)
+					return
+				}
+				metageneration++
+			}
+			fmt.Fprintf(w, `{"bucket": "some-bucket", "name": "obj", "generation": "7", "metageneration": "%d", "metadata": {"keep": "1", "drop": "2"}}`, metageneration)
+		}))
+
+		blobstore = newEmulatorBlobstore(server, nil)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("sets the content type and metadata in one conditional request", func() {
+		_, err := blobstore.UpdateMetadata("obj", MetadataUpdate{
+			ContentType: "text/plain",
+			Metadata:    map[string]string{"owner": "ci"},
+		}, storage.Conditions{})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(patches).To(HaveLen(1))
+		Expect(patches[0].IfMetagenerationMatch).To(Equal("3"))
+		Expect(patches[0].Body).To(HaveKeyWithValue("contentType", "text/plain"))
+		Expect(patches[0].Body).To(HaveKeyWithValue("metadata", map[string]interface{}{"owner": "ci"}))
+	})
+
+	It("removes keys by clearing the metadata and setting the rest again", func() {
+		_, err := blobstore.UpdateMetadata("obj", MetadataUpdate{
+			Metadata: map[string]string{"owner": "ci"},
+			Unset:    []string{"drop"},
+		}, storage.Conditions{})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(patches).To(HaveLen(2))
+		Expect(patches[0].IfMetagenerationMatch).To(Equal("3"))
+		Expect(patches[0].Body).To(HaveKeyWithValue("metadata", BeNil()))
+		Expect(patches[1].IfMetagenerationMatch).To(Equal("4"))
+		Expect(patches[1].Body).To(HaveKeyWithValue("metadata", map[string]interface{}{"keep": "1", "owner": "ci"}))
+	})
+
+	It("does not update an object at another generation", func() {
+		_, err := blobstore.UpdateMetadata("obj", MetadataUpdate{ContentType: "text/plain"}, storage.Conditions{GenerationMatch: 6})
+		Expect(errors.Is(err, ErrGenerationMismatch)).To(BeTrue())
+		Expect(patches).To(BeEmpty())
+	})
+
+	It("does not update an object whose metadata changed since the metageneration given", func() {
+		_, err := blobstore.UpdateMetadata("obj", MetadataUpdate{ContentType: "text/plain"}, storage.Conditions{MetagenerationMatch: 2})
+		Expect(errors.Is(err, ErrMetagenerationMismatch)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("'obj' changed since metageneration 2")))
+		Expect(patches).To(BeEmpty())
+
+		_, err = blobstore.UpdateMetadata("obj", MetadataUpdate{ContentType: "text/plain"}, storage.Conditions{MetagenerationMatch: 3})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(patches).To(HaveLen(1))
+	})
+
+	It("reports an object changed concurrently", func() {
+		conflict = true
+		_, err := blobstore.UpdateMetadata("obj", MetadataUpdate{ContentType: "text/plain"}, storage.Conditions{})
+		Expect(errors.Is(err, ErrConcurrentUpdate)).To(BeTrue())
+	})
+})
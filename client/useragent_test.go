@@ -0,0 +1,61 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("The User-Agent of requests", func() {
+	var server *httptest.Server
+	var userAgent string
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userAgent = r.Header.Get("User-Agent")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"bucket": "some-bucket", "name": "blob", "size": "3"}`)) //nolint:errcheck
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("identifies bosh-gcscli and its version once", func() {
+		_, err := newEmulatorBlobstore(server, nil).Stat("blob")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(userAgent).To(HaveSuffix(" bosh-gcscli/dev"))
+		Expect(strings.Count(userAgent, "bosh-gcscli")).To(Equal(1))
+	})
+
+	It("appends the configured user_agent", func() {
+		_, err := newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.UserAgent = "deployment/cf"
+		}).Stat("blob")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(userAgent).To(HaveSuffix(" bosh-gcscli/dev deployment/cf"))
+		Expect(strings.Count(userAgent, "bosh-gcscli")).To(Equal(1))
+	})
+})
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Requester-pays buckets", func() {
+	var server *httptest.Server
+	var mu sync.Mutex
+	var billed []string
+
+	BeforeEach(func() {
+		billed = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The JSON API takes the project as a parameter, the XML API
+			// used for downloads as a header.
+			project := r.URL.Query().Get("userProject")
+			if project == "" {
+				project = r.Header.Get("X-Goog-User-Project")
+			}
+			mu.Lock()
+			billed = append(billed, r.Method+" "+project)
+			mu.Unlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "No such object"}}`)) //nolint:errcheck
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newBlobstore := func(userProject string) *GCSBlobstore {
+		return newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.UserProject = userProject
+		})
+	}
+
+	It("bills every request to the configured user project", func() {
+		blobstore := newBlobstore("billing-project")
+
+		blobstore.Stat("obj")                                      //nolint:errcheck
+		blobstore.Get("obj", &bytes.Buffer{})                      //nolint:errcheck
+		blobstore.Exists("obj")                                    //nolint:errcheck
+		blobstore.Delete("obj")                                    //nolint:errcheck
+		blobstore.Put2(strings.NewReader("content"), "obj", false) //nolint:errcheck
+		blobstore.List("prefix", nil)                              //nolint:errcheck
+
+		Expect(billed).ToNot(BeEmpty())
+		for _, request := range billed {
+			Expect(request).To(HaveSuffix(" billing-project"))
+		}
+	})
+
+	It("bills requests to the bucket's project by default", func() {
+		newBlobstore("").Stat("obj") //nolint:errcheck
+
+		Expect(billed).ToNot(BeEmpty())
+		for _, request := range billed {
+			Expect(request).To(Equal("GET "))
+		}
+	})
+})
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+)
+
+// ErrVerifyMismatch is returned by Verify when an object differs from the
+// local file in size or CRC32C.
+var ErrVerifyMismatch = errors.New("object does not match local file")
+
+// Verify compares the object remoteName with the file at localPath, as
+// NeedsUpload does, by the size and CRC32C GCS stores for it rather than by
+// downloading it. It returns an error wrapping ErrVerifyMismatch if they
+// differ, and ErrObjectNotFound if the object does not exist.
+//
+// An object stored with gzip content-encoding has the size and CRC32C of
+// its compressed bytes, so unless no_decompress is configured it is
+// downloaded, decompressed and hashed instead, with a warning.
+func (client *GCSBlobstore) Verify(remoteName, localPath string) error {
+	size, crc, err := fileCRC32C(localPath)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := client.Stat(remoteName)
+	if err != nil {
+		return err
+	}
+
+	remoteSize, remoteCRC := attrs.Size, attrs.CRC32C
+	if attrs.ContentEncoding == "gzip" && !client.config.NoDecompress {
+		log.Printf("WARN: '%s' is stored gzip-encoded, so its stored CRC32C is not of its content: downloading it to compare\n", remoteName)
+		hash := crc32.New(crc32cTable)
+		counter := &countingWriter{w: hash}
+		if err := client.getUncached(remoteName, attrs, counter); err != nil {
+			return err
+		}
+		remoteSize, remoteCRC = counter.n, hash.Sum32()
+	}
+
+	if remoteSize != size {
+		return fmt.Errorf("%w: '%s' is %d bytes, '%s' is %d bytes", ErrVerifyMismatch, remoteName, remoteSize, localPath, size)
+	}
+	if remoteCRC != crc {
+		return fmt.Errorf("%w: '%s' has CRC32C %d, '%s' has %d", ErrVerifyMismatch, remoteName, remoteCRC, localPath, crc)
+	}
+	return nil
+}
+
+// countingWriter writes to w, counting the bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Verifying an object against a local file", func() {
+	const content = "0123456789"
+
+	var server *httptest.Server
+	var blobstore *GCSBlobstore
+	var localPath string
+	var downloads int
+
+	crc32c := func(data string) string {
+		sum := make([]byte, 4)
+		binary.BigEndian.PutUint32(sum, crc32.Checksum([]byte(data), crc32.MakeTable(crc32.Castagnoli)))
+		return base64.StdEncoding.EncodeToString(sum)
+	}
+
+	BeforeEach(func() {
+		downloads = 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/o/obj"):
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"bucket": "some-bucket", "name": "obj", "generation": "7", "size": "%d", "crc32c": %q}`, len(content), crc32c(content))
+			case strings.HasSuffix(r.URL.Path, "/o/compressed"):
+				// The size and CRC32C of the compressed bytes.
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"bucket": "some-bucket", "name": "compressed", "generation": "7", "size": "30", "crc32c": %q, "contentEncoding": "gzip"}`, crc32c("compressed"))
+			case strings.HasSuffix(r.URL.Path, "/some-bucket/compressed"):
+				// As GCS does when decompressing a gzip-encoded object.
+				downloads++
+				w.Header().Set("X-Goog-Generation", "7")
+				w.Header().Set("X-Goog-Stored-Content-Encoding", "gzip")
+				w.Write([]byte(content)) //nolint:errcheck
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+		blobstore = newEmulatorBlobstore(server, func(cfg *config.GCSCli) {
+			cfg.MaxAttempts = 1
+		})
+
+		localPath = filepath.Join(tempDir(), "file")
+		Expect(os.WriteFile(localPath, []byte(content), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("succeeds when the size and CRC32C match", func() {
+		Expect(blobstore.Verify("obj", localPath)).To(Succeed())
+	})
+
+	It("reports a different size as a mismatch", func() {
+		Expect(os.WriteFile(localPath, []byte(content+"0"), 0600)).To(Succeed())
+		err := blobstore.Verify("obj", localPath)
+		Expect(err).To(MatchError(ErrVerifyMismatch))
+		Expect(err).To(MatchError(ContainSubstring("'obj' is 10 bytes")))
+	})
+
+	It("reports a different CRC32C as a mismatch", func() {
+		Expect(os.WriteFile(localPath, []byte("9876543210"), 0600)).To(Succeed())
+		err := blobstore.Verify("obj", localPath)
+		Expect(err).To(MatchError(ErrVerifyMismatch))
+		Expect(err).To(MatchError(ContainSubstring("CRC32C")))
+	})
+
+	It("returns ErrObjectNotFound for a missing object", func() {
+		Expect(blobstore.Verify("missing", localPath)).To(MatchError(ErrObjectNotFound))
+	})
+
+	It("downloads and hashes an object stored gzip-encoded", func() {
+		Expect(blobstore.Verify("compressed", localPath)).To(Succeed())
+		Expect(downloads).To(Equal(1))
+
+		Expect(os.WriteFile(localPath, []byte("9876543210"), 0600)).To(Succeed())
+		Expect(blobstore.Verify("compressed", localPath)).To(MatchError(ErrVerifyMismatch))
+	})
+})
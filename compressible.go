@@ -0,0 +1,134 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"strings"
+)
+
+// maxGzipRatio is the largest size of a compressed sample, relative to the
+// sample, for which put -z still compresses an upload. Data which gzip
+// cannot shrink by more than this, such as a tarball or an image, is
+// uploaded as is.
+const maxGzipRatio = 0.9
+
+// maxStdinGzipSample caps the sample of an upload from stdin, which has to
+// be held in memory until it is uploaded. A larger -gzip-sample-size is not
+// sampled from stdin, which is then always compressed.
+const maxStdinGzipSample = 1 << 20
+
+// gzipMagic starts every gzip stream: the gzip ID bytes and the deflate
+// compression method.
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+// detectGzip reports whether the upload of src is already gzip-compressed,
+// by the magic number it starts with, so put -z does not compress it again.
+// A file is read in place; stdin, read from source, is read ahead, and the
+// returned reader must be uploaded in place of source.
+//
+// The name of src is not trusted: a .gz file which does not start with the
+// magic number is logged and compressed as any other.
+func detectGzip(src string, file *os.File, source io.Reader) (bool, io.Reader, error) {
+	head := make([]byte, len(gzipMagic))
+	var n int
+	var err error
+	if src == "-" {
+		n, err = io.ReadFull(source, head)
+		source = io.MultiReader(bytes.NewReader(head[:n]), source)
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+	} else {
+		n, err = file.ReadAt(head, 0)
+	}
+	if err != nil && err != io.EOF {
+		return false, nil, err
+	}
+
+	gzipped := bytes.Equal(head[:n], gzipMagic)
+	if !gzipped && (strings.HasSuffix(src, ".gz") || strings.HasSuffix(src, ".tgz")) {
+		log.Printf("WARN: '%s' is named as a gzip file but is not gzip-compressed\n", src)
+	}
+	return gzipped, source, nil
+}
+
+// sampleGzip decides whether put -z compresses the upload of src, by
+// compressing its first sampleSize bytes. A file is sampled in place;
+// stdin, read from source, is sampled by buffering the sample, and the
+// returned reader must be uploaded in place of source.
+func sampleGzip(src string, file *os.File, source io.Reader, sampleSize int64) (bool, io.Reader, error) {
+	var sample []byte
+	if src == "-" {
+		if sampleSize > maxStdinGzipSample {
+			log.Printf("DEBUG: compressing stdin without sampling it: gzip-sample-size is above %d bytes\n", maxStdinGzipSample)
+			return true, source, nil
+		}
+		var err error
+		sample, err = io.ReadAll(io.LimitReader(source, sampleSize))
+		if err != nil {
+			return false, nil, err
+		}
+		source = io.MultiReader(bytes.NewReader(sample), source)
+	} else {
+		sample = make([]byte, sampleSize)
+		n, err := file.ReadAt(sample, 0)
+		if err != nil && err != io.EOF {
+			return false, nil, err
+		}
+		sample = sample[:n]
+	}
+
+	if len(sample) == 0 {
+		return true, source, nil
+	}
+	ratio, err := gzipRatio(sample)
+	if err != nil {
+		return false, nil, err
+	}
+	if ratio > maxGzipRatio {
+		log.Printf("DEBUG: uploading '%s' uncompressed: the first %d bytes only compress to %.0f%% of their size\n", src, len(sample), ratio*100)
+		return false, source, nil
+	}
+	log.Printf("DEBUG: compressing '%s': the first %d bytes compress to %.0f%% of their size\n", src, len(sample), ratio*100)
+	return true, source, nil
+}
+
+// gzipRatio returns the size of data compressed with gzip relative to its
+// own size.
+func gzipRatio(data []byte) (float64, error) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(data); err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	return float64(compressed.Len()) / float64(len(data)), nil
+}
+
+// isGzipType reports whether contentType is that of a gzip file.
+func isGzipType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/gzip" || mediaType == "application/x-gzip"
+}
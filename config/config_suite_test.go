@@ -20,6 +20,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"os"
 	"testing"
 )
 
@@ -27,3 +28,22 @@ func TestConfig(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Config Suite")
 }
+
+// tempDirs are the directories created by tempDir for the current spec.
+var tempDirs []string
+
+// tempDir returns a new temporary directory, removed once the current spec
+// ends. Ginkgo v1 does not implement GinkgoT().TempDir, which returns "".
+func tempDir() string {
+	dir, err := os.MkdirTemp("", "bosh-gcscli-test")
+	Expect(err).ToNot(HaveOccurred())
+	tempDirs = append(tempDirs, dir)
+	return dir
+}
+
+var _ = AfterEach(func() {
+	for _, dir := range tempDirs {
+		os.RemoveAll(dir)
+	}
+	tempDirs = nil
+})
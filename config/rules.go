@@ -0,0 +1,200 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StorageClasses are the storage classes objects may be uploaded with.
+var StorageClasses = []string{
+	"STANDARD",
+	"NEARLINE",
+	"COLDLINE",
+	"ARCHIVE",
+	"MULTI_REGIONAL",
+	"REGIONAL",
+	"DURABLE_REDUCED_AVAILABILITY",
+}
+
+// ErrUnknownStorageClass is returned when a storage class is not one of
+// StorageClasses.
+var ErrUnknownStorageClass = errors.New("unknown storage class")
+
+// ParseStorageClass returns class in upper case, the form GCS expects, or an
+// error wrapping ErrUnknownStorageClass if it is not a storage class.
+func ParseStorageClass(class string) (string, error) {
+	upper := strings.ToUpper(class)
+	for _, known := range StorageClasses {
+		if upper == known {
+			return upper, nil
+		}
+	}
+	return "", fmt.Errorf("%w %q: must be one of %s", ErrUnknownStorageClass, class, strings.Join(StorageClasses, ", "))
+}
+
+// NormalizeLocation returns location in upper case, the form GCS reports
+// locations in. Whether it is a location is left to GCS, as new ones are
+// added over time.
+func NormalizeLocation(location string) string {
+	return strings.ToUpper(strings.TrimSpace(location))
+}
+
+// NormalizePrefix returns prefix as a directory: without a leading slash
+// or repeated slashes, and ending with a single slash, so that appending an
+// id to it never produces "//". An empty prefix stays empty.
+func NormalizePrefix(prefix string) string {
+	var parts []string
+	for _, part := range strings.Split(strings.TrimSpace(prefix), "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, "/") + "/"
+}
+
+// sizeUnits are the suffixes accepted by ParseSize, longest first so that
+// "KiB" is not mistaken for "B".
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseSize parses a size in bytes with an optional unit suffix, such as
+// "512", "10MB" or "1GiB". KB, MB, GB and TB are powers of 1000; KiB, MiB,
+// GiB and TiB are powers of 1024. Sizes beyond an int64 are rejected.
+func ParseSize(value string) (int64, error) {
+	number, multiplier := value, int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			number, multiplier = strings.TrimSuffix(value, unit.suffix), unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return n * multiplier, nil
+}
+
+// SizeClassRule selects StorageClass for objects of at least MinSize bytes.
+type SizeClassRule struct {
+	MinSize      int64
+	StorageClass string
+}
+
+// SizeClassRules choose the storage class of an upload from its size.
+//
+// In JSON, the rules are given as a string in the form accepted by
+// ParseSizeClassRules.
+type SizeClassRules []SizeClassRule
+
+// ParseSizeClassRules parses a comma separated list of size:class rules
+// such as "10MB:NEARLINE,1GB:COLDLINE". The rules are returned ordered by
+// size.
+func ParseSizeClassRules(spec string) (SizeClassRules, error) {
+	var rules SizeClassRules
+	seen := map[int64]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		size, class, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid size class rule %q: expected size:class", part)
+		}
+
+		minSize, err := ParseSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size class rule %q: %v", part, err)
+		}
+		if class, err = ParseStorageClass(class); err != nil {
+			return nil, fmt.Errorf("invalid size class rule %q: %v", part, err)
+		}
+		if seen[minSize] {
+			return nil, fmt.Errorf("invalid size class rule %q: more than one rule for %d bytes", part, minSize)
+		}
+		seen[minSize] = true
+
+		rules = append(rules, SizeClassRule{MinSize: minSize, StorageClass: class})
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].MinSize < rules[j].MinSize })
+	return rules, nil
+}
+
+// UnmarshalJSON parses rules from a JSON string.
+func (r *SizeClassRules) UnmarshalJSON(data []byte) error {
+	var spec string
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	if spec == "" {
+		*r = nil
+		return nil
+	}
+
+	rules, err := ParseSizeClassRules(spec)
+	if err != nil {
+		return err
+	}
+	*r = rules
+	return nil
+}
+
+// String returns the rules in the form parsed by ParseSizeClassRules, with
+// sizes in bytes.
+func (r SizeClassRules) String() string {
+	parts := make([]string, len(r))
+	for i, rule := range r {
+		parts[i] = fmt.Sprintf("%d:%s", rule.MinSize, rule.StorageClass)
+	}
+	return strings.Join(parts, ",")
+}
+
+// MarshalJSON encodes rules as a JSON string, as read by UnmarshalJSON.
+func (r SizeClassRules) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// StorageClass returns the storage class of the rule with the largest
+// MinSize not exceeding size, or STANDARD if size is below every rule.
+func (r SizeClassRules) StorageClass(size int64) string {
+	class := "STANDARD"
+	for _, rule := range r {
+		if size < rule.MinSize {
+			break
+		}
+		class = rule.StorageClass
+	}
+	return class
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	. "github.com/cloudfoundry/bosh-gcscli/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sizes", func() {
+	It("parses sizes with a unit", func() {
+		for value, expected := range map[string]int64{"512": 512, "10MB": 10e6, "1GiB": 1 << 30, "8388607TiB": 8388607 << 40} {
+			size, err := ParseSize(value)
+			Expect(err).ToNot(HaveOccurred(), value)
+			Expect(size).To(Equal(expected), value)
+		}
+	})
+
+	It("rejects sizes too large for an int64", func() {
+		for _, value := range []string{"9999999999TB", "8388608TiB", "9223372036854775808"} {
+			_, err := ParseSize(value)
+			Expect(err).To(HaveOccurred(), value)
+		}
+	})
+})
+
+var _ = Describe("Storage classes", func() {
+	It("accepts known classes in any case, returning them in upper case", func() {
+		for _, class := range []string{"nearline", "Coldline", "MULTI_REGIONAL", "archive"} {
+			parsed, err := ParseStorageClass(class)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed).To(Equal(strings.ToUpper(class)))
+		}
+	})
+
+	It("returns an error listing the valid classes for an unknown class", func() {
+		_, err := ParseStorageClass("FAST")
+		Expect(err).To(MatchError(ErrUnknownStorageClass))
+		Expect(err.Error()).To(ContainSubstring("STANDARD, NEARLINE, COLDLINE, ARCHIVE, MULTI_REGIONAL, REGIONAL"))
+	})
+})
+
+var _ = Describe("Locations", func() {
+	It("returns locations in upper case without surrounding space", func() {
+		Expect(NormalizeLocation(" us-central1")).To(Equal("US-CENTRAL1"))
+		Expect(NormalizeLocation("eu")).To(Equal("EU"))
+		Expect(NormalizeLocation("")).To(Equal(""))
+	})
+})
+
+var _ = Describe("Prefixes", func() {
+	It("returns prefixes as a directory without repeated slashes", func() {
+		Expect(NormalizePrefix("staging")).To(Equal("staging/"))
+		Expect(NormalizePrefix("/staging//env-1/")).To(Equal("staging/env-1/"))
+		Expect(NormalizePrefix("/")).To(Equal(""))
+		Expect(NormalizePrefix("")).To(Equal(""))
+	})
+})
+
+var _ = Describe("Size class rules", func() {
+	Describe("when the rules are valid", func() {
+		It("chooses the class of the largest threshold not exceeding the size", func() {
+			rules, err := ParseSizeClassRules("1GB:COLDLINE, 10MB:nearline")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules).To(Equal(SizeClassRules{
+				{MinSize: 10e6, StorageClass: "NEARLINE"},
+				{MinSize: 1e9, StorageClass: "COLDLINE"},
+			}))
+
+			Expect(rules.StorageClass(0)).To(Equal("STANDARD"))
+			Expect(rules.StorageClass(10e6 - 1)).To(Equal("STANDARD"))
+			Expect(rules.StorageClass(10e6)).To(Equal("NEARLINE"))
+			Expect(rules.StorageClass(5e9)).To(Equal("COLDLINE"))
+		})
+
+		It("accepts binary units and plain byte counts", func() {
+			rules, err := ParseSizeClassRules("1KiB:NEARLINE,4096:COLDLINE")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules[0].MinSize).To(Equal(int64(1024)))
+			Expect(rules[1].MinSize).To(Equal(int64(4096)))
+		})
+	})
+
+	Describe("when the rules are invalid", func() {
+		It("returns an error", func() {
+			for _, spec := range []string{"", "10MB", "10XB:NEARLINE", "-1:NEARLINE", "10MB:FAST", "1MB:NEARLINE,1000KB:COLDLINE", "9999999999TB:NEARLINE"} {
+				_, err := ParseSizeClassRules(spec)
+				Expect(err).To(HaveOccurred(), spec)
+			}
+		})
+	})
+
+	Describe("when size_class_rules is in the config", func() {
+		It("parses the rules", func() {
+			c, err := NewFromReader(bytes.NewReader([]byte(`{"bucket_name": "some-bucket", "size_class_rules": "10MB:NEARLINE"}`)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.SizeClassRules).To(Equal(SizeClassRules{{MinSize: 10e6, StorageClass: "NEARLINE"}}))
+		})
+
+		It("returns an error for invalid rules", func() {
+			_, err := NewFromReader(bytes.NewReader([]byte(`{"bucket_name": "some-bucket", "size_class_rules": "10MB:FAST"}`)))
+			Expect(err).To(MatchError(ContainSubstring("unknown storage class")))
+		})
+	})
+
+	Describe("when the rules are encoded as JSON", func() {
+		It("round-trips them", func() {
+			rules, err := ParseSizeClassRules("10MB:NEARLINE,1GiB:COLDLINE")
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := json.Marshal(rules)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal(`"10000000:NEARLINE,1073741824:COLDLINE"`))
+
+			var decoded SizeClassRules
+			Expect(json.Unmarshal(data, &decoded)).To(Succeed())
+			Expect(decoded).To(Equal(rules))
+		})
+	})
+})
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// download is the file get writes an object into. It is usually a
+// temporary file next to the destination, which only replaces the
+// destination once commit is called, so a failed or interrupted get never
+// leaves a truncated file at the destination.
+type download struct {
+	*os.File
+	// out, if set, is written instead of File, e.g. stdout.
+	out io.Writer
+	// dest is the path the temporary file is renamed to by commit, or empty
+	// if the file is written in place.
+	dest string
+	// created is set if get created dest, or the file written in place, so
+	// abort removes it.
+	created bool
+}
+
+// openDownload opens the download for get into path, handling an existing
+// file at path as selected by onExists, as createDestination does. For
+// onExistsSkip, a nil download is returned if path exists.
+//
+// A destination which exists but is not a regular file, such as /dev/null,
+// is written in place, as is one in a directory where no temporary file can
+// be created. The latter loses the guarantee that a failed get leaves an
+// existing destination as it was: it is truncated as soon as the download
+// starts, though never removed.
+func openDownload(path, onExists string) (*download, error) {
+	// created is set if get reserved path itself, and existed unless path
+	// is known not to exist, so a download written in place only removes a
+	// file it created.
+	created, existed := false, true
+	if onExists == onExistsOverwrite {
+		info, err := os.Stat(path)
+		if err == nil && !info.Mode().IsRegular() {
+			file, err := os.Create(path)
+			if err != nil {
+				return nil, err
+			}
+			return &download{File: file}, nil
+		}
+		existed = !errors.Is(err, fs.ErrNotExist)
+	} else {
+		// The destination is created empty, reserving its name, and only
+		// gets content once the download succeeds.
+		reserved, err := createDestination(path, onExists)
+		if reserved == nil || err != nil {
+			return nil, err
+		}
+		reserved.Close()
+		path, created = reserved.Name(), true
+	}
+
+	temp, err := createTempBeside(path)
+	if err != nil {
+		log.Printf("WARN: downloading directly to '%s': %v\n", path, err)
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		return &download{File: file, created: created || !existed}, nil
+	}
+	return &download{File: temp, dest: path, created: created}, nil
+}
+
+// createTempBeside creates a new file named path.tmp-<random> for writing.
+// Unlike os.CreateTemp, it is created with mode 0666 before the umask, the
+// mode os.Create gives the destination.
+func createTempBeside(path string) (*os.File, error) {
+	suffix := make([]byte, 4)
+	for {
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		name := fmt.Sprintf("%s.tmp-%s", path, hex.EncodeToString(suffix))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !errors.Is(err, fs.ErrExist) {
+			return file, err
+		}
+	}
+}
+
+func (d *download) Write(p []byte) (int, error) {
+	if d.out != nil {
+		return d.out.Write(p)
+	}
+	return d.File.Write(p)
+}
+
+// Name returns the path the download ends up at.
+func (d *download) Name() string {
+	if d.dest != "" {
+		return d.dest
+	}
+	return d.File.Name()
+}
+
+// commit moves a completed download into place. If the temporary file
+// cannot be renamed over the destination, e.g. because the destination is
+// a mount point, its content is copied into the destination instead.
+func (d *download) commit() error {
+	if d.File == nil {
+		return nil
+	}
+	if d.dest == "" {
+		return d.File.Close()
+	}
+	if err := d.File.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(d.File.Name(), d.dest); err != nil {
+		log.Printf("WARN: copying download to '%s' as it cannot be renamed into place: %v\n", d.dest, err)
+		err = copyFile(d.File.Name(), d.dest)
+		os.Remove(d.File.Name())
+		return err
+	}
+	return nil
+}
+
+// abort removes the files of a failed download. An existing destination is
+// left as it was, unless it was being written in place.
+func (d *download) abort() {
+	if d.File == nil {
+		return
+	}
+	d.File.Close()
+	if d.dest != "" {
+		os.Remove(d.File.Name())
+		if d.created {
+			os.Remove(d.dest)
+		}
+		return
+	}
+	if d.created {
+		os.Remove(d.File.Name())
+	}
+}
+
+// copyFile replaces the content of the file at dst with that of src.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
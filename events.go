@@ -0,0 +1,200 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// event is a line written to stdout by -json-events. Fields which do not
+// apply to an event are omitted; the schema is documented in the README
+// under "Machine-readable events", and fields are only ever added to it.
+type event struct {
+	// Event is the kind of event: log, progress, output, result,
+	// upload_complete, download_complete, command_complete or
+	// command_failed.
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// Command is the command the event belongs to, once it is known.
+	Command string `json:"command,omitempty"`
+
+	// Level and Message are those of a log event.
+	Level   string `json:"level,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Object is the object uploaded or downloaded, and Path the local
+	// file it was read from or written to.
+	Object     string `json:"object,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Bytes      *int64 `json:"bytes,omitempty"`
+	Total      *int64 `json:"total,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+
+	// Output is a line the command printed, and Result what it printed as
+	// JSON, such as the metadata printed by stat -json.
+	Output string          `json:"output,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+
+	// ExitCode and Error are how the command ended.
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// events writes the events of the current run if -json-events was given,
+// and is nil otherwise.
+var events *eventWriter
+
+// eventWriter writes events to out, one JSON object per line. A nil
+// *eventWriter writes nothing.
+type eventWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+	// command is the command being run, once known.
+	command string
+	// lastError is the last error logged, which command_failed reports.
+	lastError string
+	// output is what the command printed to stdout, reported when it
+	// ends.
+	output bytes.Buffer
+}
+
+func newEventWriter(out io.Writer) *eventWriter {
+	return &eventWriter{out: out}
+}
+
+// emit writes e, stamped with the time and the command.
+func (w *eventWriter) emit(e event) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.emitLocked(e)
+}
+
+func (w *eventWriter) emitLocked(e event) {
+	e.Time = time.Now().UTC()
+	e.Command = w.command
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	// A single write per event keeps lines whole.
+	w.out.Write(append(line, '\n')) //nolint:errcheck
+}
+
+// setCommand makes later events belong to cmd.
+func (w *eventWriter) setCommand(cmd string) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.command = cmd
+}
+
+// log writes a log event for message, logged at level.
+func (w *eventWriter) log(level logLevel, message string) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if level == levelError {
+		w.lastError = message
+	}
+	w.emitLocked(event{Event: "log", Level: level.String(), Message: message})
+}
+
+// stdout returns the writer commands print their output to in place of
+// stdout. The output is reported once the command ends, by finish.
+func (w *eventWriter) stdout() io.Writer {
+	return eventOutput{w}
+}
+
+type eventOutput struct {
+	w *eventWriter
+}
+
+func (o eventOutput) Write(p []byte) (int, error) {
+	o.w.mu.Lock()
+	defer o.w.mu.Unlock()
+	return o.w.output.Write(p)
+}
+
+// finish reports what the command printed and how it ended, with the exit
+// status code.
+//
+// Output which is a JSON object or array, such as that of stat -json, is
+// reported as a single result event. Otherwise each line is an output
+// event, or a result event if it is a JSON object itself, as with list
+// -list-format ndjson.
+func (w *eventWriter) finish(code int) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if output := bytes.TrimSpace(w.output.Bytes()); isJSONValue(output) {
+		w.emitLocked(event{Event: "result", Result: compactJSON(output)})
+	} else if len(output) > 0 {
+		for _, line := range bytes.Split(output, []byte("\n")) {
+			if isJSONValue(line) {
+				w.emitLocked(event{Event: "result", Result: compactJSON(line)})
+			} else {
+				w.emitLocked(event{Event: "output", Output: string(line)})
+			}
+		}
+	}
+	w.output.Reset()
+
+	if code == 0 {
+		w.emitLocked(event{Event: "command_complete", ExitCode: &code})
+		return
+	}
+	w.emitLocked(event{Event: "command_failed", ExitCode: &code, Error: w.lastError})
+}
+
+// isJSONValue reports whether data is a JSON object or array. Other JSON
+// values, such as the generation put prints, are reported as output.
+func isJSONValue(data []byte) bool {
+	return len(data) > 0 && (data[0] == '{' || data[0] == '[') && json.Valid(data)
+}
+
+func compactJSON(data []byte) json.RawMessage {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return data
+	}
+	return compact.Bytes()
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/cloudfoundry/bosh-gcscli/client"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Exit codes distinguishing why a command failed. 2 is left to the flag
+// package, which exits with it on invalid flags.
+const (
+	// exitFailure is any failure not covered by a more specific code.
+	exitFailure = 1
+	// exitUsage means the command line could not be parsed, as reported by
+	// the flag package.
+	exitUsage = 2
+	// exitNotFound means the object, the requested generation of it or the
+	// bucket does not exist. exists exits with it for a missing object, and
+	// undelete for an object without a deleted generation.
+	exitNotFound = 3
+	// exitAuth means the request was not authenticated or not authorized,
+	// or a write was attempted without credentials.
+	exitAuth = 4
+	// exitTransient means GCS or the network failed in a way that may
+	// succeed if the command is run again, including timeouts. exists
+	// exits with it when it cannot tell whether the object exists.
+	exitTransient = 5
+	// exitPrecondition means a conditional write found the object existing
+	// or at another generation, or delete found it under a hold, and
+	// nothing was written.
+	exitPrecondition = 6
+	// exitSourceNotDeleted means move copied the object but could not
+	// delete the source, so both exist.
+	exitSourceNotDeleted = 7
+	// exitPermission means config validate or info authenticated but was
+	// denied access to the bucket. Other commands exit with exitAuth
+	// instead.
+	exitPermission = 8
+	// exitDestinationExists means get found its destination file existing
+	// with -no-clobber or -on-exists fail, and downloaded nothing.
+	exitDestinationExists = 9
+	// exitBucketExists means mb found the bucket existing, or its name
+	// taken by a bucket the credentials cannot access.
+	exitBucketExists = 10
+	// exitBucketNotEmpty means rb found objects or noncurrent generations
+	// left in the bucket, and did not remove it.
+	exitBucketNotEmpty = 11
+	// exitMismatch means verify found the object differing from the local
+	// file in size or CRC32C, or the MD5 GCS computed for an upload differs
+	// from that of the bytes sent.
+	exitMismatch = 12
+	// exitChanged means delete or update -if-metageneration-match found the
+	// object's metadata changed since that metageneration, and left it
+	// alone.
+	exitChanged = 13
+	// exitInterrupted means the command was stopped by SIGINT or SIGTERM,
+	// 128 plus the number of SIGINT as shells report it.
+	exitInterrupted = 130
+)
+
+// exitCodeForError returns the exit code a command failing with err exits
+// with.
+func exitCodeForError(err error) int {
+	var apiErr *googleapi.Error
+	var retrieveErr *oauth2.RetrieveError
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, client.ErrSourceNotDeleted):
+		return exitSourceNotDeleted
+	case errors.Is(err, errDestinationExists):
+		return exitDestinationExists
+	case errors.Is(err, client.ErrBucketExists), errors.Is(err, client.ErrBucketNameTaken):
+		return exitBucketExists
+	case errors.Is(err, client.ErrBucketNotEmpty):
+		return exitBucketNotEmpty
+	case errors.Is(err, client.ErrVerifyMismatch), errors.Is(err, client.ErrUploadChecksumMismatch):
+		return exitMismatch
+	case errors.Is(err, client.ErrMetagenerationMismatch):
+		return exitChanged
+	case errors.Is(err, client.ErrObjectNotFound), errors.Is(err, client.ErrGenerationNotFound), errors.Is(err, client.ErrNoDeletedGeneration), errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist):
+		return exitNotFound
+	case errors.Is(err, client.ErrInvalidROWriteOperation), errors.As(err, &retrieveErr):
+		return exitAuth
+	case errors.Is(err, client.ErrObjectExists), errors.Is(err, client.ErrGenerationMismatch), errors.Is(err, client.ErrConcurrentUpdate), errors.Is(err, client.ErrObjectHeld):
+		return exitPrecondition
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed:
+		return exitPrecondition
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		return exitNotFound
+	case errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden):
+		return exitAuth
+	case errors.As(err, &opErr), errors.As(err, &dnsErr), errors.Is(err, context.DeadlineExceeded), storage.ShouldRetry(err):
+		// Failing to dial or resolve GCS is transient, unlike other errors
+		// of the http client such as an untrusted certificate.
+		return exitTransient
+	}
+	return exitFailure
+}
+
+// accessErrorCategory returns the category config validate and info report
+// err, the failure to access the bucket, as and the exit code for it: "auth"
+// for invalid or missing credentials, "permission" for credentials denied
+// access, "not-found" for a missing bucket and "network" for a failure to
+// reach GCS at all.
+func accessErrorCategory(err error) (string, int) {
+	var apiErr *googleapi.Error
+	var retrieveErr *oauth2.RetrieveError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+		return "permission", exitPermission
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized, errors.As(err, &retrieveErr):
+		return "auth", exitAuth
+	case errors.Is(err, storage.ErrBucketNotExist), errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		return "not-found", exitNotFound
+	case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded), storage.ShouldRetry(err):
+		return "network", exitTransient
+	}
+	return "unknown", exitFailure
+}
+
+// withRequesterPaysHint adds a hint to set -user-project to err if it is
+// GCS refusing a request to a requester-pays bucket for not naming a
+// project to bill.
+func withRequesterPaysHint(err error) error {
+	// The JSON API rejects such a request as a bad request, the XML API
+	// used for downloads with a UserProjectMissing code.
+	message := err.Error()
+	if strings.Contains(strings.ToLower(message), "requester pays") || strings.Contains(message, "UserProjectMissing") {
+		return fmt.Errorf("%w; the bucket is requester pays, set -user-project or user_project to the project to bill", err)
+	}
+	return err
+}
+
+// requestIDHeader is the response header GCS identifies each request by,
+// which Google support asks for when investigating a failure.
+const requestIDHeader = "X-Guploader-Uploadid"
+
+// withRequestID adds the id GCS gave the request to err if err is the
+// response of GCS, so that a failure can be reported to Google support.
+// Other errors, such as failures to connect, have no id.
+func withRequestID(err error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	if id := apiErr.Header.Get(requestIDHeader); id != "" {
+		return fmt.Errorf("%w (request id: %s)", err, id)
+	}
+	return err
+}
+
+// fatalOperation logs err, the failure of the operation cmd, and exits with
+// the code for err.
+func fatalOperation(cmd string, err error) {
+	log.Printf("performing operation %s: %s\n", cmd, withRequestID(withRequesterPaysHint(err)))
+	exit(exitCodeForError(err))
+}
+
+// exitCode is what exit panics with to unwind run, which recovers it and
+// returns the code.
+type exitCode int
+
+// exit ends run with code, from however deep in the command it is called.
+// Unlike os.Exit, the deferred calls of run and of the functions it called
+// are run, and tests can drive run without exiting.
+func exit(code int) {
+	panic(exitCode(code))
+}
+
+// fatalf logs a message as log.Printf does and exits with exitFailure, as
+// log.Fatalf would.
+func fatalf(format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...)) //nolint:errcheck
+	exit(exitFailure)
+}
+
+// fatalln logs a message as log.Println does and exits with exitFailure.
+func fatalln(v ...interface{}) {
+	log.Output(2, fmt.Sprintln(v...)) //nolint:errcheck
+	exit(exitFailure)
+}
+
+// fatal logs a message as log.Print does and exits with exitFailure.
+func fatal(v ...interface{}) {
+	log.Output(2, fmt.Sprint(v...)) //nolint:errcheck
+	exit(exitFailure)
+}
@@ -0,0 +1,610 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/storage"
+	"github.com/cloudfoundry/bosh-gcscli/client"
+)
+
+// listFormat is how commands printing a list of items format their output.
+type listFormat string
+
+const (
+	// namesFormat prints the name of each item, one per line.
+	namesFormat listFormat = "names"
+	// longFormat prints a table with a header and a row per item.
+	longFormat listFormat = "long"
+	// jsonFormat prints a JSON array with an object per item.
+	jsonFormat listFormat = "json"
+	// ndjsonFormat prints a JSON object per item, one per line.
+	ndjsonFormat listFormat = "ndjson"
+)
+
+// parseListFormat returns the listFormat named by value, or def if value
+// is empty.
+func parseListFormat(value string, def listFormat) (listFormat, error) {
+	switch format := listFormat(value); format {
+	case "":
+		return def, nil
+	case namesFormat, longFormat, jsonFormat, ndjsonFormat:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown list format %q: must be names, long, json or ndjson", value)
+}
+
+// listing is a list of items which can be printed in every listFormat.
+type listing interface {
+	// names returns the name of each item.
+	names() []string
+	// columns returns the header of the long format table.
+	columns() []string
+	// rows returns the values of each item in the long format table.
+	rows() [][]string
+	// records returns the value of each item encoded in the JSON formats.
+	records() []interface{}
+}
+
+// printListing writes l to w in the given format.
+func printListing(w io.Writer, format listFormat, l listing) error {
+	switch format {
+	case longFormat:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(l.columns(), "\t"))
+		for _, row := range l.rows() {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	case jsonFormat:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		// Encode an empty list as [] rather than null.
+		records := append([]interface{}{}, l.records()...)
+		return enc.Encode(records)
+	case ndjsonFormat:
+		enc := json.NewEncoder(w)
+		for _, record := range l.records() {
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		for _, name := range l.names() {
+			if _, err := fmt.Fprintln(w, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// objectRecord is how an object is encoded by the JSON list formats.
+type objectRecord struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	Updated      time.Time `json:"updated"`
+	StorageClass string    `json:"storage_class"`
+	Generation   int64     `json:"generation"`
+	CRC32C       uint32    `json:"crc32c"`
+	ContentType  string    `json:"content_type,omitempty"`
+}
+
+// prefixRecord is how a prefix collapsed by a list delimiter is encoded by
+// the JSON list formats.
+type prefixRecord struct {
+	Name   string `json:"name"`
+	Prefix bool   `json:"prefix"`
+}
+
+// objectListing lists objects by name, along with any prefixes collapsed by
+// a delimiter, which only have Prefix set.
+type objectListing []*storage.ObjectAttrs
+
+// listedName returns the name of the object, or the collapsed prefix,
+// attrs lists.
+func listedName(attrs *storage.ObjectAttrs) string {
+	if attrs.Prefix != "" {
+		return attrs.Prefix
+	}
+	return attrs.Name
+}
+
+func (l objectListing) names() []string {
+	names := make([]string, len(l))
+	for i, attrs := range l {
+		names[i] = listedName(attrs)
+	}
+	return names
+}
+
+func (l objectListing) columns() []string {
+	return []string{"SIZE", "UPDATED", "STORAGE CLASS", "NAME"}
+}
+
+func (l objectListing) rows() [][]string {
+	rows := make([][]string, len(l))
+	for i, attrs := range l {
+		if attrs.Prefix != "" {
+			rows[i] = []string{"-", "-", "-", tableName(attrs.Prefix)}
+			continue
+		}
+		rows[i] = []string{
+			strconv.FormatInt(attrs.Size, 10),
+			attrs.Updated.UTC().Format(time.RFC3339),
+			attrs.StorageClass,
+			tableName(attrs.Name),
+		}
+	}
+	return rows
+}
+
+// tableName returns name as printed in the long format table. A name with
+// a tab, newline or other control character, which would break up the
+// table's rows and columns, is quoted.
+func tableName(name string) string {
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return strconv.Quote(name)
+	}
+	return name
+}
+
+func (l objectListing) records() []interface{} {
+	records := make([]interface{}, len(l))
+	for i, attrs := range l {
+		if attrs.Prefix != "" {
+			records[i] = prefixRecord{Name: attrs.Prefix, Prefix: true}
+			continue
+		}
+		records[i] = objectRecord{
+			Name:         attrs.Name,
+			Size:         attrs.Size,
+			Updated:      attrs.Updated,
+			StorageClass: attrs.StorageClass,
+			Generation:   attrs.Generation,
+			CRC32C:       attrs.CRC32C,
+			ContentType:  attrs.ContentType,
+		}
+	}
+	return records
+}
+
+// classListing lists the usage of each storage class.
+type classListing []client.StorageClassUsage
+
+func (l classListing) names() []string {
+	names := make([]string, len(l))
+	for i, usage := range l {
+		names[i] = usage.StorageClass
+	}
+	return names
+}
+
+func (l classListing) columns() []string {
+	return []string{"STORAGE CLASS", "OBJECTS", "BYTES"}
+}
+
+func (l classListing) rows() [][]string {
+	rows := make([][]string, len(l))
+	for i, usage := range l {
+		rows[i] = []string{
+			usage.StorageClass,
+			strconv.FormatInt(usage.Objects, 10),
+			strconv.FormatInt(usage.Bytes, 10),
+		}
+	}
+	return rows
+}
+
+func (l classListing) records() []interface{} {
+	records := make([]interface{}, len(l))
+	for i, usage := range l {
+		records[i] = usage
+	}
+	return records
+}
+
+// objectHashes are the checksums GCS stores for an object, in base64 and
+// hex. An object without an MD5, such as a composite object, has empty MD5
+// fields.
+type objectHashes struct {
+	CRC32C     string `json:"crc32c"`
+	CRC32CHex  string `json:"crc32c_hex"`
+	MD5        string `json:"md5,omitempty"`
+	MD5Hex     string `json:"md5_hex,omitempty"`
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	Size       int64  `json:"size"`
+}
+
+func newObjectHashes(attrs *storage.ObjectAttrs) objectHashes {
+	crc := crc32cBytes(attrs.CRC32C)
+
+	hashes := objectHashes{
+		CRC32C:     base64.StdEncoding.EncodeToString(crc),
+		CRC32CHex:  hex.EncodeToString(crc),
+		Name:       attrs.Name,
+		Generation: attrs.Generation,
+		Size:       attrs.Size,
+	}
+	if len(attrs.MD5) > 0 {
+		hashes.MD5 = base64.StdEncoding.EncodeToString(attrs.MD5)
+		hashes.MD5Hex = hex.EncodeToString(attrs.MD5)
+	}
+	return hashes
+}
+
+// crc32cBytes returns crc in the big-endian byte order GCS encodes CRC32C
+// checksums in.
+func crc32cBytes(crc uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, crc)
+	return b
+}
+
+// printHashes writes hashes to w in format: "base64" or "hex" print each
+// checksum in that encoding, "json" prints a JSON object and "" prints both
+// encodings.
+func printHashes(w io.Writer, format string, hashes objectHashes) error {
+	type line struct{ algorithm, base64, hex string }
+	lines := []line{{"crc32c", hashes.CRC32C, hashes.CRC32CHex}}
+	if hashes.MD5 != "" {
+		lines = append(lines, line{"md5", hashes.MD5, hashes.MD5Hex})
+	}
+
+	switch format {
+	case "json":
+		return json.NewEncoder(w).Encode(hashes)
+	case "base64":
+		for _, l := range lines {
+			fmt.Fprintf(w, "%s\t%s\n", l.algorithm, l.base64)
+		}
+	case "hex":
+		for _, l := range lines {
+			fmt.Fprintf(w, "%s\t%s\n", l.algorithm, l.hex)
+		}
+	case "":
+		for _, l := range lines {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", l.algorithm, l.base64, l.hex)
+		}
+	default:
+		return fmt.Errorf("unknown hash format %q: must be base64, hex or json", format)
+	}
+	return nil
+}
+
+// signedURL is a signed url and the headers requests to it must send, as
+// printed by sign.
+type signedURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Headers   []string  `json:"headers,omitempty"`
+
+	// Method and Object are what the url was signed for, used by the curl
+	// format.
+	Method string `json:"-"`
+	Object string `json:"-"`
+}
+
+// printSignedURL writes signed to w in format: "json" prints a JSON object,
+// "curl" a curl command using the url and "" prints the url followed by a
+// line per header, without the expiry time.
+func printSignedURL(w io.Writer, format string, signed signedURL) error {
+	switch format {
+	case "json":
+		signed.ExpiresAt = signed.ExpiresAt.UTC().Truncate(time.Second)
+		return json.NewEncoder(w).Encode(signed)
+	case "curl":
+		fmt.Fprintln(w, curlCommand(signed))
+	case "":
+		fmt.Fprintln(w, signed.URL)
+		for _, header := range signed.Headers {
+			fmt.Fprintln(w, header)
+		}
+	default:
+		return fmt.Errorf("unknown sign format %q: must be json", format)
+	}
+	return nil
+}
+
+// curlCommand returns a shell command sending the request signed sends
+// with curl, including every header the url requires, such as the
+// encryption key of an object encrypted with a customer-supplied key.
+// A GET downloads the object, and a PUT uploads, to a file named after it
+// in the current directory; a HEAD prints its headers.
+func curlCommand(signed signedURL) string {
+	args := []string{"curl", "--fail"}
+	switch signed.Method {
+	case http.MethodGet:
+		args = append(args, "-o", path.Base(signed.Object))
+	case http.MethodPut:
+		// --upload-file sends a PUT.
+		args = append(args, "--upload-file", path.Base(signed.Object))
+	case http.MethodHead:
+		// -X HEAD would wait for a body which never comes.
+		args = append(args, "--head")
+	default:
+		args = append(args, "-X", signed.Method)
+	}
+	for _, header := range signed.Headers {
+		args = append(args, "-H", header)
+	}
+	args = append(args, signed.URL)
+
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// shellQuote returns s quoted for a POSIX shell if it contains anything
+// but characters which are never special to it.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// objectStat is the metadata of an object printed by stat. Checksums are
+// base64 encoded, as GCS reports them. ComponentCount is only set for a
+// composite object, which has a CRC32C but no MD5.
+type objectStat struct {
+	Name               string            `json:"name"`
+	Bucket             string            `json:"bucket"`
+	Size               int64             `json:"size"`
+	ContentType        string            `json:"content_type"`
+	ContentEncoding    string            `json:"content_encoding,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	StorageClass       string            `json:"storage_class"`
+	MD5                string            `json:"md5,omitempty"`
+	CRC32C             string            `json:"crc32c"`
+	SHA256             string            `json:"sha256,omitempty"`
+	ComponentCount     int64             `json:"component_count,omitempty"`
+	Generation         int64             `json:"generation"`
+	Metageneration     int64             `json:"metageneration"`
+	Created            time.Time         `json:"created"`
+	Updated            time.Time         `json:"updated"`
+	CustomerEncrypted  bool              `json:"customer_encrypted"`
+	KMSKeyName         string            `json:"kms_key_name,omitempty"`
+	TemporaryHold      bool              `json:"temporary_hold"`
+	EventBasedHold     bool              `json:"event_based_hold"`
+	RetainedUntil      *time.Time        `json:"retained_until,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+func newObjectStat(attrs *storage.ObjectAttrs) objectStat {
+	stat := objectStat{
+		Name:               attrs.Name,
+		Bucket:             attrs.Bucket,
+		Size:               attrs.Size,
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		StorageClass:       attrs.StorageClass,
+		CRC32C:             base64.StdEncoding.EncodeToString(crc32cBytes(attrs.CRC32C)),
+		Generation:         attrs.Generation,
+		Metageneration:     attrs.Metageneration,
+		Created:            attrs.Created.UTC(),
+		Updated:            attrs.Updated.UTC(),
+		CustomerEncrypted:  attrs.CustomerKeySHA256 != "",
+		KMSKeyName:         attrs.KMSKeyName,
+		SHA256:             attrs.Metadata[client.SHA256MetadataKey],
+		TemporaryHold:      attrs.TemporaryHold,
+		EventBasedHold:     attrs.EventBasedHold,
+		Metadata:           attrs.Metadata,
+	}
+	if len(attrs.MD5) > 0 {
+		stat.MD5 = base64.StdEncoding.EncodeToString(attrs.MD5)
+	}
+	if !attrs.RetentionExpirationTime.IsZero() {
+		// The time the bucket's retention policy keeps the object until.
+		retainedUntil := attrs.RetentionExpirationTime.UTC()
+		stat.RetainedUntil = &retainedUntil
+	}
+	return stat
+}
+
+// printSyncPlan writes the plan of a sync to w as an indented JSON object.
+func printSyncPlan(w io.Writer, plan *client.SyncPlan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
+
+// printStat writes stat to w as a JSON object if asJSON is set, and
+// otherwise as a line per field, omitting empty optional fields.
+func printStat(w io.Writer, asJSON bool, stat objectStat) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stat)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	field := func(name, value string) {
+		fmt.Fprintf(tw, "%s:\t%s\n", name, value)
+	}
+	field("Name", fmt.Sprintf("gs://%s/%s", stat.Bucket, stat.Name))
+	field("Size", strconv.FormatInt(stat.Size, 10))
+	field("Content-Type", stat.ContentType)
+	if stat.ContentEncoding != "" {
+		field("Content-Encoding", stat.ContentEncoding)
+	}
+	if stat.CacheControl != "" {
+		field("Cache-Control", stat.CacheControl)
+	}
+	if stat.ContentDisposition != "" {
+		field("Content-Disposition", stat.ContentDisposition)
+	}
+	field("Storage class", stat.StorageClass)
+	if stat.MD5 != "" {
+		field("MD5", stat.MD5)
+	}
+	field("CRC32C", stat.CRC32C)
+	if stat.SHA256 != "" {
+		field("SHA256", stat.SHA256)
+	}
+	if stat.ComponentCount > 0 {
+		field("Component count", strconv.FormatInt(stat.ComponentCount, 10))
+	}
+	field("Generation", strconv.FormatInt(stat.Generation, 10))
+	field("Metageneration", strconv.FormatInt(stat.Metageneration, 10))
+	field("Created", stat.Created.Format(time.RFC3339))
+	field("Updated", stat.Updated.Format(time.RFC3339))
+	field("Customer-encrypted", strconv.FormatBool(stat.CustomerEncrypted))
+	if stat.KMSKeyName != "" {
+		field("KMS key", stat.KMSKeyName)
+	}
+	field("Temporary hold", strconv.FormatBool(stat.TemporaryHold))
+	field("Event-based hold", strconv.FormatBool(stat.EventBasedHold))
+	if stat.RetainedUntil != nil {
+		field("Retained until", stat.RetainedUntil.Format(time.RFC3339))
+	}
+
+	keys := make([]string, 0, len(stat.Metadata))
+	for key := range stat.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field("Metadata "+key, stat.Metadata[key])
+	}
+	return tw.Flush()
+}
+
+// bucketInfo is the configuration of a bucket printed by info.
+type bucketInfo struct {
+	Name                     string            `json:"name"`
+	Location                 string            `json:"location"`
+	LocationType             string            `json:"location_type,omitempty"`
+	StorageClass             string            `json:"storage_class"`
+	Versioning               bool              `json:"versioning"`
+	UniformBucketLevelAccess bool              `json:"uniform_bucket_level_access"`
+	PublicAccessPrevention   string            `json:"public_access_prevention"`
+	RequesterPays            bool              `json:"requester_pays"`
+	DefaultKMSKeyName        string            `json:"default_kms_key_name,omitempty"`
+	RetentionPeriod          string            `json:"retention_period,omitempty"`
+	RetentionPolicyLocked    bool              `json:"retention_policy_locked,omitempty"`
+	Created                  time.Time         `json:"created"`
+	Labels                   map[string]string `json:"labels,omitempty"`
+}
+
+func newBucketInfo(attrs *storage.BucketAttrs) bucketInfo {
+	info := bucketInfo{
+		Name:                     attrs.Name,
+		Location:                 attrs.Location,
+		LocationType:             attrs.LocationType,
+		StorageClass:             attrs.StorageClass,
+		Versioning:               attrs.VersioningEnabled,
+		UniformBucketLevelAccess: attrs.UniformBucketLevelAccess.Enabled,
+		PublicAccessPrevention:   attrs.PublicAccessPrevention.String(),
+		RequesterPays:            attrs.RequesterPays,
+		Created:                  attrs.Created.UTC(),
+		Labels:                   attrs.Labels,
+	}
+	if attrs.Encryption != nil {
+		info.DefaultKMSKeyName = attrs.Encryption.DefaultKMSKeyName
+	}
+	if policy := attrs.RetentionPolicy; policy != nil && policy.RetentionPeriod > 0 {
+		info.RetentionPeriod = policy.RetentionPeriod.String()
+		info.RetentionPolicyLocked = policy.IsLocked
+	}
+	return info
+}
+
+// printBucketInfo writes info to w as a JSON object if asJSON is set, and
+// otherwise as a line per field, omitting empty optional fields.
+func printBucketInfo(w io.Writer, asJSON bool, info bucketInfo) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	field := func(name, value string) {
+		fmt.Fprintf(tw, "%s:\t%s\n", name, value)
+	}
+	field("Name", "gs://"+info.Name)
+	field("Location", info.Location)
+	if info.LocationType != "" {
+		field("Location type", info.LocationType)
+	}
+	field("Storage class", info.StorageClass)
+	field("Versioning", strconv.FormatBool(info.Versioning))
+	field("Uniform bucket-level access", strconv.FormatBool(info.UniformBucketLevelAccess))
+	field("Public access prevention", info.PublicAccessPrevention)
+	field("Requester pays", strconv.FormatBool(info.RequesterPays))
+	if info.DefaultKMSKeyName != "" {
+		field("Default KMS key", info.DefaultKMSKeyName)
+	}
+	if info.RetentionPeriod != "" {
+		field("Retention period", info.RetentionPeriod)
+		field("Retention policy locked", strconv.FormatBool(info.RetentionPolicyLocked))
+	}
+	if !info.Created.IsZero() {
+		field("Created", info.Created.Format(time.RFC3339))
+	}
+
+	keys := make([]string, 0, len(info.Labels))
+	for key := range info.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field("Label "+key, info.Labels[key])
+	}
+	return tw.Flush()
+}
+
+// buildInfo describes the build of the CLI, as printed by version.
+type buildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// printVersion writes info to w as a JSON object, or as just the version
+// in the form -v has always printed.
+func printVersion(w io.Writer, asJSON bool, info buildInfo) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	_, err := fmt.Fprintf(w, "version %s\n", info.Version)
+	return err
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/cloudfoundry/bosh-gcscli/client"
 	"github.com/cloudfoundry/bosh-gcscli/config"
@@ -84,17 +85,28 @@ var _ = Describe("Integration", func() {
 			},
 			configurations...)
 
-		DescribeTable("Delete silently ignores that the file doesn't exist",
+		DescribeTable("Delete with -ignore-not-found silently ignores that the file doesn't exist",
 			func(config *config.GCSCli) {
 				env.AddConfig(config)
 
 				session, err := RunGCSCLI(gcsCLIPath, env.ConfigPath,
-					"delete", env.GCSFileName)
+					"-ignore-not-found", "delete", env.GCSFileName)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(session.ExitCode()).To(BeZero())
 			},
 			configurations...)
 
+		DescribeTable("Delete fails with 3 when the file doesn't exist",
+			func(config *config.GCSCli) {
+				env.AddConfig(config)
+
+				session, err := RunGCSCLI(gcsCLIPath, env.ConfigPath,
+					"delete", env.GCSFileName)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(session.ExitCode()).To(Equal(3))
+			},
+			configurations...)
+
 		Context("with a regional bucket", func() {
 			var cfg *config.GCSCli
 			BeforeEach(func() {
@@ -124,6 +136,36 @@ var _ = Describe("Integration", func() {
 			})
 		})
 
+		DescribeTable("Put reads the blob from stdin",
+			func(config *config.GCSCli) {
+				env.AddConfig(config)
+
+				session, err := RunGCSCLIWithStdin(gcsCLIPath, env.ConfigPath,
+					strings.NewReader(env.ExpectedString), "put", "-", env.GCSFileName)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(session.ExitCode()).To(BeZero())
+
+				tmpLocalFile, err := os.CreateTemp("", "gcscli-download")
+				Expect(err).ToNot(HaveOccurred())
+				defer os.Remove(tmpLocalFile.Name()) //nolint:errcheck
+				Expect(tmpLocalFile.Close()).To(Succeed())
+
+				session, err = RunGCSCLI(gcsCLIPath, env.ConfigPath,
+					"get", env.GCSFileName, tmpLocalFile.Name())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(session.ExitCode()).To(BeZero())
+
+				gottenBytes, err := os.ReadFile(tmpLocalFile.Name())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(gottenBytes)).To(Equal(env.ExpectedString))
+
+				session, err = RunGCSCLI(gcsCLIPath, env.ConfigPath,
+					"delete", env.GCSFileName)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(session.ExitCode()).To(BeZero())
+			},
+			configurations...)
+
 		DescribeTable("Invalid Put should fail",
 			func(config *config.GCSCli) {
 				env.AddConfig(config)
@@ -18,6 +18,7 @@ package integration
 
 import (
 	"encoding/json"
+	"io"
 	"math/rand"
 	"os"
 	"os/exec"
@@ -73,6 +74,12 @@ func MakeContentFile(content string) string {
 // after waiting for it to finish
 func RunGCSCLI(gcsCLIPath, configPath, subcommand string,
 	args ...string) (*gexec.Session, error) {
+	return RunGCSCLIWithStdin(gcsCLIPath, configPath, nil, subcommand, args...)
+}
+
+// RunGCSCLIWithStdin is like RunGCSCLI but feeds stdin to the gcscli
+func RunGCSCLIWithStdin(gcsCLIPath, configPath string, stdin io.Reader,
+	subcommand string, args ...string) (*gexec.Session, error) {
 
 	cmdArgs := []string{
 		"-c",
@@ -82,6 +89,7 @@ func RunGCSCLI(gcsCLIPath, configPath, subcommand string,
 	cmdArgs = append(cmdArgs, args...)
 
 	command := exec.Command(gcsCLIPath, cmdArgs...)
+	command.Stdin = stdin
 	gexecSession, err := gexec.Start(command,
 		ginkgo.GinkgoWriter, ginkgo.GinkgoWriter)
 	if err != nil {
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log message.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevels maps the names accepted by -log-level to levels.
+var logLevels = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// logLevelTags are the prefixes the messages of each level but errors
+// start with, e.g. log.Printf("WARN: ..."). Messages without a tag, such as
+// those of fatalf, are errors and always written.
+var logLevelTags = []struct {
+	tag   string
+	level logLevel
+	// strip is set for tags which are not written, keeping the output of
+	// informational messages as it was before they were tagged.
+	strip bool
+}{
+	{"DEBUG: ", levelDebug, false},
+	{"INFO: ", levelInfo, true},
+	{"WARN: ", levelWarn, false},
+}
+
+// String returns the name -log-level accepts for l.
+func (l logLevel) String() string {
+	for name, level := range logLevels {
+		if level == l {
+			return name
+		}
+	}
+	return ""
+}
+
+// parseLogLevel returns the level named by name, in any case.
+func parseLogLevel(name string) (logLevel, error) {
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("log-level must be debug, info, warn or error, got %q", name)
+	}
+	return level, nil
+}
+
+// levelWriter is the output of the standard logger. It drops the messages
+// below level and writes the others to out, each preceded by the time as
+// the standard logger would, which must then be created without flags.
+// With events set, the messages are written as log events instead.
+type levelWriter struct {
+	level  logLevel
+	events *eventWriter
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// setLogLevel makes the standard logger write the messages of at least
+// level to out, or to the events of -json-events if set.
+func setLogLevel(out io.Writer, level logLevel) {
+	log.SetFlags(0)
+	log.SetOutput(&levelWriter{level: level, events: events, out: out})
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	msg, level := p, levelError
+	for _, t := range logLevelTags {
+		if !bytes.HasPrefix(p, []byte(t.tag)) {
+			continue
+		}
+		if t.level < w.level {
+			return len(p), nil
+		}
+		level = t.level
+		if t.strip || w.events != nil {
+			msg = p[len(t.tag):]
+		}
+		break
+	}
+
+	if w.events != nil {
+		w.events.log(level, string(bytes.TrimRight(msg, "\n")))
+		return len(p), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := fmt.Fprintf(w.out, "%s %s", time.Now().Format("2006/01/02 15:04:05"), msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"os"
+	"testing"
+)
+
+func TestMain(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Main Suite")
+}
+
+// specTempDirs are the directories specTempDir created for the current
+// spec.
+var specTempDirs []string
+
+// specTempDir returns a new temporary directory, removed once the current
+// spec ends. Ginkgo v1 does not implement GinkgoT().TempDir, which returns "".
+func specTempDir() string {
+	dir, err := os.MkdirTemp("", "bosh-gcscli-test")
+	Expect(err).ToNot(HaveOccurred())
+	specTempDirs = append(specTempDirs, dir)
+	return dir
+}
+
+var _ = AfterEach(func() {
+	for _, dir := range specTempDirs {
+		os.RemoveAll(dir)
+	}
+	specTempDirs = nil
+})
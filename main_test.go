@@ -0,0 +1,1132 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/cloudfoundry/bosh-gcscli/client"
+	"github.com/cloudfoundry/bosh-gcscli/client/fakeclient"
+	"github.com/cloudfoundry/bosh-gcscli/config"
+	"google.golang.org/api/googleapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Running commands", func() {
+	var fake *fakeclient.Client
+	var stdout, stderr *bytes.Buffer
+	var dir string
+	realNewClient := newClient
+
+	BeforeEach(func() {
+		fake = fakeclient.New("some-bucket")
+		newClient = func(ctx context.Context, cfg *config.GCSCli) (client.Client, error) {
+			Expect(cfg.BucketName).To(Equal("some-bucket"))
+			return fake, nil
+		}
+
+		dir = specTempDir()
+	})
+
+	AfterEach(func() {
+		newClient = realNewClient
+	})
+
+	runCommand := func(args ...string) int {
+		stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+		return run(append([]string{"-b", "some-bucket"}, args...), stdout, stderr)
+	}
+
+	It("uploads a file and downloads it back", func() {
+		src := filepath.Join(dir, "src")
+		Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+		Expect(runCommand("put", src, "obj")).To(Equal(0))
+
+		data, ok := fake.Object("obj")
+		Expect(ok).To(BeTrue())
+		Expect(string(data)).To(Equal("content"))
+
+		dst := filepath.Join(dir, "dst")
+		Expect(runCommand("get", "obj", dst)).To(Equal(0))
+		Expect(os.ReadFile(dst)).To(Equal([]byte("content")))
+
+		Expect(runCommand("get", "obj", "-")).To(Equal(0))
+		Expect(stdout.String()).To(Equal("content"))
+	})
+
+	It("downloads in parallel to a file and in a single stream to stdout", func() {
+		Expect(fake.PutWithOptions(strings.NewReader("content"), "obj", client.PutOptions{})).To(Succeed())
+
+		dst := filepath.Join(dir, "dst")
+		Expect(os.WriteFile(dst, []byte("longer previous content"), 0600)).To(Succeed())
+		Expect(runCommand("-download-parallel", "4", "get", "obj", dst)).To(Equal(0))
+		Expect(os.ReadFile(dst)).To(Equal([]byte("content")))
+
+		Expect(runCommand("-download-parallel", "4", "get", "obj", "-")).To(Equal(0))
+		Expect(stdout.String()).To(Equal("content"))
+
+		Expect(runCommand("-download-parallel", "0", "get", "obj", dst)).To(Equal(exitFailure))
+		Expect(runCommand("-download-parallel", "4", "-write-crc-sidecar", "get", "obj", dst)).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("download-parallel cannot be used with"))
+
+		Expect(runCommand("-download-parallel", "4", "get", "missing", dst)).To(Equal(exitNotFound))
+		Expect(os.ReadFile(dst)).To(Equal([]byte("content")))
+		entries, err := os.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("lists the objects written since a generation as ndjson records", func() {
+		Expect(fake.PutMarker("old", false)).To(Succeed())
+		old, err := fake.Stat("old")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fake.PutMarker("new-1", false)).To(Succeed())
+		Expect(fake.PutMarker("new-2", false)).To(Succeed())
+
+		Expect(runCommand("-list-format", "ndjson", "-since-generation", formatInt(old.Generation), "list", "")).To(Equal(0))
+		lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+		Expect(lines).To(HaveLen(2))
+		for i, name := range []string{"new-1", "new-2"} {
+			var record map[string]interface{}
+			Expect(json.Unmarshal([]byte(lines[i]), &record)).To(Succeed())
+			Expect(record).To(HaveKeyWithValue("name", name))
+		}
+	})
+
+	It("prints the generation of a conditional upload only with -print-generation", func() {
+		src := filepath.Join(dir, "src")
+		Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+		Expect(runCommand("-if-not-exists", "put", src, "obj")).To(Equal(0))
+		Expect(stdout.String()).To(BeEmpty())
+
+		attrs, err := fake.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runCommand("-print-generation", "-if-generation-match", formatInt(attrs.Generation), "put", src, "obj")).To(Equal(0))
+		attrs, err = fake.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stdout.String()).To(Equal(formatInt(attrs.Generation) + "\n"))
+
+		Expect(runCommand("-if-not-exists", "put", src, "obj")).To(Equal(exitPrecondition))
+		Expect(stderr.String()).To(ContainSubstring("performing operation put"))
+	})
+
+	It("exits with 3 for a missing object", func() {
+		Expect(runCommand("exists", "obj")).To(Equal(exitNotFound))
+		Expect(runCommand("get", "obj", filepath.Join(dir, "dst"))).To(Equal(exitNotFound))
+		Expect(filepath.Join(dir, "dst")).ToNot(BeAnExistingFile())
+
+		Expect(fake.PutMarker("obj", false)).To(Succeed())
+		Expect(runCommand("exists", "obj")).To(Equal(0))
+	})
+
+	It("exits with 5 rather than 3 when it cannot tell whether an object exists", func() {
+		fake.FailLookups("obj", &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "backend error"})
+		Expect(runCommand("exists", "obj")).To(Equal(exitTransient))
+		Expect(stderr.String()).To(ContainSubstring("cannot tell whether 'obj' exists"))
+
+		fake.FailLookups("obj", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")})
+		Expect(runCommand("exists", "obj")).To(Equal(exitTransient))
+
+		fake.FailLookups("obj", nil)
+		Expect(runCommand("exists", "obj")).To(Equal(exitNotFound))
+	})
+
+	It("prints a signed url", func() {
+		Expect(runCommand("sign", "obj", "get", "1h")).To(Equal(0))
+		Expect(stdout.String()).To(HavePrefix("https://storage.googleapis.com/some-bucket/obj?"))
+		Expect(stdout.String()).To(ContainSubstring("X-Fake-Method=GET"))
+	})
+
+	It("signs HEAD urls, checked with curl --head", func() {
+		Expect(runCommand("sign", "obj", "head", "1h")).To(Equal(0))
+		Expect(stdout.String()).To(ContainSubstring("X-Fake-Method=HEAD"))
+
+		Expect(runCommand("-print-curl", "sign", "obj", "head", "1h")).To(Equal(0))
+		Expect(stdout.String()).To(HavePrefix("curl --fail --head 'https://storage.googleapis.com/some-bucket/obj?"))
+
+		Expect(runCommand("-content-type", "text/plain", "sign", "obj", "head", "1h")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("content-type is only valid when signing PUT, got HEAD"))
+	})
+
+	Describe("signing with just the object", func() {
+		AfterEach(func() {
+			os.Unsetenv(config.SignDefaultExpiryEnv)
+			os.Unsetenv(config.SignDefaultActionEnv)
+		})
+
+		It("uses the default action and expiry", func() {
+			Expect(runCommand("sign", "obj")).To(Equal(exitFailure))
+			Expect(stderr.String()).To(ContainSubstring("set sign_default_expiry or BOSH_GCS_SIGN_DEFAULT_EXPIRY"))
+
+			os.Setenv(config.SignDefaultExpiryEnv, "1h")
+			Expect(runCommand("sign", "obj")).To(Equal(0))
+			Expect(stdout.String()).To(ContainSubstring("X-Fake-Method=GET"))
+
+			os.Setenv(config.SignDefaultActionEnv, "put")
+			Expect(runCommand("sign", "obj")).To(Equal(0))
+			Expect(stdout.String()).To(ContainSubstring("X-Fake-Method=PUT"))
+
+			Expect(runCommand("sign", "obj", "delete", "2h")).To(Equal(0))
+			Expect(stdout.String()).To(ContainSubstring("X-Fake-Method=DELETE"))
+			Expect(runCommand("sign", "obj", "get")).To(Equal(exitFailure))
+			Expect(stderr.String()).To(ContainSubstring("sign method expected 3 arguments"))
+		})
+
+		It("prefers the config file to the environment", func() {
+			cfg := filepath.Join(dir, "config.json")
+			Expect(os.WriteFile(cfg, []byte(`{"bucket_name": "some-bucket", "sign_default_expiry": "30m", "sign_default_action": "delete"}`), 0600)).To(Succeed())
+			os.Setenv(config.SignDefaultExpiryEnv, "1h")
+			os.Setenv(config.SignDefaultActionEnv, "put")
+
+			Expect(runCommand("-c", cfg, "sign", "obj")).To(Equal(0))
+			Expect(stdout.String()).To(ContainSubstring("X-Fake-Method=DELETE"))
+		})
+
+		It("validates the defaults as arguments", func() {
+			os.Setenv(config.SignDefaultExpiryEnv, "200h")
+			Expect(runCommand("sign", "obj")).To(Equal(exitFailure))
+			Expect(stderr.String()).To(ContainSubstring("Invalid BOSH_GCS_SIGN_DEFAULT_EXPIRY: duration 200h0m0s is longer than 7 days"))
+
+			os.Setenv(config.SignDefaultExpiryEnv, "1h")
+			os.Setenv(config.SignDefaultActionEnv, "post")
+			Expect(runCommand("sign", "obj")).To(Equal(exitFailure))
+			Expect(stderr.String()).To(ContainSubstring("Invalid BOSH_GCS_SIGN_DEFAULT_ACTION: invalid signing action: POST"))
+		})
+	})
+
+	It("fails with a message for invalid arguments", func() {
+		Expect(runCommand("sign", "obj", "post", "1h")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("invalid signing action: POST"))
+		Expect(stdout.String()).To(BeEmpty())
+
+		Expect(runCommand("frobnicate", "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("unknown command: 'frobnicate'"))
+	})
+
+	It("exits with 2 for an undefined flag", func() {
+		Expect(runCommand("-no-such-flag", "exists", "obj")).To(Equal(exitUsage))
+		Expect(stderr.String()).To(ContainSubstring("flag provided but not defined: -no-such-flag"))
+	})
+
+	It("resets the flags between runs", func() {
+		src := filepath.Join(dir, "src")
+		Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+		Expect(runCommand("-cache-control", "no-cache", "put", src, "first")).To(Equal(0))
+		Expect(runCommand("put", src, "second")).To(Equal(0))
+
+		attrs, err := fake.Stat("first")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.CacheControl).To(Equal("no-cache"))
+		attrs, err = fake.Stat("second")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.CacheControl).To(BeEmpty())
+	})
+
+	It("refuses to upload a file larger than max-bytes", func() {
+		src := filepath.Join(dir, "src")
+		Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+
+		Expect(runCommand("-max-bytes", "6", "put", src, "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("it is 7 bytes, more than max-bytes 6"))
+		_, ok := fake.Object("obj")
+		Expect(ok).To(BeFalse())
+
+		Expect(runCommand("-max-bytes", "7", "put", src, "obj")).To(Equal(0))
+	})
+
+	It("fails a stream as soon as it exceeds max-bytes, leaving no object", func() {
+		limited := &maxBytesReader{r: strings.NewReader("content"), limit: 6}
+		err := fake.PutWithOptions(limited, "obj", client.PutOptions{})
+		Expect(err).To(MatchError(errMaxBytesExceeded))
+		_, ok := fake.Object("obj")
+		Expect(ok).To(BeFalse())
+
+		data, err := io.ReadAll(&maxBytesReader{r: strings.NewReader("content"), limit: 7})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("content"))
+	})
+
+	It("refuses to delete an object until its holds are released", func() {
+		src := filepath.Join(dir, "src")
+		Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+		Expect(runCommand("-event-based-hold", "put", src, "obj")).To(Equal(0))
+		Expect(runCommand("-temporary-hold", "update", "obj")).To(Equal(0))
+
+		Expect(runCommand("stat", "obj")).To(Equal(0))
+		Expect(stdout.String()).To(MatchRegexp(`Temporary hold:\s+true`))
+		Expect(stdout.String()).To(MatchRegexp(`Event-based hold:\s+true`))
+
+		Expect(runCommand("delete", "obj")).To(Equal(exitPrecondition))
+		Expect(stderr.String()).To(ContainSubstring("must be released before it can be deleted; release it with the hold command"))
+
+		Expect(runCommand("hold", "obj", "event-based", "off")).To(Equal(0))
+		Expect(runCommand("-temporary-hold=false", "update", "obj")).To(Equal(0))
+		Expect(runCommand("delete", "obj")).To(Equal(0))
+		_, ok := fake.Object("obj")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("shows the component count of a composite object", func() {
+		Expect(fake.Put(strings.NewReader("abc"), "part-1")).To(Succeed())
+		Expect(fake.Put(strings.NewReader("def"), "part-2")).To(Succeed())
+		Expect(runCommand("compose", "composed", "part-1", "part-2")).To(Equal(0))
+
+		Expect(runCommand("stat", "composed")).To(Equal(0))
+		Expect(stdout.String()).To(MatchRegexp(`Component count:\s+2\n`))
+		Expect(stdout.String()).ToNot(ContainSubstring("MD5"))
+
+		Expect(runCommand("-json", "stat", "composed")).To(Equal(0))
+		var stat map[string]interface{}
+		Expect(json.Unmarshal(stdout.Bytes(), &stat)).To(Succeed())
+		Expect(stat).To(HaveKeyWithValue("component_count", 2.0))
+
+		Expect(runCommand("-json", "stat", "part-1")).To(Equal(0))
+		Expect(stdout.String()).ToNot(ContainSubstring("component_count"))
+		Expect(runCommand("stat", "part-1")).To(Equal(0))
+		Expect(stdout.String()).ToNot(ContainSubstring("Component count"))
+	})
+
+	It("only deletes or updates an object at the metageneration stat showed", func() {
+		src := filepath.Join(dir, "src")
+		Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+		Expect(runCommand("put", src, "obj")).To(Equal(0))
+
+		metageneration := func() string {
+			Expect(runCommand("stat", "obj")).To(Equal(0))
+			match := regexp.MustCompile(`Metageneration:\s+(\d+)`).FindStringSubmatch(stdout.String())
+			Expect(match).To(HaveLen(2))
+			return match[1]
+		}
+		observed := metageneration()
+
+		Expect(runCommand("-if-metageneration-match", observed, "-meta", "owner=ci", "update", "obj")).To(Equal(0))
+		Expect(runCommand("-if-metageneration-match", observed, "-meta", "owner=other", "update", "obj")).To(Equal(exitChanged))
+		Expect(stderr.String()).To(ContainSubstring("'obj' changed since metageneration " + observed))
+		Expect(runCommand("-if-metageneration-match", observed, "delete", "obj")).To(Equal(exitChanged))
+		attrs, err := fake.Stat("obj")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Metadata).To(HaveKeyWithValue("owner", "ci"))
+
+		Expect(runCommand("-if-metageneration-match", metageneration(), "delete", "obj")).To(Equal(0))
+		_, ok := fake.Object("obj")
+		Expect(ok).To(BeFalse())
+		Expect(runCommand("-if-metageneration-match", observed, "delete", "obj")).To(Equal(exitNotFound))
+
+		Expect(runCommand("-if-metageneration-match", "1", "delete", "obj", "other")).To(Equal(exitFailure))
+		Expect(runCommand("-if-metageneration-match", "-1", "delete", "obj")).To(Equal(exitFailure))
+	})
+
+	It("stores the SHA-256 of the uploaded content", func() {
+		src := filepath.Join(dir, "src")
+		content := strings.Repeat("compressible content ", 100)
+		Expect(os.WriteFile(src, []byte(content), 0600)).To(Succeed())
+		sum := sha256.Sum256([]byte(content))
+		digest := hex.EncodeToString(sum[:])
+
+		Expect(runCommand("-store-sha256", "put", src, "plain")).To(Equal(0))
+		attrs, err := fake.Stat("plain")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Metadata).To(HaveKeyWithValue(client.SHA256MetadataKey, digest))
+		// A file is hashed first, so the digest is uploaded with the object
+		// rather than patched in afterwards.
+		Expect(attrs.Metageneration).To(Equal(int64(1)))
+
+		// The digest of stdin is only known after the upload, and is added
+		// to the object by a second request.
+		realStdin := os.Stdin
+		os.Stdin, err = os.Open(src)
+		Expect(err).ToNot(HaveOccurred())
+		code := runCommand("-store-sha256", "put", "-", "streamed")
+		os.Stdin.Close()
+		os.Stdin = realStdin
+		Expect(code).To(Equal(0))
+		attrs, err = fake.Stat("streamed")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Metadata).To(HaveKeyWithValue(client.SHA256MetadataKey, digest))
+		Expect(attrs.Metageneration).To(Equal(int64(2)))
+
+		// With -z the digest is of the content before compression, so it
+		// matches what a download decompresses to.
+		Expect(runCommand("-z", "-force-gzip", "-store-sha256", "put", src, "gzipped")).To(Equal(0))
+		stored, ok := fake.Object("gzipped")
+		Expect(ok).To(BeTrue())
+		Expect(string(stored)).ToNot(Equal(content))
+		attrs, err = fake.Stat("gzipped")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.ContentEncoding).To(Equal("gzip"))
+		Expect(attrs.Metadata).To(HaveKeyWithValue(client.SHA256MetadataKey, digest))
+
+		Expect(runCommand("stat", "gzipped")).To(Equal(0))
+		Expect(stdout.String()).To(MatchRegexp(`SHA256:\s+` + digest))
+
+		Expect(runCommand("put", src, "unhashed")).To(Equal(0))
+		attrs, err = fake.Stat("unhashed")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Metadata).ToNot(HaveKey(client.SHA256MetadataKey))
+	})
+
+	It("does not compress a gzip file twice with -z", func() {
+		content := strings.Repeat("compressible content ", 100)
+		var gzipped bytes.Buffer
+		zw := gzip.NewWriter(&gzipped)
+		_, err := zw.Write([]byte(content))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(zw.Close()).To(Succeed())
+		src := filepath.Join(dir, "content.txt.gz")
+		Expect(os.WriteFile(src, gzipped.Bytes(), 0600)).To(Succeed())
+
+		Expect(runCommand("-z", "put", src, "passthrough")).To(Equal(0))
+		stored, ok := fake.Object("passthrough")
+		Expect(ok).To(BeTrue())
+		Expect(stored).To(Equal(gzipped.Bytes()))
+		attrs, err := fake.Stat("passthrough")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.ContentEncoding).To(Equal("gzip"))
+		Expect(attrs.ContentType).ToNot(ContainSubstring("gzip"))
+
+		// The stored bytes are what GCS decompresses for get: the content.
+		zr, err := gzip.NewReader(bytes.NewReader(stored))
+		Expect(err).ToNot(HaveOccurred())
+		decoded, err := io.ReadAll(zr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(decoded)).To(Equal(content))
+
+		Expect(runCommand("-z", "-force-gzip", "put", src, "twice")).To(Equal(0))
+		stored, ok = fake.Object("twice")
+		Expect(ok).To(BeTrue())
+		zr, err = gzip.NewReader(bytes.NewReader(stored))
+		Expect(err).ToNot(HaveOccurred())
+		decoded, err = io.ReadAll(zr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded).To(Equal(gzipped.Bytes()))
+
+		// A .gz name alone does not skip compression.
+		named := filepath.Join(dir, "plain.gz")
+		Expect(os.WriteFile(named, []byte(content), 0600)).To(Succeed())
+		Expect(runCommand("-z", "put", named, "named")).To(Equal(0))
+		stored, ok = fake.Object("named")
+		Expect(ok).To(BeTrue())
+		zr, err = gzip.NewReader(bytes.NewReader(stored))
+		Expect(err).ToNot(HaveOccurred())
+		decoded, err = io.ReadAll(zr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(decoded)).To(Equal(content))
+		Expect(stderr.String()).To(ContainSubstring("is named as a gzip file but is not gzip-compressed"))
+	})
+
+	It("applies the metadata of a metadata file to put and sync uploads", func() {
+		metadataFile := filepath.Join(dir, "metadata.json")
+		Expect(os.WriteFile(metadataFile, []byte(`{
+			"app.tgz": {"content_type": "application/gzip", "cache_control": "no-cache", "metadata": {"owner": "ci"}},
+			"synced/index.html": {"content_type": "text/html", "metadata": {"page": "home"}}
+		}`), 0600)).To(Succeed())
+		src := filepath.Join(dir, "src.txt")
+		Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+
+		// The entry takes precedence over the flags.
+		Expect(runCommand("-metadata-file", metadataFile, "-content-type", "text/plain", "-meta", "owner=me", "-meta", "build=1", "put", src, "app.tgz")).To(Equal(0))
+		attrs, err := fake.Stat("app.tgz")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.ContentType).To(Equal("application/gzip"))
+		Expect(attrs.CacheControl).To(Equal("no-cache"))
+		Expect(attrs.Metadata).To(HaveKeyWithValue("owner", "ci"))
+
+		Expect(runCommand("-metadata-file", metadataFile, "put", src, "other")).To(Equal(0))
+		attrs, err = fake.Stat("other")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.ContentType).To(Equal("text/plain; charset=utf-8"))
+		Expect(attrs.CacheControl).To(BeEmpty())
+
+		syncDir := filepath.Join(dir, "site")
+		Expect(os.Mkdir(syncDir, 0700)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(syncDir, "index.html"), []byte("<html>"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(syncDir, "other.html"), []byte("<html>"), 0600)).To(Succeed())
+		Expect(runCommand("-metadata-file", metadataFile, "sync", syncDir, "synced/")).To(Equal(0))
+		attrs, err = fake.Stat("synced/index.html")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.ContentType).To(Equal("text/html"))
+		Expect(attrs.Metadata).To(HaveKeyWithValue("page", "home"))
+		attrs, err = fake.Stat("synced/other.html")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attrs.Metadata).ToNot(HaveKey("page"))
+
+		Expect(os.WriteFile(metadataFile, []byte(`{"app.tgz": {"contentType": "application/gzip"}}`), 0600)).To(Succeed())
+		Expect(runCommand("-metadata-file", metadataFile, "put", src, "rejected")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring(`invalid metadata file`))
+		Expect(stderr.String()).To(ContainSubstring(`unknown field "contentType"`))
+		_, ok := fake.Object("rejected")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("writes the plan of a sync, and stops once planned with -plan-only", func() {
+		syncDir := filepath.Join(dir, "site")
+		Expect(os.Mkdir(syncDir, 0700)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(syncDir, "new.txt"), []byte("new"), 0600)).To(Succeed())
+		Expect(fake.Put(strings.NewReader("stale"), "synced/stale.txt")).To(Succeed())
+
+		Expect(runCommand("-delete", "-plan-only", "sync", syncDir, "synced/")).To(Equal(0))
+		var plan client.SyncPlan
+		Expect(json.Unmarshal(stdout.Bytes(), &plan)).To(Succeed())
+		Expect(plan.Uploads).To(Equal([]client.SyncAction{{Object: "synced/new.txt", File: filepath.Join(syncDir, "new.txt"), Reason: "missing"}}))
+		Expect(plan.Skips).To(BeEmpty())
+		Expect(plan.Deletes).To(Equal([]client.SyncAction{{Object: "synced/stale.txt", Reason: "no-local-file"}}))
+		Expect(stderr.String()).To(ContainSubstring("planned 1 uploads, 0 skips and 1 deletes, nothing was synced"))
+		_, ok := fake.Object("synced/new.txt")
+		Expect(ok).To(BeFalse())
+		_, ok = fake.Object("synced/stale.txt")
+		Expect(ok).To(BeTrue())
+
+		planFile := filepath.Join(dir, "plan.json")
+		Expect(runCommand("-delete", "-plan-out", planFile, "sync", syncDir, "synced/")).To(Equal(0))
+		Expect(stdout.String()).To(BeEmpty())
+		data, err := os.ReadFile(planFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(json.Unmarshal(data, &plan)).To(Succeed())
+		Expect(plan.Uploads).To(HaveLen(1))
+		_, ok = fake.Object("synced/new.txt")
+		Expect(ok).To(BeTrue())
+		_, ok = fake.Object("synced/stale.txt")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("resumes a sync from the manifest of an earlier one", func() {
+		objectContent := func(name string) string {
+			data, ok := fake.Object(name)
+			Expect(ok).To(BeTrue())
+			return string(data)
+		}
+		syncDir := filepath.Join(dir, "site")
+		Expect(os.Mkdir(syncDir, 0700)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(syncDir, "a.txt"), []byte("a"), 0600)).To(Succeed())
+		manifestFile := filepath.Join(dir, "manifest.jsonl")
+		Expect(runCommand("-manifest", manifestFile, "sync", syncDir, "synced/")).To(Equal(0))
+		completed, err := client.LoadManifest(manifestFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(completed).To(HaveKey("synced/a.txt"))
+
+		// The recorded file is skipped even though it changed, unless
+		// checked with -checksum-only.
+		Expect(os.WriteFile(filepath.Join(syncDir, "a.txt"), []byte("changed"), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(syncDir, "b.txt"), []byte("b"), 0600)).To(Succeed())
+		Expect(runCommand("-resume-from-manifest", manifestFile, "sync", syncDir, "synced/")).To(Equal(0))
+		Expect(stderr.String()).To(ContainSubstring("uploaded 1 objects, 0 unchanged, 1 resumed"))
+		Expect(objectContent("synced/b.txt")).To(Equal("b"))
+		Expect(objectContent("synced/a.txt")).To(Equal("a"))
+
+		Expect(runCommand("-resume-from-manifest", manifestFile, "-checksum-only", "sync", syncDir, "synced/")).To(Equal(0))
+		Expect(objectContent("synced/a.txt")).To(Equal("changed"))
+
+		Expect(runCommand("-manifest", manifestFile, "-resume-from-manifest", manifestFile, "sync", syncDir, "synced/")).To(Equal(exitFailure))
+		Expect(runCommand("-checksum-only", "sync", syncDir, "synced/")).To(Equal(exitFailure))
+		Expect(os.WriteFile(manifestFile, []byte("not json\n{}\n"), 0600)).To(Succeed())
+		Expect(runCommand("-resume-from-manifest", manifestFile, "sync", syncDir, "synced/")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("invalid manifest"))
+	})
+
+	It("only stores an upload matching the expected MD5", func() {
+		src := filepath.Join(dir, "src")
+		Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+		sum := md5.Sum([]byte("content"))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+
+		Expect(runCommand("-content-md5", expected, "put", src, "obj")).To(Equal(0))
+		Expect(runCommand("-content-md5", "auto", "put", src, "auto")).To(Equal(0))
+		_, ok := fake.Object("auto")
+		Expect(ok).To(BeTrue())
+
+		Expect(os.WriteFile(src, []byte("corrupt"), 0600)).To(Succeed())
+		Expect(runCommand("-content-md5", expected, "put", src, "corrupt")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("uploaded bytes do not match the expected MD5"))
+		_, ok = fake.Object("corrupt")
+		Expect(ok).To(BeFalse())
+
+		Expect(runCommand("-content-md5", "auto", "put", "-", "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("requires -buffer-uploads"))
+		Expect(runCommand("-content-md5", "abc", "put", src, "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("Invalid content-md5"))
+	})
+
+	It("restores a deleted object from a noncurrent generation", func() {
+		src := filepath.Join(dir, "src")
+		Expect(os.WriteFile(src, []byte("first"), 0600)).To(Succeed())
+		Expect(runCommand("-print-generation", "put", src, "obj")).To(Equal(0))
+		first := strings.TrimSpace(stdout.String())
+		Expect(os.WriteFile(src, []byte("second"), 0600)).To(Succeed())
+		Expect(runCommand("put", src, "obj")).To(Equal(0))
+
+		Expect(runCommand("undelete", "obj")).To(Equal(exitPrecondition))
+		Expect(stderr.String()).To(ContainSubstring("'obj' is not deleted"))
+
+		Expect(runCommand("delete", "obj")).To(Equal(0))
+		Expect(runCommand("undelete", "obj")).To(Equal(0))
+		data, ok := fake.Object("obj")
+		Expect(ok).To(BeTrue())
+		Expect(string(data)).To(Equal("second"))
+
+		Expect(runCommand("-generation", first, "undelete", "obj")).To(Equal(0))
+		data, _ = fake.Object("obj")
+		Expect(string(data)).To(Equal("first"))
+
+		Expect(runCommand("undelete", "missing")).To(Equal(exitNotFound))
+		Expect(stderr.String()).To(ContainSubstring("no deleted generation to restore"))
+
+		fake.Unversioned = true
+		Expect(runCommand("undelete", "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("object versioning is not enabled"))
+	})
+
+	It("deletes the objects under a prefix only once confirmed", func() {
+		for _, name := range []string{"releases/1.2/a.tgz", "releases/1.2/b.txt", "releases/1.2/sub/c.tgz", "releases/1.3/d.tgz"} {
+			Expect(fake.PutMarker(name, false)).To(Succeed())
+		}
+
+		Expect(runCommand("delete-prefix", "releases/1.2/")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("confirm with -yes or preview with -dry-run"))
+		Expect(runCommand("-yes", "delete-prefix", "")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("without -all"))
+
+		Expect(runCommand("-dry-run", "delete-prefix", "releases/1.2/")).To(Equal(0))
+		Expect(stderr.String()).To(ContainSubstring("would have deleted 3"))
+		_, ok := fake.Object("releases/1.2/a.tgz")
+		Expect(ok).To(BeTrue())
+
+		Expect(runCommand("-yes", "delete-prefix", "releases/*/*.tgz")).To(Equal(0))
+		for name, kept := range map[string]bool{"releases/1.2/a.tgz": false, "releases/1.2/b.txt": true, "releases/1.2/sub/c.tgz": true, "releases/1.3/d.tgz": false} {
+			_, ok := fake.Object(name)
+			Expect(ok).To(Equal(kept), name)
+		}
+
+		Expect(runCommand("-yes", "-all", "delete-prefix", "")).To(Equal(0))
+		_, ok = fake.Object("releases/1.2/b.txt")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("fails to delete an object which does not exist unless -ignore-not-found is given", func() {
+		Expect(fake.PutMarker("obj", false)).To(Succeed())
+
+		Expect(runCommand("delete", "missing")).To(Equal(exitNotFound))
+		Expect(runCommand("-ignore-not-found", "delete", "missing")).To(Equal(0))
+		Expect(stderr.String()).To(ContainSubstring("'missing' does not exist"))
+		Expect(runCommand("-if-metageneration-match", "1", "-ignore-not-found", "delete", "missing")).To(Equal(0))
+
+		Expect(runCommand("-dry-run", "delete", "missing")).To(Equal(exitNotFound))
+		Expect(runCommand("-dry-run", "-ignore-not-found", "delete", "missing")).To(Equal(0))
+
+		Expect(fake.PutMarker("other", false)).To(Succeed())
+		Expect(runCommand("delete", "obj", "missing", "other")).To(Equal(exitNotFound))
+		Expect(stderr.String()).To(ContainSubstring("WARN: failed on 'missing'"))
+		Expect(stderr.String()).To(ContainSubstring("deleted 2 objects, 1 failed"))
+		_, ok := fake.Object("obj")
+		Expect(ok).To(BeFalse())
+		Expect(runCommand("-ignore-not-found", "delete", "obj", "missing", "other")).To(Equal(0))
+
+		Expect(fake.PutMarker("obj", false)).To(Succeed())
+		Expect(fake.PutMarker("other", false)).To(Succeed())
+		Expect(runCommand("-fail-fast", "delete", "obj", "missing", "other")).To(Equal(exitNotFound))
+		Expect(stderr.String()).To(ContainSubstring("deleted 1 objects, 1 failed, 1 skipped"))
+		_, ok = fake.Object("other")
+		Expect(ok).To(BeTrue())
+
+		Expect(fake.PutMarker("releases/a.tgz", false)).To(Succeed())
+		Expect(runCommand("-yes", "delete-prefix", "releases/")).To(Equal(0))
+		Expect(runCommand("-yes", "delete-prefix", "releases/")).To(Equal(exitNotFound))
+		Expect(stderr.String()).To(ContainSubstring("no object under 'releases/' to delete"))
+		Expect(runCommand("-yes", "-ignore-not-found", "delete-prefix", "releases/")).To(Equal(0))
+	})
+
+	It("makes and removes the bucket", func() {
+		Expect(runCommand("mb")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("mb requires -project"))
+		Expect(runCommand("-project", "some-project", "-location", "us-east1", "mb")).To(Equal(exitBucketExists))
+
+		Expect(fake.PutMarker("obj", false)).To(Succeed())
+		Expect(runCommand("rb")).To(Equal(exitBucketNotEmpty))
+		Expect(runCommand("-force", "rb")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("confirm with -yes"))
+		Expect(runCommand("-force", "-dry-run", "rb")).To(Equal(0))
+		Expect(fake.Removed()).To(BeFalse())
+
+		Expect(runCommand("-force", "-yes", "rb")).To(Equal(0))
+		Expect(stderr.String()).To(ContainSubstring("deleted 1 objects"))
+		Expect(fake.Removed()).To(BeTrue())
+
+		Expect(runCommand("-project", "some-project", "-location", "us-east1", "mb")).To(Equal(0))
+		Expect(fake.Removed()).To(BeFalse())
+	})
+
+	It("prints the bucket's settings, exiting with 3 once it is removed", func() {
+		Expect(runCommand("info")).To(Equal(0))
+		Expect(stdout.String()).To(MatchRegexp(`Name:\s+gs://some-bucket\n`))
+		Expect(stdout.String()).To(MatchRegexp(`Location:\s+US\n`))
+		Expect(stdout.String()).To(MatchRegexp(`Storage class:\s+STANDARD\n`))
+		Expect(stdout.String()).To(MatchRegexp(`Versioning:\s+true\n`))
+		Expect(stdout.String()).To(MatchRegexp(`Uniform bucket-level access:\s+true\n`))
+
+		fake.Unversioned = true
+		Expect(runCommand("-json", "info")).To(Equal(0))
+		var info map[string]interface{}
+		Expect(json.Unmarshal(stdout.Bytes(), &info)).To(Succeed())
+		Expect(info).To(HaveKeyWithValue("name", "some-bucket"))
+		Expect(info).To(HaveKeyWithValue("location", "US"))
+		Expect(info).To(HaveKeyWithValue("versioning", false))
+		Expect(info).To(HaveKeyWithValue("uniform_bucket_level_access", true))
+
+		Expect(runCommand("info", "extra")).To(Equal(exitFailure))
+
+		Expect(runCommand("-yes", "rb")).To(Equal(0))
+		Expect(runCommand("info")).To(Equal(exitNotFound))
+		Expect(stderr.String()).To(ContainSubstring("info: not-found error: bucket 'some-bucket' not found"))
+	})
+
+	It("creates the bucket with lifecycle rules of positive ages", func() {
+		var cfg config.GCSCli
+		newClient = func(ctx context.Context, c *config.GCSCli) (client.Client, error) {
+			cfg = *c
+			return fake, nil
+		}
+		bucketFlags := []string{"-project", "some-project", "-location", "us-east1"}
+
+		Expect(runCommand(append(bucketFlags, "-lifecycle-delete-age", "0", "mb")...)).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("lifecycle-delete-age must be a positive number of days"))
+		Expect(runCommand("-lifecycle-nearline-age", "30", "stat", "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("only applies to a bucket created by mb or -create-bucket"))
+
+		Expect(runCommand(append(bucketFlags, "-lifecycle-nearline-age", "30", "-lifecycle-delete-age", "90", "-create-bucket", "exists", "obj")...)).To(Equal(exitNotFound))
+		Expect(cfg.LifecycleNearlineAge).To(Equal(30))
+		Expect(cfg.LifecycleDeleteAge).To(Equal(90))
+	})
+
+	It("copies transfers through a buffer of -buffer-size", func() {
+		var cfg config.GCSCli
+		newClient = func(ctx context.Context, c *config.GCSCli) (client.Client, error) {
+			cfg = *c
+			return fake, nil
+		}
+
+		Expect(runCommand("-buffer-size", "1KiB", "stat", "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring(`Invalid buffer-size "1KiB": must be a size between 4KiB and 1GiB`))
+
+		Expect(runCommand("stat", "obj")).To(Equal(exitNotFound))
+		Expect(cfg.CopyBufferSize).To(BeZero())
+		Expect(runCommand("-buffer-size", "1MiB", "stat", "obj")).To(Equal(exitNotFound))
+		Expect(cfg.CopyBufferSize).To(Equal(int64(1 << 20)))
+	})
+
+	It("records the tool version in uploads unless -no-provenance is given", func() {
+		var cfg config.GCSCli
+		newClient = func(ctx context.Context, c *config.GCSCli) (client.Client, error) {
+			cfg = *c
+			return fake, nil
+		}
+
+		Expect(runCommand("stat", "obj")).To(Equal(exitNotFound))
+		Expect(cfg.UploadedBy).To(Equal("bosh-gcscli/dev"))
+		Expect(cfg.NoProvenance).To(BeFalse())
+		Expect(runCommand("-no-provenance", "stat", "obj")).To(Equal(exitNotFound))
+		Expect(cfg.NoProvenance).To(BeTrue())
+
+		path := filepath.Join(dir, "config.json")
+		Expect(os.WriteFile(path, []byte(`{"bucket_name": "some-bucket", "uploaded_by": "pipeline"}`), 0600)).To(Succeed())
+		Expect(runCommand("-c", path, "stat", "obj")).To(Equal(exitNotFound))
+		Expect(cfg.UploadedBy).To(Equal("pipeline"))
+	})
+
+	It("connects through the Private Google Access VIP given by -private-access", func() {
+		var cfg config.GCSCli
+		newClient = func(ctx context.Context, c *config.GCSCli) (client.Client, error) {
+			cfg = *c
+			return fake, nil
+		}
+
+		Expect(runCommand("-private-access", "public", "stat", "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring(`private-access must be private or restricted, got "public"`))
+		Expect(runCommand("-private-access", "private", "-endpoint", "http://localhost:4443", "-emulator-insecure", "stat", "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring(config.ErrPrivateAccessWithEmulator.Error()))
+
+		Expect(runCommand("-private-access", "restricted", "stat", "obj")).To(Equal(exitNotFound))
+		Expect(cfg.PrivateAccess).To(Equal(config.PrivateAccessRestricted))
+	})
+
+	It("verifies a blob against a local file", func() {
+		src := filepath.Join(dir, "src")
+		Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+		Expect(runCommand("put", src, "obj")).To(Equal(0))
+
+		Expect(runCommand("verify", "obj", src)).To(Equal(0))
+		Expect(stderr.String()).To(ContainSubstring("'obj' matches"))
+
+		Expect(os.WriteFile(src, []byte("changed"), 0600)).To(Succeed())
+		Expect(runCommand("verify", "obj", src)).To(Equal(exitMismatch))
+		Expect(stderr.String()).To(ContainSubstring(client.ErrVerifyMismatch.Error()))
+
+		Expect(runCommand("verify", "missing", src)).To(Equal(exitNotFound))
+		Expect(runCommand("verify", "obj")).To(Equal(exitFailure))
+		Expect(stderr.String()).To(ContainSubstring("verify method expected 2 arguments got 1"))
+	})
+
+	It("includes the request id of a failed request in the error", func() {
+		fake.FailLookups("obj", &googleapi.Error{
+			Code:    http.StatusServiceUnavailable,
+			Message: "backend error",
+			Header:  http.Header{"X-Guploader-Uploadid": {"ADPycdsome-id"}},
+		})
+		Expect(runCommand("stat", "obj")).To(Equal(exitTransient))
+		Expect(stderr.String()).To(ContainSubstring("backend error (request id: ADPycdsome-id)"))
+
+		Expect(runCommand("stat", "missing")).To(Equal(exitNotFound))
+		Expect(stderr.String()).ToNot(ContainSubstring("request id"))
+	})
+
+	It("writes only errors and the output asked for with -quiet", func() {
+		Expect(runCommand("stat", "obj")).To(Equal(exitNotFound))
+		Expect(stderr.String()).To(ContainSubstring("does not exist"))
+
+		Expect(runCommand("-quiet", "-log-level", "debug", "stat", "obj")).To(Equal(exitNotFound))
+		Expect(stderr.String()).To(BeEmpty())
+
+		Expect(runCommand("-quiet", "get", "obj", filepath.Join(dir, "dst"))).To(Equal(exitNotFound))
+		Expect(stderr.String()).ToNot(BeEmpty())
+
+		Expect(runCommand("-quiet", "sign", "obj", "get", "1h")).To(Equal(0))
+		Expect(stdout.String()).To(HavePrefix("https://storage.googleapis.com/some-bucket/obj?"))
+		Expect(stderr.String()).To(BeEmpty())
+	})
+
+	Describe("with -c -", func() {
+		realStdin := os.Stdin
+
+		BeforeEach(func() {
+			cfg := filepath.Join(dir, "config.json")
+			Expect(os.WriteFile(cfg, []byte(`{"bucket_name": "some-bucket", "content_type": "text/plain"}`), 0600)).To(Succeed())
+			var err error
+			os.Stdin, err = os.Open(cfg)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.Stdin.Close()
+			os.Stdin = realStdin
+		})
+
+		runWithStdinConfig := func(args ...string) int {
+			stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+			return run(append([]string{"-c", "-"}, args...), stdout, stderr)
+		}
+
+		It("reads the config piped to stdin", func() {
+			var contentType string
+			newClient = func(ctx context.Context, cfg *config.GCSCli) (client.Client, error) {
+				Expect(cfg.BucketName).To(Equal("some-bucket"))
+				contentType = cfg.ContentType
+				return fake, nil
+			}
+
+			src := filepath.Join(dir, "src")
+			Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+			Expect(runWithStdinConfig("put", src, "obj")).To(Equal(0))
+			Expect(contentType).To(Equal("text/plain"))
+			_, ok := fake.Object("obj")
+			Expect(ok).To(BeTrue())
+		})
+
+		It("refuses commands which read stdin too", func() {
+			Expect(runWithStdinConfig("put", "-", "obj")).To(Equal(exitFailure))
+			Expect(stderr.String()).To(ContainSubstring("-c - reads the config from stdin, so put cannot read from stdin too"))
+			_, ok := fake.Object("obj")
+			Expect(ok).To(BeFalse())
+
+			Expect(runWithStdinConfig("exists")).To(Equal(exitFailure))
+			Expect(stderr.String()).To(ContainSubstring("so exists cannot read from stdin too"))
+		})
+	})
+
+	Describe("with -json-events", func() {
+		// decodeEvents returns the events written to stdout, failing unless
+		// every line is one.
+		decodeEvents := func() []map[string]interface{} {
+			var decoded []map[string]interface{}
+			for _, line := range strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n") {
+				var e map[string]interface{}
+				Expect(json.Unmarshal([]byte(line), &e)).To(Succeed(), line)
+				Expect(e).To(HaveKey("event"))
+				Expect(e).To(HaveKey("time"))
+				decoded = append(decoded, e)
+			}
+			return decoded
+		}
+
+		// eventsOf returns the decoded events of the given kind.
+		eventsOf := func(all []map[string]interface{}, kind string) []map[string]interface{} {
+			var found []map[string]interface{}
+			for _, e := range all {
+				if e["event"] == kind {
+					found = append(found, e)
+				}
+			}
+			return found
+		}
+
+		var src string
+
+		BeforeEach(func() {
+			src = filepath.Join(dir, "src")
+			Expect(os.WriteFile(src, []byte("content"), 0600)).To(Succeed())
+			Expect(fake.PutWithOptions(strings.NewReader("content"), "obj", client.PutOptions{})).To(Succeed())
+		})
+
+		It("reports an upload with the size and generation of the object", func() {
+			Expect(runCommand("-json-events", "put", src, "new")).To(Equal(0))
+			Expect(stderr.String()).To(BeEmpty())
+			attrs, err := fake.Stat("new")
+			Expect(err).ToNot(HaveOccurred())
+
+			all := decodeEvents()
+			uploads := eventsOf(all, "upload_complete")
+			Expect(uploads).To(HaveLen(1))
+			Expect(uploads[0]).To(HaveKeyWithValue("command", "put"))
+			Expect(uploads[0]).To(HaveKeyWithValue("object", "new"))
+			Expect(uploads[0]).To(HaveKeyWithValue("path", src))
+			Expect(uploads[0]).To(HaveKeyWithValue("bytes", float64(7)))
+			Expect(uploads[0]).To(HaveKeyWithValue("generation", float64(attrs.Generation)))
+			Expect(all[len(all)-1]).To(HaveKeyWithValue("event", "command_complete"))
+			Expect(all[len(all)-1]).To(HaveKeyWithValue("exit_code", float64(0)))
+		})
+
+		It("reports a download with the bytes written", func() {
+			dst := filepath.Join(dir, "dst")
+			Expect(runCommand("-json-events", "get", "obj", dst)).To(Equal(0))
+			downloads := eventsOf(decodeEvents(), "download_complete")
+			Expect(downloads).To(HaveLen(1))
+			Expect(downloads[0]).To(HaveKeyWithValue("object", "obj"))
+			Expect(downloads[0]).To(HaveKeyWithValue("path", dst))
+			Expect(downloads[0]).To(HaveKeyWithValue("bytes", float64(7)))
+
+			Expect(runCommand("-json-events", "-download-parallel", "4", "get", "obj", dst)).To(Equal(0))
+			downloads = eventsOf(decodeEvents(), "download_complete")
+			Expect(downloads[0]).To(HaveKeyWithValue("bytes", float64(7)))
+		})
+
+		It("writes log messages and failures as events", func() {
+			Expect(runCommand("-json-events", "-log-level", "debug", "get", "missing", filepath.Join(dir, "dst"))).To(Equal(exitNotFound))
+			Expect(stderr.String()).To(BeEmpty())
+
+			all := decodeEvents()
+			Expect(eventsOf(all, "log")).To(ContainElement(And(
+				HaveKeyWithValue("level", "debug"),
+				HaveKeyWithValue("message", ContainSubstring("creating client for bucket 'some-bucket'")),
+			)))
+			failed := all[len(all)-1]
+			Expect(failed).To(HaveKeyWithValue("event", "command_failed"))
+			Expect(failed).To(HaveKeyWithValue("command", "get"))
+			Expect(failed).To(HaveKeyWithValue("exit_code", float64(exitNotFound)))
+			Expect(failed).To(HaveKeyWithValue("error", ContainSubstring("performing operation get")))
+		})
+
+		It("reports JSON output as a result and other output line by line", func() {
+			Expect(runCommand("-json-events", "-json", "stat", "obj")).To(Equal(0))
+			results := eventsOf(decodeEvents(), "result")
+			Expect(results).To(HaveLen(1))
+			Expect(results[0]["result"]).To(HaveKeyWithValue("name", "obj"))
+
+			Expect(fake.PutMarker("other", false)).To(Succeed())
+			Expect(runCommand("-json-events", "list", "")).To(Equal(0))
+			outputs := eventsOf(decodeEvents(), "output")
+			Expect(outputs).To(HaveLen(2))
+			Expect(outputs[0]).To(HaveKeyWithValue("output", "obj"))
+			Expect(outputs[1]).To(HaveKeyWithValue("output", "other"))
+
+			Expect(runCommand("-json-events", "-list-format", "ndjson", "list", "")).To(Equal(0))
+			Expect(eventsOf(decodeEvents(), "result")).To(HaveLen(2))
+		})
+
+		It("refuses to write an object to stdout", func() {
+			Expect(runCommand("-json-events", "cat", "obj")).To(Equal(exitFailure))
+			Expect(runCommand("-json-events", "get", "obj", "-")).To(Equal(exitFailure))
+			all := decodeEvents()
+			Expect(all[len(all)-1]).To(HaveKeyWithValue("error", ContainSubstring("json-events cannot be used when writing the object to stdout")))
+		})
+
+		It("ends every command with an event", func() {
+			syncDir := filepath.Join(dir, "sync")
+			Expect(os.Mkdir(syncDir, 0700)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(syncDir, "file"), []byte("content"), 0600)).To(Succeed())
+			oldKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+			commands := []struct {
+				args []string
+				code int
+			}{
+				{[]string{"put", src, "new"}, 0},
+				{[]string{"put-marker", "marker"}, 0},
+				{[]string{"get", "obj", filepath.Join(dir, "dst")}, 0},
+				{[]string{"exists", "obj"}, 0},
+				{[]string{"hash", "obj"}, 0},
+				{[]string{"verify", "obj", src}, 0},
+				{[]string{"stat", "obj"}, 0},
+				{[]string{"sign", "obj", "get", "1h"}, 0},
+				{[]string{"copy", "obj", "copied"}, 0},
+				{[]string{"compose", "composed", "obj", "copied"}, 0},
+				{[]string{"-meta", "owner=ci", "update", "obj"}, 0},
+				{[]string{"hold", "obj", "temporary", "on"}, 0},
+				{[]string{"clear-expired-holds", "obj"}, 0},
+				{[]string{"hold", "obj", "temporary", "off"}, 0},
+				{[]string{"-old-encryption-key", oldKey, "rotate-key", "obj"}, 0},
+				{[]string{"undelete", "obj"}, exitPrecondition},
+				{[]string{"move", "copied", "moved"}, 0},
+				{[]string{"delete", "moved"}, 0},
+				{[]string{"rename-prefix", "composed", "renamed"}, 0},
+				{[]string{"migrate", "renamed", "gs://other-bucket/renamed"}, 0},
+				{[]string{"sync", syncDir, "synced/"}, 0},
+				{[]string{"classes", ""}, 0},
+				{[]string{"list", ""}, 0},
+				{[]string{"config", "validate"}, 0},
+				{[]string{"info"}, 0},
+				{[]string{"-yes", "delete-prefix", "synced/"}, 0},
+				{[]string{"-project", "some-project", "-location", "us-east1", "mb"}, exitBucketExists},
+				{[]string{"-force", "-yes", "rb"}, 0},
+				{[]string{"version"}, 0},
+				{[]string{"frobnicate", "obj"}, exitFailure},
+			}
+			for _, c := range commands {
+				Expect(runCommand(append([]string{"-json-events"}, c.args...)...)).To(Equal(c.code), strings.Join(c.args, " ")+": "+stdout.String())
+				Expect(stderr.String()).To(BeEmpty())
+
+				all := decodeEvents()
+				last := all[len(all)-1]
+				Expect(last).To(HaveKeyWithValue("exit_code", float64(c.code)))
+				if c.code == 0 {
+					Expect(last).To(HaveKeyWithValue("event", "command_complete"))
+				} else {
+					Expect(last).To(HaveKeyWithValue("event", "command_failed"))
+					Expect(last).To(HaveKeyWithValue("error", Not(BeEmpty())))
+				}
+				if cmd := c.args[len(c.args)-1]; cmd == "mb" || cmd == "rb" || cmd == "version" {
+					Expect(last).To(HaveKeyWithValue("command", cmd))
+				}
+			}
+		})
+	})
+
+	It("prints the usage without a command", func() {
+		Expect(runCommand()).To(Equal(0))
+		Expect(stderr.String()).To(ContainSubstring("Usage of"))
+		Expect(stdout.String()).To(ContainSubstring("bosh-gcscli -b bucket put"))
+	})
+})
+
+var _ = Describe("Downloading in place", func() {
+	// path has a name of the longest length the file system allows, so it
+	// can be created but no temporary file beside it can.
+	var path string
+
+	BeforeEach(func() {
+		path = filepath.Join(specTempDir(), strings.Repeat("a", 255))
+	})
+
+	It("leaves an existing destination which it overwrote when aborted", func() {
+		Expect(os.WriteFile(path, []byte("old"), 0644)).To(Succeed())
+
+		dst, err := openDownload(path, onExistsOverwrite)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dst.dest).To(BeEmpty())
+		dst.abort()
+
+		Expect(path).To(BeAnExistingFile())
+	})
+
+	It("removes a destination which it created when aborted", func() {
+		for _, onExists := range []string{onExistsOverwrite, onExistsFail} {
+			dst, err := openDownload(path, onExists)
+			Expect(err).ToNot(HaveOccurred(), onExists)
+			Expect(dst.dest).To(BeEmpty(), onExists)
+			dst.abort()
+
+			Expect(path).ToNot(BeAnExistingFile(), onExists)
+		}
+	})
+})
+
+var _ = Describe("Mapping errors to exit codes", func() {
+	It("returns the exit code for each kind of error", func() {
+		cases := []struct {
+			err  error
+			code int
+		}{
+			{&googleapi.Error{Code: http.StatusUnauthorized}, exitAuth},
+			{&googleapi.Error{Code: http.StatusForbidden}, exitAuth},
+			{client.ErrInvalidROWriteOperation, exitAuth},
+			{&googleapi.Error{Code: http.StatusNotFound}, exitNotFound},
+			{client.ErrObjectNotFound, exitNotFound},
+			{storage.ErrObjectNotExist, exitNotFound},
+			{&googleapi.Error{Code: http.StatusPreconditionFailed}, exitPrecondition},
+			{client.ErrObjectExists, exitPrecondition},
+			{client.ErrGenerationMismatch, exitPrecondition},
+			{&googleapi.Error{Code: http.StatusServiceUnavailable}, exitTransient},
+			{&googleapi.Error{Code: http.StatusInternalServerError}, exitTransient},
+			{&googleapi.Error{Code: http.StatusTooManyRequests}, exitTransient},
+			{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, exitTransient},
+			{&net.DNSError{Name: "storage.googleapis.com", Err: "no such host"}, exitTransient},
+			{context.DeadlineExceeded, exitTransient},
+			{client.ErrVerifyMismatch, exitMismatch},
+			{client.ErrUploadChecksumMismatch, exitMismatch},
+			{context.Canceled, exitInterrupted},
+			{errors.New("something else"), exitFailure},
+			{&googleapi.Error{Code: http.StatusBadRequest}, exitFailure},
+		}
+		for _, c := range cases {
+			Expect(exitCodeForError(c.err)).To(Equal(c.code), c.err.Error())
+
+			wrapped := fmt.Errorf("performing operation: %w", fmt.Errorf("copying 'blob': %w", c.err))
+			Expect(exitCodeForError(wrapped)).To(Equal(c.code), wrapped.Error())
+		}
+	})
+
+	It("returns the exit code of the failures of a partially failed bulk operation", func() {
+		result := &client.BulkResult{
+			Succeeded: []string{"a", "b"},
+			Failed:    map[string]error{"held": &googleapi.Error{Code: http.StatusPreconditionFailed}},
+		}
+		Expect(exitCodeForError(result.Err())).To(Equal(exitPrecondition))
+
+		result.Failed = map[string]error{"missing": client.ErrObjectNotFound}
+		Expect(exitCodeForError(result.Err())).To(Equal(exitNotFound))
+	})
+})
+
+func formatInt(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errMaxBytesExceeded is returned when the source of put is larger than
+// -max-bytes.
+var errMaxBytesExceeded = errors.New("source larger than max-bytes")
+
+// maxBytesReader reads from r until more than limit bytes have been read
+// from it, and then fails with errMaxBytesExceeded. Unlike io.LimitReader,
+// which ends with io.EOF, it makes a streamed upload fail rather than store
+// the first limit bytes.
+type maxBytesReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	// Reading one byte past the limit tells a source of exactly limit bytes
+	// from a larger one.
+	if room := m.limit + 1 - m.read; int64(len(p)) > room {
+		p = p[:room]
+	}
+	n, err := m.r.Read(p)
+	m.read += int64(n)
+	if m.read > m.limit {
+		return n - int(m.read-m.limit), fmt.Errorf("%w: more than %d bytes read", errMaxBytesExceeded, m.limit)
+	}
+	return n, err
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2017 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often progress is reported.
+const progressInterval = time.Second
+
+// progress reports the number of bytes transferred by put or get, and the
+// rate they are transferred at, to w every progressInterval, or as progress
+// events with -json-events.
+type progress struct {
+	w     io.Writer
+	verb  string
+	total int64
+	start time.Time
+	n     atomic.Int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startProgress starts reporting the bytes counted by the returned progress
+// as "<verb> <bytes>". total is the number of bytes expected, shown as a
+// percentage, or -1 if unknown.
+func startProgress(w io.Writer, verb string, total int64) *progress {
+	p := &progress{w: w, verb: verb, total: total, start: time.Now(), done: make(chan struct{})}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Write counts the bytes written to a destination the progress is
+// multiplexed with, e.g. through io.MultiWriter.
+func (p *progress) Write(b []byte) (int, error) {
+	p.n.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// reader returns r counting the bytes read from it.
+//
+// If the total is known, the reader also reports the number of bytes left
+// through Len, so uploads of small files are still sent in a single
+// request.
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p.total < 0 {
+		return &progressReader{r: r, p: p}
+	}
+	return &sizedProgressReader{progressReader{r: r, p: p}}
+}
+
+// stop stops the periodic reports and reports the final count.
+func (p *progress) stop() {
+	close(p.done)
+	p.wg.Wait()
+	p.report()
+}
+
+func (p *progress) report() {
+	n := p.n.Load()
+	if events != nil {
+		e := event{Event: "progress", Bytes: &n}
+		if p.total >= 0 {
+			e.Total = &p.total
+		}
+		events.emit(e)
+		return
+	}
+	line := p.verb + " " + formatBytes(n)
+	if p.total > 0 {
+		line += fmt.Sprintf(" of %s (%d%%)", formatBytes(p.total), n*100/p.total)
+	}
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		line += fmt.Sprintf(", %s/s", formatBytes(int64(float64(n)/elapsed)))
+	}
+	fmt.Fprintln(p.w, line)
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.n.Add(int64(n))
+	return n, err
+}
+
+type sizedProgressReader struct {
+	progressReader
+}
+
+func (r *sizedProgressReader) Len() int {
+	return int(r.p.total - r.p.n.Load())
+}
+
+// formatBytes formats n bytes in the largest binary unit it reaches, e.g.
+// "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}